@@ -0,0 +1,50 @@
+package lsvd
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func (c *Controller) scheduleCheckpoint() <-chan time.Time {
+	if c.d.checkpointInterval <= 0 || c.d.readOnly {
+		return nil
+	}
+
+	return c.d.clock.After(c.d.checkpointInterval)
+}
+
+// segmentFlushed counts a flushed segment towards the next checkpoint,
+// queueing it once WithCheckpoints' number of segments is reached.
+func (c *Controller) segmentFlushed() {
+	c.sinceCheckpoint++
+
+	if c.d.checkpointSegments > 0 && c.sinceCheckpoint >= c.d.checkpointSegments {
+		c.queueInternal(Event{
+			Kind: Checkpoint,
+		})
+	}
+}
+
+// checkpoint saves the LBA map. The controller is what applies flushed
+// segments to the map, so between events the map reflects exactly the
+// segments in the volume, which is what loadLBAMap relies on.
+func (c *Controller) checkpoint(ctx context.Context) error {
+	start := time.Now()
+
+	err := c.d.saveLBAMap(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "checkpointing lba map")
+	}
+
+	c.log.Info("checkpointed lba map",
+		"segments", c.sinceCheckpoint,
+		"extents", c.d.lba2pba.Len(),
+		"dur", time.Since(start),
+	)
+
+	c.sinceCheckpoint = 0
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package lsvd
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCleanupInterval is how often deleted segments are removed when
+	// WithSegmentCleanup isn't used.
+	DefaultCleanupInterval = time.Second
+
+	// DefaultCleanupWorkers is how many segments are removed at once when
+	// WithSegmentCleanup isn't used.
+	DefaultCleanupWorkers = 4
+)
+
+// scheduleCleanup returns when to next remove deleted segments. The interval
+// is jittered by up to a quarter either way so that the volumes on a host
+// don't all list and rewrite their manifests at the same moment.
+func (c *Controller) scheduleCleanup() <-chan time.Time {
+	if c.d.readOnly {
+		return nil
+	}
+
+	interval := c.d.cleanupInterval
+	if interval <= 0 {
+		interval = DefaultCleanupInterval
+	}
+
+	if spread := int64(interval / 2); spread > 0 {
+		interval += time.Duration(rand.Int63n(spread)) - interval/4
+	}
+
+	return c.d.clock.After(interval)
+}
+
+// cleanupDeletedSegments removes the deleted segments from the volume in one
+// update of its list, then removes from storage those that no other volume
+// references. If the storage can't remove them in a batch, up to
+// WithSegmentCleanup's number of workers are removed at once.
+func (d *Disk) cleanupDeletedSegments(ctx context.Context) error {
+	// The segments are the writer's to remove.
+	if d.readOnly {
+		return nil
+	}
+
+	d.deleteMu.Lock()
+	defer d.deleteMu.Unlock()
+
+	d.metrics.segmentCleanups.Inc()
+
+	deleted := d.s.FindDeleted()
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	d.logs.gc.Info("removing segments from volume", "volume", d.volName, "segments", deleted)
+
+	err := RemoveSegmentsFromVolume(ctx, d.sa, d.volName, deleted)
+	if err != nil {
+		return err
+	}
+
+	// Nothing in the volume reads them anymore, even if another volume
+	// still holds on to them.
+	for _, seg := range deleted {
+		d.EvictSegment(seg)
+	}
+
+	referenced, err := referencedSegments(ctx, d.sa)
+	if err != nil {
+		return err
+	}
+
+	var unused []SegmentId
+
+	for _, seg := range deleted {
+		// Someone is holding on to it.
+		if _, ok := referenced[seg]; !ok {
+			unused = append(unused, seg)
+		}
+	}
+
+	if len(unused) == 0 {
+		return nil
+	}
+
+	// No volume has them, we can remove them.
+	d.logs.gc.Info("removing segments", "segments", unused)
+
+	if _, ok := d.sa.(SegmentBatchRemover); ok {
+		return RemoveSegments(ctx, d.sa, unused)
+	}
+
+	return d.eachSegment(unused, func(seg SegmentId) error {
+		err := d.sa.RemoveSegment(ctx, seg)
+		if err != nil {
+			return errors.Wrapf(err, "removing segment: %s", seg)
+		}
+
+		return nil
+	})
+}
+
+// eachSegment calls +fn+ on each of +segments+, up to the cleanup workers at
+// once, returning the first error.
+func (d *Disk) eachSegment(segments []SegmentId, fn func(seg SegmentId) error) error {
+	workers := d.cleanupWorkers
+	if workers <= 0 {
+		workers = DefaultCleanupWorkers
+	}
+
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, workers)
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for _, seg := range segments {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(seg SegmentId) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := fn(seg)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(seg)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,66 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentCleanup(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	t.Run("flushes leave removing segments to the next cleanup", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		clk := newFakeClock(time.Now())
+		m := NewMetrics(nil)
+
+		d, err := NewDisk(ctx, log, tmpdir,
+			WithClock(clk),
+			WithMetrics(m),
+			WithSegmentCleanup(time.Minute, 2),
+		)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		// Each flush overwrites the segment before it.
+		for i := 0; i < 10; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		r.Zero(counterValue(m.segmentCleanups))
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 10)
+
+		syncs := countSyncs(d.sa.(*LocalFileAccess).fileSyncer())
+
+		clk.Add(2 * time.Minute)
+
+		r.Eventually(func() bool {
+			segs, err := d.sa.ListSegments(ctx, d.volName)
+			return err == nil && len(segs) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		r.Equal(int64(1), counterValue(m.segmentCleanups))
+
+		// All of them were removed with one write of the volume's list.
+		r.Equal(1, syncs.countMatching("segments.tmp"))
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		blockEqual(t, testRandX, data.ReadData())
+	})
+}
@@ -22,8 +22,6 @@ import (
 
 	"github.com/lab47/lsvd/logger"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/lab47/cleo"
 	"github.com/lab47/lsvd"
 	"github.com/lab47/lsvd/pkg/nbd"
@@ -116,22 +114,21 @@ func (c *CLI) loadSegmentAccess(ctx context.Context, path string) (lsvd.SegmentA
 
 		sa = &lsvd.LocalFileAccess{Dir: storagePath}
 	} else if cfg.Storage.S3.Bucket != "" {
-		awsCfg, err := config.LoadDefaultConfig(ctx, func(lo *config.LoadOptions) error {
-			lo.Region = cfg.Storage.S3.Region
+		s3cfg := cfg.Storage.S3
 
-			if cfg.Storage.S3.AccessKey != "" {
-				lo.Credentials = credentials.NewStaticCredentialsProvider(
-					cfg.Storage.S3.AccessKey, cfg.Storage.S3.SecretKey, "",
-				)
-			}
-			return nil
-		})
-		if err != nil {
-			c.log.Error("error initializing S3 configuration", "error", err)
-			os.Exit(1)
+		opts := []lsvd.S3Option{
+			lsvd.WithKeyPrefix(s3cfg.Directory),
+			lsvd.WithPathStyle(!s3cfg.VirtualHostStyle),
+		}
+
+		if s3cfg.AccessKey != "" {
+			sa, err = lsvd.NewS3AccessStatic(c.log, s3cfg.URL, s3cfg.Bucket, s3cfg.Region,
+				s3cfg.AccessKey, s3cfg.SecretKey, opts...)
+		} else {
+			sa, err = lsvd.NewS3AccessFromProfile(ctx, c.log, s3cfg.URL, s3cfg.Bucket, s3cfg.Region,
+				s3cfg.Profile, opts...)
 		}
 
-		sa, err = lsvd.NewS3Access(c.log, cfg.Storage.S3.URL, cfg.Storage.S3.Bucket, awsCfg)
 		if err != nil {
 			c.log.Error("error initializing S3 access", "error", err)
 			os.Exit(1)
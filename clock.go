@@ -0,0 +1,20 @@
+package lsvd
+
+import "time"
+
+// Clock is the source of time for a disk, covering segment ids, timestamps,
+// the controller's periodic work, and the delays between retries.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,376 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when told to, firing any After channels that come due.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+
+	f.waiters = append(f.waiters, fakeWaiter{at: f.now.Add(d), ch: ch})
+
+	return ch
+}
+
+// Set moves the clock to +now+, which may be in the past.
+func (f *fakeClock) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = now
+
+	waiters := f.waiters[:0]
+
+	for _, w := range f.waiters {
+		if w.at.After(now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- now
+		}
+	}
+
+	f.waiters = waiters
+}
+
+func (f *fakeClock) Add(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// waiting reports if something is waiting for the clock to reach +at+.
+func (f *fakeClock) waiting(at time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, w := range f.waiters {
+		if w.at.Equal(at) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestClock(t *testing.T) {
+	log := logger.New(logger.Trace)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	t.Run("packs small segments once the disk has been idle", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		clk := newFakeClock(time.Now())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithClock(clk))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(d.CloseSegment(ctx))
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 2)
+
+		clk.Add(6 * time.Minute)
+
+		r.Eventually(func() bool {
+			segs, err := d.sa.ListSegments(ctx, d.volName)
+			return err == nil && len(segs) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 2})
+		r.NoError(err)
+
+		blockEqual(t, testRandX, data.ReadData()[:BlockSize])
+		blockEqual(t, testExtent, data.ReadData()[BlockSize:])
+	})
+
+	t.Run("retries failed flushes after the clock advances", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		var sa failingLocal
+
+		sa.Dir = tmpdir
+
+		clk := newFakeClock(time.Now())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa), WithClock(clk))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		sa.failing.Store(true)
+
+		ch, err := d.closeSegmentAsync(ctx)
+		r.NoError(err)
+
+		// The first attempt fails and then waits on the clock, which isn't
+		// moving, so the flush can't finish until it's advanced.
+		r.Never(func() bool {
+			return len(ch) > 0
+		}, 100*time.Millisecond, 10*time.Millisecond)
+
+		sa.failing.Store(false)
+		clk.Add(d.flushRetryDelay)
+
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			r.FailNow("flush was not retried")
+		}
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 1)
+	})
+	t.Run("flushes the write cache once the disk has been idle", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		const idle = 10 * time.Second
+
+		start := time.Now()
+		clk := newFakeClock(start)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithClock(clk), WithIdleFlush(idle))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		segments := func(n int) func() bool {
+			return func() bool {
+				segs, err := d.sa.ListSegments(ctx, d.volName)
+				return err == nil && len(segs) == n
+			}
+		}
+
+		// The watchdog checks again at +at+.
+		armed := func(at time.Time) {
+			r.Eventually(func() bool {
+				return clk.waiting(at)
+			}, 5*time.Second, time.Millisecond)
+		}
+
+		armed(start.Add(idle))
+
+		// Nothing was written, so there's nothing to flush.
+		clk.Add(idle)
+		armed(start.Add(2 * idle))
+		r.True(segments(0)())
+
+		now := clk.Now()
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		clk.Add(idle / 2)
+
+		// Pushes the flush back.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		clk.Add(idle / 2)
+
+		armed(now.Add(idle + idle/2))
+		r.True(segments(0)())
+
+		clk.Add(idle / 2)
+
+		r.Eventually(segments(1), 5*time.Second, 10*time.Millisecond)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 2})
+		r.NoError(err)
+
+		blockEqual(t, testRandX, data.ReadData()[:BlockSize])
+		blockEqual(t, testExtent, data.ReadData()[BlockSize:])
+
+		// A write flushed explicitly leaves nothing for the watchdog.
+		armed(clk.Now().Add(idle))
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(2)))
+		r.NoError(d.CloseSegment(ctx))
+		r.True(segments(2)())
+
+		clk.Add(idle)
+		armed(clk.Now().Add(idle))
+		r.True(segments(2)())
+	})
+	t.Run("idle flushes don't interfere with transactions", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		const idle = 10 * time.Second
+
+		clk := newFakeClock(time.Now())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithClock(clk), WithIdleFlush(idle))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		for i := 0; i < 20; i++ {
+			lba := LBA(2 * i)
+
+			r.NoError(d.WriteExtent(ctx, testExtent.MapTo(lba)))
+
+			// Lets the watchdog flush while the transaction flushes and
+			// replaces the write cache.
+			advanced := make(chan struct{})
+			go func() {
+				defer close(advanced)
+				clk.Add(idle)
+			}()
+
+			r.NoError(d.WriteTransaction(ctx, func(tx *WriteTx) error {
+				return tx.WriteExtent(testRandX.MapTo(lba + 1))
+			}))
+
+			<-advanced
+		}
+
+		r.NoError(d.CloseSegment(ctx))
+
+		for i := 0; i < 20; i++ {
+			data, err := d.ReadExtent(ctx, Extent{LBA: LBA(2 * i), Blocks: 2})
+			r.NoError(err)
+
+			blockEqual(t, testExtent, data.ReadData()[:BlockSize])
+			blockEqual(t, testRandX, data.ReadData()[BlockSize:])
+		}
+	})
+	t.Run("reads stay consistent while idle flushes replace the write cache", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		const idle = 10 * time.Second
+
+		clk := newFakeClock(time.Now())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithClock(clk), WithIdleFlush(idle),
+			WithMaxConcurrentFlushes(4))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		const blocks = 50
+
+		var (
+			written atomic.Int64
+			wg      sync.WaitGroup
+		)
+
+		stop := make(chan struct{})
+		readErr := make(chan error, 1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rctx := NewContext(context.Background())
+			defer rctx.Close()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				n := LBA(written.Load())
+
+				data, err := d.ReadExtent(rctx, Extent{LBA: 0, Blocks: blocks})
+				if err == nil {
+					for lba := LBA(0); lba < n; lba++ {
+						blk := data.ReadData()[int(lba)*BlockSize : int(lba+1)*BlockSize]
+						if !bytes.Equal(blk, testExtent) {
+							err = fmt.Errorf("block %d missing while the write cache was flushed", lba)
+							break
+						}
+					}
+				}
+
+				if err != nil {
+					readErr <- err
+					return
+				}
+
+				rctx.Reset()
+			}
+		}()
+
+		for i := 0; i < blocks; i++ {
+			r.NoError(d.WriteExtent(ctx, testExtent.MapTo(LBA(i))))
+			written.Add(1)
+
+			// The watchdog flushes the write cache in the background.
+			clk.Add(idle)
+		}
+
+		close(stop)
+		wg.Wait()
+
+		select {
+		case err := <-readErr:
+			r.NoError(err)
+		default:
+		}
+	})
+}
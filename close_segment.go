@@ -7,10 +7,22 @@ import (
 // CloseSegment synchronously closes the current segment, as well as giving
 // any background GC process to finish up first.
 func (d *Disk) CloseSegment(ctx context.Context) error {
+	if d.detached.Load() {
+		return ErrDetached
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	return d.closeSegment(ctx)
+}
+
+// closeSegment is CloseSegment with writeMu held.
+func (d *Disk) closeSegment(ctx context.Context) error {
 	if d.curOC == nil || d.curOC.EmptyP() {
 		err := d.cleanupDeletedSegments(ctx)
 		if err != nil {
-			d.log.Error("error cleaning up deleted segments", "error", err)
+			d.logs.gc.Error("error cleaning up deleted segments", "error", err)
 		}
 		return nil
 	}
@@ -21,8 +33,8 @@ func (d *Disk) CloseSegment(ctx context.Context) error {
 	}
 
 	select {
-	case <-ch:
-		return nil
+	case res := <-ch:
+		return res.Error
 	case <-ctx.Done():
 		return ctx.Err()
 	}
@@ -37,9 +49,10 @@ func (d *Disk) finalizeSegment(gctx context.Context) error {
 		return d.curOC.Close()
 	}
 
-	d.log.Info("flushing last segment to storage", "segment", d.curSeq)
+	d.logs.flush.Info("flushing last segment to storage", "segment", d.curSeq)
 
-	done := make(chan EventResult)
+	// Buffered so that the controller doesn't block on a Close that gave up.
+	done := make(chan EventResult, 1)
 	select {
 	case <-gctx.Done():
 		return gctx.Err()
@@ -55,8 +68,8 @@ func (d *Disk) finalizeSegment(gctx context.Context) error {
 	select {
 	case <-gctx.Done():
 		return gctx.Err()
-	case <-done:
-		return nil
+	case res := <-done:
+		return res.Error
 	}
 }
 
@@ -65,29 +78,40 @@ func (d *Disk) closeSegmentAsync(gctx context.Context) (chan EventResult, error)
 
 	//s := time.Now()
 	oc := d.curOC
+	oc.segment = segId
 
-	var err error
-	d.curOC, err = d.newSegmentCreator()
+	// Wait for a flush slot before starting a new segment so that a slow
+	// backend pushes back on writers rather than accumulating segments.
+	err := d.prevCache.Add(gctx, oc)
 	if err != nil {
 		return nil, err
 	}
 
-	d.log.Info("flushing segment to storage in background", "segment", segId)
+	next, err := d.newSegmentCreator()
+	if err != nil {
+		d.prevCache.Remove(oc)
+		return nil, err
+	}
 
-	d.prevCache.SetWhenClear(oc)
+	d.setWriteCache(next)
+
+	d.recordWriteCache()
+
+	d.logs.flush.Info("flushing segment to storage in background", "segment", segId)
 
 	done := make(chan EventResult, 1)
 
-	select {
-	case <-gctx.Done():
-		return nil, gctx.Err()
-	case d.controller.EventsCh() <- Event{
+	// Past this point the flush is queued even if gctx is done. oc is no
+	// longer the write cache, so giving up would leave it holding its slot
+	// in prevCache with writes that never reach a segment. The events
+	// channel has room for a flush of everything prevCache holds, so the
+	// send doesn't wait on the controller, which could be stuck retrying
+	// an earlier flush.
+	d.controller.EventsCh() <- Event{
 		Kind:      CloseSegment,
 		Value:     oc,
 		SegmentId: segId,
 		Done:      done,
-	}:
-		// ok
 	}
 
 	return done, nil
@@ -97,23 +121,3 @@ const (
 	GCDensityThreshold = 70.0
 	GCTotalThreshold   = 1024 * 1024 // 1MB
 )
-
-func (d *Disk) cleanupDeletedSegments(ctx context.Context) error {
-	d.deleteMu.Lock()
-	defer d.deleteMu.Unlock()
-
-	for _, i := range d.s.FindDeleted() {
-		d.log.Info("removing segment from volume", "volume", d.volName, "segment", i)
-		err := d.sa.RemoveSegmentFromVolume(ctx, d.volName, i)
-		if err != nil {
-			return err
-		}
-
-		err = d.removeSegmentIfPossible(ctx, i)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,139 @@
+package lsvd
+
+import (
+	"time"
+)
+
+// CompactionPolicy decides when a disk compacts its segments on its own,
+// see WithCompactionPolicy. Compaction runs on the disk's controller, the
+// same as flushing segments does, so only one compaction ever runs at a time
+// and flushes wait for it; the limits bound how long they wait.
+type CompactionPolicy struct {
+	// How often the policy is checked.
+	Interval time.Duration
+
+	// Compact once more than this percent of the volume's blocks are dead,
+	// by GC'ing the least dense segments. 0 disables the trigger.
+	DeadPercent float64
+
+	// Compact once the volume has more than this many segments, by packing
+	// small segments together. 0 disables the trigger.
+	MaxSegments int
+
+	// The most segments a single run GC's or packs. Defaults to 4, and a run
+	// that packs always takes at least 2.
+	MaxSegmentsPerRun int
+
+	// The least time between the start of one run and the next, regardless of
+	// the triggers.
+	MinGap time.Duration
+}
+
+const defaultCompactionPerRun = 4
+
+// Why a CompactionPolicy wants a volume compacted.
+const (
+	compactDead     = "dead-blocks"
+	compactSegments = "segment-count"
+)
+
+// due returns why the segments in +s+ should be compacted, or "" if they
+// shouldn't be.
+func (p *CompactionPolicy) due(s *Segments) string {
+	if p.DeadPercent > 0 && s.TotalBytes() > 0 {
+		if dead := 100 - s.Usage(); dead > p.DeadPercent {
+			return compactDead
+		}
+	}
+
+	if p.MaxSegments > 0 && len(s.LiveSegments()) > p.MaxSegments {
+		return compactSegments
+	}
+
+	return ""
+}
+
+func (p *CompactionPolicy) perRun() int {
+	if p.MaxSegmentsPerRun <= 0 {
+		return defaultCompactionPerRun
+	}
+
+	return p.MaxSegmentsPerRun
+}
+
+// scheduleCompaction returns when the compaction policy should next be
+// checked, or nil if the disk doesn't have one.
+func (c *Controller) scheduleCompaction() <-chan time.Time {
+	d := c.d
+
+	if d.compaction == nil || d.readOnly {
+		return nil
+	}
+
+	d.statsMu.Lock()
+	d.nextCompaction = d.clock.Now().Add(d.compaction.Interval)
+	d.statsMu.Unlock()
+
+	return d.clock.After(d.compaction.Interval)
+}
+
+// checkCompaction compacts the disk's segments if its policy calls for it.
+func (c *Controller) checkCompaction(ctx *Context) error {
+	d := c.d
+	p := d.compaction
+
+	now := d.clock.Now()
+
+	d.statsMu.Lock()
+	last := d.lastCompaction
+	d.statsMu.Unlock()
+
+	if !last.IsZero() && now.Sub(last) < p.MinGap {
+		c.gcLog.Debug("skipping compaction check, last run was too recent", "last", last)
+		return nil
+	}
+
+	reason := p.due(d.s)
+	if reason == "" {
+		return nil
+	}
+
+	c.gcLog.Info("compaction policy triggered", "reason", reason, "density", d.s.Usage())
+
+	d.statsMu.Lock()
+	d.lastCompaction = now
+	d.lastCompactionReason = reason
+	d.statsMu.Unlock()
+
+	if reason == compactSegments {
+		segments := d.s.FindSmallSegments(SmallSegmentCutOff, MaxBlocksPerSmallPack)
+		if limit := max(p.perRun(), 2); len(segments) > limit {
+			segments = segments[:limit]
+		}
+
+		if len(segments) < 2 {
+			c.gcLog.Info("no small segments to pack")
+			return nil
+		}
+
+		return c.packSegments(ctx, Event{}, segments)
+	}
+
+	for i := 0; i < p.perRun() && p.due(d.s) == compactDead; i++ {
+		toGC, _, ok, err := d.s.LeastDenseSegment(c.gcLog)
+		if err != nil || !ok {
+			return err
+		}
+
+		if size, used := d.s.SegmentBlocks(toGC); used == size {
+			return nil
+		}
+
+		err = c.gcSegment(ctx, Event{}, toGC)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
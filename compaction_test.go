@@ -0,0 +1,241 @@
+package lsvd
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionPolicy(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	segments := func(stats ...[2]uint64) *Segments {
+		s := NewSegments()
+
+		for _, st := range stats {
+			seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+			s.SetSegment(seg, st[0], st[1])
+		}
+
+		return s
+	}
+
+	t.Run("triggers on the dead block percentage", func(t *testing.T) {
+		r := require.New(t)
+
+		p := CompactionPolicy{DeadPercent: 30}
+
+		r.Equal("", p.due(NewSegments()))
+		r.Equal("", p.due(segments([2]uint64{100, 80}, [2]uint64{100, 90})))
+		r.Equal(compactDead, p.due(segments([2]uint64{100, 40}, [2]uint64{100, 90})))
+	})
+
+	t.Run("triggers on the segment count", func(t *testing.T) {
+		r := require.New(t)
+
+		p := CompactionPolicy{MaxSegments: 2}
+
+		r.Equal("", p.due(segments([2]uint64{10, 1}, [2]uint64{10, 1})))
+
+		s := segments([2]uint64{10, 10}, [2]uint64{10, 10}, [2]uint64{10, 10})
+		r.Equal(compactSegments, p.due(s))
+
+		s.SetDeleted(s.LiveSegments()[0], log)
+		r.Equal("", p.due(s))
+	})
+
+	t.Run("disabled triggers never fire", func(t *testing.T) {
+		r := require.New(t)
+
+		var p CompactionPolicy
+
+		r.Equal("", p.due(segments([2]uint64{100, 0}, [2]uint64{100, 0}, [2]uint64{100, 0})))
+	})
+
+	// start returns a disk using +p+ on a fake clock, once its controller is
+	// waiting for the first check.
+	start := func(t *testing.T, p CompactionPolicy) (*Disk, *fakeClock) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		clk := newFakeClock(time.Now())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithClock(clk), WithCompactionPolicy(p))
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		r.Eventually(func() bool {
+			return !d.Stats().NextCompaction.IsZero()
+		}, 5*time.Second, 10*time.Millisecond)
+
+		return d, clk
+	}
+
+	// advance moves +clk+ forward by +dur+ and waits for the disk to finish
+	// the check that triggers.
+	advance := func(t *testing.T, d *Disk, clk *fakeClock, dur time.Duration) {
+		clk.Add(dur)
+
+		next := clk.Now().Add(d.compaction.Interval)
+
+		require.Eventually(t, func() bool {
+			return d.Stats().NextCompaction.Equal(next)
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	listSegments := func(t *testing.T, d *Disk) []SegmentId {
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		require.NoError(t, err)
+		return segs
+	}
+
+	write := func(t *testing.T, d *Disk, ext Extent) RangeData {
+		data := NewRangeData(ctx, ext)
+		_, err := io.ReadFull(rand.Reader, data.WriteData())
+		require.NoError(t, err)
+
+		require.NoError(t, d.WriteExtent(ctx, data))
+
+		return data
+	}
+
+	t.Run("packs segments once there are too many", func(t *testing.T) {
+		r := require.New(t)
+
+		d, clk := start(t, CompactionPolicy{
+			Interval:    30 * time.Second,
+			MaxSegments: 2,
+		})
+
+		for i := 0; i < 3; i++ {
+			write(t, d, Extent{LBA(i), 1})
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		r.Len(listSegments(t, d), 3)
+
+		advance(t, d, clk, 31*time.Second)
+
+		r.Eventually(func() bool {
+			return len(listSegments(t, d)) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		stats := d.Stats()
+		r.Equal(compactSegments, stats.LastCompactionReason)
+		r.True(stats.LastCompaction.Equal(clk.Now()))
+		r.True(stats.NextCompaction.Equal(clk.Now().Add(30 * time.Second)))
+	})
+
+	t.Run("GCs the least dense segments, a limited number per run", func(t *testing.T) {
+		r := require.New(t)
+
+		d, clk := start(t, CompactionPolicy{
+			Interval:          30 * time.Second,
+			DeadPercent:       10,
+			MaxSegmentsPerRun: 1,
+		})
+
+		write(t, d, Extent{0, 4})
+		r.NoError(d.CloseSegment(ctx))
+
+		write(t, d, Extent{4, 4})
+		r.NoError(d.CloseSegment(ctx))
+
+		first := listSegments(t, d)
+		r.Len(first, 2)
+
+		// Leave a single live block in each of the first two segments.
+		a := write(t, d, Extent{0, 3})
+		b := write(t, d, Extent{4, 3})
+		r.NoError(d.CloseSegment(ctx))
+
+		advance(t, d, clk, 31*time.Second)
+
+		r.Eventually(func() bool {
+			segs := listSegments(t, d)
+			return len(segs) == 3 && !slices.Contains(segs, first[0])
+		}, 5*time.Second, 10*time.Millisecond)
+
+		r.Contains(listSegments(t, d), first[1])
+		r.Equal(compactDead, d.Stats().LastCompactionReason)
+
+		advance(t, d, clk, 31*time.Second)
+
+		r.Eventually(func() bool {
+			return !slices.Contains(listSegments(t, d), first[1])
+		}, 5*time.Second, 10*time.Millisecond)
+
+		data, err := d.ReadExtent(ctx, Extent{0, 3})
+		r.NoError(err)
+		r.Equal(a.ReadData(), data.ReadData())
+
+		data, err = d.ReadExtent(ctx, Extent{4, 3})
+		r.NoError(err)
+		r.Equal(b.ReadData(), data.ReadData())
+	})
+
+	t.Run("waits the minimum gap between runs", func(t *testing.T) {
+		r := require.New(t)
+
+		d, clk := start(t, CompactionPolicy{
+			Interval:    30 * time.Second,
+			MaxSegments: 1,
+			MinGap:      90 * time.Second,
+		})
+
+		for i := 0; i < 2; i++ {
+			write(t, d, Extent{LBA(i), 1})
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		advance(t, d, clk, 31*time.Second)
+
+		r.Eventually(func() bool {
+			return len(listSegments(t, d)) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		last := d.Stats().LastCompaction
+
+		for i := 0; i < 2; i++ {
+			write(t, d, Extent{LBA(i + 2), 1})
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		advance(t, d, clk, 31*time.Second)
+
+		r.Len(listSegments(t, d), 3)
+		r.True(d.Stats().LastCompaction.Equal(last))
+
+		advance(t, d, clk, 61*time.Second)
+
+		r.Eventually(func() bool {
+			return len(listSegments(t, d)) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		r.True(d.Stats().LastCompaction.After(last))
+	})
+
+	t.Run("requires a positive interval", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		_, err = NewDisk(ctx, log, tmpdir, WithCompactionPolicy(CompactionPolicy{MaxSegments: 1}))
+		r.Error(err)
+	})
+}
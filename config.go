@@ -17,6 +17,10 @@ type Config struct {
 			SecretKey string `hcl:"secret_key,optional"`
 			Directory string `hcl:"directory,optional"`
 			URL       string `hcl:"host,optional"`
+			Profile   string `hcl:"profile,optional"`
+
+			// Address buckets as "bucket.host" rather than "host/bucket".
+			VirtualHostStyle bool `hcl:"virtual_host_style,optional"`
 		} `hcl:"s3,block"`
 	} `hcl:"storage,block"`
 }
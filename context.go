@@ -1,11 +1,18 @@
 package lsvd
 
-import "context"
+import (
+	"context"
+	"sync/atomic"
+)
 
 type Context struct {
 	context.Context
 
 	buffers *Buffers
+
+	// How many bytes have been read from segment storage rather than a cache
+	// using the context.
+	coldBytes int64
 }
 
 func NewContext(ctx context.Context) *Context {
@@ -15,6 +22,14 @@ func NewContext(ctx context.Context) *Context {
 	}
 }
 
+// addColdBytes records that +n+ bytes were read from segment storage using
+// +ctx+, if it's a Context.
+func addColdBytes(ctx context.Context, n int) {
+	if c, ok := ctx.(*Context); ok && n > 0 {
+		atomic.AddInt64(&c.coldBytes, int64(n))
+	}
+}
+
 func (c *Context) Reset() {
 	c.buffers.Reset()
 }
@@ -17,6 +17,7 @@ const (
 	CleanupSegments
 	StartGC
 	SweepSmallSegments
+	Checkpoint
 )
 
 type Event struct {
@@ -33,18 +34,33 @@ type EventResult struct {
 
 type Controller struct {
 	log      logger.Logger
+	gcLog    logger.Logger
 	d        *Disk
 	events   chan Event
 	internal []Event
 
 	lastNewSegment time.Time
+
+	// Segments flushed since the LBA map was last saved.
+	sinceCheckpoint int
+
+	// Set when a flush may have left segments to remove.
+	cleanupPending bool
 }
 
+// How many events other than segment flushes can be queued for the
+// controller before their senders wait. On top of these, the events channel
+// has a slot for each segment the previous cache can hold, so that queueing
+// a flush never waits, even while the controller is retrying an earlier one
+// against an unreachable backend. See closeSegmentAsync.
+const controllerEventSlots = 20
+
 func NewController(ctx context.Context, d *Disk) (*Controller, error) {
 	c := &Controller{
-		log:    d.log,
+		log:    d.logs.flush,
+		gcLog:  d.logs.gc,
 		d:      d,
-		events: make(chan Event, 20),
+		events: make(chan Event, d.prevCache.max+controllerEventSlots),
 	}
 
 	return c, nil
@@ -65,8 +81,11 @@ func (c *Controller) queueInternal(ev Event) {
 func (c *Controller) handleControl(gctx context.Context) {
 	ctx := NewContext(gctx)
 
-	tick := time.NewTicker(time.Minute)
-	defer tick.Stop()
+	tick := c.d.clock.After(time.Minute)
+	compact := c.scheduleCompaction()
+	refresh := c.scheduleRefresh()
+	checkpoint := c.scheduleCheckpoint()
+	cleanup := c.scheduleCleanup()
 
 	for {
 		for _, ev := range c.internal {
@@ -94,18 +113,61 @@ func (c *Controller) handleControl(gctx context.Context) {
 			if err != nil {
 				c.log.Error("error handling event", "error", err, "event-kind", ev.Kind)
 			}
-		case <-tick.C:
+		case <-tick:
+			tick = c.d.clock.After(time.Minute)
+
 			err := c.handleTick(ctx)
 			if err != nil {
 				c.log.Error("error handling tick", "error", err)
 			}
+		case <-compact:
+			err := c.checkCompaction(ctx)
+			if err != nil {
+				c.log.Error("error compacting segments", "error", err)
+			}
+
+			compact = c.scheduleCompaction()
+		case <-refresh:
+			err := c.d.Refresh(ctx)
+			if err != nil {
+				c.log.Error("error refreshing segments", "error", err)
+			}
+
+			refresh = c.scheduleRefresh()
+		case <-checkpoint:
+			if c.sinceCheckpoint > 0 {
+				err := c.checkpoint(ctx)
+				if err != nil {
+					c.log.Error("error checkpointing lba map", "error", err)
+				}
+			}
+
+			checkpoint = c.scheduleCheckpoint()
+		case <-cleanup:
+			if c.cleanupPending {
+				c.cleanupPending = false
+
+				err := c.d.cleanupDeletedSegments(ctx)
+				if err != nil {
+					c.gcLog.Error("error cleaning up deleted segments", "error", err)
+				}
+			}
+
+			cleanup = c.scheduleCleanup()
 		}
 	}
 }
 
 func (c *Controller) handleTick(ctx *Context) error {
-	if time.Since(c.lastNewSegment) >= 5*time.Minute {
-		c.lastNewSegment = time.Now()
+	// Packing and GC write segments, which is left to the writer.
+	if c.d.readOnly {
+		return nil
+	}
+
+	now := c.d.clock.Now()
+
+	if now.Sub(c.lastNewSegment) >= 5*time.Minute {
+		c.lastNewSegment = now
 
 		err := c.handleLongIdle(ctx)
 		if err != nil {
@@ -128,19 +190,19 @@ func (c *Controller) handleLongIdle(ctx *Context) error {
 		return c.improveDensity(ctx)
 	}
 
-	c.log.Info("gather small segments for packing cycle", "segments", len(smallSegments))
+	c.gcLog.Info("gather small segments for packing cycle", "segments", len(smallSegments))
 
 	return c.packSegments(ctx, Event{}, smallSegments)
 }
 
 func (c *Controller) improveDensity(ctx *Context) error {
-	toGC, density, ok, err := c.d.s.LeastDenseSegment(c.log)
+	toGC, density, ok, err := c.d.s.LeastDenseSegment(c.gcLog)
 	if err != nil {
 		return err
 	}
 
 	if !ok {
-		c.log.Warn("GC was requested, but no least dense segment available")
+		c.gcLog.Warn("GC was requested, but no least dense segment available")
 		return nil
 	}
 
@@ -148,7 +210,7 @@ func (c *Controller) improveDensity(ctx *Context) error {
 		return nil
 	}
 
-	c.log.Info("improving density by GC'ing segment", "segment", toGC, "density", density)
+	c.gcLog.Info("improving density by GC'ing segment", "segment", toGC, "density", density)
 
 	return c.gcSegment(ctx, Event{}, toGC)
 }
@@ -159,7 +221,7 @@ func (c *Controller) sweepSmallSegments(ctx *Context, ev Event) error {
 		return c.returnError(ev, nil)
 	}
 
-	c.log.Info("gather small segments for packing cycle", "segments", len(smallSegments))
+	c.gcLog.Info("gather small segments for packing cycle", "segments", len(smallSegments))
 
 	return c.packSegments(ctx, ev, smallSegments)
 }
@@ -174,11 +236,17 @@ func (c *Controller) handleEvent(ctx *Context, ev Event) error {
 		return c.startGC(ctx, ev)
 	case SweepSmallSegments:
 		return c.sweepSmallSegments(ctx, ev)
+	case Checkpoint:
+		return c.returnError(ev, c.checkpoint(ctx))
 	default:
 		return fmt.Errorf("unknown kind: %d", ev.Kind)
 	}
 }
 
+// How many times flushing a segment has to fail before it's reported to the
+// flush error handler.
+const flushFailuresBeforeReport = 3
+
 func (c *Controller) closeSegment(ctx *Context, ev Event) error {
 	oc := ev.Value.(*SegmentCreator)
 	done := ev.Done
@@ -186,22 +254,25 @@ func (c *Controller) closeSegment(ctx *Context, ev Event) error {
 
 	s := time.Now()
 
-	c.lastNewSegment = s
+	c.lastNewSegment = c.d.clock.Now()
 
 	d := c.d
 
+	var flushErr error
+
 	defer c.log.Debug("finished goroutine to close segment")
 	defer func() {
 		defer close(done)
 		done <- EventResult{
 			Segment: segId,
+			Error:   flushErr,
 		}
 	}()
-	defer segmentsWritten.Inc()
+	defer c.d.metrics.segmentsWritten.Inc()
 	defer oc.Close()
 
 	defer func() {
-		segmentTotalTime.Add(time.Since(s).Seconds())
+		c.d.metrics.segmentTotalTime.Add(time.Since(s).Seconds())
 	}()
 
 	var (
@@ -213,11 +284,31 @@ func (c *Controller) closeSegment(ctx *Context, ev Event) error {
 	// We retry because flush does network calls and we want to just keep trying
 	// forever.
 	start := time.Now()
-	for {
+	for failures := 1; ; failures++ {
 		entries, stats, err = oc.Flush(ctx, d.sa, segId)
+		if errors.Is(err, ErrFenced) {
+			// Retrying won't help, the volume belongs to a newer writer now.
+			c.log.Error("volume attached by a newer writer, dropping segment", "segment", segId, "error", err)
+
+			d.fenced.Store(true)
+			d.prevCache.Remove(oc)
+
+			if d.onFlushErr != nil {
+				go d.onFlushErr(segId, err)
+			}
+
+			flushErr = err
+			return err
+		}
+
 		if err != nil {
-			c.log.Error("error flushing data to segment, retrying", "error", err)
-			time.Sleep(5 * time.Second)
+			c.log.Error("error flushing data to segment, retrying", "error", err, "failures", failures)
+
+			if failures == flushFailuresBeforeReport && d.onFlushErr != nil {
+				go d.onFlushErr(segId, err)
+			}
+
+			<-d.clock.After(d.flushRetryDelay)
 			continue
 		}
 
@@ -226,6 +317,8 @@ func (c *Controller) closeSegment(ctx *Context, ev Event) error {
 
 	flushDur := time.Since(start)
 
+	c.d.metrics.recordSegment(stats)
+
 	c.log.Debug("segment published, resetting write cache")
 
 	var validator *extentValidator
@@ -239,14 +332,22 @@ func (c *Controller) closeSegment(ctx *Context, ev Event) error {
 
 	d.s.Create(segId, stats)
 
+	if refs := oc.builder.refSegments(); len(refs) > 0 {
+		d.s.SetRefs(segId, refs)
+	}
+
 	err = d.lba2pba.UpdateBatch(c.log, entries, segId, d.s)
 	if err != nil {
 		c.log.Error("error updating lba map", "error", err)
 	}
 
-	extents.Set(float64(d.lba2pba.m.Len()))
+	c.d.metrics.extents.Set(float64(d.lba2pba.m.Len()))
 
-	d.prevCache.Clear()
+	if d.dedup != nil {
+		d.dedup.add(segId, entries, oc.builder.keys)
+	}
+
+	d.prevCache.Remove(oc)
 
 	mapDur := time.Since(mapStart)
 
@@ -262,12 +363,14 @@ func (c *Controller) closeSegment(ctx *Context, ev Event) error {
 
 	c.log.Info("uploaded new segment", "segment", segId, "flush-dur", flushDur, "map-dur", mapDur, "dur", finDur)
 
-	c.queueInternal(Event{
-		Kind: CleanupSegments,
-	})
+	// Segments the flush overwrote are removed on the next cleanup, so that
+	// a run of flushes doesn't each wait on listing and rewriting the volume.
+	c.cleanupPending = true
+
+	c.segmentFlushed()
 
 	density := d.s.Usage()
-	dataDensity.Set(density)
+	c.d.metrics.dataDensity.Set(density)
 
 	c.log.Info("finished background segment flush", "total-density", density)
 
@@ -299,11 +402,11 @@ func (c *Controller) returnError(ev Event, err error) error {
 }
 
 func (c *Controller) startGC(ctx *Context, ev Event) error {
-	gcCount.Inc()
+	c.d.metrics.gcCount.Inc()
 	s := time.Now()
 
 	defer func() {
-		gcTime.Add(time.Since(s).Seconds())
+		c.d.metrics.gcTime.Add(time.Since(s).Seconds())
 	}()
 
 	d := c.d
@@ -314,26 +417,21 @@ func (c *Controller) startGC(ctx *Context, ev Event) error {
 			Kind: CleanupSegments,
 		})
 
-		d.log.Info("detected and pruned dead segments", "segments", dead, "new-density", newDensity)
+		d.logs.gc.Info("detected and pruned dead segments", "segments", dead, "new-density", newDensity)
 		if newDensity > GCDensityThreshold {
-			if ev.Done != nil {
-				go func() {
-					defer close(ev.Done)
-					ev.Done <- EventResult{}
-				}()
-			}
+			return c.returnError(ev, nil)
 		}
 	}
 
 	if density := d.s.Usage(); density > GCDensityThreshold {
-		d.log.Debug("skipping GC has usage has raised since request", "density", density)
-		return nil
+		d.logs.gc.Debug("skipping GC has usage has raised since request", "density", density)
+		return c.returnError(ev, nil)
 	}
 
-	toGC, _, ok, err := d.s.LeastDenseSegment(d.log)
+	toGC, _, ok, err := d.s.LeastDenseSegment(d.logs.gc)
 	if !ok {
-		d.log.Warn("GC was requested, but no least dense segment available")
-		return nil
+		d.logs.gc.Warn("GC was requested, but no least dense segment available")
+		return c.returnError(ev, nil)
 	}
 
 	if err != nil {
@@ -348,7 +446,7 @@ func (c *Controller) gcSegment(ctx *Context, ev Event, toGC SegmentId) error {
 
 	ci, err := d.CopyIterator(ctx, toGC)
 	if err != nil {
-		d.log.Error("error creating copy iterator segment to GC",
+		d.logs.gc.Error("error creating copy iterator segment to GC",
 			"error", err,
 			"segment", toGC,
 		)
@@ -356,28 +454,28 @@ func (c *Controller) gcSegment(ctx *Context, ev Event, toGC SegmentId) error {
 	}
 
 	if ci == nil {
-		d.log.Info("copied found a dead segment and deleted it directly, gc skipped")
+		d.logs.gc.Info("copied found a dead segment and deleted it directly, gc skipped")
 	} else {
-		d.log.Info("beginning GC of segment", "segment", toGC)
+		d.logs.gc.Info("beginning GC of segment", "segment", toGC)
 
-		err = ci.ProcessFromExtents(ctx, d.log)
+		err = ci.ProcessFromExtents(ctx, d.logs.gc)
 		if err != nil {
-			d.log.Error("error processing segment for gc", "error", err, "segment", toGC)
+			d.logs.gc.Error("error processing segment for gc", "error", err, "segment", toGC)
 			return c.returnError(ev, err)
 		}
 
 		err = ci.Close(ctx)
 		if err != nil {
-			d.log.Error("error closing segment after gc", "error", err, "segment", toGC)
+			d.logs.gc.Error("error closing segment after gc", "error", err, "segment", toGC)
 			return c.returnError(ev, err)
 		}
 	}
 
 	density := d.s.Usage()
 
-	d.log.Info("GC cycle complete", "updated-density", density)
+	d.logs.gc.Info("GC cycle complete", "updated-density", density)
 
-	dataDensity.Set(density)
+	c.d.metrics.dataDensity.Set(density)
 
 	if ev.Done != nil {
 		go func() {
@@ -388,7 +486,7 @@ func (c *Controller) gcSegment(ctx *Context, ev Event, toGC SegmentId) error {
 		}()
 	}
 
-	c.lastNewSegment = time.Now()
+	c.lastNewSegment = c.d.clock.Now()
 
 	c.queueInternal(Event{
 		Kind: CleanupSegments,
@@ -398,18 +496,18 @@ func (c *Controller) gcSegment(ctx *Context, ev Event, toGC SegmentId) error {
 }
 
 func (c *Controller) packSegments(ctx *Context, ev Event, segments []SegmentId) error {
-	gcCount.Inc()
+	c.d.metrics.gcCount.Inc()
 	s := time.Now()
 
 	defer func() {
-		gcTime.Add(time.Since(s).Seconds())
+		c.d.metrics.gcTime.Add(time.Since(s).Seconds())
 	}()
 
 	d := c.d
 
 	ci := CopyIterator{
 		d:       c.d,
-		builder: NewSegmentBuilder(),
+		builder: c.d.newSegmentBuilder(),
 	}
 
 	for _, toGC := range segments {
@@ -418,26 +516,26 @@ func (c *Controller) packSegments(ctx *Context, ev Event, segments []SegmentId)
 			return c.returnError(ev, errors.Wrapf(err, "reseting copy iterator"))
 		}
 
-		d.log.Info("beginning GC of segment", "segment", toGC)
+		d.logs.gc.Info("beginning GC of segment", "segment", toGC)
 
-		err = ci.ProcessFromExtents(ctx, d.log)
+		err = ci.ProcessFromExtents(ctx, d.logs.gc)
 		if err != nil {
-			d.log.Error("error processing segment for gc", "error", err, "segment", toGC)
+			d.logs.gc.Error("error processing segment for gc", "error", err, "segment", toGC)
 			return c.returnError(ev, err)
 		}
 	}
 
 	err := ci.Close(ctx)
 	if err != nil {
-		d.log.Error("error closing segment after gc", "error", err)
+		d.logs.gc.Error("error closing segment after gc", "error", err)
 		return c.returnError(ev, err)
 	}
 
 	density := d.s.Usage()
 
-	d.log.Info("GC cycle complete", "updated-density", density)
+	d.logs.gc.Info("GC cycle complete", "updated-density", density)
 
-	dataDensity.Set(density)
+	c.d.metrics.dataDensity.Set(density)
 
 	if ev.Done != nil {
 		go func() {
@@ -446,7 +544,7 @@ func (c *Controller) packSegments(ctx *Context, ev Event, segments []SegmentId)
 		}()
 	}
 
-	c.lastNewSegment = time.Now()
+	c.lastNewSegment = c.d.clock.Now()
 
 	c.queueInternal(Event{
 		Kind: CleanupSegments,
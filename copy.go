@@ -0,0 +1,111 @@
+package lsvd
+
+import (
+	"github.com/pkg/errors"
+)
+
+// How many blocks CopyVolume reads from the source and writes to the
+// destination at a time.
+const copyBatchBlocks = 256
+
+// CopyCursor is how far CopyVolume has got.
+type CopyCursor struct {
+	// The next block to copy. Passing the cursor to CopyResume continues
+	// the copy from there.
+	Next LBA
+
+	// How many bytes have been written to the destination. Zero blocks
+	// aren't written, so they aren't counted.
+	Copied int64
+}
+
+type copyOpts struct {
+	resume   *CopyCursor
+	progress func(CopyCursor)
+}
+
+type CopyOption func(o *copyOpts)
+
+// CopyResume continues a copy from +cur+, as returned or reported by an
+// earlier CopyVolume of the same range.
+func CopyResume(cur CopyCursor) CopyOption {
+	return func(o *copyOpts) {
+		o.resume = &cur
+	}
+}
+
+// CopyProgress registers a function that is called with the cursor after
+// each batch is written to the destination.
+func CopyProgress(fn func(cur CopyCursor)) CopyOption {
+	return func(o *copyOpts) {
+		o.progress = fn
+	}
+}
+
+var ErrCopyToSelf = errors.New("can't copy a volume into itself")
+
+// CopyVolume copies the blocks of +rng+ in +src+ to the same blocks of +dst+,
+// such as to consolidate volumes. Like ImportRaw, all-zero blocks are skipped
+// rather than written so that +dst+ stays thinly provisioned, which means
+// that any data +dst+ already has in those regions is left in place.
+//
+// The blocks are copied in batches, each written with WriteExtents. The
+// returned cursor is how far the copy got, even if it fails, so that it can
+// be resumed with CopyResume.
+func CopyVolume(ctx *Context, src, dst *Disk, rng Extent, opts ...CopyOption) (CopyCursor, error) {
+	var o copyOpts
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cur := CopyCursor{Next: rng.LBA}
+	if o.resume != nil {
+		cur = *o.resume
+	}
+
+	if src == dst {
+		return cur, ErrCopyToSelf
+	}
+
+	if dst.readOnly {
+		return cur, ErrReadOnly
+	}
+
+	end := rng.LBA + LBA(rng.Blocks)
+
+	for cur.Next < end {
+		if err := ctx.Err(); err != nil {
+			return cur, err
+		}
+
+		batch := Extent{LBA: cur.Next, Blocks: uint32(min(copyBatchBlocks, end-cur.Next))}
+
+		marker := ctx.Marker()
+
+		data, err := src.ReadExtent(ctx, batch)
+		if err != nil {
+			ctx.ResetTo(marker)
+			return cur, errors.Wrapf(err, "reading extent %s", batch)
+		}
+
+		written, err := dst.importChunk(ctx, batch.LBA, data.ReadData())
+
+		ctx.ResetTo(marker)
+
+		if err != nil {
+			return cur, errors.Wrapf(err, "writing extent %s", batch)
+		}
+
+		cur.Next += LBA(batch.Blocks)
+		cur.Copied += int64(written) * BlockSize
+
+		if o.progress != nil {
+			o.progress(cur)
+		}
+	}
+
+	src.log.Info("copied volume", "range", rng, "to", dst.volName, "bytes", cur.Copied)
+
+	return cur, nil
+}
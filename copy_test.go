@@ -0,0 +1,116 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyVolume(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	const volumeBlocks = 600
+
+	newDisk := func(t *testing.T) *Disk {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		return d
+	}
+
+	// newSource returns a disk with data both in a segment and in its write
+	// cache, spread over several batches.
+	newSource := func(t *testing.T) *Disk {
+		r := require.New(t)
+
+		src := newDisk(t)
+
+		r.NoError(src.WriteExtent(ctx, testRandX.MapTo(1)))
+		r.NoError(src.WriteExtent(ctx, testExtent.MapTo(2)))
+		r.NoError(src.CloseSegment(ctx))
+
+		r.NoError(src.WriteExtent(ctx, testExtent2.MapTo(300)))
+		r.NoError(src.WriteExtent(ctx, testExtent3.MapTo(volumeBlocks-1)))
+
+		return src
+	}
+
+	readAll := func(t *testing.T, d *Disk) []byte {
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: volumeBlocks})
+		require.NoError(t, err)
+
+		return data.ReadData()
+	}
+
+	t.Run("copies a volume into a fresh one", func(t *testing.T) {
+		r := require.New(t)
+
+		src := newSource(t)
+		dst := newDisk(t)
+
+		cur, err := CopyVolume(ctx, src, dst, Extent{LBA: 0, Blocks: volumeBlocks})
+		r.NoError(err)
+
+		r.Equal(LBA(volumeBlocks), cur.Next)
+		r.Equal(int64(4*BlockSize), cur.Copied)
+
+		r.Equal(readAll(t, src), readAll(t, dst))
+
+		// Only the written blocks were written.
+		r.Equal(4, dst.curOC.TotalBlocks())
+	})
+
+	t.Run("resumes from a cursor", func(t *testing.T) {
+		r := require.New(t)
+
+		src := newSource(t)
+		dst := newDisk(t)
+
+		rng := Extent{LBA: 0, Blocks: volumeBlocks}
+
+		var cursors []CopyCursor
+
+		_, err := CopyVolume(ctx, src, dst, rng, CopyProgress(func(cur CopyCursor) {
+			cursors = append(cursors, cur)
+		}))
+		r.NoError(err)
+		r.Len(cursors, 3)
+
+		// Resuming after the first batch only copies the rest.
+		resumed := newDisk(t)
+
+		cur, err := CopyVolume(ctx, src, resumed, rng, CopyResume(cursors[0]))
+		r.NoError(err)
+		r.Equal(cursors[2], cur)
+
+		data, err := resumed.ReadExtent(ctx, Extent{LBA: 0, Blocks: copyBatchBlocks})
+		r.NoError(err)
+		r.True(isEmpty(data.ReadData()))
+
+		r.Equal(readAll(t, src)[copyBatchBlocks*BlockSize:], readAll(t, resumed)[copyBatchBlocks*BlockSize:])
+	})
+
+	t.Run("won't copy a volume into itself", func(t *testing.T) {
+		r := require.New(t)
+
+		d := newDisk(t)
+
+		_, err := CopyVolume(ctx, d, d, Extent{LBA: 0, Blocks: 1})
+		r.ErrorIs(err, ErrCopyToSelf)
+	})
+}
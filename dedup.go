@@ -0,0 +1,202 @@
+package lsvd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// DefaultDedupEntries is how many extents the dedup index remembers when
+// WithDedup isn't given a limit.
+const DefaultDedupEntries = 1 << 20
+
+// dedupKey identifies the data of an extent by its size in blocks and the
+// SHA-256 of its contents. The zero key is never the key of any data.
+type dedupKey struct {
+	Blocks uint32            `cbor:"1,keyasint"`
+	Sum    [sha256.Size]byte `cbor:"2,keyasint"`
+}
+
+func newDedupKey(data RangeDataView) dedupKey {
+	return dedupKey{
+		Blocks: data.Blocks,
+		Sum:    sha256.Sum256(data.ReadData()),
+	}
+}
+
+// dedupIndex remembers where the data of the extents flushed to a volume is
+// stored, so that a segment can refer to data that's already stored rather
+// than store it again.
+//
+// An entry stays valid as long as its segment is live, since the data in a
+// segment never changes. Entries for segments that have been deleted since
+// are dropped when they're looked up.
+type dedupIndex struct {
+	s   *Segments
+	max int
+
+	mu      sync.Mutex
+	entries map[dedupKey]ExtentLocation
+}
+
+func newDedupIndex(s *Segments, max int) *dedupIndex {
+	if max <= 0 {
+		max = DefaultDedupEntries
+	}
+
+	return &dedupIndex{
+		s:       s,
+		max:     max,
+		entries: make(map[dedupKey]ExtentLocation),
+	}
+}
+
+// lookup returns where the data with +key+ is stored. The segment holding it
+// is pinned, so the caller has to unpin it once it's done referring to it.
+func (x *dedupIndex) lookup(key dedupKey) (ExtentLocation, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	loc, ok := x.entries[key]
+	if !ok {
+		return ExtentLocation{}, false
+	}
+
+	if !x.s.Pin(loc.Segment) {
+		delete(x.entries, key)
+		return ExtentLocation{}, false
+	}
+
+	return loc, true
+}
+
+// add records where the extents in +entries+ that +seg+ stores are, using
+// the keys in +keys+, which line up with +entries+. Data that's already
+// stored elsewhere keeps pointing there.
+func (x *dedupIndex) add(seg SegmentId, entries []ExtentLocation, keys []dedupKey) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for i, ent := range entries {
+		if i >= len(keys) {
+			break
+		}
+
+		key := keys[i]
+
+		if key.Blocks == 0 || ent.Segment != seg || ent.Size == 0 {
+			continue
+		}
+
+		if cur, ok := x.entries[key]; ok && x.s.IsLive(cur.Segment) {
+			continue
+		}
+
+		// Forget an arbitrary entry to make room, which only means that the
+		// data it's for is stored again if it's written again.
+		if len(x.entries) >= x.max {
+			for k := range x.entries {
+				delete(x.entries, k)
+				break
+			}
+		}
+
+		ent.Extent.LBA = 0
+		x.entries[key] = ent
+	}
+}
+
+func (x *dedupIndex) len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return len(x.entries)
+}
+
+func (d *Disk) dedupIndexPath() string {
+	return filepath.Join(d.path, "dedup.idx")
+}
+
+type dedupRecord struct {
+	Key dedupKey       `cbor:"1,keyasint"`
+	Loc ExtentLocation `cbor:"2,keyasint"`
+}
+
+// save writes the index to +path+, replacing it in one step so that a crash
+// leaves either the old or the new index.
+func (x *dedupIndex) save(path string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	enc := cbor.NewEncoder(bw)
+
+	for key, loc := range x.entries {
+		err = enc.Encode(dedupRecord{Key: key, Loc: loc})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// load adds the entries saved to +path+, if it exists.
+func (x *dedupIndex) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer f.Close()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	dec := cbor.NewDecoder(bufio.NewReader(f))
+
+	for len(x.entries) < x.max {
+		var rec dedupRecord
+
+		err := dec.Decode(&rec)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return errors.Wrapf(err, "reading dedup index %s", path)
+		}
+
+		x.entries[rec.Key] = rec.Loc
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	tempDir := func(t *testing.T) string {
+		dir, err := os.MkdirTemp("", "lsvd")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+
+	segmentBytes := func(t *testing.T, d *Disk, seg SegmentId) uint64 {
+		stats, ok := d.s.segments[seg]
+		require.True(t, ok)
+		return stats.Bytes
+	}
+
+	readEqual := func(t *testing.T, d *Disk, lba LBA, data []byte) {
+		rd, err := d.ReadExtent(ctx, Extent{LBA: lba, Blocks: 1})
+		require.NoError(t, err)
+
+		blockEqual(t, rd.RawBlocks().BlockView(0), data)
+	}
+
+	t.Run("stores duplicate data within a segment once", func(t *testing.T) {
+		r := require.New(t)
+
+		plain, err := NewDisk(ctx, log, tempDir(t))
+		r.NoError(err)
+		defer plain.Close(ctx)
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithDedup(0))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		for _, disk := range []*Disk{plain, d} {
+			r.NoError(disk.WriteExtent(ctx, testRandX.MapTo(0)))
+			r.NoError(disk.WriteExtent(ctx, testRandX.MapTo(10)))
+			r.NoError(disk.WriteExtent(ctx, testRandX.MapTo(20)))
+		}
+
+		plainSeg := SegmentId(plain.curSeq)
+		r.NoError(plain.CloseSegment(ctx))
+
+		seg := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		saved := segmentBytes(t, plain, plainSeg) - segmentBytes(t, d, seg)
+		r.GreaterOrEqual(saved, uint64(2*BlockSize))
+
+		for _, lba := range []LBA{0, 10, 20} {
+			readEqual(t, d, lba, testRand)
+		}
+	})
+
+	t.Run("refers to data stored in an earlier segment", func(t *testing.T) {
+		r := require.New(t)
+
+		dir := tempDir(t)
+
+		d, err := NewDisk(ctx, log, dir, WithDedup(0))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		s1 := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(47)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(48)))
+
+		s2 := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		r.Less(segmentBytes(t, d, s2), uint64(2*BlockSize))
+		r.Equal([]SegmentId{s1}, d.s.segments[s2].refs)
+
+		// The reference is a use of the segment that stores the data.
+		r.Equal(uint64(2), d.s.segments[s1].Used)
+
+		readEqual(t, d, 47, testRand)
+		readEqual(t, d, 48, testData)
+
+		d.lba2pba.m.Clear()
+		r.NoError(d.rebuildFromSegments(ctx))
+
+		readEqual(t, d, 0, testRand)
+		readEqual(t, d, 47, testRand)
+		readEqual(t, d, 48, testData)
+
+		r.Equal(uint64(2), d.s.segments[s1].Used)
+	})
+
+	t.Run("keeps a segment while its data is referenced", func(t *testing.T) {
+		r := require.New(t)
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithDedup(0))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		s1 := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(10)))
+
+		s2 := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		// Overwriting the original extent leaves only the reference using s1.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		// s2 stores no data of its own, but it's what maps the reference.
+		d.s.PruneDeadSegments()
+		r.NoError(d.cleanupDeletedSegments(ctx))
+
+		r.True(d.s.IsLive(s1))
+		r.Contains(d.s.segments, s2)
+		readEqual(t, d, 10, testRand)
+
+		// Once the reference is overwritten too, both can go.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(10)))
+		r.NoError(d.CloseSegment(ctx))
+
+		d.s.PruneDeadSegments()
+		r.NoError(d.cleanupDeletedSegments(ctx))
+
+		_, ok := d.s.segments[s1]
+		r.False(ok)
+
+		_, ok = d.s.segments[s2]
+		r.False(ok)
+	})
+
+	t.Run("finds data stored before the disk was reopened", func(t *testing.T) {
+		r := require.New(t)
+
+		dir := tempDir(t)
+
+		d, err := NewDisk(ctx, log, dir, WithDedup(0))
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
+
+		d, err = NewDisk(ctx, log, dir, WithDedup(0))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.Equal(1, d.dedup.len())
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(30)))
+
+		seg := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		r.Len(d.s.segments[seg].refs, 1)
+		readEqual(t, d, 30, testRand)
+	})
+}
@@ -2,10 +2,15 @@ package lsvd
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lab47/lsvd/logger"
@@ -26,39 +31,130 @@ const (
 type Disk struct {
 	SeqGen func() ulid.ULID
 	log    logger.Logger
+	logs   diskLogs
 	path   string
 
+	writeCacheDir  string
+	writeCacheSync *fileSyncer
+
 	size     int64
 	volName  string
 	readOnly bool
 	useZstd  bool
 
+	compRatio float64
+
+	noCompression bool
+	maxExtent     int
+	zeroRun       int
+
+	boundedReads bool
+
+	// Read extents with unknown flags as zeros, see UnknownFlagsAsHoles.
+	unknownFlagsAsHoles bool
+
+	// Read only the wanted blocks of uncompressed extents, see RangedReads.
+	rangedReads bool
+
+	// Recorded in the metadata of every segment we write.
+	writerId   string
+	generation uint64
+
+	// Set once a flush finds that a newer writer has attached.
+	fenced atomic.Bool
+
+	// Set by Detach.
+	detached atomic.Bool
+
 	prevCache *PreviousCache
 
 	curSeq SegmentId
 
+	// Per disk so that segment ids are monotonic without sharing state
+	// with other disks.
+	entropy io.Reader
+	clock   Clock
+
+	// Put the volume's tag into generated segment ids, see
+	// WithVolumeTaggedSegments.
+	tagSegments bool
+
 	lba2pba *ExtentMap
 	er      *ExtentReader
 
 	sa    SegmentAccess
 	curOC *SegmentCreator
 
+	// Held for writing while curOC is replaced, and for reading by the reads
+	// and syncs of curOC that don't hold writeMu, see setWriteCache.
+	ocMu sync.RWMutex
+
 	s *Segments
 
+	// Set when WithDedup is used.
+	dedup *dedupIndex
+
 	afterNS func(SegmentId)
 
+	onFlushErr      func(SegmentId, error)
+	flushRetryDelay time.Duration
+	syncFlush       bool
+
+	// Serializes the writes to curOC and closing it with the idle flush
+	// watchdog, see WithIdleFlush.
+	writeMu   sync.Mutex
+	lastWrite time.Time
+	idleFlush time.Duration
+	stopIdle  context.CancelFunc
+	idleDone  chan struct{}
+
 	readDisks []*Disk
 
 	bgmu sync.Mutex
 
 	autoGC bool
 
+	compaction *CompactionPolicy
+
+	refreshInterval time.Duration
+	refreshMu       sync.Mutex
+
+	// When the controller saves the LBA map, see WithCheckpoints.
+	checkpointSegments int
+	checkpointInterval time.Duration
+
+	// How often the controller removes deleted segments and how many it
+	// removes at once, see WithSegmentCleanup.
+	cleanupInterval time.Duration
+	cleanupWorkers  int
+
 	deleteMu sync.Mutex
 
+	metrics *Metrics
+
+	statsMu           sync.Mutex
+	readSegments      movingAverage
+	readCacheBlocks   movingAverage
+	readBackendBlocks movingAverage
+	coldReads         int64
+	coldReadBytes     movingAverage
+
+	nextCompaction       time.Time
+	lastCompaction       time.Time
+	lastCompactionReason string
+
+	// The occupancy of curOC, as of the last write to it.
+	writeCacheBytes   atomic.Int64
+	writeCacheEntries atomic.Int64
+	writeCacheBlocks  atomic.Int64
+
 	controller *Controller
 	wg         sync.WaitGroup
 	closed     bool
 
+	// What Close returned, which it returns again if called after that.
+	closeErr error
+
 	cpsScratch     []CachePosition
 	readReqScratch []readRequest
 	extentsScratch []Extent
@@ -81,12 +177,46 @@ func NewDisk(ctx context.Context, log logger.Logger, path string, options ...Opt
 		o.volName = "default"
 	}
 
-	err := o.sa.InitContainer(ctx)
+	err := ValidateVolumeName(o.volName)
 	if err != nil {
 		return nil, err
 	}
 
-	var sz int64
+	if o.metrics == nil {
+		o.metrics = defaultMetrics
+	}
+
+	if o.writerId == "" {
+		o.writerId, _ = os.Hostname()
+	}
+
+	if o.entropy == nil {
+		o.entropy = rand.Reader
+	}
+
+	if o.clock == nil {
+		o.clock = realClock{}
+	}
+
+	if o.writeCacheDir == "" {
+		o.writeCacheDir = path
+	}
+
+	if o.readCacheDir == "" {
+		o.readCacheDir = path
+	}
+
+	for _, dir := range []string{o.writeCacheDir, o.readCacheDir} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, errors.Wrapf(err, "creating cache directory")
+		}
+	}
+
+	err = o.sa.InitContainer(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	vi, err := o.sa.GetVolumeInfo(ctx, o.volName)
 	if err != nil || vi.Name == "" {
@@ -94,12 +224,30 @@ func NewDisk(ctx context.Context, log logger.Logger, path string, options ...Opt
 			return nil, fmt.Errorf("unknown volume: %s", o.volName)
 		}
 
-		err = o.sa.InitVolume(ctx, &VolumeInfo{Name: o.volName})
+		vi = &VolumeInfo{Name: o.volName}
+
+		err = o.sa.InitVolume(ctx, vi)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		sz = vi.Size
+	}
+
+	sz := vi.Size
+	gen := vi.Generation
+
+	if !o.ro {
+		gen, err = nextGeneration(ctx, o.sa, vi)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.compaction != nil && o.compaction.Interval <= 0 {
+		return nil, fmt.Errorf("compaction policy interval must be positive")
+	}
+
+	if o.refreshInterval > 0 && !o.ro {
+		return nil, fmt.Errorf("only read-only disks can be refreshed")
 	}
 
 	for _, ld := range o.lowers {
@@ -108,35 +256,86 @@ func NewDisk(ctx context.Context, log logger.Logger, path string, options ...Opt
 		}
 	}
 
-	log.Info("attaching to volume", "name", o.volName, "size", sz)
+	log.Info("attaching to volume", "name", o.volName, "size", sz, "generation", gen)
 
-	er, err := NewExtentReader(log, filepath.Join(path, "readcache"), o.sa)
+	cachePath := filepath.Join(o.readCacheDir, "readcache")
+	if o.noCache {
+		cachePath = ""
+	}
+
+	logs, err := newDiskLogs(log, o.logLevels)
 	if err != nil {
 		return nil, err
 	}
+
+	er, err := NewExtentReader(logs.cache, cachePath, o.sa, o.metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.openSegments > 0 {
+		er.SetOpenSegments(o.openSegments)
+	}
 	d := &Disk{
-		log:            log,
-		path:           path,
-		size:           sz,
-		lba2pba:        NewExtentMap(),
-		sa:             o.sa,
-		volName:        o.volName,
-		SeqGen:         o.seqGen,
-		afterNS:        o.afterNS,
-		readOnly:       o.ro,
-		useZstd:        o.useZstd,
-		er:             er,
-		prevCache:      NewPreviousCache(),
-		s:              NewSegments(),
-		cpsScratch:     make([]CachePosition, 0, 1),
-		readReqScratch: make([]readRequest, 0, 10),
-		extentsScratch: make([]Extent, 0, 10),
-		peScratch:      make([]PartialExtent, 0, 10),
+		log:             log,
+		logs:            logs,
+		path:            path,
+		writeCacheDir:   o.writeCacheDir,
+		size:            sz,
+		lba2pba:         newExtentMap(o.metrics),
+		sa:              o.sa,
+		volName:         o.volName,
+		SeqGen:          o.seqGen,
+		entropy:         &ulid.LockedMonotonicReader{MonotonicReader: ulid.Monotonic(o.entropy, 0)},
+		clock:           o.clock,
+		afterNS:         o.afterNS,
+		onFlushErr:      o.onFlushErr,
+		readOnly:        o.ro,
+		boundedReads:    o.boundedReads,
+		syncFlush:       o.syncFlush,
+		compaction:      o.compaction,
+		refreshInterval: o.refreshInterval,
+		writeCacheSync:  newFileSyncer(o.writeCacheFsync, o.writeCacheFsyncInterval, o.clock),
+		writerId:        o.writerId,
+		generation:      gen,
+		useZstd:         o.useZstd,
+		compRatio:       o.compRatio,
+		er:              er,
+		metrics:         o.metrics,
+		prevCache:       NewPreviousCache(o.maxFlushes),
+		s:               NewSegments(),
+		cpsScratch:      make([]CachePosition, 0, 1),
+		readReqScratch:  make([]readRequest, 0, 10),
+		extentsScratch:  make([]Extent, 0, 10),
+		peScratch:       make([]PartialExtent, 0, 10),
 	}
 
+	d.unknownFlagsAsHoles = o.unknownFlagsAsHoles
+	d.rangedReads = o.rangedReads
+	d.prevCache.maxBytes = o.maxFlushBytes
+	d.tagSegments = o.tagSegs
+	d.noCompression = o.noCompression
+	d.maxExtent = o.maxExtent
+	d.lba2pba.maxCoalesce = uint32(extentBlocks(d.maxExtent))
+	d.zeroRun = o.zeroRun
+	d.checkpointSegments = o.checkpointSegments
+	d.cleanupInterval = o.cleanupInterval
+	d.cleanupWorkers = o.cleanupWorkers
+	d.checkpointInterval = o.checkpointInterval
+
 	d.readDisks = append(d.readDisks, d)
 	d.readDisks = append(d.readDisks, o.lowers...)
 
+	if o.dedup && !d.readOnly {
+		d.dedup = newDedupIndex(d.s, o.dedupEntries)
+
+		err = d.dedup.load(d.dedupIndexPath())
+		if err != nil {
+			log.Warn("unable to load dedup index, starting over", "error", err)
+			d.dedup = newDedupIndex(d.s, o.dedupEntries)
+		}
+	}
+
 	if !d.readOnly {
 		err = d.restoreWriteCache(ctx)
 		if err != nil {
@@ -181,9 +380,18 @@ func NewDisk(ctx context.Context, log logger.Logger, path string, options ...Opt
 		}
 	}
 
-	dataDensity.Set(d.s.Usage())
+	d.metrics.dataDensity.Set(d.s.Usage())
 
 	d.autoGC = o.autoGC
+	d.flushRetryDelay = 5 * time.Second
+
+	// Writes restored from the write cache count as written now.
+	d.lastWrite = d.clock.Now()
+
+	if o.idleFlush > 0 && !d.readOnly {
+		d.idleFlush = o.idleFlush
+		d.startIdleFlush()
+	}
 
 	return d, nil
 }
@@ -207,19 +415,71 @@ func (r *PartialExtent) String() string {
 	return fmt.Sprintf("%s (%s): %s %d:%d", r.Live, r.Extent, r.Segment, r.Offset, r.Size)
 }
 
+var ErrNonMonotonicSeq = errors.New("segment id is not greater than the current one")
+
 func (d *Disk) nextSeq() (SegmentId, error) {
 	if d.SeqGen != nil {
-		return SegmentId(d.SeqGen()), nil
+		ul := d.SeqGen()
+		if ul.Compare(ulid.ULID(d.curSeq)) <= 0 {
+			return SegmentId{}, errors.Wrapf(ErrNonMonotonicSeq, "generated %s, current %s", ul, d.curSeq)
+		}
+
+		return SegmentId(ul), nil
 	}
 
-	ul, err := ulid.New(ulid.Now(), ulid.DefaultEntropy())
+	// Don't let the clock going backwards generate an id that sorts
+	// before the current one.
+	now, cur := ulid.Timestamp(d.clock.Now()), ulid.ULID(d.curSeq).Time()
+	if now < cur {
+		d.log.Warn("clock is behind the current segment id, using its time instead",
+			"segment", d.curSeq, "behind", time.Duration(cur-now)*time.Millisecond)
+	}
+
+	ms := max(now, cur)
+
+	ul, err := d.newULID(ms)
 	if err != nil {
 		return SegmentId{}, err
 	}
 
+	// The current id may not have come from our entropy (ie, SeqGen or
+	// another process), or the tag may have replaced bits our entropy
+	// incremented, so it may still be ahead within the same ms.
+	if ul.Compare(ulid.ULID(d.curSeq)) <= 0 {
+		ul, err = d.newULID(ms + 1)
+		if err != nil {
+			return SegmentId{}, err
+		}
+	}
+
 	return SegmentId(ul), nil
 }
 
+// newULID generates an id at +ms+, tagged with the volume when
+// WithVolumeTaggedSegments is used.
+func (d *Disk) newULID(ms uint64) (ulid.ULID, error) {
+	ul, err := ulid.New(ms, d.entropy)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+
+	if d.tagSegments {
+		ul = ulid.ULID(SegmentId(ul).withVolumeTag(VolumeTag(d.volName)))
+	}
+
+	return ul, nil
+}
+
+// setWriteCache makes +oc+ the current write cache. It waits for the reads
+// of the one it replaces to finish, so the caller holding writeMu can then
+// close or flush that one.
+func (d *Disk) setWriteCache(oc *SegmentCreator) {
+	d.ocMu.Lock()
+	defer d.ocMu.Unlock()
+
+	d.curOC = oc
+}
+
 func (d *Disk) newSegmentCreator() (*SegmentCreator, error) {
 	seq, err := d.nextSeq()
 	if err != nil {
@@ -228,9 +488,25 @@ func (d *Disk) newSegmentCreator() (*SegmentCreator, error) {
 
 	d.curSeq = seq
 
-	path := filepath.Join(d.path, "writecache."+seq.String())
-	sc, err := NewSegmentCreator(d.log, d.volName, path)
+	path := d.writeCachePath(seq)
+	sc, err := newSegmentCreator(d.log, d.volName, path, d.metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.builder.meta = d.segmentMetadata()
+	sc.builder.compRatio = d.compRatio
+	sc.builder.noCompression = d.noCompression
+	sc.builder.maxExtent = d.maxExtent
+	sc.builder.zeroRun = d.zeroRun
+	sc.builder.clock = d.clock
+	sc.builder.syncer = d.writeCacheSync
+	sc.builder.dedup = d.dedup
+
+	// So that the log is found again after a crash.
+	err = d.writeCacheSync.syncDir(d.writeCacheDir)
 	if err != nil {
+		sc.Close()
 		return nil, err
 	}
 
@@ -238,23 +514,92 @@ func (d *Disk) newSegmentCreator() (*SegmentCreator, error) {
 	return sc, nil
 }
 
+// writeCachePath returns the path of the write cache file for the segment
+// +seg+ is built in.
+func (d *Disk) writeCachePath(seg SegmentId) string {
+	return filepath.Join(d.writeCacheDir, "writecache."+seg.String())
+}
+
+// newSegmentBuilder returns a SegmentBuilder that reports into our metrics
+// and records our metadata in the segment it flushes.
+func (d *Disk) newSegmentBuilder() *SegmentBuilder {
+	sb := newSegmentBuilder(d.metrics)
+	sb.meta = d.segmentMetadata()
+	sb.compRatio = d.compRatio
+	sb.noCompression = d.noCompression
+	sb.clock = d.clock
+
+	return sb
+}
+
+func (d *Disk) segmentMetadata() SegmentMetadata {
+	return SegmentMetadata{
+		WriterId:   d.writerId,
+		Generation: d.generation,
+	}
+}
+
 // Used to test things are setup the way we expect
 func (d *Disk) resolveSegmentAccess(ext Extent) ([]PartialExtent, error) {
-	return d.lba2pba.Resolve(d.log, ext, nil)
+	return d.lba2pba.Resolve(d.logs.read, ext, nil)
+}
+
+// ReadOptions adjust how a single read is performed.
+type ReadOptions struct {
+	// BypassCache reads the data directly from the segments without adding
+	// it to the read cache, so that reads which won't be repeated, such as a
+	// scan of the whole volume for a backup, don't evict hot data.
+	BypassCache bool
+
+	// Priority hints how soon the data is needed relative to other reads,
+	// higher being sooner. It's not used to order reads yet.
+	Priority int
+
+	// Where the data came from, see ReadExtentTraced.
+	trace *ReadTrace
 }
 
 func (d *Disk) ReadExtent(ctx *Context, rng Extent) (RangeData, error) {
+	return d.ReadExtentWithOptions(ctx, rng, ReadOptions{})
+}
+
+func (d *Disk) ReadExtentWithOptions(ctx *Context, rng Extent, opts ReadOptions) (RangeData, error) {
 	data := NewRangeData(ctx, rng)
 
-	cp, err := d.ReadExtentInto(ctx, data)
+	err := d.readExtentIntoData(ctx, rng, data, opts)
+	if err != nil {
+		return RangeData{}, err
+	}
+
+	return data, nil
+}
+
+// ReadExtentIntoData is ReadExtent, reading into +data+ rather than a
+// RangeData allocated for the read, so that callers can reuse their buffers,
+// such as via a sync.Pool. +data+ must be for exactly +rng+, but doesn't need
+// to be zeroed.
+//
+// The name ReadExtentInto was taken by the lower level read that can leave
+// the data in the read cache for the caller to copy out.
+func (d *Disk) ReadExtentIntoData(ctx *Context, rng Extent, data RangeData) error {
+	return d.readExtentIntoData(ctx, rng, data, ReadOptions{})
+}
+
+func (d *Disk) readExtentIntoData(ctx *Context, rng Extent, data RangeData, opts ReadOptions) error {
+	if data.Extent != rng {
+		return errors.Wrapf(ErrInvalidRangeData, "range data is for %s, reading %s", data.Extent, rng)
+	}
+
+	cp, err := d.readExtentIntoWithOptions(ctx, data, opts)
+	if err != nil {
+		return err
+	}
+
 	if cp.fd != nil {
-		err = FillFromeCache(data.WriteData(), []CachePosition{cp})
-		if err != nil {
-			return RangeData{}, err
-		}
+		return FillFromeCache(data.WriteData(), []CachePosition{cp})
 	}
 
-	return data, err
+	return nil
 }
 
 type readRequest struct {
@@ -263,33 +608,120 @@ type readRequest struct {
 	extra  []Extent
 }
 
+var (
+	ErrOutOfRange = errors.New("read beyond the end of the volume")
+	ErrBufferSize = errors.New("buffer size doesn't match the extent")
+)
+
 func (d *Disk) ReadExtentInto(ctx *Context, data RangeData) (CachePosition, error) {
-	start := time.Now()
+	return d.readExtentIntoWithOptions(ctx, data, ReadOptions{})
+}
+
+// ReadExtentIntoBuffer reads +rng+ directly into +dst+, which must be exactly
+// the size of +rng+, rather than into a buffer allocated for the read.
+func (d *Disk) ReadExtentIntoBuffer(ctx *Context, rng Extent, dst []byte) error {
+	if len(dst) != rng.ByteSize() {
+		return errors.Wrapf(ErrBufferSize, "extent %s is %d bytes, buffer is %d", rng, rng.ByteSize(), len(dst))
+	}
+
+	return d.readExtentIntoData(ctx, rng, MapRangeData(rng, dst), ReadOptions{})
+}
+
+func (d *Disk) readExtentIntoWithOptions(ctx *Context, data RangeData, opts ReadOptions) (CachePosition, error) {
+	if d.detached.Load() {
+		return CachePosition{}, ErrDetached
+	}
+
+	start := d.clock.Now()
 
 	defer func() {
-		blocksReadLatency.Observe(time.Since(start).Seconds())
+		d.metrics.blocksReadLatency.Observe(d.clock.Now().Sub(start).Seconds())
 	}()
 
-	rng := data.Extent
+	err := data.validate()
+	if err != nil {
+		return CachePosition{}, err
+	}
+
+	d.metrics.blocksRead.Add(float64(data.Blocks))
+
+	d.metrics.iops.Inc()
+
+	if d.boundedReads && d.size > 0 {
+		inside, clamped, err := d.clampRead(data)
+		if err != nil {
+			return CachePosition{}, err
+		}
+
+		if clamped {
+			// The cache position only covers inside, so we have to resolve
+			// it here rather than let the caller use it for all of data.
+			cp, err := d.readExtentInto(ctx, inside, opts)
+			if err != nil {
+				return CachePosition{}, err
+			}
+
+			if cp.fd != nil {
+				err = FillFromeCache(inside.WriteData(), []CachePosition{cp})
+				if err != nil {
+					return CachePosition{}, err
+				}
+			}
+
+			return CachePosition{}, nil
+		}
+	}
+
+	return d.readExtentInto(ctx, data, opts)
+}
+
+// clampRead checks data against the size of the volume. A read that begins
+// at or past the end returns ErrOutOfRange. A read that straddles the end has
+// the portion past the end zero'd and the portion inside the volume is returned.
+func (d *Disk) clampRead(data RangeData) (RangeData, bool, error) {
+	end := LBA(d.size / BlockSize)
+
+	if data.LBA >= end {
+		return RangeData{}, false, ErrOutOfRange
+	}
+
+	if data.Last() < end {
+		return data, false, nil
+	}
+
+	inside := Extent{LBA: data.LBA, Blocks: uint32(end - data.LBA)}
 
-	blocksRead.Add(float64(rng.Blocks))
+	buf := data.WriteData()
+	clear(buf[inside.ByteSize():])
 
-	iops.Inc()
+	return MapRangeData(inside, buf[:inside.ByteSize()]), true, nil
+}
 
-	log := d.log
+func (d *Disk) readExtentInto(ctx *Context, data RangeData, opts ReadOptions) (CachePosition, error) {
+	rng := data.Extent
+
+	log := d.logs.read
 
 	if log.IsDebug() {
 		log.Debug("attempting to fill request from write cache", "extent", rng)
 	}
 
-	remaining, err := d.fillFromWriteCache(ctx, log, data)
+	remaining, err := d.fillFromWriteCache(ctx, log, data, opts.trace)
 	if err != nil {
 		return CachePosition{}, err
 	}
 
+	fan := readFanout{coldStart: atomic.LoadInt64(&ctx.coldBytes)}
+	defer d.recordRead(ctx, &fan)
+
+	fan.cacheBlocks = int(rng.Blocks)
+	for _, h := range remaining {
+		fan.cacheBlocks -= int(h.Blocks)
+	}
+
 	// Completely filled range from the write cache
 	if len(remaining) == 0 {
-		d.log.Debug("extent filled entirely from write cache")
+		d.logs.read.Debug("extent filled entirely from write cache")
 		return CachePosition{}, nil
 	}
 
@@ -314,26 +746,40 @@ func (d *Disk) ReadExtentInto(ctx *Context, data RangeData) (CachePosition, erro
 			return CachePosition{}, err
 		}
 
+		// The buffer isn't pre-zero'd and the partial extents might not
+		// cover all of +h+, so clear it before filling in what is mapped.
+		if v, ok := data.SubRange(h); ok {
+			clear(v.WriteData())
+		}
+
 		if len(pes) == 0 {
 			log.Debug("no partial extents found")
-			if v, ok := data.SubRange(h); ok {
-				clear(v.WriteData())
-			}
-			// nothing for range, and since the data is pre-zero'd, we
-			// don't need to clear anything here.
 		} else {
 			// Pure read from one extent, optimize!
-			if len(remaining) == 1 && remaining[0] == rng && len(pes) == 1 && pes[0].Flags() == Uncompressed {
+			if !opts.BypassCache && len(remaining) == 1 && remaining[0] == rng && len(pes) == 1 && pes[0].Flags() == FlagUncompressed {
 				log.Trace("reading single, uncompressed extent via fast path")
 				// Invariants: remaining[0] == rng == data.Extent
 				// Invariants: pes[0].Live fully covers remaining[0]
 				pe := pes[0]
 				ld := d.readDisks[pe.Disk]
+
+				var traceStart time.Time
+				if opts.trace != nil {
+					traceStart = d.clock.Now()
+				}
+
 				cps, err := ld.readOneExtent(ctx, &pe, rng, data)
 				if err != nil {
 					return CachePosition{}, err
 				}
 
+				if opts.trace != nil {
+					opts.trace.addSegment(ctx, &pe, remaining, fan.coldStart, d.clock.Now().Sub(traceStart))
+				}
+
+				fan.segments = 1
+				fan.backendBlocks = int(rng.Blocks)
+
 				return cps, nil
 			}
 
@@ -342,6 +788,13 @@ func (d *Disk) ReadExtentInto(ctx *Context, data RangeData) (CachePosition, erro
 					if v, ok := data.SubRange(pe.Live); ok {
 						clear(v.WriteData())
 					}
+
+					if opts.trace != nil {
+						if x, ok := pe.Live.Clamp(h); ok {
+							opts.trace.add(ReadTraceEntry{Extent: x, Source: ReadFromHole})
+						}
+					}
+
 					// it's empty! cool cool, we don't need to fill the hole
 					// since the slice we're filling inside data has already been
 					// cleared when it's created.
@@ -381,6 +834,10 @@ func (d *Disk) ReadExtentInto(ctx *Context, data RangeData) (CachePosition, erro
 		}
 	}
 
+	fan.segments, fan.backendBlocks = fanout(reqs)
+
+	d.prefetchSegments(ctx, reqs)
+
 	// With our set of segments and partial extents in hand, go reach each one
 	// and populate data. This could be parallelized as each touches a different
 	// range of data.
@@ -393,10 +850,24 @@ func (d *Disk) ReadExtentInto(ctx *Context, data RangeData) (CachePosition, erro
 			extents = append(extents, o.extra...)
 		}
 
-		err := ld.readPartialExtent(ctx, &o.pe, extents, rng, data)
+		var (
+			traceStart time.Time
+			coldStart  int64
+		)
+
+		if opts.trace != nil {
+			traceStart = d.clock.Now()
+			coldStart = atomic.LoadInt64(&ctx.coldBytes)
+		}
+
+		err := ld.readPartialExtent(ctx, &o.pe, extents, rng, data, opts.BypassCache)
 		if err != nil {
 			return CachePosition{}, err
 		}
+
+		if opts.trace != nil {
+			opts.trace.addSegment(ctx, &o.pe, extents, coldStart, d.clock.Now().Sub(traceStart))
+		}
 	}
 
 	d.readReqScratch = reqs[:0]
@@ -404,16 +875,58 @@ func (d *Disk) ReadExtentInto(ctx *Context, data RangeData) (CachePosition, erro
 	return CachePosition{}, nil
 }
 
-func (d *Disk) fillFromWriteCache(ctx *Context, log logger.Logger, data RangeData) ([]Extent, error) {
+// prefetchSegments opens the segments that +reqs+ read from ahead of the
+// reads, so that the opens happen in parallel rather than one by one as each
+// read gets to them.
+func (d *Disk) prefetchSegments(ctx context.Context, reqs []readRequest) {
+	if len(reqs) < 2 {
+		return
+	}
+
+	segs := map[uint16][]SegmentId{}
+
+	for _, o := range reqs {
+		if !slices.Contains(segs[o.pe.Disk], o.pe.Segment) {
+			segs[o.pe.Disk] = append(segs[o.pe.Disk], o.pe.Segment)
+		}
+	}
+
+	for disk, ids := range segs {
+		d.readDisks[disk].er.prefetchSegments(ctx, ids)
+	}
+}
+
+// fillFromWriteCache fills what it can of +data+ from the current write cache
+// and then the write caches being flushed, returning the extents that neither
+// had. Data that was written is never missed while it's flushed: a write
+// cache is added to the previous caches before it stops being the current
+// one, and it's only removed from them once the disk's map reads the data
+// from its segment. Holding the previous caches for the whole fill keeps a
+// write cache that was current when the fill started from being closed
+// before the fill is done with it.
+func (d *Disk) fillFromWriteCache(ctx *Context, log logger.Logger, data RangeData, trace *ReadTrace) ([]Extent, error) {
+	// Acquiring the previous caches under ocMu means the write cache can't
+	// move to them between the two, and isn't closed while it's read.
+	d.ocMu.RLock()
+
+	caches, release := d.prevCache.Acquire()
+	defer release()
+
 	if d.curOC == nil {
+		d.ocMu.RUnlock()
 		return []Extent{data.Extent}, nil
 	}
 
 	used, err := d.curOC.FillExtent(ctx, data.View())
+
+	d.ocMu.RUnlock()
+
 	if err != nil {
 		return nil, err
 	}
 
+	trace.addExtents(used, ReadFromWriteCache)
+
 	var remaining []Extent
 
 	if log.IsTrace() {
@@ -434,17 +947,31 @@ func (d *Disk) fillFromWriteCache(ctx *Context, log logger.Logger, data RangeDat
 		log.Trace("requesting reads from prev cache", "used", used, "remaining", remaining)
 	}
 
-	return d.fillingFromPrevWriteCache(ctx, log, data, remaining)
+	return d.fillingFromPrevWriteCache(ctx, log, data, caches, remaining, trace)
 }
 
-func (d *Disk) fillingFromPrevWriteCache(ctx *Context, log logger.Logger, data RangeData, holes []Extent) ([]Extent, error) {
-	oc := d.prevCache.Load()
+func (d *Disk) fillingFromPrevWriteCache(ctx *Context, log logger.Logger, data RangeData, caches []*SegmentCreator, holes []Extent, trace *ReadTrace) ([]Extent, error) {
+	// Newer caches take precedence, so check them first.
+	for _, oc := range caches {
+		if len(holes) == 0 {
+			break
+		}
 
-	// If there is no previous cache, bail.
-	if oc == nil {
-		return holes, nil
+		var err error
+		holes, err = d.fillFromCache(ctx, oc, data, holes, trace)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	if log.IsDebug() {
+		log.Debug("write cache didn't find", "holes", holes)
+	}
+
+	return holes, nil
+}
+
+func (d *Disk) fillFromCache(ctx *Context, oc *SegmentCreator, data RangeData, holes []Extent, trace *ReadTrace) ([]Extent, error) {
 	var remaining []Extent
 
 	for _, sub := range holes {
@@ -458,6 +985,8 @@ func (d *Disk) fillingFromPrevWriteCache(ctx *Context, log logger.Logger, data R
 			return nil, err
 		}
 
+		trace.addExtents(used, ReadFromPrevCache)
+
 		if len(used) == 0 {
 			remaining = append(remaining, sub)
 		} else {
@@ -470,8 +999,6 @@ func (d *Disk) fillingFromPrevWriteCache(ctx *Context, log logger.Logger, data R
 		}
 	}
 
-	log.Debug("write cache didn't find", "input", holes, "holes", remaining)
-
 	return remaining, nil
 }
 
@@ -481,13 +1008,13 @@ func (d *Disk) readOneExtent(
 	x Extent,
 	dest RangeData,
 ) (CachePosition, error) {
-	src, cps, err := d.er.fetchExtent(ctx, d.log, pe, d.cpsScratch[:0])
+	src, cps, err := d.er.fetchExtent(ctx, d.logs.read, pe, d.cpsScratch[:0])
 	if err != nil {
 		return CachePosition{}, err
 	}
 
 	if len(cps) == 1 {
-		d.log.Trace("single extent found directly in read cache")
+		d.logs.read.Trace("single extent found directly in read cache")
 		// There are a few elements, let's write them out so we keep them straight:
 		// pe.Extent is the data covered by cps[0]
 		// pe.Live is sub-range of pe.Extent that is only the data to consider
@@ -508,18 +1035,21 @@ func (d *Disk) readOneExtent(
 
 	d.cpsScratch = cps[:0]
 
-	d.log.Trace("single extent not found in cache", "cps", len(cps))
+	// Without any cache positions, src already holds the data.
+	if len(cps) > 0 {
+		d.logs.read.Trace("single extent not found in cache", "cps", len(cps))
 
-	inflateCache.Inc()
+		d.metrics.inflateCache.Inc()
 
-	rawData := ctx.Allocate(int(pe.Size))
+		rawData := ctx.Allocate(int(pe.Size))
 
-	err = FillFromeCache(rawData, cps)
-	if err != nil {
-		return CachePosition{}, err
-	}
+		err = FillFromeCache(rawData, cps)
+		if err != nil {
+			return CachePosition{}, extentError(err, pe)
+		}
 
-	src = MapRangeData(pe.Extent, rawData)
+		src = MapRangeData(pe.Extent, rawData)
+	}
 
 	// the bytes at the beginning of data are for LBA dataBegin.LBA.
 	// the bytes at the beginning of rawData are for LBA full.LBA.
@@ -529,32 +1059,32 @@ func (d *Disk) readOneExtent(
 	// Then we copy the bytes from 2 to 1.
 	overlap, ok := pe.Live.Clamp(x)
 	if !ok {
-		d.log.Error("error clamping required range to usable range", "request", x, "partial", pe.Live)
-		return CachePosition{}, fmt.Errorf("error clamping range")
+		d.logs.read.Error("error clamping required range to usable range", "request", x, "partial", pe.Live)
+		return CachePosition{}, extentError(errors.Wrapf(ErrClamp, "request %s to usable %s", x, pe.Live), pe)
 	}
 
-	d.log.Debug("preparing to copy data from segment", "request", x, "clamped", overlap)
+	d.logs.read.Debug("preparing to copy data from segment", "request", x, "clamped", overlap)
 
 	// Compute our source range and destination range against overlap
 
 	subDest, ok := dest.SubRange(overlap)
 	if !ok {
-		d.log.Error("error clamping range", "full", pe.Live, "sub", overlap)
-		return CachePosition{}, fmt.Errorf("error clamping range: %s => %s", pe.Live, overlap)
+		d.logs.read.Error("error clamping range", "full", pe.Live, "sub", overlap)
+		return CachePosition{}, extentError(errors.Wrapf(ErrClamp, "request %s: %s => %s", x, pe.Live, overlap), pe)
 	}
 
 	subSrc, ok := src.SubRange(overlap)
 	if !ok {
-		d.log.Error("error calculate source subrange",
+		d.logs.read.Error("error calculate source subrange",
 			"input", src.Extent, "sub", overlap,
 			"request", x, "usable", pe.Live,
 			"full", pe.Extent,
 		)
-		return CachePosition{}, fmt.Errorf("error calculate source subrange")
+		return CachePosition{}, extentError(errors.Wrapf(ErrClamp, "request %s: source subrange %s of %s", x, overlap, src.Extent), pe)
 	}
 
-	if d.log.Is(logger.Debug) {
-		d.log.Debug("copying segment data",
+	if d.logs.read.Is(logger.Debug) {
+		d.logs.read.Debug("copying segment data",
 			"src", src.Extent,
 			"dest", dest.Extent,
 			"sub-source", subSrc.Extent, "sub-dest", subDest.Extent,
@@ -563,7 +1093,7 @@ func (d *Disk) readOneExtent(
 
 	n := subDest.Copy(subSrc)
 	if n != subDest.ByteSize() {
-		d.log.Error("error copying data from partial extent", "expected", subDest.ByteSize(), "was", n)
+		d.logs.read.Error("error copying data from partial extent", "expected", subDest.ByteSize(), "was", n)
 	}
 
 	return CachePosition{}, nil
@@ -575,13 +1105,53 @@ func (d *Disk) readPartialExtent(
 	rngs []Extent,
 	dataRange Extent,
 	dest RangeData,
+	bypassCache bool,
 ) error {
-	src, _, err := d.er.fetchExtent(ctx, d.log, pe, nil)
+	// A single compressed block that's wanted whole is uncompressed straight
+	// into dest rather than via a buffer of its own.
+	if pe.Flags() == FlagLZ4 && pe.Extent.Blocks == 1 && pe.Live == pe.Extent && len(rngs) == 1 {
+		if _, ok := pe.Live.Clamp(rngs[0]); ok {
+			if sub, ok := dest.SubRange(pe.Live); ok && sub.ByteSize() == int(pe.RawSize) {
+				err := d.er.readCompressedInto(ctx, d.logs.read, pe, sub.WriteData(), bypassCache)
+				if err != nil {
+					return d.repairFromWriteCache(ctx, pe, rngs, dest, err)
+				}
+
+				return nil
+			}
+		}
+	}
+
+	if d.rangedReads && pe.Flags() == FlagUncompressed {
+		err := d.readUncompressedRanges(ctx, pe, rngs, dest, bypassCache)
+		if err != nil {
+			return d.repairFromWriteCache(ctx, pe, rngs, dest, err)
+		}
+
+		return nil
+	}
+
+	var (
+		src RangeData
+		err error
+	)
+
+	if bypassCache {
+		src, _, err = d.er.fetchExtentUncached(ctx, d.logs.read, pe, nil)
+	} else {
+		src, _, err = d.er.fetchExtent(ctx, d.logs.read, pe, nil)
+	}
+
 	if err != nil {
+		err = d.repairFromWriteCache(ctx, pe, rngs, dest, err)
+		if err != nil && d.unknownFlagsAsHoles && errors.Is(err, ErrUnknownExtentFlag) {
+			return d.fillUnknownAsHole(pe, rngs, dest, err)
+		}
+
 		return err
 	}
 
-	isDebug := d.log.IsDebug()
+	isDebug := d.logs.read.IsDebug()
 
 	// the bytes at the beginning of data are for LBA dataBegin.LBA.
 	// the bytes at the beginning of rawData are for LBA full.LBA.
@@ -592,34 +1162,34 @@ func (d *Disk) readPartialExtent(
 	for _, x := range rngs {
 		overlap, ok := pe.Live.Clamp(x)
 		if !ok {
-			d.log.Error("error clamping required range to usable range", "request", x, "partial", pe.Live)
-			return fmt.Errorf("error clamping range")
+			d.logs.read.Error("error clamping required range to usable range", "request", x, "partial", pe.Live)
+			return extentError(errors.Wrapf(ErrClamp, "request %s to usable %s", x, pe.Live), pe)
 		}
 
 		if isDebug {
-			d.log.Debug("preparing to copy data from segment", "request", x, "clamped", overlap)
+			d.logs.read.Debug("preparing to copy data from segment", "request", x, "clamped", overlap)
 		}
 
 		// Compute our source range and destination range against overlap
 
 		subDest, ok := dest.SubRange(overlap)
 		if !ok {
-			d.log.Error("error clamping range", "full", pe.Live, "sub", overlap)
-			return fmt.Errorf("error clamping range: %s => %s", pe.Live, overlap)
+			d.logs.read.Error("error clamping range", "full", pe.Live, "sub", overlap)
+			return extentError(errors.Wrapf(ErrClamp, "request %s: %s => %s", x, pe.Live, overlap), pe)
 		}
 
 		subSrc, ok := src.SubRange(overlap)
 		if !ok {
-			d.log.Error("error calculate source subrange",
+			d.logs.read.Error("error calculate source subrange",
 				"input", src.Extent, "sub", overlap,
 				"request", x, "usable", pe.Live,
 				"full", pe.Extent,
 			)
-			return fmt.Errorf("error calculate source subrange")
+			return extentError(errors.Wrapf(ErrClamp, "request %s: source subrange %s of %s", x, overlap, src.Extent), pe)
 		}
 
 		if isDebug {
-			d.log.Debug("copying segment data",
+			d.logs.read.Debug("copying segment data",
 				"src", src.Extent,
 				"dest", dest.Extent,
 				"sub-source", subSrc.Extent, "sub-dest", subDest.Extent,
@@ -628,27 +1198,192 @@ func (d *Disk) readPartialExtent(
 
 		n := subDest.Copy(subSrc)
 		if n != subDest.ByteSize() {
-			d.log.Error("error copying data from partial extent", "expected", subDest.ByteSize(), "was", n)
+			d.logs.read.Error("error copying data from partial extent", "expected", subDest.ByteSize(), "was", n)
+		}
+	}
+
+	return nil
+}
+
+// readUncompressedRanges reads just +rngs+ of the uncompressed +pe+ straight
+// into +dest+, see RangedReads.
+func (d *Disk) readUncompressedRanges(
+	ctx *Context,
+	pe *PartialExtent,
+	rngs []Extent,
+	dest RangeData,
+	bypassCache bool,
+) error {
+	for _, x := range rngs {
+		overlap, ok := pe.Live.Clamp(x)
+		if !ok {
+			d.logs.read.Error("error clamping required range to usable range", "request", x, "partial", pe.Live)
+			return extentError(errors.Wrapf(ErrClamp, "request %s to usable %s", x, pe.Live), pe)
+		}
+
+		subDest, ok := dest.SubRange(overlap)
+		if !ok {
+			d.logs.read.Error("error clamping range", "full", pe.Live, "sub", overlap)
+			return extentError(errors.Wrapf(ErrClamp, "request %s: %s => %s", x, pe.Live, overlap), pe)
+		}
+
+		off := int64(overlap.LBA-pe.Extent.LBA) * BlockSize
+
+		err := d.er.readRawRange(ctx, d.logs.read, pe, off, subDest.WriteData(), bypassCache)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fillUnknownAsHole zeros +rngs+ of +pe+ in +dest+, after reading it failed
+// with +readErr+ because its flags are unknown.
+func (d *Disk) fillUnknownAsHole(pe *PartialExtent, rngs []Extent, dest RangeData, readErr error) error {
+	d.logs.read.Error("extent has unknown flags, reading it as zeros",
+		"segment", pe.Segment, "extent", pe.Live, "error", readErr)
+
+	d.metrics.unknownFlagHoles.Inc()
+
+	for _, x := range rngs {
+		overlap, ok := pe.Live.Clamp(x)
+		if !ok {
+			continue
+		}
+
+		subDest, ok := dest.SubRange(overlap)
+		if !ok {
+			return extentError(errors.Wrapf(ErrClamp, "request %s: %s => %s", x, pe.Live, overlap), pe)
+		}
+
+		clear(subDest.WriteData())
+	}
+
+	return nil
+}
+
+// repairFromWriteCache fills +rngs+ of +pe+ into +dest+ from the write cache
+// that's still held while it's flushed to pe's segment, after reading the
+// segment failed with +readErr+. Only that write cache is used, as the data
+// any other has for the blocks may be newer or older than the segment's. If
+// it can't fill every block, +readErr+ is returned.
+func (d *Disk) repairFromWriteCache(ctx *Context, pe *PartialExtent, rngs []Extent, dest RangeData, readErr error) error {
+	var oc *SegmentCreator
+
+	caches, release := d.prevCache.Acquire()
+	defer release()
+
+	for _, sc := range caches {
+		if sc.segment == pe.Segment {
+			oc = sc
+			break
+		}
+	}
+
+	if oc == nil {
+		return readErr
+	}
+
+	for _, x := range rngs {
+		overlap, ok := pe.Live.Clamp(x)
+		if !ok {
+			return readErr
+		}
+
+		sub, ok := dest.SubRange(overlap)
+		if !ok {
+			return readErr
+		}
+
+		used, err := oc.FillExtent(ctx, sub)
+		if err != nil {
+			return readErr
+		}
+
+		var blocks uint32
+		for _, u := range used {
+			blocks += u.Blocks
+		}
+
+		if blocks != overlap.Blocks {
+			return readErr
 		}
 	}
 
+	d.logs.read.Warn("error reading segment, filled from its write cache",
+		"segment", pe.Segment, "extent", pe.Live, "error", readErr)
+
 	return nil
 }
 
 func (d *Disk) ZeroBlocks(ctx context.Context, rng Extent) error {
+	if d.detached.Load() {
+		return ErrDetached
+	}
+
 	if d.readOnly {
-		return nil
+		return ErrReadOnly
+	}
+
+	if d.fenced.Load() {
+		return ErrFenced
 	}
 
-	iops.Inc()
-	blocksWritten.Add(float64(rng.Blocks))
+	d.metrics.iops.Inc()
+	d.metrics.blocksWritten.Add(float64(rng.Blocks))
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	d.lastWrite = d.clock.Now()
+
+	defer d.recordWriteCache()
 
 	return d.curOC.ZeroBlocks(rng)
 }
 
-func (d *Disk) checkFlush(ctx context.Context) error {
+// Trim discards the data in +rng+, so that it reads back as zeros. Unlike
+// ZeroBlocks, +rng+ can be of any size: it's recorded as empty extents of at
+// most MaxBlocks each.
+//
+// No cache needs to be purged for the discarded data to stop being read. The
+// empty extents go into the current write cache, which reads check before the
+// write caches still being flushed, and the read cache is keyed by where data
+// is stored in a segment, which is never reused for other data.
+func (d *Disk) Trim(ctx context.Context, rng Extent) error {
+	if d.detached.Load() {
+		return ErrDetached
+	}
+
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	if d.fenced.Load() {
+		return ErrFenced
+	}
+
+	for rng.Blocks > 0 {
+		part := Extent{LBA: rng.LBA, Blocks: min(rng.Blocks, MaxBlocks)}
+
+		err := d.ZeroBlocks(ctx, part)
+		if err != nil {
+			return err
+		}
+
+		rng.LBA += LBA(part.Blocks)
+		rng.Blocks -= part.Blocks
+	}
+
+	return nil
+}
+
+// checkFlush starts flushing the current segment once it's full, returning
+// whether it did.
+func (d *Disk) checkFlush(ctx context.Context) (bool, error) {
 	if d.curOC.ShouldFlush(FlushThreshHold) {
-		d.log.Info("flushing new segment",
+		d.logs.write.Info("flushing new segment",
 			"body-size", d.curOC.BodySize(),
 			"extents", d.curOC.Entries(),
 			"blocks", d.curOC.TotalBlocks(),
@@ -661,45 +1396,85 @@ func (d *Disk) checkFlush(ctx context.Context) error {
 		)
 		ch, err := d.closeSegmentAsync(ctx)
 		if err != nil {
-			return err
+			return false, err
+		}
+
+		if d.syncFlush {
+			select {
+			case res := <-ch:
+				return true, res.Error
+			case <-ctx.Done():
+				return true, ctx.Err()
+			}
 		}
 
 		if mode.Debug() {
 			select {
 			case <-ch:
-				d.log.Debug("segment has been flushed")
+				d.logs.write.Debug("segment has been flushed")
 			case <-ctx.Done():
 			}
 		}
+
+		return true, nil
 	}
 
-	return nil
+	return false, nil
 }
 
 var ErrReadOnly = errors.New("disk open'd read-only")
 
 func (d *Disk) WriteExtent(ctx context.Context, data RangeData) error {
+	_, err := d.WriteExtentCounted(ctx, data)
+	return err
+}
+
+// WriteExtentCounted is WriteExtent, also returning how many blocks were
+// written and how many were all zeros and recorded as empty. The counts
+// reflect the data accepted even if flushing the segment afterwards fails.
+func (d *Disk) WriteExtentCounted(ctx context.Context, data RangeData) (WriteCounts, error) {
+	if d.detached.Load() {
+		return WriteCounts{}, ErrDetached
+	}
+
 	if d.readOnly {
-		return ErrReadOnly
+		return WriteCounts{}, ErrReadOnly
+	}
+
+	if d.fenced.Load() {
+		return WriteCounts{}, ErrFenced
+	}
+
+	err := data.validate()
+	if err != nil {
+		return WriteCounts{}, err
 	}
 
-	start := time.Now()
+	start := d.clock.Now()
 
 	defer func() {
-		blocksWriteLatency.Observe(time.Since(start).Seconds())
+		d.metrics.blocksWriteLatency.Observe(d.clock.Now().Sub(start).Seconds())
 	}()
 
-	blocksWritten.Add(float64(data.Blocks))
+	d.metrics.blocksWritten.Add(float64(data.Blocks))
 
-	iops.Inc()
+	d.metrics.iops.Inc()
 
-	err := d.curOC.WriteExtent(data)
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	d.lastWrite = start
+
+	counts, err := d.curOC.writeExtent(data)
 	if err != nil {
-		d.log.Error("error write extents to segment creator", "error", err)
-		return err
+		d.logs.write.Error("error write extents to segment creator", "error", err)
+		return counts, err
 	}
 
-	return d.checkFlush(ctx)
+	d.recordWriteCache()
+
+	_, err = d.checkFlush(ctx)
+	return counts, err
 }
 
 func (d *Disk) Extents() int {
@@ -710,35 +1485,102 @@ func (d *Disk) Extents() int {
 // flush checking between them, thusly making sure that all of them end
 // up in the same segment.
 func (d *Disk) WriteExtents(ctx context.Context, ranges []RangeData) error {
+	_, err := d.WriteExtentsCounted(ctx, ranges)
+	return err
+}
+
+// WriteExtentsCounted is WriteExtents, also returning the counts of blocks
+// written and recorded as empty across all the ranges.
+func (d *Disk) WriteExtentsCounted(ctx context.Context, ranges []RangeData) (WriteCounts, error) {
+	wp, err := d.WriteExtentsPlaced(ctx, ranges)
+	return wp.WriteCounts, err
+}
+
+// WritePlacement reports where the writes of WriteExtentsPlaced went.
+type WritePlacement struct {
+	WriteCounts
+
+	// The segment the writes were added to. It's the segment the write cache
+	// will be flushed as, so it can't be read from storage until the flush
+	// completes, and it's never published at all if the flush is fenced.
+	Segment SegmentId
+
+	// Whether the writes filled the segment and started its flush.
+	Flushed bool
+}
+
+// WriteExtentsPlaced is WriteExtentsCounted, also returning the segment the
+// writes went to and whether they started its flush.
+func (d *Disk) WriteExtentsPlaced(ctx context.Context, ranges []RangeData) (WritePlacement, error) {
+	if d.detached.Load() {
+		return WritePlacement{}, ErrDetached
+	}
+
 	if d.readOnly {
-		return ErrReadOnly
+		return WritePlacement{}, ErrReadOnly
 	}
 
-	start := time.Now()
+	if d.fenced.Load() {
+		return WritePlacement{}, ErrFenced
+	}
+
+	// Checked up front so that none of the ranges are written if any can't
+	// be.
+	for i := range ranges {
+		err := ranges[i].validate()
+		if err != nil {
+			return WritePlacement{}, err
+		}
+	}
+
+	start := d.clock.Now()
 
 	defer func() {
-		blocksWriteLatency.Observe(time.Since(start).Seconds())
+		d.metrics.blocksWriteLatency.Observe(d.clock.Now().Sub(start).Seconds())
 	}()
 
-	iops.Add(float64(len(ranges)))
+	d.metrics.iops.Add(float64(len(ranges)))
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	d.lastWrite = start
+
+	wp := WritePlacement{
+		Segment: d.curSeq,
+	}
 
 	for _, data := range ranges {
-		err := d.curOC.WriteExtent(data)
+		counts, err := d.curOC.writeExtent(data)
 		if err != nil {
-			d.log.Error("error write extents to segment creator", "error", err)
-			return err
+			d.logs.write.Error("error write extents to segment creator", "error", err)
+			return wp, err
 		}
+
+		wp.add(counts)
 	}
 
-	return d.checkFlush(ctx)
+	d.recordWriteCache()
+
+	var err error
+	wp.Flushed, err = d.checkFlush(ctx)
+
+	return wp, err
 }
 
 func (d *Disk) SyncWriteCache() error {
+	if d.detached.Load() {
+		return ErrDetached
+	}
+
 	if d.readOnly {
 		return nil
 	}
 
-	iops.Inc()
+	d.metrics.iops.Inc()
+
+	d.ocMu.RLock()
+	defer d.ocMu.RUnlock()
 
 	if d.curOC != nil {
 		return d.curOC.builder.Sync()
@@ -747,40 +1589,151 @@ func (d *Disk) SyncWriteCache() error {
 	return nil
 }
 
+// ErrDetached is returned by IO on a disk after Detach.
+var ErrDetached = errors.New("disk is detached")
+
+// Detach releases the volume so that another process can attach to it,
+// flushing the current segment and saving the LBA map the same as Close.
+// Unlike a closed disk, a detached disk rejects further IO with ErrDetached,
+// while Stats and the other accessors keep reporting its final state.
+//
+// If ctx is done before the detach completes, the *CloseError reports which
+// steps didn't. The disk stays detached, and calling Detach or Close again
+// returns the same error without retrying them. The writes that weren't
+// flushed are replayed from the write cache when the volume is next opened.
+func (d *Disk) Detach(ctx context.Context) error {
+	d.detached.Store(true)
+
+	return d.Close(ctx)
+}
+
+// CloseError is returned by Close when some of its steps didn't complete,
+// usually because ctx was done first.
+type CloseError struct {
+	// The steps that did complete, in the order they ran.
+	Completed []string
+
+	// Why each of the other steps didn't complete.
+	Errors []error
+}
+
+func (e *CloseError) Error() string {
+	msg := fmt.Sprintf("closing disk, completed %v", e.Completed)
+
+	for _, err := range e.Errors {
+		msg += "; " + err.Error()
+	}
+
+	return msg
+}
+
+func (e *CloseError) Unwrap() []error {
+	return e.Errors
+}
+
+// Close flushes the current segment, saves the LBA map and releases the
+// disk. Each step gives up once ctx is done, in which case the returned
+// *CloseError reports which steps completed. The LBA map is saved even if
+// the flush didn't finish so that reopening the disk doesn't have to rebuild
+// it; the writes that weren't flushed are replayed from the write cache.
+// It isn't saved while background work is still running though, as a flush
+// could have listed its segment without having updated the map for it yet,
+// and the saved map would then claim a segment it's missing the data of.
+//
+// The steps only run once. Calling Close again returns what the first call
+// did.
 func (d *Disk) Close(ctx context.Context) error {
 	if d.closed {
-		return nil
+		return d.closeErr
 	}
 
-	err := d.finalizeSegment(ctx)
-	if err != nil {
-		return errors.Wrapf(err, "error closing segment")
-	}
+	d.closed = true
+
+	// Nothing is left for it to flush that the close doesn't.
+	d.stopIdleFlush()
 
-	done := make(chan EventResult)
+	var cerr CloseError
 
-	d.controller.EventsCh() <- Event{
-		Kind: CleanupSegments,
-		Done: done,
+	step := func(name string, err error) {
+		if err != nil {
+			cerr.Errors = append(cerr.Errors, errors.Wrapf(err, "%s", name))
+		} else {
+			cerr.Completed = append(cerr.Completed, name)
+		}
+	}
+
+	step("flushing segment", d.finalizeSegment(ctx))
+
+	// Closing the events channel lets the controller exit once it's done
+	// with whatever it's already working on.
+	done := make(chan EventResult, 1)
+
+	select {
+	case <-ctx.Done():
+		step("cleaning up segments", ctx.Err())
+	case d.controller.EventsCh() <- Event{Kind: CleanupSegments, Done: done}:
+		select {
+		case <-ctx.Done():
+			step("cleaning up segments", ctx.Err())
+		case res := <-done:
+			step("cleaning up segments", res.Error)
+		}
 	}
 
 	close(d.controller.EventsCh())
 
-	<-done
+	stopped := make(chan struct{})
+
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
 
-	d.wg.Wait()
+	var running bool
 
-	err = d.saveLBAMap(ctx)
-	if err != nil {
-		d.log.Error("error saving LBA cached map", "error", err)
-		err = errors.Wrapf(err, "error saving lba map")
+	select {
+	case <-ctx.Done():
+		running = true
+		step("stopping background work", ctx.Err())
+	case <-stopped:
+		step("stopping background work", nil)
 	}
 
-	d.er.Close()
+	if running {
+		step("saving lba map", errors.New("background work still running"))
+	} else {
+		err := d.saveLBAMap(ctx)
+		if err != nil {
+			d.log.Error("error saving LBA cached map", "error", err)
+		}
 
-	d.closed = true
+		step("saving lba map", err)
+	}
 
-	return err
+	if d.dedup != nil {
+		err := d.dedup.save(d.dedupIndexPath())
+		if err != nil {
+			d.log.Error("error saving dedup index", "error", err)
+		}
+
+		step("saving dedup index", err)
+	}
+
+	// A flush that's still running reads and fills the caches, so they're
+	// left for it.
+	if running {
+		step("closing caches", errors.New("background work still running"))
+	} else {
+		d.er.Close()
+		step("closing caches", nil)
+	}
+
+	if len(cerr.Errors) > 0 {
+		d.closeErr = &cerr
+		return &cerr
+	}
+
+	return nil
 }
 
 func (d *Disk) Size() int64 {
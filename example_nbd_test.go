@@ -0,0 +1,59 @@
+package lsvd
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/lab47/lsvd/pkg/nbd"
+)
+
+// Serves a disk over NBD on a unix socket. Attach it with:
+//
+//	nbd-client -unix /tmp/lsvd.sock -N default /dev/nbd0
+func ExampleNBDBackendOpen() {
+	ctx := context.Background()
+	log := logger.New(logger.Info)
+
+	d, err := NewDisk(ctx, log, "/var/lib/lsvd")
+	if err != nil {
+		log.Error("error opening disk", "error", err)
+		os.Exit(1)
+	}
+
+	defer d.Close(ctx)
+
+	l, err := net.Listen("unix", "/tmp/lsvd.sock")
+	if err != nil {
+		log.Error("error listening", "error", err)
+		os.Exit(1)
+	}
+
+	defer l.Close()
+
+	exports := []*nbd.Export{
+		{
+			Name:        "default",
+			Description: "lsvd disk",
+			BackendOpen: &NBDBackendOpen{Ctx: ctx, Log: log, Disk: d},
+		},
+	}
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Error("error accepting connection", "error", err)
+			return
+		}
+
+		go func() {
+			defer c.Close()
+
+			err := nbd.Handle(log, c, exports, nil)
+			if err != nil {
+				log.Error("error handling nbd connection", "error", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,168 @@
+package lsvd
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// How many blocks to read from the disk at a time while exporting.
+const exportChunkBlocks = 256
+
+type exportOpts struct {
+	sparse   bool
+	progress func(done, total int64)
+}
+
+type ExportOption func(o *exportOpts)
+
+// ExportSparse causes ExportRaw to skip all-zero blocks rather than writing
+// them. Only the non-zero blocks are written, in order, and the skipped blocks
+// are returned as a hole map that is needed to reconstruct the image.
+func ExportSparse() ExportOption {
+	return func(o *exportOpts) {
+		o.sparse = true
+	}
+}
+
+// ExportProgress registers a function that is called after each chunk
+// is exported with the number of bytes of the volume processed so far.
+func ExportProgress(fn func(done, total int64)) ExportOption {
+	return func(o *exportOpts) {
+		o.progress = fn
+	}
+}
+
+var ErrUnknownSize = errors.New("volume size is unknown")
+
+// ExportRaw writes the entire logical volume to +w+ as a raw image, with
+// unwritten regions as zeros. In sparse mode, the returned extents are the
+// holes that were not written.
+func (d *Disk) ExportRaw(ctx *Context, w io.Writer, opts ...ExportOption) ([]Extent, error) {
+	var o exportOpts
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if d.size <= 0 {
+		return nil, ErrUnknownSize
+	}
+
+	end := LBA(d.size / BlockSize)
+	total := int64(end) * BlockSize
+
+	var holes []Extent
+
+	for lba := LBA(0); lba < end; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		rng := Extent{LBA: lba, Blocks: uint32(min(exportChunkBlocks, end-lba))}
+
+		marker := ctx.Marker()
+
+		data, err := d.ReadExtent(ctx, rng)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading extent %s", rng)
+		}
+
+		if o.sparse {
+			holes, err = writeSparse(w, data, holes)
+		} else {
+			_, err = w.Write(data.ReadData())
+		}
+
+		ctx.ResetTo(marker)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "writing extent %s", rng)
+		}
+
+		lba += LBA(rng.Blocks)
+
+		if o.progress != nil {
+			o.progress(int64(lba)*BlockSize, total)
+		}
+	}
+
+	return CoalesceExtents(holes), nil
+}
+
+// ReadRangeTo streams the data of +rng+ to +w+, with unwritten blocks as
+// zeros, reading it a chunk at a time so that the memory used doesn't grow
+// with the size of the range. It stops between chunks if +ctx+ is canceled,
+// and returns how many bytes were written to +w+.
+func (d *Disk) ReadRangeTo(ctx *Context, rng Extent, w io.Writer) (int64, error) {
+	var written int64
+
+	for lba, end := rng.LBA, rng.LBA+LBA(rng.Blocks); lba < end; {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		chunk := Extent{LBA: lba, Blocks: uint32(min(exportChunkBlocks, end-lba))}
+
+		marker := ctx.Marker()
+
+		data, err := d.ReadExtent(ctx, chunk)
+		if err != nil {
+			ctx.ResetTo(marker)
+			return written, errors.Wrapf(err, "reading extent %s", chunk)
+		}
+
+		n, err := w.Write(data.ReadData())
+		written += int64(n)
+
+		ctx.ResetTo(marker)
+
+		if err != nil {
+			return written, errors.Wrapf(err, "writing extent %s", chunk)
+		}
+
+		lba += LBA(chunk.Blocks)
+	}
+
+	return written, nil
+}
+
+// writeSparse writes the runs of non-zero blocks in +data+ to +w+ and
+// appends the all-zero blocks to +holes+.
+func writeSparse(w io.Writer, data RangeData, holes []Extent) ([]Extent, error) {
+	buf := data.ReadData()
+
+	var start int
+
+	for i := 0; i < int(data.Blocks); i++ {
+		blk := buf[i*BlockSize : (i+1)*BlockSize]
+		if !emptyBytes(blk) {
+			continue
+		}
+
+		if start < i {
+			if _, err := w.Write(buf[start*BlockSize : i*BlockSize]); err != nil {
+				return nil, err
+			}
+		}
+
+		holes = append(holes, Extent{LBA: data.LBA + LBA(i), Blocks: 1})
+		start = i + 1
+	}
+
+	if start < int(data.Blocks) {
+		if _, err := w.Write(buf[start*BlockSize:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return holes, nil
+}
+
+// ReadRawSegment returns the bytes of +seg+ exactly as they are stored, along
+// with its size, so that backup tools can copy segments without decoding
+// them. The size is -1 if the segment access can't report it up front.
+func (d *Disk) ReadRawSegment(ctx context.Context, seg SegmentId) (io.ReadCloser, int64, error) {
+	return StreamSegment(ctx, d.sa, seg)
+}
@@ -0,0 +1,193 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	const volBlocks = 600
+
+	setup := func(t *testing.T) *Disk {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		d.size = volBlocks * BlockSize
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(1)))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(2)))
+		r.NoError(d.CloseSegment(ctx))
+
+		// Straddles a chunk boundary, and stays in the write cache.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(255)))
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(256)))
+		r.NoError(d.WriteExtent(ctx, testExtent3.MapTo(volBlocks-1)))
+
+		return d
+	}
+
+	t.Run("exports the volume as a dense raw image", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		var (
+			buf      bytes.Buffer
+			progress []int64
+		)
+
+		holes, err := d.ExportRaw(ctx, &buf, ExportProgress(func(done, total int64) {
+			r.Equal(d.size, total)
+			progress = append(progress, done)
+		}))
+		r.NoError(err)
+		r.Nil(holes)
+
+		r.Equal(int(d.size), buf.Len())
+		r.Equal([]int64{256 * BlockSize, 512 * BlockSize, d.size}, progress)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: volBlocks})
+		r.NoError(err)
+
+		r.Equal(data.ReadData(), buf.Bytes())
+	})
+
+	t.Run("sparse mode records holes instead of writing zeros", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		var buf bytes.Buffer
+
+		holes, err := d.ExportRaw(ctx, &buf, ExportSparse())
+		r.NoError(err)
+
+		r.Equal([]Extent{
+			{LBA: 0, Blocks: 1},
+			{LBA: 3, Blocks: 252},
+			{LBA: 257, Blocks: volBlocks - 258},
+		}, holes)
+
+		var expected []byte
+		expected = append(expected, testRand...)
+		expected = append(expected, testRand...)
+		expected = append(expected, testData...)
+		expected = append(expected, testData2...)
+		expected = append(expected, testData3...)
+
+		r.Equal(expected, buf.Bytes())
+	})
+
+	t.Run("requires the volume size", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+		d.size = 0
+
+		_, err := d.ExportRaw(ctx, &bytes.Buffer{})
+		r.ErrorIs(err, ErrUnknownSize)
+	})
+
+	t.Run("streams a range in chunks", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		// Starts and ends mid-chunk, and spans holes.
+		rng := Extent{LBA: 1, Blocks: volBlocks - 2}
+
+		var buf bytes.Buffer
+
+		n, err := d.ReadRangeTo(ctx, rng, &buf)
+		r.NoError(err)
+		r.Equal(int64(rng.ByteSize()), n)
+
+		var expected []byte
+
+		for lba := rng.LBA; lba <= rng.Last(); lba++ {
+			data, err := d.ReadExtent(ctx, Extent{LBA: lba, Blocks: 1})
+			r.NoError(err)
+
+			expected = append(expected, data.ReadData()...)
+		}
+
+		r.Equal(expected, buf.Bytes())
+	})
+
+	t.Run("stops streaming between chunks when canceled", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		sctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		w := &cancelingWriter{cancel: cancel}
+
+		n, err := d.ReadRangeTo(NewContext(sctx), Extent{LBA: 0, Blocks: volBlocks}, w)
+		r.ErrorIs(err, context.Canceled)
+
+		r.Equal(int64(exportChunkBlocks*BlockSize), n)
+		r.Equal(n, w.written)
+	})
+
+	t.Run("reads segments as they were uploaded", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 1)
+
+		rc, size, err := d.ReadRawSegment(ctx, segs[0])
+		r.NoError(err)
+
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		r.NoError(err)
+
+		uploaded, err := os.ReadFile(
+			filepath.Join(d.path, "segments", "segment."+segs[0].String()))
+		r.NoError(err)
+
+		r.Equal(uploaded, data)
+		r.Equal(int64(len(uploaded)), size)
+	})
+}
+
+// cancelingWriter discards what's written to it, canceling a context after
+// the first write.
+type cancelingWriter struct {
+	cancel  func()
+	written int64
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	w.cancel()
+
+	return len(p), nil
+}
@@ -41,6 +41,19 @@ func (e Extent) Last() LBA {
 	return (e.LBA + LBA(e.Blocks) - 1)
 }
 
+// Union returns the extent covering both +e+ and +o+ if they overlap or are
+// adjacent.
+func (e Extent) Union(o Extent) (Extent, bool) {
+	if e.LBA > o.Last()+1 || o.LBA > e.Last()+1 {
+		return Extent{}, false
+	}
+
+	start := min(e.LBA, o.LBA)
+	end := max(e.Last(), o.Last())
+
+	return Extent{LBA: start, Blocks: uint32(end-start) + 1}, true
+}
+
 func (e Extent) Range() (LBA, LBA) {
 	return e.LBA, e.LBA + LBA(e.Blocks) - 1
 }
@@ -204,6 +217,36 @@ func (e Extent) SubMany(subs []Extent) ([]Extent, bool) {
 	return holes, true
 }
 
+// CoalesceExtents sorts +xs+ and merges any extents that overlap or are
+// adjacent, returning the minimal set of extents covering the same blocks.
+func CoalesceExtents(xs []Extent) []Extent {
+	if len(xs) == 0 {
+		return nil
+	}
+
+	sort.Slice(xs, func(i, j int) bool {
+		return xs[i].LBA < xs[j].LBA
+	})
+
+	var out []Extent
+
+	cur := xs[0]
+
+	for _, x := range xs[1:] {
+		if x.LBA > cur.LBA+LBA(cur.Blocks) {
+			out = append(out, cur)
+			cur = x
+			continue
+		}
+
+		if end := x.LBA + LBA(x.Blocks); end > cur.LBA+LBA(cur.Blocks) {
+			cur.Blocks = uint32(end - cur.LBA)
+		}
+	}
+
+	return append(out, cur)
+}
+
 type Mask struct {
 	remaining []Extent
 }
@@ -2,6 +2,7 @@ package lsvd
 
 import (
 	"encoding/binary"
+	"slices"
 
 	"github.com/hashicorp/go-hclog"
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -9,13 +10,20 @@ import (
 )
 
 type lruEntry struct {
-	seg SegmentId
-	off uint32
-	ext Extent
+	seg  SegmentId
+	off  uint32
+	size uint32
+	ext  Extent
 
 	data []byte
 }
 
+// ExtentCache keeps the data of extents read from segments. Entries are keyed
+// by where the extent is stored, that is its segment, offset, and size, along
+// with the extent itself. Segments are never changed once written and a disk
+// never reuses a segment id (see nextSeq), so a key always refers to the same
+// data: an overwrite or compaction writes the new data to a new segment and
+// the extent map stops referring to the old key, leaving it to age out.
 type ExtentCache struct {
 	log    hclog.Logger
 	db     *bbolt.DB
@@ -68,40 +76,66 @@ func (e *ExtentCache) Close() error {
 	return e.db.Close()
 }
 
-func (e *ExtentCache) parseKey(b []byte) (SegmentId, uint32, Extent) {
+const extentCacheKeySize = SegmentIdSize + 20
+
+func (e *ExtentCache) parseKey(b []byte) (SegmentId, uint32, uint32, Extent) {
 	seg := SegmentId(b[:SegmentIdSize])
 
 	b = b[SegmentIdSize:]
 
 	offset := binary.LittleEndian.Uint32(b)
+	size := binary.LittleEndian.Uint32(b[4:])
 
-	b = b[4:]
+	b = b[8:]
 
 	var ext Extent
 	ext.LBA = LBA(binary.LittleEndian.Uint64(b))
 	ext.Blocks = binary.LittleEndian.Uint32(b[8:])
 
-	return seg, offset, ext
+	return seg, offset, size, ext
 }
 
-func (e *ExtentCache) serializeKey(seg SegmentId, offset uint32, x Extent) []byte {
-	var data [16 + SegmentIdSize]byte
+func (e *ExtentCache) serializeKey(seg SegmentId, offset, size uint32, x Extent) []byte {
+	var data [extentCacheKeySize]byte
 	copy(data[:], seg[:])
 	binary.LittleEndian.PutUint32(data[SegmentIdSize:], offset)
-	binary.LittleEndian.PutUint64(data[SegmentIdSize+4:], uint64(x.LBA))
-	binary.LittleEndian.PutUint32(data[SegmentIdSize+12:], uint32(x.Blocks))
+	binary.LittleEndian.PutUint32(data[SegmentIdSize+4:], size)
+	binary.LittleEndian.PutUint64(data[SegmentIdSize+8:], uint64(x.LBA))
+	binary.LittleEndian.PutUint32(data[SegmentIdSize+16:], uint32(x.Blocks))
 	return data[:]
 }
 
+// populateInUse loads the keys of the entries already in the cache. The data
+// is read on demand, since values from bbolt are only valid during the
+// transaction they were read in. Entries with keys from before the size was
+// part of them are removed.
 func (e *ExtentCache) populateInUse() error {
-	return e.db.View(func(tx *bbolt.Tx) error {
+	return e.db.Update(func(tx *bbolt.Tx) error {
 		buk := tx.Bucket(extentsBucket)
 
-		buk.ForEach(func(k, v []byte) error {
-			seg, off, ext := e.parseKey(k)
-			e.inUse.Add(string(k), lruEntry{seg, off, ext, v})
+		var stale [][]byte
+
+		err := buk.ForEach(func(k, v []byte) error {
+			if len(k) != extentCacheKeySize {
+				stale = append(stale, slices.Clone(k))
+				return nil
+			}
+
+			seg, off, size, ext := e.parseKey(k)
+			e.inUse.Add(string(k), lruEntry{seg, off, size, ext, nil})
+			e.blocks += int(ext.Blocks)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := buk.Delete(k); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 }
@@ -126,8 +160,9 @@ func (e *ExtentCache) WriteExtent(robpb *PartialExtent, data []byte) error {
 	ext := robpb.Extent
 	seg := robpb.Segment
 	off := robpb.Offset
+	size := robpb.Size
 
-	key := e.serializeKey(seg, off, ext)
+	key := e.serializeKey(seg, off, size, ext)
 
 	// dup := slices.Clone(data)
 	//e.blocks += int(ext.Blocks)
@@ -143,7 +178,7 @@ func (e *ExtentCache) WriteExtent(robpb *PartialExtent, data []byte) error {
 		}
 
 		e.blocks += int(ext.Blocks)
-		e.inUse.Add(string(key), lruEntry{seg, off, ext, nil})
+		e.inUse.Add(string(key), lruEntry{seg, off, size, ext, nil})
 
 		return buk.Put(key, data)
 	})
@@ -153,8 +188,9 @@ func (e *ExtentCache) ReadExtent(robpb *PartialExtent, data []byte) (bool, error
 	ext := robpb.Extent
 	seg := robpb.Segment
 	off := robpb.Offset
+	size := robpb.Size
 
-	key := e.serializeKey(seg, off, ext)
+	key := e.serializeKey(seg, off, size, ext)
 
 	ent, ok := e.inUse.Get(string(key))
 	if !ok {
@@ -162,17 +198,24 @@ func (e *ExtentCache) ReadExtent(robpb *PartialExtent, data []byte) (bool, error
 	}
 
 	if ent.data != nil {
+		if len(ent.data) != len(data) {
+			return false, nil
+		}
+
 		copy(data, ent.data)
 		return true, nil
 	}
 
+	ok = false
+
 	err := e.db.View(func(tx *bbolt.Tx) error {
 		buk := tx.Bucket(extentsBucket)
+
+		// Only whole entries are returned, never part of one.
 		b := buk.Get(key)
-		if b != nil {
+		if b != nil && len(b) == len(data) {
 			ok = true
 			copy(data, b)
-
 		}
 
 		return nil
@@ -1,10 +1,12 @@
 package lsvd
 
 import (
+	"bytes"
 	"os"
 	"testing"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/require"
 	"go.etcd.io/bbolt"
 )
@@ -39,4 +41,98 @@ func TestExtentCache(t *testing.T) {
 		r.Equal((maxBlocks - 100), ec.blocks)
 		r.Equal(0, ec.inUse.Len())
 	})
+
+	newPE := func(seg SegmentId, off, size uint32) *PartialExtent {
+		pe := &PartialExtent{Live: Extent{LBA: 10, Blocks: 2}}
+		pe.Segment = seg
+		pe.Extent = Extent{LBA: 10, Blocks: 2}
+		pe.Offset = off
+		pe.Size = size
+		return pe
+	}
+
+	open := func(t *testing.T, path string) *ExtentCache {
+		ec, err := NewExtentCache(hclog.L(), path)
+		require.NoError(t, err)
+		return ec
+	}
+
+	t.Run("keys entries by where the extent is stored", func(t *testing.T) {
+		r := require.New(t)
+
+		tmp, err := os.CreateTemp("", "")
+		r.NoError(err)
+
+		defer tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		ec := open(t, tmp.Name())
+		defer ec.Close()
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+		other := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		data := bytes.Repeat([]byte{0x47}, 100)
+
+		r.NoError(ec.WriteExtent(newPE(seg, 50, 100), data))
+
+		buf := make([]byte, 100)
+
+		ok, err := ec.ReadExtent(newPE(seg, 50, 100), buf)
+		r.NoError(err)
+		r.True(ok)
+		r.Equal(data, buf)
+
+		// The same place in another segment, or data of another size at the
+		// same offset, is different data.
+		ok, err = ec.ReadExtent(newPE(other, 50, 100), buf)
+		r.NoError(err)
+		r.False(ok)
+
+		ok, err = ec.ReadExtent(newPE(seg, 50, 80), make([]byte, 80))
+		r.NoError(err)
+		r.False(ok)
+	})
+
+	t.Run("serves entries after being reopened", func(t *testing.T) {
+		r := require.New(t)
+
+		tmp, err := os.CreateTemp("", "")
+		r.NoError(err)
+
+		defer tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+		data := bytes.Repeat([]byte{0x48}, 100)
+
+		ec := open(t, tmp.Name())
+		r.NoError(ec.WriteExtent(newPE(seg, 50, 100), data))
+
+		// A key from before the size was part of it.
+		r.NoError(ec.db.Update(func(tx *bbolt.Tx) error {
+			key := ec.serializeKey(seg, 200, 100, Extent{LBA: 10, Blocks: 2})
+			return tx.Bucket(extentsBucket).Put(key[:len(key)-4], data)
+		}))
+
+		r.NoError(ec.Close())
+
+		ec = open(t, tmp.Name())
+		defer ec.Close()
+
+		r.Equal(1, ec.inUse.Len())
+		r.Equal(2, ec.blocks)
+
+		buf := make([]byte, 100)
+
+		ok, err := ec.ReadExtent(newPE(seg, 50, 100), buf)
+		r.NoError(err)
+		r.True(ok)
+		r.Equal(data, buf)
+
+		r.NoError(ec.db.View(func(tx *bbolt.Tx) error {
+			r.Equal(1, tx.Bucket(extentsBucket).Stats().KeyN)
+			return nil
+		}))
+	})
 }
@@ -5,6 +5,7 @@ import (
 	"math"
 	"strings"
 	"sync"
+	"unsafe"
 
 	"github.com/lab47/lsvd/logger"
 	"github.com/lab47/lsvd/pkg/treemap"
@@ -118,13 +119,32 @@ type ExtentMap struct {
 	affected   []PartialExtent
 	addScratch []compactPE
 	delScratch []LBA
+
+	// Disables coalescing in UpdateBatch, to compare in benchmarks.
+	noCoalesce bool
+
+	// The most blocks coalescing merges uncompressed extents into, so that
+	// entries don't outgrow the disk's max extent size. maxCombinedBlocks
+	// if 0.
+	maxCoalesce uint32
+
+	// Disables building the tree in one go in load, to compare in
+	// benchmarks.
+	noBulkLoad bool
+
+	metrics *Metrics
 }
 
 func NewExtentMap() *ExtentMap {
+	return newExtentMap(defaultMetrics)
+}
+
+func newExtentMap(m *Metrics) *ExtentMap {
 	return &ExtentMap{
 		m:             treemap.New[LBA, compactPE](),
 		segmentByDesc: make(map[segLocations]uint32),
 		segmentByIdx:  make(map[uint32]segLocations),
+		metrics:       m,
 	}
 }
 
@@ -132,6 +152,27 @@ func (e *ExtentMap) Len() int {
 	return e.m.Len()
 }
 
+// MemoryUsage returns the approximate bytes used by the map's entries and
+// its table of the segments they refer to.
+func (e *ExtentMap) MemoryUsage() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.segmentsMu.Lock()
+	defer e.segmentsMu.Unlock()
+
+	// Each segment is in both tables, and a map takes about twice the size
+	// of its entries.
+	segEntry := int(unsafe.Sizeof(segLocations{})) + int(unsafe.Sizeof(uint32(0)))
+	segs := len(e.segmentByDesc) * segEntry * 2 * 2
+
+	scratch := cap(e.affected)*int(unsafe.Sizeof(PartialExtent{})) +
+		cap(e.addScratch)*int(unsafe.Sizeof(compactPE{})) +
+		cap(e.delScratch)*int(unsafe.Sizeof(LBA(0)))
+
+	return e.m.MemoryUsage() + segs + scratch
+}
+
 type Iterator struct {
 	e  *ExtentMap
 	mu *sync.Mutex
@@ -145,6 +186,33 @@ func (e *ExtentMap) Iterator() *Iterator {
 	}
 }
 
+// Snapshot copies the extents in the map, in order. The map is only locked
+// while they're copied, so that saving it doesn't hold up reads.
+func (e *ExtentMap) Snapshot() []PartialExtent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	pes := make([]PartialExtent, 0, e.m.Len())
+
+	for it := e.m.Iterator(); it.Valid(); it.Next() {
+		pes = append(pes, e.ToPE(it.Value()))
+	}
+
+	return pes
+}
+
+// Iterate calls +fn+ with the live part of each mapped extent and where its
+// data is stored, in ascending LBA order, stopping early if +fn+ returns
+// false. It walks a snapshot of the map, so +fn+ sees the map as it was when
+// Iterate was called and is free to use or update the map itself.
+func (e *ExtentMap) Iterate(fn func(Extent, ExtentLocation) bool) {
+	for _, pe := range e.Snapshot() {
+		if !fn(pe.Live, pe.ExtentLocation) {
+			return
+		}
+	}
+}
+
 func (m *ExtentMap) LockedIterator() *Iterator {
 	i := &Iterator{
 		e:               m,
@@ -236,6 +304,12 @@ func (e *ExtentMap) UpdateBatch(log logger.Logger, entries []ExtentLocation, seg
 		if mode.Debug() {
 			log.Trace("updating read map", "extent", ent.Extent)
 		}
+		// Data dedup found already stored in another segment is a use of
+		// that segment.
+		if ent.Segment != segId {
+			s.CreateOrUpdate(ent.Segment, uint64(ent.Blocks))
+		}
+
 		affected = affected[:0]
 		affected, err = e.update(log, ent, affected)
 		if err != nil {
@@ -243,6 +317,10 @@ func (e *ExtentMap) UpdateBatch(log logger.Logger, entries []ExtentLocation, seg
 		}
 
 		s.UpdateUsage(log, segId, affected)
+
+		if !e.noCoalesce {
+			e.coalesce(ent.LBA)
+		}
 	}
 
 	e.affected = affected
@@ -250,6 +328,81 @@ func (e *ExtentMap) UpdateBatch(log logger.Logger, entries []ExtentLocation, seg
 	return nil
 }
 
+// coalesce merges the entry at +lba+ with the entries before and after it
+// where one entry can describe the same data, see mergeEntries.
+func (e *ExtentMap) coalesce(lba LBA) {
+	cur, ok := e.m.Get(lba)
+
+	// Compressed data is only readable as the extent it was stored as.
+	if !ok || cur.rawSize != 0 {
+		return
+	}
+
+	if lba > 0 {
+		if i := e.m.Floor(lba - 1); i.Valid() {
+			if merged, ok := mergeEntries(i.Value(), cur, e.coalesceLimit()); ok {
+				e.m.Del(lba)
+				e.m.Set(merged.LiveLBA(), merged)
+				cur = merged
+			}
+		}
+	}
+
+	if next, ok := e.m.Get(cur.LiveLast() + 1); ok {
+		if merged, ok := mergeEntries(cur, next, e.coalesceLimit()); ok {
+			e.m.Del(next.LiveLBA())
+			e.m.Set(merged.LiveLBA(), merged)
+		}
+	}
+}
+
+// coalesceLimit returns the most blocks an entry merged from uncompressed
+// extents can cover.
+func (e *ExtentMap) coalesceLimit() uint32 {
+	if e.maxCoalesce > 0 {
+		return min(e.maxCoalesce, maxCombinedBlocks)
+	}
+
+	return maxCombinedBlocks
+}
+
+// mergeEntries returns a single entry covering +a+ and +b+, which directly
+// follows it, if both are empty extents, which have no data to locate, or
+// whole uncompressed extents stored back to back, up to +maxBlocks+.
+// Compressed extents are never merged. The entries must be in the same
+// segment so that the segment's usage is still accounted for when the
+// merged entry is overwritten.
+func mergeEntries(a, b compactPE, maxBlocks uint32) (compactPE, bool) {
+	if a.segIdx != b.segIdx || a.LiveLast()+1 != b.LiveLBA() {
+		return compactPE{}, false
+	}
+
+	blocks := a.LiveBlocks() + b.LiveBlocks()
+
+	if blocks > physBlockMask {
+		return compactPE{}, false
+	}
+
+	whole := func(c compactPE) bool {
+		return c.liveLBADiff == 0 && c.liveBlockDiff == 0
+	}
+
+	switch {
+	case a.byteSize == 0 && b.byteSize == 0:
+	case a.rawSize == 0 && b.rawSize == 0 && a.byteSize != 0 && b.byteSize != 0 &&
+		whole(a) && whole(b) && a.offset+a.byteSize == b.offset && blocks <= maxBlocks:
+	default:
+		return compactPE{}, false
+	}
+
+	return compactPE{
+		physX:    uint64(a.LiveLBA()<<physLBAShift) | uint64(blocks),
+		segIdx:   a.segIdx,
+		byteSize: a.byteSize + b.byteSize,
+		offset:   a.offset,
+	}, true
+}
+
 func (e *ExtentMap) Update(log logger.Logger, pba ExtentLocation, affected []PartialExtent) ([]PartialExtent, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -257,6 +410,33 @@ func (e *ExtentMap) Update(log logger.Logger, pba ExtentLocation, affected []Par
 	return e.update(log, pba, affected)
 }
 
+// RemoveSegments drops the entries that map ranges to any of +segs+ in the
+// disk's own segments, returning them. The ranges they covered are left
+// unmapped.
+func (e *ExtentMap) RemoveSegments(segs map[SegmentId]struct{}) []PartialExtent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var removed []PartialExtent
+
+	for i := e.m.Iterator(); i.Valid(); i.Next() {
+		pe := e.ToPE(i.Value())
+		if pe.Disk != 0 {
+			continue
+		}
+
+		if _, ok := segs[pe.Segment]; ok {
+			removed = append(removed, pe)
+		}
+	}
+
+	for _, pe := range removed {
+		e.m.Del(pe.Live.LBA)
+	}
+
+	return removed
+}
+
 func (e *ExtentMap) update(log logger.Logger, pba ExtentLocation, affected []PartialExtent) ([]PartialExtent, error) {
 	var (
 		toDelete = e.delScratch[:0]
@@ -266,7 +446,7 @@ func (e *ExtentMap) update(log logger.Logger, pba ExtentLocation, affected []Par
 	)
 
 	defer func() {
-		extentUpdates.Inc()
+		e.metrics.extentUpdates.Inc()
 		e.addScratch = toAdd[:0]
 		e.delScratch = toDelete[:0]
 	}()
@@ -504,6 +684,12 @@ func (ce *compactPE) SetFromHeader(eh ExtentHeader, seg uint32) {
 }
 
 func (e *ExtentMap) set(pe PartialExtent) {
+	ce := e.compact(pe)
+
+	e.m.Set(ce.LiveLBA(), ce)
+}
+
+func (e *ExtentMap) compact(pe PartialExtent) compactPE {
 	ce := compactPE{
 		physX:    uint64(pe.LBA<<physLBAShift) | uint64(pe.Blocks),
 		segIdx:   e.segmentIdx(pe.ExtentLocation),
@@ -514,7 +700,30 @@ func (e *ExtentMap) set(pe PartialExtent) {
 
 	ce.SetLive(pe.Live)
 
-	e.m.Set(ce.LiveLBA(), ce)
+	return ce
+}
+
+// load fills the empty map with +pes+, which mustn't overlap. When they're
+// in ascending order, as a saved map's are, the tree is built from them in
+// one go, rather than inserting each which costs O(log n) apiece.
+func (e *ExtentMap) load(pes []PartialExtent) {
+	if !e.noBulkLoad && e.m.Len() == 0 {
+		keys := make([]LBA, len(pes))
+		values := make([]compactPE, len(pes))
+
+		for i, pe := range pes {
+			values[i] = e.compact(pe)
+			keys[i] = values[i].LiveLBA()
+		}
+
+		if e.m.BuildSorted(keys, values) {
+			return
+		}
+	}
+
+	for _, pe := range pes {
+		e.set(pe)
+	}
 }
 
 func (e *ExtentMap) Validate(log logger.Logger) error {
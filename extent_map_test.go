@@ -1,6 +1,8 @@
 package lsvd
 
 import (
+	"math/rand"
+	"slices"
 	"testing"
 
 	"github.com/lab47/lsvd/logger"
@@ -605,4 +607,396 @@ func TestExtentMap(t *testing.T) {
 		r.Equal(LBA(7234450), pes[0].LBA)
 		r.Equal(LBA(7234490), pes[1].LBA)
 	})
+
+	// batch applies +entries+ of +seg+ the way a flushed segment is applied.
+	batch := func(t *testing.T, m *ExtentMap, s *Segments, seg SegmentId, entries ...ExtentHeader) {
+		var blocks uint64
+
+		locs := make([]ExtentLocation, len(entries))
+		for i, eh := range entries {
+			locs[i] = ExtentLocation{ExtentHeader: eh, Segment: seg}
+			blocks += uint64(eh.Blocks)
+		}
+
+		s.CreateOrUpdate(seg, blocks)
+
+		require.NoError(t, m.UpdateBatch(log, locs, seg, s))
+	}
+
+	s2 := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	t.Run("coalesces empty extents in a batch", func(t *testing.T) {
+		r := require.New(t)
+
+		m := NewExtentMap()
+
+		batch(t, m, NewSegments(), s1,
+			ExtentHeader{Extent: Extent{0, 8}},
+			ExtentHeader{Extent: Extent{100, 1}, Size: 10, RawSize: BlockSize, Offset: 20},
+			ExtentHeader{Extent: Extent{8, 8}},
+		)
+
+		r.Equal(2, m.Len())
+
+		pes, err := m.Resolve(log, Extent{0, 16}, nil)
+		r.NoError(err)
+		r.Len(pes, 1)
+		r.Equal(Extent{0, 16}, pes[0].Live)
+		r.Equal(FlagEmpty, pes[0].Flags())
+	})
+
+	t.Run("coalesces uncompressed extents stored back to back", func(t *testing.T) {
+		r := require.New(t)
+
+		m := NewExtentMap()
+
+		batch(t, m, NewSegments(), s1,
+			ExtentHeader{Extent: Extent{0, 2}, Size: 2 * BlockSize, Offset: 100},
+			ExtentHeader{Extent: Extent{2, 3}, Size: 3 * BlockSize, Offset: 100 + 2*BlockSize},
+
+			// A gap in the segment, and compressed data, keep their own
+			// entries.
+			ExtentHeader{Extent: Extent{5, 1}, Size: BlockSize, Offset: 200 + 5*BlockSize},
+			ExtentHeader{Extent: Extent{6, 1}, Size: 10, RawSize: BlockSize, Offset: 200 + 6*BlockSize},
+		)
+
+		r.Equal(3, m.Len())
+
+		pes, err := m.Resolve(log, Extent{1, 3}, nil)
+		r.NoError(err)
+		r.Len(pes, 1)
+		r.Equal(Extent{0, 5}, pes[0].Live)
+		r.Equal(Extent{0, 5}, pes[0].Extent)
+		r.Equal(uint32(5*BlockSize), pes[0].Size)
+		r.Equal(uint32(100), pes[0].Offset)
+		r.Equal(FlagUncompressed, pes[0].Flags())
+	})
+
+	t.Run("keeps extents of different segments apart", func(t *testing.T) {
+		r := require.New(t)
+
+		m := NewExtentMap()
+		s := NewSegments()
+
+		batch(t, m, s, s1, ExtentHeader{Extent: Extent{0, 8}})
+		batch(t, m, s, s2, ExtentHeader{Extent: Extent{8, 8}})
+
+		r.Equal(2, m.Len())
+	})
+
+	t.Run("resolves overwrites of a coalesced entry", func(t *testing.T) {
+		r := require.New(t)
+
+		m := NewExtentMap()
+		s := NewSegments()
+
+		batch(t, m, s, s1,
+			ExtentHeader{Extent: Extent{0, 8}},
+			ExtentHeader{Extent: Extent{100, 1}, Size: 10, RawSize: BlockSize, Offset: 20},
+			ExtentHeader{Extent: Extent{8, 8}},
+		)
+
+		batch(t, m, s, s2, ExtentHeader{Extent: Extent{4, 8}, Size: 8 * BlockSize, Offset: 50})
+
+		pes, err := m.Resolve(log, Extent{0, 16}, nil)
+		r.NoError(err)
+		r.Len(pes, 3)
+
+		r.Equal(Extent{0, 4}, pes[0].Live)
+		r.Equal(s1, pes[0].Segment)
+		r.Equal(Extent{4, 8}, pes[1].Live)
+		r.Equal(s2, pes[1].Segment)
+		r.Equal(Extent{12, 4}, pes[2].Live)
+		r.Equal(s1, pes[2].Segment)
+
+		_, used := s.SegmentBlocks(s1)
+		r.Equal(uint64(9), used)
+
+		// Zeroing the middle again in the first segment merges it back.
+		batch(t, m, s, s1, ExtentHeader{Extent: Extent{4, 8}})
+		r.Equal(2, m.Len())
+	})
+
+	t.Run("reports its memory usage", func(t *testing.T) {
+		r := require.New(t)
+
+		m := NewExtentMap()
+		empty := m.MemoryUsage()
+
+		for i := 0; i < 100; i++ {
+			_, err := m.Update(log, ExtentLocation{
+				ExtentHeader: ExtentHeader{Extent: Extent{LBA(i * 2), 1}, Size: BlockSize},
+				Segment:      s1,
+			}, nil)
+			r.NoError(err)
+		}
+
+		r.Greater(m.MemoryUsage(), empty)
+	})
+
+	t.Run("iterates the mapped extents in order", func(t *testing.T) {
+		r := require.New(t)
+
+		s2 := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		m := NewExtentMap()
+
+		for _, loc := range []ExtentLocation{
+			{ExtentHeader: ExtentHeader{Extent: Extent{47, 10}, Offset: 47}, Segment: s1},
+			{ExtentHeader: ExtentHeader{Extent: Extent{0, 8}}, Segment: s1},
+			{ExtentHeader: ExtentHeader{Extent: Extent{50, 3}, Offset: 100}, Segment: s2},
+			{ExtentHeader: ExtentHeader{Extent: Extent{100, 1}, Offset: 200}, Segment: s2},
+		} {
+			_, err := m.Update(log, loc, nil)
+			r.NoError(err)
+		}
+
+		type mapped struct {
+			live Extent
+			seg  SegmentId
+		}
+
+		var seen []mapped
+
+		m.Iterate(func(live Extent, loc ExtentLocation) bool {
+			seen = append(seen, mapped{live, loc.Segment})
+
+			// The map can be updated while iterating.
+			_, err := m.Update(log, ExtentLocation{
+				ExtentHeader: ExtentHeader{Extent: Extent{200, 1}},
+				Segment:      s2,
+			}, nil)
+			r.NoError(err)
+
+			return true
+		})
+
+		r.Equal([]mapped{
+			{Extent{0, 8}, s1},
+			{Extent{47, 3}, s1},
+			{Extent{50, 3}, s2},
+			{Extent{53, 4}, s1},
+			{Extent{100, 1}, s2},
+		}, seen)
+
+		var n int
+
+		m.Iterate(func(live Extent, loc ExtentLocation) bool {
+			n++
+			return live.LBA < 47
+		})
+
+		r.Equal(2, n)
+	})
+}
+
+func TestExtentMapLoad(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	s1 := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	// fragmented returns the extents of a map after many overlapping writes.
+	fragmented := func(t *testing.T, rng *rand.Rand, writes int) []PartialExtent {
+		m := NewExtentMap()
+
+		for i := 0; i < writes; i++ {
+			_, err := m.Update(log, ExtentLocation{
+				ExtentHeader: ExtentHeader{
+					Extent: Extent{LBA(rng.Intn(100_000)), uint32(1 + rng.Intn(64))},
+					Size:   BlockSize,
+					Offset: uint32(i),
+				},
+				Segment: s1,
+			}, nil)
+			require.NoError(t, err)
+		}
+
+		return m.Snapshot()
+	}
+
+	t.Run("builds the same map as inserting each extent", func(t *testing.T) {
+		r := require.New(t)
+
+		rng := rand.New(rand.NewSource(1))
+
+		for _, writes := range []int{0, 1, 2, 3, 7, 100, 5000} {
+			pes := fragmented(t, rng, writes)
+
+			bulk := NewExtentMap()
+			bulk.load(pes)
+
+			tree := NewExtentMap()
+			tree.noBulkLoad = true
+			tree.load(pes)
+
+			r.Equal(len(pes), bulk.Len())
+			r.Equal(tree.Snapshot(), bulk.Snapshot())
+			r.NoError(bulk.Validate(log))
+
+			for i := 0; i < 100; i++ {
+				x := Extent{LBA(rng.Intn(100_000)), uint32(1 + rng.Intn(256))}
+
+				want, err := tree.Resolve(log, x, nil)
+				r.NoError(err)
+
+				got, err := bulk.Resolve(log, x, nil)
+				r.NoError(err)
+
+				r.Equal(want, got)
+			}
+
+			// The tree stays balanced and ordered as it's updated after.
+			for i := 0; i < 200; i++ {
+				loc := ExtentLocation{
+					ExtentHeader: ExtentHeader{
+						Extent: Extent{LBA(rng.Intn(100_000)), uint32(1 + rng.Intn(64))},
+						Size:   BlockSize,
+					},
+					Segment: s1,
+				}
+
+				_, err := tree.Update(log, loc, nil)
+				r.NoError(err)
+
+				_, err = bulk.Update(log, loc, nil)
+				r.NoError(err)
+			}
+
+			r.Equal(tree.Snapshot(), bulk.Snapshot())
+			r.NoError(bulk.Validate(log))
+		}
+	})
+
+	t.Run("falls back to inserting extents out of order", func(t *testing.T) {
+		r := require.New(t)
+
+		pes := fragmented(t, rand.New(rand.NewSource(2)), 100)
+
+		shuffled := slices.Clone(pes)
+		slices.Reverse(shuffled)
+
+		m := NewExtentMap()
+		m.load(shuffled)
+
+		r.Equal(pes, m.Snapshot())
+	})
+}
+
+// BenchmarkExtentMapLoad reads a large, fragmented map back in, building
+// the tree in one go and by inserting each extent.
+func BenchmarkExtentMapLoad(b *testing.B) {
+	seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	var pes []PartialExtent
+
+	for i := 0; i < 1_000_000; i++ {
+		pes = append(pes, PartialExtent{
+			Live: Extent{LBA(i * 2), 1},
+			ExtentLocation: ExtentLocation{
+				ExtentHeader: ExtentHeader{
+					Extent: Extent{LBA(i * 2), 1},
+					Size:   BlockSize,
+					Offset: uint32(i * 16),
+				},
+				Segment: seg,
+			},
+		})
+	}
+
+	for _, bulk := range []bool{true, false} {
+		name := "bulk"
+		if !bulk {
+			name = "insert"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m := NewExtentMap()
+				m.noBulkLoad = !bulk
+				m.load(pes)
+
+				if m.Len() != len(pes) {
+					b.Fatal("missing extents")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkExtentMapFragmented applies segments from a guest that discards
+// ranges as it goes while writing elsewhere, reporting the map's size with
+// and without coalescing.
+func BenchmarkExtentMapFragmented(b *testing.B) {
+	log := logger.New(logger.Info)
+
+	const (
+		segments   = 50
+		perSegment = 1000
+	)
+
+	rng := rand.New(rand.NewSource(42))
+
+	var (
+		ids   []SegmentId
+		locs  [][]ExtentLocation
+		trim  LBA
+		write = LBA(1 << 30)
+	)
+
+	for i := 0; i < segments; i++ {
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		var entries []ExtentLocation
+
+		for j := 0; j < perSegment; j++ {
+			entries = append(entries,
+				ExtentLocation{
+					ExtentHeader: ExtentHeader{Extent: Extent{trim, 8}},
+					Segment:      seg,
+				},
+				ExtentLocation{
+					ExtentHeader: ExtentHeader{
+						Extent: Extent{write + LBA(rng.Intn(1<<20)), 1},
+						Size:   BlockSize,
+						Offset: uint32(j * (BlockSize + 16)),
+					},
+					Segment: seg,
+				})
+
+			trim += 8
+		}
+
+		ids = append(ids, seg)
+		locs = append(locs, entries)
+	}
+
+	for _, coalesce := range []bool{true, false} {
+		name := "coalesced"
+		if !coalesce {
+			name = "uncoalesced"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var m *ExtentMap
+
+			for i := 0; i < b.N; i++ {
+				m = NewExtentMap()
+				m.noCoalesce = !coalesce
+
+				s := NewSegments()
+
+				for j, seg := range ids {
+					s.CreateOrUpdate(seg, perSegment*9)
+
+					err := m.UpdateBatch(log, locs[j], seg, s)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			b.ReportMetric(float64(m.Len()), "entries")
+			b.ReportMetric(float64(m.MemoryUsage()), "map-bytes")
+		})
+	}
 }
@@ -3,6 +3,8 @@ package lsvd
 import (
 	"context"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -11,17 +13,66 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Errors returned when the data for an extent can't be read, wrapped with
+// where it was being read from.
+var (
+	ErrShortRead  = errors.New("short read detected")
+	ErrDecompress = errors.New("error uncompressing data")
+	ErrClamp      = errors.New("error clamping range")
+
+	// ErrUnknownExtentFlag is matched by UnknownExtentFlagError.
+	ErrUnknownExtentFlag = errors.New("unknown extent flags")
+)
+
+// UnknownExtentFlagError is returned for an extent whose data is stored in a
+// way we don't know how to read, such as by a newer version or because its
+// header is corrupt.
+type UnknownExtentFlagError struct {
+	Segment SegmentId
+	Extent  Extent
+	Flags   Flags
+}
+
+func (e *UnknownExtentFlagError) Error() string {
+	return fmt.Sprintf("unknown flags value %d for extent %s in segment %s", byte(e.Flags), e.Extent, e.Segment)
+}
+
+func (e *UnknownExtentFlagError) Is(target error) bool {
+	return target == ErrUnknownExtentFlag
+}
+
+func unknownFlagError(pe *PartialExtent) error {
+	return &UnknownExtentFlagError{
+		Segment: pe.Segment,
+		Extent:  pe.Extent,
+		Flags:   pe.Flags(),
+	}
+}
+
+// extentError adds the location of +pe+ to +err+.
+func extentError(err error, pe *PartialExtent) error {
+	return errors.Wrapf(err, "reading extent %s from segment %s (offset: %d, size: %d)",
+		pe.Extent, pe.Segment, pe.Offset, pe.Size)
+}
+
 type ExtentReader struct {
 	log          logger.Logger
 	openSegments *lru.Cache[SegmentId, SegmentReader]
 	sa           SegmentAccess
-	rangeCache   *RangeCache
+	rangeCache   ReadCache
+	metrics      *Metrics
 }
 
-func NewExtentReader(log logger.Logger, path string, sa SegmentAccess) (*ExtentReader, error) {
+// DefaultOpenSegments is how many segments are kept open for reading when
+// WithOpenSegments isn't used.
+const DefaultOpenSegments = 256
+
+// NewExtentReader returns an ExtentReader that caches the segment data it
+// reads in the file at +path+. If +path+ is empty, nothing is cached.
+func NewExtentReader(log logger.Logger, path string, sa SegmentAccess, m *Metrics) (*ExtentReader, error) {
 	openSegments, err := lru.NewWithEvict[SegmentId, SegmentReader](
-		256, func(key SegmentId, value SegmentReader) {
-			openSegments.Dec()
+		DefaultOpenSegments, func(key SegmentId, value SegmentReader) {
+			m.openSegments.Dec()
 			value.Close()
 		})
 	if err != nil {
@@ -32,6 +83,12 @@ func NewExtentReader(log logger.Logger, path string, sa SegmentAccess) (*ExtentR
 		log:          log,
 		openSegments: openSegments,
 		sa:           sa,
+		metrics:      m,
+	}
+
+	if path == "" {
+		er.rangeCache = &noReadCache{fetch: er.fetchData, metrics: m}
+		return er, nil
 	}
 
 	rc, err := NewRangeCache(RangeCacheOptions{
@@ -39,6 +96,8 @@ func NewExtentReader(log logger.Logger, path string, sa SegmentAccess) (*ExtentR
 		ChunkSize: 1024 * 1024,
 		MaxSize:   1024 * 1024 * 1024,
 		Fetch:     er.fetchData,
+		Metrics:   m,
+		Log:       log,
 	})
 	if err != nil {
 		return nil, err
@@ -49,6 +108,12 @@ func NewExtentReader(log logger.Logger, path string, sa SegmentAccess) (*ExtentR
 	return er, nil
 }
 
+// SetOpenSegments changes how many segments are kept open for reading,
+// closing the least recently used ones beyond +n+.
+func (d *ExtentReader) SetOpenSegments(n int) {
+	d.openSegments.Resize(n)
+}
+
 func (d *ExtentReader) Close() error {
 	d.rangeCache.Close()
 	d.openSegments.Purge()
@@ -57,29 +122,112 @@ func (d *ExtentReader) Close() error {
 }
 
 func (d *ExtentReader) fetchData(ctx context.Context, seg SegmentId, data []byte, off int64) error {
-	ci, ok := d.openSegments.Get(seg)
-	if !ok {
-		lf, err := d.sa.OpenSegment(ctx, seg)
-		if err != nil {
-			return err
-		}
+	// We don't check the size because the last chunk might not be a full chunk,
+	// which is also why io.EOF is ok here.
+	_, err := d.readSegment(ctx, seg, data, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
 
-		ci = lf
+	return nil
+}
 
-		d.openSegments.Add(seg, ci)
-		openSegments.Inc()
+// readSegment reads +data+ from +seg+ at +off+, returning how much was read.
+func (d *ExtentReader) readSegment(ctx context.Context, seg SegmentId, data []byte, off int64) (int, error) {
+	ci, err := d.openSegment(ctx, seg)
+	if err != nil {
+		return 0, err
 	}
 
 	d.log.Trace("reading data from segment in storage", "segment", seg, "offset", off)
 
-	_, err := ci.ReadAt(data, off)
+	var n int
+
+	if cr, ok := ci.(ContextSegmentReader); ok {
+		n, err = cr.ReadAtContext(ctx, data, off)
+	} else {
+		n, err = ci.ReadAt(data, off)
+	}
+
+	addColdBytes(ctx, n)
+
+	return n, err
+}
+
+// openSegment returns the reader for +seg+, opening it if it isn't open yet.
+func (d *ExtentReader) openSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	ci, ok := d.openSegments.Get(seg)
+	if ok {
+		return ci, nil
+	}
+
+	lf, err := d.sa.OpenSegment(ctx, seg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// We don't check the size because the last chunk might not be a full chunk.
+	// Another read may have opened it meanwhile, in which case we use theirs.
+	if found, _ := d.openSegments.ContainsOrAdd(seg, lf); found {
+		if ci, ok := d.openSegments.Get(seg); ok {
+			lf.Close()
+			return ci, nil
+		}
 
-	return nil
+		d.openSegments.Add(seg, lf)
+	}
+
+	d.metrics.openSegments.Inc()
+
+	return lf, nil
+}
+
+// forgetSegment closes the reader of +seg+ if it's open, so that the next
+// read reopens it and sees data that was rewritten since.
+func (d *ExtentReader) forgetSegment(seg SegmentId) {
+	d.openSegments.Remove(seg)
+}
+
+// How many segments prefetchSegments opens at once.
+const maxPrefetchOpens = 8
+
+// prefetchSegments opens those of +segs+ that aren't open yet concurrently,
+// so that a read touching several of them doesn't wait on each open in turn.
+// Errors are left for the reads that follow to report.
+func (d *ExtentReader) prefetchSegments(ctx context.Context, segs []SegmentId) {
+	var missing []SegmentId
+
+	for _, seg := range segs {
+		if !d.openSegments.Contains(seg) {
+			missing = append(missing, seg)
+		}
+	}
+
+	// A single segment is opened just as quickly by the read itself.
+	if len(missing) < 2 {
+		return
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, maxPrefetchOpens)
+	)
+
+	for _, seg := range missing {
+		sem <- struct{}{}
+
+		wg.Add(1)
+		go func(seg SegmentId) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			_, err := d.openSegment(ctx, seg)
+			if err != nil {
+				d.log.Debug("error prefetching segment", "segment", seg, "error", err)
+			}
+		}(seg)
+	}
+
+	wg.Wait()
 }
 
 func FillFromeCache(d []byte, cps []CachePosition) error {
@@ -107,14 +255,14 @@ func (d *ExtentReader) fetchUncompressedExtent(
 
 	cp, err := d.rangeCache.CachePositions(ctx, addr.Segment, int64(addr.Size), int64(addr.Offset), cps)
 	if err != nil {
-		return RangeData{}, nil, err
+		return RangeData{}, nil, extentError(err, pe)
 	}
 
-	if log.IsTrace() {
+	if log.IsTrace() && len(cp) > 0 {
 		log.Trace("reading uncompressed extent", "offset", addr.Offset, "size", addr.Size, "cache-offset", cp[0].off)
 	}
 
-	readProcessing.Add(time.Since(startFetch).Seconds())
+	d.metrics.readProcessing.Add(time.Since(startFetch).Seconds())
 	return RangeData{}, cp, nil
 }
 
@@ -124,122 +272,194 @@ func (d *ExtentReader) fetchExtent(
 	pe *PartialExtent,
 	cps []CachePosition,
 ) (RangeData, []CachePosition, error) {
-	if cap(cps) > 0 && pe.Flags() == Uncompressed {
-		return d.fetchUncompressedExtent(ctx, log, pe, cps)
-	}
-
-	startFetch := time.Now()
+	if cap(cps) > 0 && pe.Flags() == FlagUncompressed {
+		src, cps, err := d.fetchUncompressedExtent(ctx, log, pe, cps)
+		if err != nil || len(cps) > 0 {
+			return src, cps, err
+		}
 
-	addr := pe.ExtentLocation
+		// The cache doesn't keep the data in a file, so read it below.
+	}
 
-	rawData := ctx.Allocate(int(addr.Size))
+	return d.fetchExtentData(ctx, log, pe, false)
+}
 
-	n, err := d.rangeCache.ReadAt(ctx, addr.Segment, rawData, int64(addr.Offset))
-	if err != nil {
-		return RangeData{}, nil, err
+func (d *ExtentReader) fetchExtentUncached(
+	ctx *Context,
+	log logger.Logger,
+	pe *PartialExtent,
+	cps []CachePosition,
+) (RangeData, []CachePosition, error) {
+	if cap(cps) > 0 && pe.Flags() == FlagUncompressed {
+		src, cps, err := d.fetchUncompressedExtent(ctx, log, pe, cps)
+		if err != nil || len(cps) > 0 {
+			return src, cps, err
+		}
 	}
 
-	if n != len(rawData) {
-		log.Error("didn't read full data", "read", n, "expected", len(rawData), "size", addr.Size)
-		return RangeData{}, nil, fmt.Errorf("short read detected")
-	}
+	return d.fetchExtentData(ctx, log, pe, true)
+}
+
+// fetchExtentData reads the data of +pe+ into a buffer of its own,
+// uncompressing it if needed. If +uncached+ is set, it's read directly from
+// the segment rather than via the read cache.
+func (d *ExtentReader) fetchExtentData(
+	ctx *Context,
+	log logger.Logger,
+	pe *PartialExtent,
+	uncached bool,
+) (RangeData, []CachePosition, error) {
+	startFetch := time.Now()
 
 	var rangeData []byte
 
 	switch pe.Flags() {
-	case Uncompressed:
-		rangeData = rawData
-	case Compressed:
-		startDecomp := time.Now()
-		sz := pe.RawSize
+	case FlagUncompressed:
+		rangeData = ctx.Allocate(int(pe.Size))
 
-		uncomp := ctx.Allocate(int(sz))
-
-		n, err := lz4.UncompressBlock(rawData, uncomp)
+		err := d.readRaw(ctx, log, pe, rangeData, uncached)
 		if err != nil {
-			d.log.Error("error uncompressing block, retrying", "error", err, "comp-hash", rangeSum(rawData))
-			rn, err := d.rangeCache.ReadAt(ctx, addr.Segment, rawData, int64(addr.Offset))
-			if err != nil {
-				return RangeData{}, nil, err
-			}
-
-			if rn != len(rawData) {
-				log.Error("didn't read full data during retry", "read", n, "expected", len(rawData), "size", addr.Size)
-				return RangeData{}, nil, fmt.Errorf("short read detected")
-			}
-
-			n, err = lz4.UncompressBlock(rawData, uncomp)
-			if err != nil {
-				return RangeData{}, nil, errors.Wrapf(err, "error uncompressing data (rawsize: %d, compdata: %d)", len(rawData), len(uncomp))
-			}
-
-			log.Warn("retried reading compressed data and worked", "comp-hash", rangeSum(rawData))
+			return RangeData{}, nil, err
 		}
-
-		if n != int(sz) {
-			return RangeData{}, nil, fmt.Errorf("failed to uncompress correctly, %d != %d", n, sz)
+	case FlagLZ4:
+		err := checkRawSize(pe)
+		if err != nil {
+			return RangeData{}, nil, err
 		}
 
-		rangeData = uncomp
-		compressionOverhead.Add(time.Since(startDecomp).Seconds())
+		rangeData = ctx.Allocate(int(pe.RawSize))
+
+		err = d.readCompressedInto(ctx, log, pe, rangeData, uncached)
+		if err != nil {
+			return RangeData{}, nil, err
+		}
 	default:
-		return RangeData{}, nil, fmt.Errorf("unknown flags value: %d", pe.Flags())
+		return RangeData{}, nil, unknownFlagError(pe)
 	}
 
 	src := MapRangeData(pe.Extent, rangeData)
 
-	readProcessing.Add(time.Since(startFetch).Seconds())
+	d.metrics.readProcessing.Add(time.Since(startFetch).Seconds())
 	return src, nil, nil
 }
 
-func (d *ExtentReader) fetchExtentUncached(
+// readRaw reads the data of +pe+ as it's stored in the segment into
+// +rawData+, which must be pe.Size bytes.
+func (d *ExtentReader) readRaw(
 	ctx *Context,
 	log logger.Logger,
 	pe *PartialExtent,
-	cps []CachePosition,
-) (RangeData, []CachePosition, error) {
-	if cap(cps) > 0 && pe.Flags() == Uncompressed {
-		return d.fetchUncompressedExtent(ctx, log, pe, cps)
+	rawData []byte,
+	uncached bool,
+) error {
+	return d.readRawRange(ctx, log, pe, 0, rawData, uncached)
+}
+
+// readRawRange reads the bytes of +pe+ as it's stored in the segment from
+// +off+ into +rawData+.
+func (d *ExtentReader) readRawRange(
+	ctx *Context,
+	log logger.Logger,
+	pe *PartialExtent,
+	off int64,
+	rawData []byte,
+	uncached bool,
+) error {
+	addr := pe.ExtentLocation
+
+	if off < 0 || off+int64(len(rawData)) > int64(addr.Size) {
+		return extentError(errors.Wrapf(ErrClamp, "bytes %d to %d of %d", off, off+int64(len(rawData)), addr.Size), pe)
 	}
 
-	startFetch := time.Now()
+	var (
+		n   int
+		err error
+	)
 
-	addr := pe.ExtentLocation
+	d.metrics.readExtentBytes.Add(float64(len(rawData)))
 
-	rawData := ctx.Allocate(int(addr.Size))
+	if uncached {
+		// Unlike the chunks read by the cache, the extent is read exactly, so
+		// reaching the end of the segment means it's missing data.
+		n, err = d.readSegment(ctx, addr.Segment, rawData, int64(addr.Offset)+off)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	} else {
+		n, err = d.rangeCache.ReadAt(ctx, addr.Segment, rawData, int64(addr.Offset)+off)
+	}
 
-	err := d.fetchData(ctx, addr.Segment, rawData, int64(addr.Offset))
 	if err != nil {
-		return RangeData{}, nil, err
+		return extentError(err, pe)
 	}
 
-	var rangeData []byte
+	if n != len(rawData) {
+		log.Error("didn't read full data", "read", n, "expected", len(rawData), "size", addr.Size)
+		return extentError(errors.Wrapf(ErrShortRead, "read %d of %d bytes", n, len(rawData)), pe)
+	}
 
-	switch pe.Flags() {
-	case Uncompressed:
-		rangeData = rawData
-	case Compressed:
-		startDecomp := time.Now()
-		sz := pe.RawSize
+	return nil
+}
 
-		uncomp := ctx.Allocate(int(sz))
+// checkRawSize returns an error if the uncompressed size of the compressed
+// +pe+ isn't the size of the blocks it covers, which compressed extents of
+// any number of blocks must be.
+func checkRawSize(pe *PartialExtent) error {
+	if int(pe.RawSize) != pe.Extent.ByteSize() {
+		return extentError(errors.Wrapf(ErrDecompress, "uncompressed size is %d, extent %s is %d", pe.RawSize, pe.Extent, pe.Extent.ByteSize()), pe)
+	}
 
-		n, err := lz4.UncompressBlock(rawData, uncomp)
+	return nil
+}
+
+// readCompressedInto reads the compressed data of +pe+ and uncompresses it
+// straight into +dst+, which must be pe.RawSize bytes. The read cache keeps
+// the compressed form, as it does for every read.
+func (d *ExtentReader) readCompressedInto(
+	ctx *Context,
+	log logger.Logger,
+	pe *PartialExtent,
+	dst []byte,
+	uncached bool,
+) error {
+	if len(dst) != int(pe.RawSize) {
+		return extentError(errors.Wrapf(ErrBufferSize, "uncompressed size is %d, buffer is %d", pe.RawSize, len(dst)), pe)
+	}
+
+	rawData := ctx.Allocate(int(pe.Size))
+
+	err := d.readRaw(ctx, log, pe, rawData, uncached)
+	if err != nil {
+		return err
+	}
+
+	startDecomp := time.Now()
+
+	n, err := lz4.UncompressBlock(rawData, dst)
+	if err != nil && !uncached {
+		d.log.Error("error uncompressing block, retrying", "error", err, "comp-hash", rangeSum(rawData))
+
+		err = d.readRaw(ctx, log, pe, rawData, uncached)
 		if err != nil {
-			return RangeData{}, nil, errors.Wrapf(err, "error uncompressing data (rawsize: %d, compdata: %d)", len(rawData), len(uncomp))
+			return err
 		}
 
-		if n != int(sz) {
-			return RangeData{}, nil, fmt.Errorf("failed to uncompress correctly, %d != %d", n, sz)
+		n, err = lz4.UncompressBlock(rawData, dst)
+		if err == nil {
+			log.Warn("retried reading compressed data and worked", "comp-hash", rangeSum(rawData))
 		}
+	}
 
-		rangeData = uncomp
-		compressionOverhead.Add(time.Since(startDecomp).Seconds())
-		return RangeData{}, nil, fmt.Errorf("unknown flags value: %d", pe.Flags())
+	if err != nil {
+		return extentError(errors.Wrapf(ErrDecompress, "%s (rawsize: %d, compdata: %d)", err, len(rawData), len(dst)), pe)
 	}
 
-	src := MapRangeData(pe.Extent, rangeData)
+	if n != len(dst) {
+		return extentError(errors.Wrapf(ErrDecompress, "failed to uncompress correctly, %d != %d", n, len(dst)), pe)
+	}
 
-	readProcessing.Add(time.Since(startFetch).Seconds())
-	return src, nil, nil
+	d.metrics.compressionOverhead.Add(time.Since(startDecomp).Seconds())
+	observeCodec(d.metrics.decompressBlockTime, startDecomp, n)
+
+	return nil
 }
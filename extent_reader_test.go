@@ -0,0 +1,523 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtentReaderErrors(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	// setup flushes +data+ to a segment of its own and returns where it's
+	// stored.
+	setup := func(t *testing.T, data RawBlocks, options ...Option) (*Disk, PartialExtent, string) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		d, err := NewDisk(ctx, log, tmpdir, options...)
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		r.NoError(d.WriteExtent(ctx, data.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.resolveSegmentAccess(Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		r.Len(pes, 1)
+
+		path := filepath.Join(tmpdir, "segments", "segment."+pes[0].Segment.String())
+
+		return d, pes[0], path
+	}
+
+	requireLocation := func(t *testing.T, err error, pe PartialExtent) {
+		require.Contains(t, err.Error(), pe.Segment.String())
+		require.Contains(t, err.Error(), fmt.Sprintf("offset: %d", pe.Offset))
+		require.Contains(t, err.Error(), fmt.Sprintf("size: %d", pe.Size))
+	}
+
+	t.Run("reports reads cut short by the end of the segment", func(t *testing.T) {
+		r := require.New(t)
+
+		d, pe, path := setup(t, testRandX)
+
+		r.NoError(os.Truncate(path, int64(pe.Offset+pe.Size)-100))
+
+		_, err := d.ReadExtentWithOptions(ctx, Extent{LBA: 0, Blocks: 1}, ReadOptions{BypassCache: true})
+		r.ErrorIs(err, ErrShortRead)
+		requireLocation(t, err, pe)
+	})
+
+	t.Run("reports data that can't be uncompressed", func(t *testing.T) {
+		r := require.New(t)
+
+		d, pe, path := setup(t, testExtent)
+		r.NotZero(pe.RawSize)
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+		r.NoError(err)
+
+		_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, int(pe.Size)), int64(pe.Offset))
+		r.NoError(err)
+		r.NoError(f.Close())
+
+		// Checking the flush already put the data in the read cache.
+		_, err = d.ReadExtentWithOptions(ctx, Extent{LBA: 0, Blocks: 1}, ReadOptions{BypassCache: true})
+		r.ErrorIs(err, ErrDecompress)
+		requireLocation(t, err, pe)
+	})
+
+	t.Run("reports requests outside of the extent", func(t *testing.T) {
+		r := require.New(t)
+
+		d, pe, _ := setup(t, testRandX)
+
+		req := Extent{LBA: 10, Blocks: 1}
+
+		err := d.readPartialExtent(ctx, &pe, []Extent{req}, req, NewRangeData(ctx, req), false)
+		r.ErrorIs(err, ErrClamp)
+		requireLocation(t, err, pe)
+		r.Contains(err.Error(), req.String())
+	})
+
+	// An empty extent is never read from its segment, so one stands in for
+	// flags that we don't know how to read.
+	unknownFlags := func(pe PartialExtent) PartialExtent {
+		pe.Size = 0
+		return pe
+	}
+
+	t.Run("reports extents with unknown flags", func(t *testing.T) {
+		r := require.New(t)
+
+		d, pe, _ := setup(t, testRandX)
+
+		pe = unknownFlags(pe)
+
+		dest := NewRangeData(ctx, pe.Live)
+
+		err := d.readPartialExtent(ctx, &pe, []Extent{pe.Live}, pe.Live, dest, false)
+		r.ErrorIs(err, ErrUnknownExtentFlag)
+
+		var ferr *UnknownExtentFlagError
+		r.ErrorAs(err, &ferr)
+		r.Equal(pe.Segment, ferr.Segment)
+		r.Equal(FlagEmpty, ferr.Flags)
+	})
+
+	t.Run("reads extents with unknown flags as zeros if asked to", func(t *testing.T) {
+		r := require.New(t)
+
+		m := NewMetrics(nil)
+
+		d, pe, _ := setup(t, testRandX, UnknownFlagsAsHoles(), WithMetrics(m))
+
+		pe = unknownFlags(pe)
+
+		dest := NewRangeData(ctx, pe.Live)
+		copy(dest.WriteData(), testRand)
+
+		r.NoError(d.readPartialExtent(ctx, &pe, []Extent{pe.Live}, pe.Live, dest, false))
+		r.True(isEmpty(dest.ReadData()))
+
+		r.Equal(int64(1), counterValue(m.unknownFlagHoles))
+	})
+}
+
+// slowOpenAccess is a memAccess whose segments take a while to open, keeping
+// track of how many were being opened at once.
+type slowOpenAccess struct {
+	*memAccess
+
+	mu          sync.Mutex
+	opening     int
+	maxOpening  int
+	openedCount int
+}
+
+func (s *slowOpenAccess) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	s.mu.Lock()
+	s.opening++
+	s.openedCount++
+	s.maxOpening = max(s.maxOpening, s.opening)
+	s.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	s.mu.Lock()
+	s.opening--
+	s.mu.Unlock()
+
+	return s.memAccess.OpenSegment(ctx, seg)
+}
+
+func (s *slowOpenAccess) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxOpening = 0
+	s.openedCount = 0
+}
+
+func TestExtentReaderPrefetch(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	t.Run("opens the segments of a read in parallel", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &slowOpenAccess{memAccess: newMemAccess()}
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
+		r.NoError(err)
+
+		for i := 0; i < 4; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		r.NoError(d.Close(ctx))
+
+		// A fresh disk has none of the segments open.
+		tmpdir2, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir2)
+
+		d, err = NewDisk(ctx, log, tmpdir2, WithSegmentAccess(sa))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		sa.reset()
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 4})
+		r.NoError(err)
+
+		for i := 0; i < 4; i++ {
+			r.Equal(testRand, data.ReadData()[i*BlockSize:(i+1)*BlockSize])
+		}
+
+		sa.mu.Lock()
+		defer sa.mu.Unlock()
+
+		r.Equal(4, sa.openedCount)
+		r.Equal(4, sa.maxOpening)
+	})
+
+	t.Run("keeps as many segments open as configured", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithOpenSegments(2))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		for i := 0; i < 4; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		data, err := d.ReadExtentWithOptions(ctx, Extent{LBA: 0, Blocks: 4}, ReadOptions{BypassCache: true})
+		r.NoError(err)
+
+		for i := 0; i < 4; i++ {
+			r.Equal(testRand, data.ReadData()[i*BlockSize:(i+1)*BlockSize])
+		}
+
+		r.Equal(2, d.er.openSegments.Len())
+	})
+}
+
+func TestCompressedReads(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	multi := make([]byte, 4*BlockSize)
+	for i := range multi {
+		multi[i] = byte(i / 512)
+	}
+
+	setup := func(t *testing.T) *Disk {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, BlockDataView(multi).MapTo(10)))
+		r.NoError(d.CloseSegment(ctx))
+
+		return d
+	}
+
+	for _, tc := range []struct {
+		name string
+		rng  Extent
+		data []byte
+	}{
+		{"single block", Extent{LBA: 0, Blocks: 1}, testData},
+		{"multiple blocks", Extent{LBA: 10, Blocks: 4}, multi},
+	} {
+		tc := tc
+
+		t.Run("reads a compressed extent of "+tc.name, func(t *testing.T) {
+			r := require.New(t)
+
+			d := setup(t)
+
+			pes, err := d.resolveSegmentAccess(tc.rng)
+			r.NoError(err)
+			r.Len(pes, 1)
+			r.True(pes[0].Flags() == FlagLZ4)
+
+			for _, opts := range []ReadOptions{{}, {BypassCache: true}} {
+				data, err := d.ReadExtentWithOptions(ctx, tc.rng, opts)
+				r.NoError(err)
+				r.Equal(tc.data, data.ReadData())
+			}
+		})
+	}
+
+	t.Run("reads part of a multiple block compressed extent", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		for _, rng := range []Extent{{LBA: 11, Blocks: 2}, {LBA: 13, Blocks: 1}, {LBA: 9, Blocks: 3}} {
+			for _, opts := range []ReadOptions{{}, {BypassCache: true}} {
+				data, err := d.ReadExtentWithOptions(ctx, rng, opts)
+				r.NoError(err)
+
+				for lba := rng.LBA; lba < rng.LBA+LBA(rng.Blocks); lba++ {
+					sub, ok := data.SubRange(Extent{LBA: lba, Blocks: 1})
+					r.True(ok)
+
+					switch {
+					case lba >= 10 && lba < 14:
+						off := int(lba-10) * BlockSize
+						r.Equal(multi[off:off+BlockSize], sub.ReadData())
+					default:
+						r.True(isEmpty(sub.ReadData()))
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("rejects an uncompressed size that isn't the extent's", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		pes, err := d.resolveSegmentAccess(Extent{LBA: 10, Blocks: 4})
+		r.NoError(err)
+		r.Len(pes, 1)
+
+		for _, size := range []uint32{BlockSize, 4*BlockSize + 100} {
+			pe := pes[0]
+			pe.RawSize = size
+
+			_, _, err = d.er.fetchExtentData(NewContext(gctx), log, &pe, true)
+			r.ErrorIs(err, ErrDecompress)
+		}
+	})
+
+	t.Run("uncompresses a single block straight into the destination", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		for _, tc := range []struct {
+			rng    Extent
+			staged func(pe PartialExtent) int
+		}{
+			// Only the compressed bytes need a buffer.
+			{Extent{LBA: 0, Blocks: 1}, func(pe PartialExtent) int { return int(pe.Size) }},
+			// Larger extents are uncompressed into a buffer and copied.
+			{Extent{LBA: 10, Blocks: 4}, func(pe PartialExtent) int { return int(pe.Size + pe.RawSize) }},
+		} {
+			pes, err := d.resolveSegmentAccess(tc.rng)
+			r.NoError(err)
+			r.Len(pes, 1)
+
+			pe := pes[0]
+
+			rctx := NewContext(gctx)
+			dest := MapRangeData(tc.rng, make([]byte, tc.rng.ByteSize()))
+
+			r.NoError(d.readPartialExtent(rctx, &pe, []Extent{tc.rng}, tc.rng, dest, false))
+			r.Equal(tc.staged(pe), rctx.Marker())
+
+			data, err := d.ReadExtent(ctx, tc.rng)
+			r.NoError(err)
+			r.Equal(data.ReadData(), dest.ReadData())
+		}
+	})
+
+	t.Run("keeps the compressed form in the read cache", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		rng := Extent{LBA: 0, Blocks: 1}
+
+		pes, err := d.resolveSegmentAccess(rng)
+		r.NoError(err)
+
+		pe := pes[0]
+
+		_, err = d.ReadExtent(ctx, rng)
+		r.NoError(err)
+
+		raw := make([]byte, pe.Size)
+		_, err = d.er.rangeCache.ReadAt(ctx, pe.Segment, raw, int64(pe.Offset))
+		r.NoError(err)
+
+		rctx := NewContext(gctx)
+		direct := rctx.Allocate(int(pe.Size))
+		r.NoError(d.er.readRaw(rctx, log, &pe, direct, true))
+
+		r.Equal(direct, raw)
+	})
+}
+
+func TestRangedReads(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	const extentBlocks = 64
+
+	large := make([]byte, extentBlocks*BlockSize)
+	_, err := io.ReadFull(rand.Reader, large)
+	require.NoError(t, err)
+
+	// setup writes +large+ as a single uncompressed extent at LBA 0.
+	setup := func(t *testing.T, options ...Option) (*Disk, *Metrics) {
+		r := require.New(t)
+
+		m := NewMetrics(nil)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		d, err := NewDisk(ctx, log, tmpdir, append(options, WithMetrics(m))...)
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		r.NoError(d.WriteExtent(ctx, BlockDataView(large).MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.resolveSegmentAccess(Extent{LBA: 0, Blocks: extentBlocks})
+		r.NoError(err)
+		r.Len(pes, 1)
+		r.Equal(FlagUncompressed, pes[0].Flags())
+		r.Equal(uint32(extentBlocks), pes[0].Extent.Blocks)
+
+		return d, m
+	}
+
+	blocks := func(rng Extent) []byte {
+		return large[int(rng.LBA)*BlockSize : int(rng.LBA+LBA(rng.Blocks))*BlockSize]
+	}
+
+	t.Run("reads only the wanted blocks of an uncompressed extent", func(t *testing.T) {
+		rng := Extent{LBA: 10, Blocks: 2}
+
+		for _, tc := range []struct {
+			name    string
+			options []Option
+			read    int
+		}{
+			{"whole extent", nil, extentBlocks * BlockSize},
+			{"ranged", []Option{RangedReads()}, rng.ByteSize()},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				r := require.New(t)
+
+				d, m := setup(t, tc.options...)
+
+				data, err := d.ReadExtentWithOptions(ctx, rng, ReadOptions{BypassCache: true})
+				r.NoError(err)
+				r.Equal(blocks(rng), data.ReadData())
+
+				r.Equal(int64(tc.read), counterValue(m.readExtentBytes))
+			})
+		}
+	})
+
+	t.Run("reads sub-ranges around newer data", func(t *testing.T) {
+		r := require.New(t)
+
+		d, m := setup(t, RangedReads())
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(11)))
+		r.NoError(d.CloseSegment(ctx))
+
+		expected := append([]byte(nil), blocks(Extent{LBA: 8, Blocks: 8})...)
+		copy(expected[3*BlockSize:], testRand)
+
+		for _, opts := range []ReadOptions{{BypassCache: true}, {}} {
+			data, err := d.ReadExtentWithOptions(ctx, Extent{LBA: 8, Blocks: 8}, opts)
+			r.NoError(err)
+			r.Equal(expected, data.ReadData())
+		}
+
+		// Each read only read the blocks it wanted.
+		r.Equal(int64(2*8*BlockSize), counterValue(m.readExtentBytes))
+	})
+
+	t.Run("reads the last blocks of an extent", func(t *testing.T) {
+		r := require.New(t)
+
+		d, _ := setup(t, RangedReads())
+
+		rng := Extent{LBA: extentBlocks - 3, Blocks: 3}
+
+		data, err := d.ReadExtentWithOptions(ctx, rng, ReadOptions{BypassCache: true})
+		r.NoError(err)
+		r.Equal(blocks(rng), data.ReadData())
+	})
+}
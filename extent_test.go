@@ -133,6 +133,44 @@ func TestExtent(t *testing.T) {
 		r.False(ok)
 	})
 
+	t.Run("coalesce", func(t *testing.T) {
+		r := require.New(t)
+
+		r.Nil(CoalesceExtents(nil))
+
+		r.Equal(
+			[]Extent{e(0, 10), e(20, 2)},
+			CoalesceExtents([]Extent{e(20, 2), e(5, 2), e(0, 5), e(7, 3)}),
+		)
+
+		r.Equal(
+			[]Extent{e(0, 8), e(9, 1)},
+			CoalesceExtents([]Extent{e(0, 4), e(2, 6), e(1, 1), e(9, 1)}),
+		)
+	})
+
+	t.Run("union", func(t *testing.T) {
+		r := require.New(t)
+
+		u, ok := e(0, 5).Union(e(5, 5))
+		r.True(ok)
+		r.Equal(e(0, 10), u)
+
+		u, ok = e(5, 5).Union(e(0, 7))
+		r.True(ok)
+		r.Equal(e(0, 10), u)
+
+		u, ok = e(0, 10).Union(e(2, 2))
+		r.True(ok)
+		r.Equal(e(0, 10), u)
+
+		_, ok = e(0, 5).Union(e(6, 5))
+		r.False(ok)
+
+		_, ok = e(6, 5).Union(e(0, 5))
+		r.False(ok)
+	})
+
 	t.Run("mask", func(t *testing.T) {
 		r := require.New(t)
 
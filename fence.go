@@ -0,0 +1,78 @@
+package lsvd
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrFenced is returned when flushing a segment to a volume that a newer
+// writer has attached to since we did. Our writes are no longer the volume's
+// and are dropped rather than published over the new writer's.
+var ErrFenced = errors.New("volume was attached by a newer writer")
+
+// VolumeInfoUpdater is implemented by a SegmentAccess that can replace the
+// info of an existing volume, which is needed to track volume generations.
+// Without it, writers aren't fenced.
+type VolumeInfoUpdater interface {
+	UpdateVolumeInfo(ctx context.Context, vol *VolumeInfo) error
+}
+
+// nextGeneration increments the generation of +vi+ and stores it, fencing
+// any writer attached with an older generation. It returns the new
+// generation, or 0 if +sa+ can't store it.
+func nextGeneration(ctx context.Context, sa SegmentAccess, vi *VolumeInfo) (uint64, error) {
+	vu, ok := sa.(VolumeInfoUpdater)
+	if !ok {
+		return 0, nil
+	}
+
+	next := *vi
+	next.Generation++
+
+	err := vu.UpdateVolumeInfo(ctx, &next)
+	if err != nil {
+		return 0, errors.Wrapf(err, "updating generation of volume %s", vi.Name)
+	}
+
+	*vi = next
+
+	return vi.Generation, nil
+}
+
+// checkGeneration returns ErrFenced if +vol+ was attached with a newer
+// generation than +gen+. A generation of 0 is never fenced.
+func checkGeneration(ctx context.Context, sa SegmentAccess, vol string, gen uint64) error {
+	if gen == 0 {
+		return nil
+	}
+
+	vi, err := sa.GetVolumeInfo(ctx, vol)
+	if err != nil {
+		return errors.Wrapf(err, "checking generation of volume %s", vol)
+	}
+
+	if vi.Generation > gen {
+		return errors.Wrapf(ErrFenced, "volume %s is at generation %d, ours is %d", vol, vi.Generation, gen)
+	}
+
+	return nil
+}
+
+// fencedSegment reports if +meta+ is from an older generation than the
+// newest seen so far in +latest+, meaning that it was flushed late by a
+// writer that had already been fenced. Segments without a generation are
+// never considered fenced.
+func fencedSegment(meta SegmentMetadata, latest *uint64) bool {
+	if meta.Generation == 0 {
+		return false
+	}
+
+	if meta.Generation < *latest {
+		return true
+	}
+
+	*latest = meta.Generation
+
+	return false
+}
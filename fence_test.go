@@ -0,0 +1,228 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFencing(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	tempDir := func(t *testing.T) string {
+		dir, err := os.MkdirTemp("", "lsvd")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+
+	setGeneration := func(t *testing.T, sa *LocalFileAccess, gen uint64) {
+		vi, err := sa.GetVolumeInfo(ctx, "default")
+		require.NoError(t, err)
+
+		vi.Generation = gen
+		require.NoError(t, sa.UpdateVolumeInfo(ctx, vi))
+	}
+
+	t.Run("attaching increments the generation", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		r.Equal(uint64(1), d.generation)
+		r.NoError(d.Close(ctx))
+
+		d, err = NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		r.Equal(uint64(2), d.generation)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		segs, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Len(segs, 1)
+
+		r.Equal(uint64(2), d.s.segments[segs[0]].Generation)
+
+		r.NoError(d.Close(ctx))
+
+		// Read-only disks don't fence the writer.
+		ro, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa), ReadOnly())
+		r.NoError(err)
+		defer ro.Close(ctx)
+
+		vi, err := sa.GetVolumeInfo(ctx, "default")
+		r.NoError(err)
+		r.Equal(uint64(2), vi.Generation)
+	})
+
+	t.Run("rejects flushes from a writer that was fenced", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		flushErr := make(chan error, 1)
+
+		old, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa),
+			WithFlushErrorHandler(func(_ SegmentId, err error) { flushErr <- err }))
+		r.NoError(err)
+		defer old.Close(ctx)
+
+		r.NoError(old.WriteExtent(ctx, testExtent.MapTo(0)))
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.ErrorIs(old.CloseSegment(ctx), ErrFenced)
+		r.ErrorIs(<-flushErr, ErrFenced)
+
+		r.ErrorIs(old.WriteExtent(ctx, testExtent.MapTo(0)), ErrFenced)
+		r.ErrorIs(old.ZeroBlocks(ctx, Extent{LBA: 0, Blocks: 1}), ErrFenced)
+		r.ErrorIs(old.Trim(ctx, Extent{LBA: 0, Blocks: 1}), ErrFenced)
+		r.True(old.curOC.EmptyP())
+
+		segs, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Empty(segs)
+
+		// The newer writer is unaffected.
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testExtent2, data)
+	})
+
+	t.Run("fails a transaction from a writer that was fenced", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		old, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer old.Close(ctx)
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		write := func(tx *WriteTx) error {
+			return tx.WriteExtent(testExtent.MapTo(0))
+		}
+
+		// Only the flush finds out, after the segment was dropped.
+		r.ErrorIs(old.WriteTransaction(ctx, write), ErrFenced)
+
+		// After that, up front.
+		r.ErrorIs(old.WriteTransaction(ctx, write), ErrFenced)
+
+		segs, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Empty(segs)
+	})
+
+	t.Run("rejects a segment from a writer fenced during its upload", func(t *testing.T) {
+		r := require.New(t)
+
+		dir := tempDir(t)
+
+		slow := &slowLocal{}
+		slow.Dir = dir
+
+		old, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(slow))
+		r.NoError(err)
+		defer old.Close(ctx)
+
+		slow.wait = make(chan struct{})
+
+		r.NoError(old.WriteExtent(ctx, testExtent.MapTo(0)))
+
+		ch, err := old.closeSegmentAsync(ctx)
+		r.NoError(err)
+
+		r.Eventually(slow.waiting.Load, 5*time.Second, time.Millisecond)
+
+		// Attaches while the old writer's segment is being uploaded.
+		sa := &LocalFileAccess{Dir: dir}
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		close(slow.wait)
+
+		res := <-ch
+		r.ErrorIs(res.Error, ErrFenced)
+
+		segs, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Empty(segs)
+	})
+
+	t.Run("a late segment from a fenced writer is quarantined on rebuild", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		// Give the old writer ids that sort after the new writer's, as though
+		// its segment was flushed after the new writer's.
+		late := ulid.Timestamp(time.Now().Add(time.Hour))
+
+		old, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa),
+			WithSeqGen(func() ulid.ULID {
+				late++
+				return ulid.MustNew(late, ulid.DefaultEntropy())
+			}))
+		r.NoError(err)
+		defer old.Close(ctx)
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
+
+		// Simulate the old writer checking its generation just before the new
+		// writer attached.
+		setGeneration(t, sa, 1)
+
+		r.NoError(old.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(old.CloseSegment(ctx))
+
+		setGeneration(t, sa, 2)
+
+		segs, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Len(segs, 2)
+
+		for _, workers := range []int{1, rebuildWorkers} {
+			ro, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa), ReadOnly())
+			r.NoError(err)
+
+			ro.lba2pba = NewExtentMap()
+			ro.s = NewSegments()
+			r.NoError(ro.rebuildSegments(ctx, segs, workers))
+
+			data, err := ro.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+			extentEqual(t, testExtent2, data)
+
+			r.NotContains(ro.s.segments, segs[1])
+
+			r.NoError(ro.Close(ctx))
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package lsvd
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FsyncPolicy controls when files written to local disk are synced to
+// stable storage.
+type FsyncPolicy int
+
+const (
+	// FsyncOnClose syncs a file once it's written in full, along with the
+	// directory holding it so that creating or renaming it is durable too.
+	FsyncOnClose FsyncPolicy = iota
+
+	// FsyncNever leaves syncing to the OS. It's the fastest, but a crash can
+	// lose or truncate files that were reported as written.
+	FsyncNever
+
+	// FsyncOnInterval syncs the files and directories written to in the
+	// background, at most once per interval, bounding what a crash can lose
+	// without a sync per file.
+	FsyncOnInterval
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncOnClose:
+		return "on-close"
+	case FsyncNever:
+		return "never"
+	case FsyncOnInterval:
+		return "on-interval"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultFsyncInterval is how often FsyncOnInterval syncs when no interval
+// is given.
+const DefaultFsyncInterval = time.Second
+
+// fileSyncer syncs the files written to local disk as its policy requires.
+type fileSyncer struct {
+	policy   FsyncPolicy
+	interval time.Duration
+	clock    Clock
+
+	// Syncs an open file or directory, replaced in tests to count syncs.
+	sync func(f *os.File) error
+
+	mu        sync.Mutex
+	pending   map[string]struct{}
+	scheduled bool
+
+	// The error from the last background sync, returned by the next call.
+	err error
+}
+
+func newFileSyncer(policy FsyncPolicy, interval time.Duration, clock Clock) *fileSyncer {
+	if interval <= 0 {
+		interval = DefaultFsyncInterval
+	}
+
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	return &fileSyncer{
+		policy:   policy,
+		interval: interval,
+		clock:    clock,
+		sync:     (*os.File).Sync,
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// syncFile makes the data written to +f+ durable. +path+ is where the data
+// is found once any rename of +f+ is done.
+func (s *fileSyncer) syncFile(f *os.File, path string) error {
+	switch s.policy {
+	case FsyncNever:
+		return nil
+	case FsyncOnInterval:
+		return s.later(path)
+	}
+
+	return s.sync(f)
+}
+
+// syncDir makes the entries created, renamed or removed in +dir+ durable.
+func (s *fileSyncer) syncDir(dir string) error {
+	switch s.policy {
+	case FsyncNever:
+		return nil
+	case FsyncOnInterval:
+		return s.later(dir)
+	}
+
+	return s.open(dir)
+}
+
+func (s *fileSyncer) open(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return s.sync(f)
+}
+
+// later records +path+ to be synced by the next background sync, starting
+// one if none is due.
+func (s *fileSyncer) later(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending[path] = struct{}{}
+
+	if !s.scheduled {
+		s.schedule()
+	}
+
+	err := s.err
+	s.err = nil
+
+	return err
+}
+
+// syncPending syncs everything recorded by later. Paths that fail to sync
+// stay pending for the next background sync.
+func (s *fileSyncer) syncPending() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scheduled = false
+
+	for path := range s.pending {
+		err := s.open(path)
+
+		// Removed since, which leaves nothing to sync.
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.err = errors.Wrapf(err, "syncing %s", path)
+			continue
+		}
+
+		delete(s.pending, path)
+	}
+
+	if len(s.pending) > 0 {
+		s.schedule()
+	}
+}
+
+// schedule starts the next background sync. s.mu must be held.
+func (s *fileSyncer) schedule() {
+	s.scheduled = true
+
+	after := s.clock.After(s.interval)
+
+	go func() {
+		<-after
+		s.syncPending()
+	}()
+}
+
+// syncedFile is a file being written that is synced as the policy requires
+// when it's closed.
+type syncedFile struct {
+	*os.File
+	s *fileSyncer
+}
+
+func (f *syncedFile) Close() error {
+	err := f.s.syncFile(f.File, f.Name())
+	if err != nil {
+		f.File.Close()
+		return err
+	}
+
+	err = f.File.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.s.syncDir(filepath.Dir(f.Name()))
+}
@@ -0,0 +1,244 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// syncCounter wraps the syncs of a fileSyncer to count them by path.
+type syncCounter struct {
+	mu    sync.Mutex
+	paths map[string]int
+}
+
+func countSyncs(s *fileSyncer) *syncCounter {
+	c := &syncCounter{paths: make(map[string]int)}
+
+	sync := s.sync
+
+	s.sync = func(f *os.File) error {
+		c.mu.Lock()
+		c.paths[f.Name()]++
+		c.mu.Unlock()
+
+		return sync(f)
+	}
+
+	return c
+}
+
+func (c *syncCounter) count(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.paths[path]
+}
+
+func (c *syncCounter) total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+
+	for _, cnt := range c.paths {
+		n += cnt
+	}
+
+	return n
+}
+
+// countMatching returns the syncs of paths that contain +sub+.
+func (c *syncCounter) countMatching(sub string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+
+	for path, cnt := range c.paths {
+		if strings.Contains(path, sub) {
+			n += cnt
+		}
+	}
+
+	return n
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	tempDir := func(t *testing.T) string {
+		dir, err := os.MkdirTemp("", "lsvd")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+
+	// writeSegment writes a segment to +sa+ and adds it to volume "test".
+	writeSegment := func(t *testing.T, sa *LocalFileAccess) SegmentId {
+		r := require.New(t)
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		w, err := sa.WriteSegment(ctx, seg)
+		r.NoError(err)
+
+		_, err = w.Write([]byte("segment data"))
+		r.NoError(err)
+		r.NoError(w.Close())
+
+		r.NoError(sa.AppendToSegments(ctx, "test", seg))
+
+		return seg
+	}
+
+	setup := func(t *testing.T, sa *LocalFileAccess) {
+		r := require.New(t)
+		r.NoError(sa.InitContainer(ctx))
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "test"}))
+	}
+
+	segmentPath := func(sa *LocalFileAccess, seg SegmentId) string {
+		return filepath.Join(sa.Dir, "segments", "segment."+ulid.ULID(seg).String())
+	}
+
+	t.Run("syncs files and their directory on close by default", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+		setup(t, sa)
+
+		c := countSyncs(sa.fileSyncer())
+
+		seg := writeSegment(t, sa)
+
+		r.Equal(1, c.count(segmentPath(sa, seg)))
+		r.Equal(1, c.count(filepath.Join(sa.Dir, "segments")))
+
+		// The new list is synced before it's renamed into place, then the
+		// rename.
+		r.Equal(1, c.countMatching("segments.tmp"))
+		r.Equal(1, c.count(filepath.Join(sa.Dir, "volumes", "test")))
+
+		r.NoError(sa.UpdateVolumeInfo(ctx, &VolumeInfo{Name: "test", Size: 1}))
+		r.Equal(1, c.countMatching("info.json.tmp"))
+		r.Equal(2, c.count(filepath.Join(sa.Dir, "volumes", "test")))
+	})
+
+	t.Run("never syncs", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t), Fsync: FsyncNever}
+
+		c := countSyncs(sa.fileSyncer())
+
+		setup(t, sa)
+		writeSegment(t, sa)
+		r.NoError(sa.UpdateVolumeInfo(ctx, &VolumeInfo{Name: "test", Size: 1}))
+
+		r.Zero(c.total())
+	})
+
+	t.Run("syncs in the background on an interval", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{
+			Dir:           tempDir(t),
+			Fsync:         FsyncOnInterval,
+			FsyncInterval: time.Minute,
+		}
+
+		clk := newFakeClock(time.Now())
+
+		s := sa.fileSyncer()
+		s.clock = clk
+
+		c := countSyncs(s)
+
+		setup(t, sa)
+
+		seg := writeSegment(t, sa)
+		seg2 := writeSegment(t, sa)
+
+		r.Zero(c.total())
+
+		clk.Add(time.Minute)
+
+		// Each path is synced once however often it was written, the
+		// segment list under its final name.
+		r.Eventually(func() bool {
+			return c.count(segmentPath(sa, seg)) == 1 &&
+				c.count(segmentPath(sa, seg2)) == 1 &&
+				c.count(filepath.Join(sa.Dir, "volumes", "test", "segments")) == 1 &&
+				c.count(filepath.Join(sa.Dir, "volumes", "test")) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		r.Zero(c.countMatching(".tmp"))
+
+		r.NoError(sa.RemoveSegmentFromVolume(ctx, "test", seg))
+		r.NoError(sa.RemoveSegment(ctx, seg))
+
+		clk.Add(time.Minute)
+
+		r.Eventually(func() bool {
+			return c.count(filepath.Join(sa.Dir, "volumes", "test")) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		r.Equal(1, c.count(segmentPath(sa, seg)))
+	})
+
+	t.Run("syncs the write cache as configured", func(t *testing.T) {
+		r := require.New(t)
+
+		for _, policy := range []FsyncPolicy{FsyncOnClose, FsyncNever} {
+			t.Run(policy.String(), func(t *testing.T) {
+				d, err := NewDisk(ctx, log, tempDir(t), WithWriteCacheFsync(policy, 0))
+				r.NoError(err)
+				defer d.Close(ctx)
+
+				c := countSyncs(d.writeCacheSync)
+
+				r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+				r.Zero(c.total())
+
+				r.NoError(d.SyncWriteCache())
+
+				if policy == FsyncNever {
+					r.Zero(c.total())
+				} else {
+					r.Equal(1, c.countMatching("writecache."))
+				}
+			})
+		}
+
+		clk := newFakeClock(time.Now())
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithClock(clk),
+			WithWriteCacheFsync(FsyncOnInterval, time.Minute))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		c := countSyncs(d.writeCacheSync)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(1)))
+		r.NoError(d.SyncWriteCache())
+		r.Zero(c.total())
+
+		clk.Add(time.Minute)
+
+		r.Eventually(func() bool {
+			return c.countMatching("writecache.") == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -4,8 +4,6 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"path/filepath"
-	"slices"
 	"time"
 
 	"github.com/lab47/lsvd/logger"
@@ -106,12 +104,16 @@ func (d *CopyIterator) fetchExtent(
 	var rangeData []byte
 
 	switch addr.Flags() {
-	case Uncompressed:
+	case FlagUncompressed:
 		rangeData = rawData
-	case Compressed:
+	case FlagLZ4:
 		startDecomp := time.Now()
 		sz := addr.RawSize
 
+		if int(sz) != addr.Extent.ByteSize() {
+			return RangeData{}, fmt.Errorf("uncompressed size is %d, extent %s is %d", sz, addr.Extent, addr.Extent.ByteSize())
+		}
+
 		uncomp := ctx.Allocate(int(sz))
 
 		n, err := lz4.UncompressBlock(rawData, uncomp)
@@ -124,14 +126,18 @@ func (d *CopyIterator) fetchExtent(
 		}
 
 		rangeData = uncomp
-		compressionOverhead.Add(time.Since(startDecomp).Seconds())
+		d.d.metrics.compressionOverhead.Add(time.Since(startDecomp).Seconds())
 	default:
-		return RangeData{}, fmt.Errorf("unknown flags value: %d", addr.Flags())
+		return RangeData{}, &UnknownExtentFlagError{
+			Segment: addr.Segment,
+			Extent:  addr.Extent,
+			Flags:   addr.Flags(),
+		}
 	}
 
 	src := MapRangeData(addr.Extent, rangeData)
 
-	readProcessing.Add(time.Since(startFetch).Seconds())
+	d.d.metrics.readProcessing.Add(time.Since(startFetch).Seconds())
 	return src, nil
 }
 
@@ -154,7 +160,7 @@ func (c *CopyIterator) ProcessFromExtents(ctx *Context, log logger.Logger) error
 			continue
 		}
 
-		data, err := c.fetchExtent(ctx, c.d.log, rng.ExtentLocation)
+		data, err := c.fetchExtent(ctx, c.d.logs.gc, rng.ExtentLocation)
 		if err != nil {
 			return err
 		}
@@ -166,7 +172,7 @@ func (c *CopyIterator) ProcessFromExtents(ctx *Context, log logger.Logger) error
 			return fmt.Errorf("error calculating sub-range from %s to %s", rng.Extent, rng.Live)
 		}
 
-		_, eh, err := c.builder.WriteExtent(c.d.log, view)
+		_, eh, err := c.builder.WriteExtent(c.d.logs.gc, view)
 		if err != nil {
 			return err
 		}
@@ -193,23 +199,27 @@ func (ci *CopyIterator) extentsByteSize() int {
 }
 
 func (c *CopyIterator) updateDisk(ctx context.Context) error {
-	c.d.log.Trace("uploading post-gc segment", "segment", c.newSegment)
+	c.d.logs.gc.Trace("uploading post-gc segment", "segment", c.newSegment)
 	var (
 		stats *SegmentStats
 		err   error
 	)
 
 	for {
-		_, stats, err = c.builder.Flush(ctx, c.d.log, c.d.sa, c.newSegment, c.d.volName)
+		_, stats, err = c.builder.Flush(ctx, c.d.logs.gc, c.d.sa, c.newSegment, c.d.volName)
+		if errors.Is(err, ErrFenced) {
+			return err
+		}
+
 		if err != nil {
-			c.d.log.Error("error flushing data to segment, retrying", "error", err)
-			time.Sleep(5 * time.Second)
+			c.d.logs.gc.Error("error flushing data to segment, retrying", "error", err)
+			<-c.d.clock.After(5 * time.Second)
 			continue
 		}
 		break
 	}
 
-	c.d.log.Trace("patching block map from post-gc segment", "segment", c.newSegment)
+	c.d.logs.gc.Trace("patching block map from post-gc segment", "segment", c.newSegment)
 	c.d.s.Create(c.newSegment, stats)
 
 	newIdx := c.d.lba2pba.segmentIdx(ExtentLocation{
@@ -225,20 +235,27 @@ func (c *CopyIterator) updateDisk(ctx context.Context) error {
 			// we manage extents in segments.
 			if pe.CE.segIdx != pe.Segment {
 				c.errorPatching = true
-				c.d.log.Warn("unable to patch segment, detected recycled compactExtent")
+				c.d.logs.gc.Warn("unable to patch segment, detected recycled compactExtent")
 				continue
 			}
 
 			// Double check that we're patching for the same live extent. Otherwise bail!
 			if pe.CE.Live() != pe.Live {
 				c.errorPatching = true
-				c.d.log.Warn("unable to patch segment, detected live range has changed")
+				c.d.logs.gc.Warn("unable to patch segment, detected live range has changed")
 				continue
 			}
 
 			eh := c.results[i]
 			if eh.Size != 0 {
-				eh.Offset += stats.DataOffset
+				off, ok := c.builder.bodyOffset(eh.Offset)
+				if !ok {
+					c.errorPatching = true
+					c.d.logs.gc.Warn("unable to patch segment, extent missing from post-gc segment", "extent", eh.Extent)
+					continue
+				}
+
+				eh.Offset = stats.DataOffset + off
 			}
 
 			pe.CE.SetFromHeader(eh, newIdx)
@@ -256,11 +273,11 @@ func (c *CopyIterator) Close(ctx context.Context) error {
 
 	if !c.errorPatching {
 		for _, seg := range c.segmentsProcessed {
-			c.d.s.SetDeleted(seg, c.d.log)
+			c.d.s.SetDeleted(seg, c.d.logs.gc)
 		}
 	}
 
-	c.d.log.Info("gc cycle complete",
+	c.d.logs.gc.Info("gc cycle complete",
 		"segments", len(c.segmentsProcessed),
 		"new-segment", c.newSegment,
 		"extents", c.copiedExtents,
@@ -270,7 +287,7 @@ func (c *CopyIterator) Close(ctx context.Context) error {
 		"percent", float64(c.copiedBlocks)/float64(c.hdr.ExtentCount),
 	)
 
-	c.builder.Close(c.d.log)
+	c.builder.Close(c.d.logs.gc)
 
 	return c.or.Close()
 }
@@ -280,9 +297,9 @@ func (ci *CopyIterator) Reset(ctx context.Context, seg SegmentId) error {
 	ci.gatherExtents()
 
 	if ci.expectedBlocks == 0 {
-		ci.d.log.Info("detected segment completely unused, deleting without GC", "segment", seg)
+		ci.d.logs.gc.Info("detected segment completely unused, deleting without GC", "segment", seg)
 
-		ci.d.s.SetDeleted(seg, ci.d.log)
+		ci.d.s.SetDeleted(seg, ci.d.logs.gc)
 
 		return nil
 	}
@@ -297,12 +314,12 @@ func (ci *CopyIterator) Reset(ctx context.Context, seg SegmentId) error {
 	}
 
 	if ci.builder.em == nil {
-		ci.builder.em = NewExtentMap()
+		ci.builder.em = newExtentMap(ci.d.metrics)
 	}
 
 	if !ci.builder.OpenP() {
-		path := filepath.Join(ci.d.path, "writecache."+ci.newSegment.String())
-		err := ci.builder.OpenWrite(path, ci.d.log)
+		path := ci.d.writeCachePath(ci.newSegment)
+		err := ci.builder.OpenWrite(path, ci.d.logs.gc)
 		if err != nil {
 			return err
 		}
@@ -333,7 +350,7 @@ func (d *Disk) CopyIterator(ctx context.Context, seg SegmentId) (*CopyIterator,
 	ci := &CopyIterator{
 		d:       d,
 		seg:     seg,
-		builder: NewSegmentBuilder(),
+		builder: d.newSegmentBuilder(),
 	}
 
 	err := ci.Reset(ctx, seg)
@@ -346,29 +363,32 @@ func (d *Disk) CopyIterator(ctx context.Context, seg SegmentId) (*CopyIterator,
 }
 
 func (d *Disk) removeSegmentIfPossible(ctx context.Context, seg SegmentId) error {
-	volumes, err := d.sa.ListVolumes(ctx)
+	referenced, err := referencedSegments(ctx, d.sa)
 	if err != nil {
 		return err
 	}
 
-	for _, vol := range volumes {
-		segments, err := d.sa.ListSegments(ctx, vol)
-		if err != nil {
-			return err
-		}
-
-		if slices.Index(segments, seg) != -1 {
-			// ok, someone holding on to it, return early
-			return nil
-		}
+	if _, ok := referenced[seg]; ok {
+		// ok, someone holding on to it, return early
+		return nil
 	}
 
-	d.log.Info("removing segment", "segment", seg)
+	d.logs.gc.Info("removing segment", "segment", seg)
 	// ok, no volume has it, we can remove it.
 	err = d.sa.RemoveSegment(ctx, seg)
 	if err != nil {
 		return errors.Wrapf(err, "removing segment: %s", seg)
 	}
 
+	d.EvictSegment(seg)
+
 	return nil
 }
+
+// EvictSegment closes the reader the disk keeps open for +seg+, if any, so
+// that a read never goes to a segment that has been removed through a reader
+// opened before. The disk evicts the segments it removes itself; this is for
+// segments removed by others, such as another disk sharing them.
+func (d *Disk) EvictSegment(seg SegmentId) {
+	d.er.forgetSegment(seg)
+}
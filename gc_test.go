@@ -2,9 +2,13 @@ package lsvd
 
 import (
 	"context"
+	"crypto/rand"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lab47/lsvd/logger"
 	"github.com/oklog/ulid/v2"
@@ -86,6 +90,58 @@ func TestGC(t *testing.T) {
 		extentEqual(t, testExtent2, x2)
 	})
 
+	t.Run("closes the readers of the segments it removes", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		sa := &openTrackingAccess{memAccess: newMemAccess()}
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa), WithoutReadCache())
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(1)))
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NoError(d.WriteExtent(ctx, testExtent3.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		// Open the reader of every segment.
+		for lba := LBA(0); lba < 2; lba++ {
+			_, err := d.ReadExtent(ctx, Extent{LBA: lba, Blocks: 1})
+			r.NoError(err)
+		}
+
+		r.Equal(2, d.er.openSegments.Len())
+
+		gcSeg, err := d.GCOnce(ctx)
+		r.NoError(err)
+
+		// GC queues removing the segment it copied from.
+		r.Eventually(func() bool {
+			return !d.er.openSegments.Contains(gcSeg)
+		}, 5*time.Second, 10*time.Millisecond)
+
+		_, err = sa.OpenSegment(ctx, gcSeg)
+		r.Error(err)
+
+		sa.reset()
+
+		x, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testExtent3, x)
+
+		x, err = d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testExtent2, x)
+
+		r.Zero(sa.openedCount(gcSeg))
+	})
+
 	t.Run("works concurrently", func(t *testing.T) {
 		r := require.New(t)
 
@@ -402,9 +458,11 @@ func TestGC(t *testing.T) {
 		err = d.CloseSegment(ctx)
 		r.NoError(err)
 
-		segments, err := d.sa.ListSegments(ctx, d.volName)
-		r.NoError(err)
-		r.Len(segments, 2)
+		// The first segment was entirely overwritten, so it was marked deleted
+		// as soon as the second was flushed.
+		live := d.s.LiveSegments()
+		r.Len(live, 1)
+		r.NotContains(live, SegmentId(origSeq))
 
 		density := d.s.Usage()
 		t.Logf("pre gc density: %f", density)
@@ -425,13 +483,74 @@ func TestGC(t *testing.T) {
 
 		d2 := d.s.Usage()
 		t.Logf("post gc density: %f", d2)
-		r.Greater(d2, density)
+		r.Equal(d2, density)
 
-		segments, err = d.sa.ListSegments(ctx, d.volName)
+		segments, err := d.sa.ListSegments(ctx, d.volName)
 		r.NoError(err)
 		r.Len(segments, 1)
 	})
 
+	t.Run("schedules overwritten segments for deletion on flush", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		origSeq := ulid.MustNew(ulid.Now(), ulid.DefaultEntropy())
+		orig := SegmentId(origSeq)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(func() ulid.ULID {
+			return origSeq
+		}))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		data := NewRangeData(ctx, Extent{LBA: 0, Blocks: 10})
+		_, err = io.ReadFull(rand.Reader, data.WriteData())
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, data))
+
+		d.SeqGen = nil
+
+		r.NoError(d.CloseSegment(ctx))
+
+		// Partially overwrite it, leaving half of it live.
+		for lba := LBA(0); lba < 5; lba++ {
+			r.NoError(d.WriteExtent(ctx, testExtent.MapTo(lba)))
+		}
+
+		r.NoError(d.CloseSegment(ctx))
+
+		total, used := d.s.SegmentBlocks(orig)
+		r.Equal(uint64(10), total)
+		r.Equal(uint64(5), used)
+		r.Contains(d.s.LiveSegments(), orig)
+
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(5)))
+		r.NoError(d.WriteExtent(ctx, MapRangeData(Extent{LBA: 6, Blocks: 4}, data.ReadData()[:4*BlockSize])))
+
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NotContains(d.s.LiveSegments(), orig)
+
+		// Run the cleanup ourselves so we don't race the controller's.
+		r.NoError(d.CloseSegment(ctx))
+
+		segments, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.NotContains(segments, orig)
+		r.Len(segments, 2)
+
+		_, err = os.Stat(filepath.Join(tmpdir, "segments", "segment."+orig.String()))
+		r.True(os.IsNotExist(err))
+
+		rd, err := d.ReadExtent(ctx, Extent{LBA: 6, Blocks: 4})
+		r.NoError(err)
+		r.Equal(data.ReadData()[:4*BlockSize], rd.ReadData())
+	})
+
 	t.Run("can pack small segments in one pass", func(t *testing.T) {
 		r := require.New(t)
 
@@ -504,4 +623,104 @@ func TestGC(t *testing.T) {
 		extentEqual(t, testExtent2, x2)
 	})
 
+	t.Run("reads the current data after compacting a cached segment", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, pat(1, 4).MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		expected := pat(1, 4)
+
+		check := func(d *Disk) {
+			t.Helper()
+
+			for _, opts := range []ReadOptions{{}, {BypassCache: true}} {
+				data, err := d.ReadExtentWithOptions(ctx, Extent{LBA: 0, Blocks: 4}, opts)
+				r.NoError(err)
+				r.Equal([]byte(expected), data.ReadData())
+			}
+		}
+
+		// Reading puts the first segment's data in the read cache.
+		check(d)
+
+		// Overwrite half of it so it's sparse enough to be compacted.
+		r.NoError(d.WriteExtent(ctx, pat(2, 2).MapTo(1)))
+		r.NoError(d.CloseSegment(ctx))
+
+		copy(expected[BlockSize:], pat(2, 2))
+
+		check(d)
+
+		gcSeg, err := d.GCOnce(ctx)
+		r.NoError(err)
+		r.NotEmpty(gcSeg)
+
+		// The live data of the compacted segment now lives elsewhere, and
+		// the cached copy of it isn't used.
+		pes, err := d.resolveSegmentAccess(Extent{LBA: 0, Blocks: 4})
+		r.NoError(err)
+
+		for _, pe := range pes {
+			r.NotEqual(gcSeg, pe.Segment)
+		}
+
+		check(d)
+
+		r.NoError(d.WriteExtent(ctx, pat(3, 1).MapTo(3)))
+		r.NoError(d.CloseSegment(ctx))
+
+		copy(expected[3*BlockSize:], pat(3, 1))
+
+		check(d)
+
+		r.NoError(d.Close(ctx))
+
+		d2, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d2.Close(ctx)
+
+		check(d2)
+	})
+}
+
+// openTrackingAccess is a memAccess that counts the opens of each segment.
+type openTrackingAccess struct {
+	*memAccess
+
+	openMu sync.Mutex
+	opened map[SegmentId]int
+}
+
+func (o *openTrackingAccess) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	o.openMu.Lock()
+	if o.opened == nil {
+		o.opened = make(map[SegmentId]int)
+	}
+	o.opened[seg]++
+	o.openMu.Unlock()
+
+	return o.memAccess.OpenSegment(ctx, seg)
+}
+
+func (o *openTrackingAccess) openedCount(seg SegmentId) int {
+	o.openMu.Lock()
+	defer o.openMu.Unlock()
+
+	return o.opened[seg]
+}
+
+func (o *openTrackingAccess) reset() {
+	o.openMu.Lock()
+	defer o.openMu.Unlock()
+
+	o.opened = nil
 }
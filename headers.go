@@ -1,19 +1,36 @@
 package lsvd
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"time"
 	"unsafe"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
 )
 
 type Segment struct {
 	Size uint64
 	Used uint64
 
+	// The size of the segment in storage, 0 if it isn't known.
+	Bytes uint64
+
+	SegmentMetadata
+
 	deleted bool
 	cleared []Extent
+
+	// Flushes referring to the segment's data keep it from being removed,
+	// see Segments.Pin.
+	pins int
+
+	// The segments whose data the segment's references point to.
+	refs []SegmentId
 }
 
 func (s *Segment) detectedCleared(ext Extent) (Extent, bool) {
@@ -57,6 +74,171 @@ func (s SegmentHeader) Write(w io.Writer) error {
 	return binary.Write(w, binary.BigEndian, s)
 }
 
+// SegmentFormatVersion is the newest version of the segment format that this
+// code can read in full.
+const SegmentFormatVersion = 2
+
+// ErrSegmentTooNew is returned for a segment that contains data which can only
+// be read by a newer version of lsvd.
+var ErrSegmentTooNew = errors.New("segment requires a newer segment format")
+
+// The data between the extent headers and DataOffset is a sequence of
+// sections, each encoded as:
+//
+//	kind        uvarint
+//	min-version uvarint
+//	length      uvarint
+//	data        [length]byte
+//
+// A reader skips sections of a kind it doesn't know, unless the section's
+// min-version is newer than SegmentFormatVersion, in which case the segment
+// can't be read correctly without it. The sections are preceded by
+// segmentSectionsMarker, which distinguishes them from the CBOR encoded
+// SegmentMetadata that was stored there on its own before sections existed,
+// as a CBOR map never begins with a 0 byte.
+const segmentSectionsMarker = 0
+
+const (
+	sectionMetadata   = 1
+	sectionReferences = 2
+)
+
+// A segment with references has to be read with them, as the extents they map
+// would otherwise read as whatever was written to them before.
+const referencesMinVersion = 2
+
+// errBadReferences is returned for a segment whose references can't be
+// decoded, which unlike its metadata it can't be used without.
+var errBadReferences = errors.New("unable to decode segment references")
+
+// segmentRef is an extent whose data is stored in another segment of the
+// volume, recorded when dedup finds the data already stored there rather
+// than storing it again. Offset is relative to the start of that segment.
+type segmentRef struct {
+	ExtentHeader `cbor:"1,keyasint"`
+	Segment      SegmentId `cbor:"2,keyasint"`
+}
+
+// writeSegmentSection appends a section to +buf+.
+func writeSegmentSection(buf *bytes.Buffer, kind, minVersion uint64, data []byte) {
+	WriteUvarint(buf, kind)
+	WriteUvarint(buf, minVersion)
+	WriteUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+// writeSegmentSections appends the sections that follow the extent headers to
+// +buf+.
+func writeSegmentSections(buf *bytes.Buffer, meta *SegmentMetadata, refs []segmentRef) error {
+	var mbuf bytes.Buffer
+
+	err := meta.encode(&mbuf)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteByte(segmentSectionsMarker)
+	writeSegmentSection(buf, sectionMetadata, 0, mbuf.Bytes())
+
+	if len(refs) > 0 {
+		mbuf.Reset()
+
+		err = cbor.NewEncoder(&mbuf).Encode(refs)
+		if err != nil {
+			return err
+		}
+
+		writeSegmentSection(buf, sectionReferences, referencesMinVersion, mbuf.Bytes())
+	}
+
+	return nil
+}
+
+// readSegmentSections parses the data between the extent headers and the
+// segment data.
+func readSegmentSections(data []byte) (SegmentMetadata, []segmentRef, error) {
+	var (
+		meta SegmentMetadata
+		refs []segmentRef
+	)
+
+	if len(data) == 0 {
+		return meta, nil, nil
+	}
+
+	if data[0] != segmentSectionsMarker {
+		err := meta.decode(data)
+		return meta, nil, err
+	}
+
+	r := bytes.NewReader(data[1:])
+
+	for r.Len() > 0 {
+		kind, _, err := ReadUvarint(r)
+		if err != nil {
+			return meta, refs, err
+		}
+
+		minVersion, _, err := ReadUvarint(r)
+		if err != nil {
+			return meta, refs, err
+		}
+
+		length, _, err := ReadUvarint(r)
+		if err != nil {
+			return meta, refs, err
+		}
+
+		if length > uint64(r.Len()) {
+			return meta, refs, io.ErrUnexpectedEOF
+		}
+
+		start := len(data) - r.Len()
+		section := data[start : start+int(length)]
+
+		r.Seek(int64(length), io.SeekCurrent)
+
+		switch kind {
+		case sectionMetadata:
+			err = meta.decode(section)
+			if err != nil {
+				return meta, refs, err
+			}
+		case sectionReferences:
+			err = cbor.Unmarshal(section, &refs)
+			if err != nil {
+				return meta, refs, errors.Wrapf(errBadReferences, "%s", err)
+			}
+		default:
+			if minVersion > SegmentFormatVersion {
+				return meta, refs, errors.Wrapf(ErrSegmentTooNew,
+					"section %d requires version %d, this reader supports %d",
+					kind, minVersion, SegmentFormatVersion)
+			}
+		}
+	}
+
+	return meta, refs, nil
+}
+
+// SegmentMetadata is optional information about a segment. It's stored in
+// a section between the extent headers and the data, so it's covered by
+// DataOffset and ignored by readers that only consume ExtentCount headers.
+// Segments written before it was introduced don't contain it.
+type SegmentMetadata struct {
+	CreatedAt  time.Time `json:"created_at" cbor:"1,keyasint"`
+	WriterId   string    `json:"writer_id,omitempty" cbor:"2,keyasint,omitempty"`
+	Generation uint64    `json:"generation,omitempty" cbor:"3,keyasint,omitempty"`
+}
+
+func (m *SegmentMetadata) encode(w io.Writer) error {
+	return cbor.NewEncoder(w).Encode(m)
+}
+
+func (m *SegmentMetadata) decode(data []byte) error {
+	return cbor.Unmarshal(data, m)
+}
+
 func (s *SegmentHeader) Read(r io.Reader) error {
 	err := binary.Read(r, binary.BigEndian, &s.ExtentCount)
 	if err != nil {
@@ -71,10 +253,41 @@ func (s *SegmentHeader) Read(r io.Reader) error {
 	return nil
 }
 
+// Flags is how the data of an extent is stored. It isn't stored itself, but
+// follows from the sizes in the extent's header, see ExtentHeader.Flags, so
+// only the values below can occur. Another codec would need a change to the
+// segment format to record it.
+type Flags byte
+
+const (
+	// The data is stored as is, Size bytes of it.
+	FlagUncompressed Flags = 0
+
+	// The data is an LZ4 block of Size bytes that uncompresses to RawSize.
+	FlagLZ4 Flags = 1
+
+	// The extent is all zeros and has no data stored.
+	FlagEmpty Flags = 2
+)
+
+func (f Flags) String() string {
+	switch f {
+	case FlagUncompressed:
+		return "uncompressed"
+	case FlagLZ4:
+		return "lz4"
+	case FlagEmpty:
+		return "empty"
+	default:
+		return fmt.Sprintf("flags(%d)", byte(f))
+	}
+}
+
+// Deprecated: use FlagUncompressed, FlagLZ4 and FlagEmpty.
 const (
-	Uncompressed = 0
-	Compressed   = 1
-	Empty        = 2
+	Uncompressed = FlagUncompressed
+	Compressed   = FlagLZ4
+	Empty        = FlagEmpty
 )
 
 type ExtentHeader struct {
@@ -86,14 +299,14 @@ type ExtentHeader struct {
 	RawSize uint32 `json:"raw_size,omitempty" cbor:"4,keyasint,omitempty"`
 }
 
-func (e *ExtentHeader) Flags() byte {
+func (e *ExtentHeader) Flags() Flags {
 	switch {
 	case e.Size == 0:
-		return Empty
+		return FlagEmpty
 	case e.RawSize != 0:
-		return Compressed
+		return FlagLZ4
 	default:
-		return Uncompressed
+		return FlagUncompressed
 	}
 }
 
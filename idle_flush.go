@@ -0,0 +1,87 @@
+package lsvd
+
+import (
+	"context"
+	"time"
+)
+
+// startIdleFlush runs the watchdog of WithIdleFlush until stopIdleFlush.
+func (d *Disk) startIdleFlush() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d.stopIdle = cancel
+	d.idleDone = make(chan struct{})
+
+	go func() {
+		defer close(d.idleDone)
+		d.idleFlushLoop(ctx)
+	}()
+}
+
+// stopIdleFlush stops the watchdog, waiting for a flush it started to be
+// handed to the controller.
+func (d *Disk) stopIdleFlush() {
+	if d.stopIdle == nil {
+		return
+	}
+
+	d.stopIdle()
+	<-d.idleDone
+
+	d.stopIdle = nil
+}
+
+// idleFlushLoop flushes the write cache each time no write has arrived for
+// the idle flush interval. Rather than being reset on every write, the timer
+// checks when it fires how long ago the last write was and waits out the
+// rest of the interval if it wasn't long enough.
+func (d *Disk) idleFlushLoop(ctx context.Context) {
+	wait := d.idleFlush
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.clock.After(wait):
+		}
+
+		var err error
+
+		wait, err = d.flushIfIdle(ctx)
+		if err != nil {
+			d.logs.flush.Error("error flushing idle write cache", "error", err)
+			wait = d.idleFlush
+		}
+	}
+}
+
+// flushIfIdle starts flushing the current segment if it has any writes and
+// the last of them was at least the idle flush interval ago. It returns how
+// long to wait before checking again.
+func (d *Disk) flushIfIdle(ctx context.Context) (time.Duration, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	if idle := d.clock.Now().Sub(d.lastWrite); idle < d.idleFlush {
+		return d.idleFlush - idle, nil
+	}
+
+	// Nothing written since the last flush, explicit or not.
+	if d.curOC == nil || d.curOC.EmptyP() {
+		return d.idleFlush, nil
+	}
+
+	d.logs.flush.Info("flushing idle write cache",
+		"segment", d.curSeq,
+		"body-size", d.curOC.BodySize(),
+		"extents", d.curOC.Entries(),
+		"idle", d.idleFlush,
+	)
+
+	_, err := d.closeSegmentAsync(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.idleFlush, nil
+}
@@ -0,0 +1,193 @@
+package lsvd
+
+import (
+	"context"
+	"io"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// How many blocks to read from the image and write to the disk at a time
+// while importing.
+const importBatchBlocks = 256
+
+type importOpts struct {
+	holes []Extent
+}
+
+type ImportOption func(o *importOpts)
+
+// ImportHoles indicates that the image is sparse, as written by ExportRaw with
+// ExportSparse: the reader only contains the blocks that are not within +holes+.
+func ImportHoles(holes []Extent) ImportOption {
+	return func(o *importOpts) {
+		o.holes = holes
+	}
+}
+
+var ErrImageTooLarge = errors.New("image is larger than the volume")
+
+// ErrVolumeSizeUnknown is returned by ImportRaw for a volume without a size
+// when the size of the image can't be stored as the volume's.
+var ErrVolumeSizeUnknown = errors.New("volume has no size")
+
+// ImportRaw reads a raw image from +r+ and writes it to the disk, starting at
+// LBA 0. All-zero blocks are skipped rather than written so that the volume
+// stays thinly provisioned, which means that any data the volume already has
+// in those regions is left in place. If the volume's size is unknown, it's set
+// to the size of the image and stored in the volume's info, which requires
+// the segment access to implement VolumeInfoUpdater. Otherwise the image must
+// fit within the volume.
+func (d *Disk) ImportRaw(ctx context.Context, r io.Reader, opts ...ImportOption) error {
+	if d.detached.Load() {
+		return ErrDetached
+	}
+
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	if _, ok := d.sa.(VolumeInfoUpdater); !ok && d.size == 0 {
+		return errors.Wrapf(ErrVolumeSizeUnknown, "segment access %T can't store the size of the image", d.sa)
+	}
+
+	var o importOpts
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	holes := CoalesceExtents(slices.Clone(o.holes))
+
+	buf := make([]byte, importBatchBlocks*BlockSize)
+
+	var lba LBA
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for len(holes) > 0 && holes[0].LBA <= lba {
+			if end := holes[0].LBA + LBA(holes[0].Blocks); end > lba {
+				lba = end
+			}
+
+			holes = holes[1:]
+		}
+
+		want := importBatchBlocks
+		if len(holes) > 0 {
+			want = min(want, int(holes[0].LBA-lba))
+		}
+
+		n, err := io.ReadFull(r, buf[:want*BlockSize])
+
+		partial := err == io.ErrUnexpectedEOF
+
+		if err != nil && err != io.EOF && !partial {
+			return errors.Wrapf(err, "reading image at lba %d", lba)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		blocks := (n + BlockSize - 1) / BlockSize
+		clear(buf[n : blocks*BlockSize])
+
+		if d.size > 0 && int64(lba+LBA(blocks))*BlockSize > d.size {
+			return ErrImageTooLarge
+		}
+
+		_, err = d.importChunk(ctx, lba, buf[:blocks*BlockSize])
+		if err != nil {
+			return err
+		}
+
+		lba += LBA(blocks)
+
+		if partial {
+			break
+		}
+	}
+
+	// Holes at the end of the image still count towards its size.
+	for _, h := range holes {
+		if end := h.LBA + LBA(h.Blocks); end > lba {
+			lba = end
+		}
+	}
+
+	size := int64(lba) * BlockSize
+
+	if d.size == 0 {
+		err := d.setVolumeSize(ctx, size)
+		if err != nil {
+			return err
+		}
+	} else if size > d.size {
+		return ErrImageTooLarge
+	}
+
+	d.log.Info("imported raw image", "size", size)
+
+	return nil
+}
+
+// setVolumeSize stores +size+ as the size of the volume in its info, so
+// that it's still the volume's size when it's attached again.
+func (d *Disk) setVolumeSize(ctx context.Context, size int64) error {
+	vu := d.sa.(VolumeInfoUpdater)
+
+	vi, err := d.sa.GetVolumeInfo(ctx, d.volName)
+	if err != nil {
+		return errors.Wrapf(err, "reading info of volume %s", d.volName)
+	}
+
+	vi.Size = size
+
+	err = vu.UpdateVolumeInfo(ctx, vi)
+	if err != nil {
+		return errors.Wrapf(err, "storing size of volume %s", d.volName)
+	}
+
+	d.size = size
+
+	return nil
+}
+
+// importChunk writes the runs of non-zero blocks in +buf+, which starts at
+// +lba+, returning how many blocks it wrote.
+func (d *Disk) importChunk(ctx context.Context, lba LBA, buf []byte) (int, error) {
+	var (
+		ranges  []RangeData
+		start   = -1
+		written int
+	)
+
+	blocks := len(buf) / BlockSize
+
+	for i := 0; i <= blocks; i++ {
+		if i < blocks && !emptyBytes(buf[i*BlockSize:(i+1)*BlockSize]) {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+
+		if start != -1 {
+			ext := Extent{LBA: lba + LBA(start), Blocks: uint32(i - start)}
+			ranges = append(ranges, MapRangeData(ext, buf[start*BlockSize:i*BlockSize]))
+			written += i - start
+			start = -1
+		}
+	}
+
+	if len(ranges) == 0 {
+		return 0, nil
+	}
+
+	return written, d.WriteExtents(ctx, ranges)
+}
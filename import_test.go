@@ -0,0 +1,170 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImport(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	const imageBlocks = 1000
+
+	image := make([]byte, imageBlocks*BlockSize)
+	copy(image[1*BlockSize:], testRand)
+	copy(image[2*BlockSize:], testData)
+	copy(image[700*BlockSize:], testData2)
+	copy(image[(imageBlocks-1)*BlockSize:], testData3)
+
+	newDisk := func(t *testing.T) *Disk {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		return d
+	}
+
+	t.Run("imports a raw image and reads it back", func(t *testing.T) {
+		r := require.New(t)
+
+		d := newDisk(t)
+
+		r.NoError(d.ImportRaw(ctx, bytes.NewReader(image)))
+		r.Equal(int64(len(image)), d.Size())
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: imageBlocks})
+		r.NoError(err)
+		r.Equal(image, data.ReadData())
+
+		r.NoError(d.CloseSegment(ctx))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: imageBlocks})
+		r.NoError(err)
+		r.Equal(image, data.ReadData())
+
+		// The zero runs were not written at all.
+		pes, err := d.lba2pba.Resolve(log, Extent{LBA: 3, Blocks: 697}, nil)
+		r.NoError(err)
+		r.Empty(pes)
+
+		pes, err = d.lba2pba.Resolve(log, Extent{LBA: 701, Blocks: 298}, nil)
+		r.NoError(err)
+		r.Empty(pes)
+
+		r.Equal(3, d.lba2pba.Len())
+	})
+
+	t.Run("imports a sparse export", func(t *testing.T) {
+		r := require.New(t)
+
+		src := newDisk(t)
+		r.NoError(src.ImportRaw(ctx, bytes.NewReader(image)))
+
+		var buf bytes.Buffer
+
+		holes, err := src.ExportRaw(ctx, &buf, ExportSparse())
+		r.NoError(err)
+		r.Equal(4*BlockSize, buf.Len())
+
+		d := newDisk(t)
+
+		r.NoError(d.ImportRaw(ctx, &buf, ImportHoles(holes)))
+		r.Equal(int64(len(image)), d.Size())
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: imageBlocks})
+		r.NoError(err)
+		r.Equal(image, data.ReadData())
+	})
+
+	t.Run("pads a trailing partial block", func(t *testing.T) {
+		r := require.New(t)
+
+		d := newDisk(t)
+
+		r.NoError(d.ImportRaw(ctx, bytes.NewReader(testRand[:100])))
+		r.Equal(int64(BlockSize), d.Size())
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		r.Equal(testRand[:100], data.ReadData()[:100])
+		r.True(isEmpty(data.ReadData()[100:]))
+	})
+
+	t.Run("keeps the size of the image when reopened", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithBoundedReads())
+		r.NoError(err)
+
+		r.NoError(d.ImportRaw(ctx, bytes.NewReader(image)))
+		r.NoError(d.Close(ctx))
+
+		d, err = NewDisk(ctx, log, tmpdir, WithBoundedReads())
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.Equal(int64(len(image)), d.Size())
+
+		// The tail of the image is still inside the volume.
+		data, err := d.ReadExtent(ctx, Extent{LBA: imageBlocks - 1, Blocks: 1})
+		r.NoError(err)
+		r.Equal(testData3, data.ReadData())
+	})
+
+	t.Run("rejects an image it can't store the size of", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		// Only the methods of SegmentAccess, so not VolumeInfoUpdater.
+		sa := struct{ SegmentAccess }{newMemAccess()}
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.ImportRaw(ctx, bytes.NewReader(image))
+		r.ErrorIs(err, ErrVolumeSizeUnknown)
+	})
+
+	t.Run("rejects imports once detached", func(t *testing.T) {
+		r := require.New(t)
+
+		d := newDisk(t)
+		r.NoError(d.Detach(ctx))
+
+		r.ErrorIs(d.ImportRaw(ctx, bytes.NewReader(image)), ErrDetached)
+	})
+
+	t.Run("rejects images larger than the volume", func(t *testing.T) {
+		r := require.New(t)
+
+		d := newDisk(t)
+		d.size = 10 * BlockSize
+
+		err := d.ImportRaw(ctx, bytes.NewReader(image))
+		r.ErrorIs(err, ErrImageTooLarge)
+	})
+}
@@ -2,16 +2,19 @@ package lsvd
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/oklog/ulid/v2"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 type LocalFile struct {
@@ -35,11 +38,45 @@ func (l *LocalFile) Close() error {
 	return l.f.Close()
 }
 
+func (l *LocalFile) Size() (int64, error) {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
 type LocalFileAccess struct {
 	Dir string
+
+	// When the files written are synced to disk, FsyncOnClose by default.
+	Fsync FsyncPolicy
+
+	// How often FsyncOnInterval syncs, DefaultFsyncInterval if 0.
+	FsyncInterval time.Duration
+
+	syncOnce sync.Once
+	syncer   *fileSyncer
 }
 
-var _ SegmentAccess = (*LocalFileAccess)(nil)
+// fileSyncer returns the syncer applying our policy, created on first use
+// so that the zero LocalFileAccess is ready to use.
+func (l *LocalFileAccess) fileSyncer() *fileSyncer {
+	l.syncOnce.Do(func() {
+		l.syncer = newFileSyncer(l.Fsync, l.FsyncInterval, nil)
+	})
+
+	return l.syncer
+}
+
+var (
+	_ SegmentAccess       = (*LocalFileAccess)(nil)
+	_ VolumeTrash         = (*LocalFileAccess)(nil)
+	_ VolumeInfoUpdater   = (*LocalFileAccess)(nil)
+	_ SegmentBatchRemover = (*LocalFileAccess)(nil)
+	_ SegmentSizer        = (*LocalFileAccess)(nil)
+)
 
 func (l *LocalFileAccess) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
 	return OpenLocalFile(
@@ -83,9 +120,39 @@ func (l *LocalFileAccess) ListSegments(ctx context.Context, vol string) ([]Segme
 	return ReadSegments(f)
 }
 
+// ListAllSegments returns every segment in the container.
+func (l *LocalFileAccess) ListAllSegments(ctx context.Context) ([]SegmentId, error) {
+	entries, err := os.ReadDir(filepath.Join(l.Dir, "segments"))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []SegmentId
+
+	for _, ent := range entries {
+		name, ok := strings.CutPrefix(ent.Name(), "segment.")
+		if !ok {
+			continue
+		}
+
+		id, err := ulid.Parse(name)
+		if err != nil {
+			continue
+		}
+
+		out = append(out, SegmentId(id))
+	}
+
+	return out, nil
+}
+
 func (l *LocalFileAccess) WriteMetadata(ctx context.Context, vol, name string) (io.WriteCloser, error) {
 	f, err := os.Create(filepath.Join(l.Dir, "volumes", vol, name))
-	return f, err
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncedFile{File: f, s: l.fileSyncer()}, nil
 }
 
 func (l *LocalFileAccess) ReadMetadata(ctx context.Context, vol, name string) (io.ReadCloser, error) {
@@ -93,14 +160,44 @@ func (l *LocalFileAccess) ReadMetadata(ctx context.Context, vol, name string) (i
 	return f, err
 }
 
+// SegmentSize returns the size of the file of +seg+.
+func (l *LocalFileAccess) SegmentSize(ctx context.Context, seg SegmentId) (int64, error) {
+	fi, err := os.Stat(
+		filepath.Join(l.Dir, "segments", "segment."+ulid.ULID(seg).String()))
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
 func (l *LocalFileAccess) RemoveSegment(ctx context.Context, seg SegmentId) error {
 	return os.Remove(
 		filepath.Join(l.Dir, "segments", "segment."+ulid.ULID(seg).String()))
 }
 
+// RemoveSegments removes each of +segs+, there being no cheaper way to remove
+// several files.
+func (l *LocalFileAccess) RemoveSegments(ctx context.Context, segs []SegmentId) error {
+	for _, seg := range segs {
+		err := l.RemoveSegment(ctx, seg)
+		if err != nil {
+			return errors.Wrapf(err, "removing segment: %s", seg)
+		}
+	}
+
+	return nil
+}
+
 func (l *LocalFileAccess) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteCloser, error) {
 	path := filepath.Join(l.Dir, "segments", "segment."+ulid.ULID(seg).String())
-	return os.Create(path)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncedFile{File: f, s: l.fileSyncer()}, nil
 }
 
 func (l *LocalFileAccess) UploadSegment(ctx context.Context, seg SegmentId, f *os.File) error {
@@ -110,76 +207,117 @@ func (l *LocalFileAccess) UploadSegment(ctx context.Context, seg SegmentId, f *o
 		return err
 	}
 
-	_, err = io.Copy(dest, f)
-	return err
+	sf := &syncedFile{File: dest, s: l.fileSyncer()}
+
+	_, err = io.Copy(sf, f)
+	if err != nil {
+		dest.Close()
+		return err
+	}
+
+	return sf.Close()
+}
+
+// lockSegments takes an exclusive lock on the segment list of +vol+, which
+// excludes other processes as well as other goroutines, returning the
+// function to release it.
+func (l *LocalFileAccess) lockSegments(vol string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(l.Dir, "volumes", vol, "segments.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
 }
 
 func (l *LocalFileAccess) AppendToSegments(ctx context.Context, vol string, seg SegmentId) error {
-	segments, err := l.ListSegments(ctx, vol)
+	unlock, err := l.lockSegments(vol)
 	if err != nil {
 		return err
 	}
 
-	path := filepath.Join(l.Dir, "volumes", vol, "segments")
+	defer unlock()
+
+	segments, err := l.ListSegments(ctx, vol)
+	if err != nil {
+		return err
+	}
 
 	segments = append(segments, seg)
 
-	f, err := os.Create(path)
+	return writeSegmentsFile(l.fileSyncer(), filepath.Join(l.Dir, "volumes", vol, "segments"), segments)
+}
+
+// writeSegmentsFile replaces the segment list at +path+. The new list is
+// written to a temporary file that is renamed over the old one, so a failed
+// write leaves the old list intact.
+func writeSegmentsFile(s *fileSyncer, path string, segments []SegmentId) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
 		return err
 	}
 
+	defer os.Remove(f.Name())
 	defer f.Close()
 
 	bw := bufio.NewWriter(f)
 
-	defer bw.Flush()
-
 	for _, seg := range segments {
 		bw.Write(seg[:])
 	}
 
-	return nil
-}
-
-func (l *LocalFileAccess) RemoveSegmentFromVolume(ctx context.Context, vol string, seg SegmentId) error {
-	var buf bytes.Buffer
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
 
-	segmentsPath := filepath.Join(l.Dir, "volumes", vol, "segments")
-	f, err := os.OpenFile(segmentsPath, os.O_RDONLY, 0644)
+	err = s.syncFile(f, path)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	err = f.Close()
+	if err != nil {
+		return err
+	}
 
-	var cur SegmentId
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
 
-	for {
-		_, err = f.Read(cur[:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
+	return s.syncDir(filepath.Dir(path))
+}
 
-			return err
-		}
+func (l *LocalFileAccess) RemoveSegmentFromVolume(ctx context.Context, vol string, seg SegmentId) error {
+	return l.RemoveSegmentsFromVolume(ctx, vol, []SegmentId{seg})
+}
 
-		if seg != cur {
-			buf.Write(cur[:])
-		}
+// RemoveSegmentsFromVolume removes +segs+ from the segments of +vol+,
+// rewriting the list once.
+func (l *LocalFileAccess) RemoveSegmentsFromVolume(ctx context.Context, vol string, segs []SegmentId) error {
+	unlock, err := l.lockSegments(vol)
+	if err != nil {
+		return err
 	}
 
-	f.Close()
+	defer unlock()
 
-	f, err = os.Create(segmentsPath)
+	segments, err := l.ListSegments(ctx, vol)
 	if err != nil {
 		return err
 	}
 
-	io.Copy(f, &buf)
+	segments = withoutSegments(segments, segs)
 
-	return nil
+	return writeSegmentsFile(l.fileSyncer(), filepath.Join(l.Dir, "volumes", vol, "segments"), segments)
 }
 
 func (l *LocalFileAccess) InitContainer(ctx context.Context) error {
@@ -200,13 +338,14 @@ func (l *LocalFileAccess) InitContainer(ctx context.Context) error {
 }
 
 func (l *LocalFileAccess) InitVolume(ctx context.Context, vol *VolumeInfo) error {
-	if vol.Name == "" {
-		return fmt.Errorf("volume name must not be empty")
+	err := ValidateVolumeName(vol.Name)
+	if err != nil {
+		return err
 	}
 
 	path := filepath.Join(l.Dir, "volumes", vol.Name)
 
-	_, err := os.Stat(path)
+	_, err = os.Stat(path)
 	if err == nil {
 		return nil
 	}
@@ -224,9 +363,15 @@ func (l *LocalFileAccess) InitVolume(ctx context.Context, vol *VolumeInfo) error
 		return err
 	}
 
-	defer f.Close()
+	sf := &syncedFile{File: f, s: l.fileSyncer()}
+
+	err = json.NewEncoder(sf).Encode(&vol)
+	if err != nil {
+		f.Close()
+		return err
+	}
 
-	return json.NewEncoder(f).Encode(&vol)
+	return sf.Close()
 }
 
 func (l *LocalFileAccess) ListVolumes(ctx context.Context) ([]string, error) {
@@ -238,14 +383,169 @@ func (l *LocalFileAccess) ListVolumes(ctx context.Context) ([]string, error) {
 	var volumes []string
 
 	for _, ent := range entries {
+		if ent.Name() == trashDir {
+			continue
+		}
+
+		// Not a volume we could have created, such as something left
+		// there by hand.
+		if ValidateVolumeName(ent.Name()) != nil {
+			continue
+		}
+
 		volumes = append(volumes, ent.Name())
 	}
 
 	return volumes, nil
 }
 
+func (l *LocalFileAccess) trashPath(vol string) string {
+	return filepath.Join(l.Dir, "volumes", trashDir, vol)
+}
+
+// SoftDeleteVolume moves the directory of +vol+ into the trash, recording
+// when it was deleted inside it first so the move is the only change visible
+// to others.
+func (l *LocalFileAccess) SoftDeleteVolume(ctx context.Context, vol string) error {
+	path := filepath.Join(l.Dir, "volumes", vol)
+
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	dest := l.trashPath(vol)
+
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("volume %s is already in the trash", vol)
+	}
+
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(path, deletedAtName), []byte(time.Now().Format(deletedAtStamp)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path, dest)
+}
+
+func (l *LocalFileAccess) RestoreVolume(ctx context.Context, vol string) error {
+	path := l.trashPath(vol)
+
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.Wrapf(ErrVolumeNotTrashed, "restoring volume %s", vol)
+		}
+
+		return err
+	}
+
+	dest := filepath.Join(l.Dir, "volumes", vol)
+
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("volume %s already exists", vol)
+	}
+
+	err := os.Rename(path, dest)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(dest, deletedAtName))
+}
+
+func (l *LocalFileAccess) ListTrashedVolumes(ctx context.Context) ([]TrashedVolume, error) {
+	entries, err := os.ReadDir(filepath.Join(l.Dir, "volumes", trashDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var out []TrashedVolume
+
+	for _, ent := range entries {
+		data, err := os.ReadFile(filepath.Join(l.trashPath(ent.Name()), deletedAtName))
+		if err != nil {
+			return nil, err
+		}
+
+		ts, err := time.Parse(deletedAtStamp, string(data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing deletion time of volume %s", ent.Name())
+		}
+
+		out = append(out, TrashedVolume{Name: ent.Name(), DeletedAt: ts})
+	}
+
+	return out, nil
+}
+
+func (l *LocalFileAccess) ListTrashedSegments(ctx context.Context, vol string) ([]SegmentId, error) {
+	return l.ListSegments(ctx, filepath.Join(trashDir, vol))
+}
+
+func (l *LocalFileAccess) PurgeVolume(ctx context.Context, vol string) error {
+	path := l.trashPath(vol)
+
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.Wrapf(ErrVolumeNotTrashed, "purging volume %s", vol)
+		}
+
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
+
+// UpdateVolumeInfo replaces the info of an existing volume. It's written to
+// a temporary file first so that readers never see a partial update.
+func (l *LocalFileAccess) UpdateVolumeInfo(ctx context.Context, vol *VolumeInfo) error {
+	path := filepath.Join(l.Dir, "volumes", vol.Name, "info.json")
+
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	s := l.fileSyncer()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = s.syncFile(f, path)
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	return s.syncDir(filepath.Dir(path))
+}
+
 func (l *LocalFileAccess) GetVolumeInfo(ctx context.Context, vol string) (*VolumeInfo, error) {
-	f, err := os.Open(filepath.Join("volumes", vol, "info.json"))
+	f, err := os.Open(filepath.Join(l.Dir, "volumes", vol, "info.json"))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,148 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalFileAccess(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) *LocalFileAccess {
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		sa := &LocalFileAccess{Dir: tmpdir}
+		require.NoError(t, sa.InitContainer(ctx))
+		require.NoError(t, sa.InitVolume(ctx, &VolumeInfo{Name: "default"}))
+
+		return sa
+	}
+
+	t.Run("removes a segment from the volume", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := setup(t)
+
+		var segs []SegmentId
+
+		for i := 0; i < 3; i++ {
+			seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+			segs = append(segs, seg)
+
+			r.NoError(sa.AppendToSegments(ctx, "default", seg))
+		}
+
+		r.NoError(sa.RemoveSegmentFromVolume(ctx, "default", segs[1]))
+
+		listed, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+
+		r.Equal([]SegmentId{segs[0], segs[2]}, listed)
+
+		r.NoError(sa.RemoveSegmentFromVolume(ctx, "default", segs[0]))
+
+		listed, err = sa.ListSegments(ctx, "default")
+		r.NoError(err)
+
+		r.Equal([]SegmentId{segs[2]}, listed)
+	})
+
+	t.Run("doesn't leave temporary files behind", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := setup(t)
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		r.NoError(sa.AppendToSegments(ctx, "default", seg))
+		r.NoError(sa.RemoveSegmentFromVolume(ctx, "default", seg))
+
+		entries, err := os.ReadDir(filepath.Join(sa.Dir, "volumes", "default"))
+		r.NoError(err)
+
+		var names []string
+		for _, ent := range entries {
+			names = append(names, ent.Name())
+		}
+
+		r.ElementsMatch([]string{"info.json", "segments", "segments.lock"}, names)
+	})
+
+	t.Run("concurrent changes to the segment list aren't lost", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := setup(t)
+
+		const (
+			workers   = 8
+			perWorker = 20
+		)
+
+		// Each worker removes the segments it added earlier while appending
+		// new ones, so every change races with the others.
+		var (
+			initial [workers][]SegmentId
+			added   [workers][]SegmentId
+		)
+
+		for w := range initial {
+			for i := 0; i < perWorker; i++ {
+				seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+				initial[w] = append(initial[w], seg)
+
+				r.NoError(sa.AppendToSegments(ctx, "default", seg))
+			}
+		}
+
+		var wg sync.WaitGroup
+
+		errs := make(chan error, workers)
+
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				for i := 0; i < perWorker; i++ {
+					seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+					added[w] = append(added[w], seg)
+
+					err := sa.AppendToSegments(ctx, "default", seg)
+					if err == nil {
+						err = sa.RemoveSegmentFromVolume(ctx, "default", initial[w][i])
+					}
+
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(w)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			r.NoError(err)
+		}
+
+		var expected []SegmentId
+		for _, segs := range added {
+			expected = append(expected, segs...)
+		}
+
+		listed, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+
+		r.ElementsMatch(expected, listed)
+	})
+}
@@ -27,10 +27,81 @@ type LabLogger struct {
 	*slog.Logger
 
 	level slog.LevelVar
+
+	// Set on a logger from Named, whose level follows parent's until
+	// SetLevel is called on it.
+	name   string
+	parent *LabLogger
+	own    atomic.Bool
 }
 
 func (l *LabLogger) SetLevel(level slog.Level) {
 	l.level.Set(level)
+	l.own.Store(true)
+}
+
+// Level returns the level l logs at.
+func (l *LabLogger) Level() slog.Level {
+	if l.parent != nil && !l.own.Load() {
+		return l.parent.Level()
+	}
+
+	return l.level.Level()
+}
+
+// NameKey is the key of the attribute that records from a logger returned by
+// Named carry its name in.
+const NameKey = "logger"
+
+// Named returns a logger for a part of what l logs for, such as a subsystem,
+// so that its level can be set on its own. Its records carry its name, after
+// l's if l is named too, and it logs at l's level until SetLevel is called
+// on it.
+func (l *LabLogger) Named(name string) Logger {
+	root := l
+	for root.parent != nil {
+		root = root.parent
+	}
+
+	if l.name != "" {
+		name = l.name + "." + name
+	}
+
+	sub := &LabLogger{
+		name:   name,
+		parent: l,
+	}
+
+	sub.Logger = slog.New(&levelHandler{
+		Handler: root.Handler().WithAttrs([]slog.Attr{slog.String(NameKey, name)}),
+		level:   sub,
+	})
+
+	return sub
+}
+
+// Name returns the name l was given by Named, if any.
+func (l *LabLogger) Name() string {
+	return l.name
+}
+
+// levelHandler handles the records at or above its own level, rather than
+// the level of the handler it wraps.
+type levelHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
 }
 
 func (l *LabLogger) Trace(msg string, args ...any) {
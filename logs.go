@@ -0,0 +1,47 @@
+package lsvd
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/lab47/lsvd/logger"
+)
+
+// The subsystems the disk logs for on loggers of their own, named after
+// them, so that their levels can be set apart with WithLogLevel.
+const (
+	LogRead  = "read"
+	LogWrite = "write"
+	LogFlush = "flush"
+	LogGC    = "gc"
+	LogCache = "cache"
+)
+
+type diskLogs struct {
+	read, write, flush, gc, cache logger.Logger
+}
+
+func newDiskLogs(log logger.Logger, levels map[string]slog.Level) (diskLogs, error) {
+	named := map[string]logger.Logger{}
+
+	for _, name := range []string{LogRead, LogWrite, LogFlush, LogGC, LogCache} {
+		named[name] = log.Named(name)
+	}
+
+	for name, level := range levels {
+		l, ok := named[name]
+		if !ok {
+			return diskLogs{}, fmt.Errorf("unknown log subsystem: %s", name)
+		}
+
+		l.SetLevel(level)
+	}
+
+	return diskLogs{
+		read:  named[LogRead],
+		write: named[LogWrite],
+		flush: named[LogFlush],
+		gc:    named[LogGC],
+		cache: named[LogCache],
+	}, nil
+}
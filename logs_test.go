@@ -0,0 +1,125 @@
+package lsvd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedLog struct {
+	level slog.Level
+	msg   string
+	name  string
+}
+
+// recordingHandler keeps the records logged at Info or above, or at any
+// level by a named logger, along with the name of the logger.
+type recordingHandler struct {
+	mu      *sync.Mutex
+	records *[]recordedLog
+	name    string
+}
+
+func newRecordingLogger() (logger.Logger, *recordingHandler) {
+	h := &recordingHandler{
+		mu:      &sync.Mutex{},
+		records: &[]recordedLog{},
+	}
+
+	return &logger.LabLogger{Logger: slog.New(h)}, h
+}
+
+func (h *recordingHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	*h.records = append(*h.records, recordedLog{level: r.Level, msg: r.Message, name: h.name})
+
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+
+	for _, a := range attrs {
+		if a.Key == logger.NameKey {
+			h2.name = a.Value.String()
+		}
+	}
+
+	return &h2
+}
+
+func (h *recordingHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+func (h *recordingHandler) logged() []recordedLog {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]recordedLog(nil), *h.records...)
+}
+
+func TestSubsystemLogs(t *testing.T) {
+	ctx := NewContext(context.Background())
+
+	t.Run("names the records of each subsystem", func(t *testing.T) {
+		r := require.New(t)
+
+		log, h := newRecordingLogger()
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithLogLevel(LogRead, logger.Trace))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		_, err = d.ReadExtentWithOptions(ctx, Extent{LBA: 0, Blocks: 1}, ReadOptions{BypassCache: true})
+		r.NoError(err)
+
+		names := map[string]bool{}
+
+		for _, rec := range h.logged() {
+			names[rec.name] = true
+
+			if rec.msg == "flushing segment to storage in background" {
+				r.Equal(LogFlush, rec.name)
+			}
+
+			// Only the read logger was set below the disk's level.
+			if rec.level < slog.LevelInfo {
+				r.Equal(LogRead, rec.name, "record %q", rec.msg)
+			}
+		}
+
+		r.True(names[""])
+		r.True(names[LogRead])
+		r.True(names[LogFlush])
+	})
+
+	t.Run("rejects unknown subsystems", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		_, err = NewDisk(ctx, logger.New(logger.Info), tmpdir, WithLogLevel("nope", logger.Debug))
+		r.Error(err)
+	})
+}
@@ -7,8 +7,11 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+	"log/slog"
+	mrand "math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -16,6 +19,7 @@ import (
 	"github.com/lab47/lsvd/logger"
 	"github.com/lab47/lz4decode"
 	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,6 +80,18 @@ func blockEqual(t *testing.T, a, b []byte) {
 	//require.True(t, bytes.Equal(a, b), "blocks are not the same")
 }
 
+// segmentMetadataSize returns how many bytes the metadata written into
+// each of +d+'s segments takes up.
+func segmentMetadataSize(t *testing.T, d *Disk) uint32 {
+	meta := d.segmentMetadata()
+	meta.CreatedAt = time.Now()
+
+	var buf bytes.Buffer
+	require.NoError(t, writeSegmentSections(&buf, &meta))
+
+	return uint32(buf.Len())
+}
+
 func extentEqual(t *testing.T, actual RawBlocks, expected RangeData) {
 	t.Helper()
 
@@ -277,334 +293,443 @@ func TestLSVD(t *testing.T) {
 		})
 	})
 
-	t.Run("writes to clear blocks don't corrupt the cache", func(t *testing.T) {
+	t.Run("can read from segments without the read cache", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
+		d, err := NewDisk(ctx, log, tmpdir, WithoutReadCache())
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		r.NoError(d.WriteExtent(ctx, testEmptyX.MapTo(47)))
+		big := make([]byte, 4*BlockSize)
 
-		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		_, err = io.ReadFull(rand.Reader, big)
 		r.NoError(err)
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		err = d.WriteExtent(ctx, MapRangeData(Extent{0, 4}, big))
 		r.NoError(err)
 
-		extentEqual(t, testRandX, d2)
+		err = d.WriteExtent(ctx, testExtent.MapTo(10))
+		r.NoError(err)
+
+		r.NoError(d.CloseSegment(ctx))
+
+		for i := 0; i < 2; i++ {
+			d2, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+			r.NoError(err)
+
+			blockEqual(t, d2.ReadData(), big[BlockSize:BlockSize+BlockSize])
+
+			d2, err = d.ReadExtent(ctx, Extent{LBA: 10, Blocks: 1})
+			r.NoError(err)
+
+			extentEqual(t, testExtent, d2)
+		}
+
+		_, err = os.Stat(filepath.Join(tmpdir, "readcache"))
+		r.True(os.IsNotExist(err), "read cache should not be created")
 	})
 
-	t.Run("stale reads aren't returned", func(t *testing.T) {
+	t.Run("reads from segments respect the deadline of the read", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
-		r.NoError(err)
-		defer d.Close(ctx)
-
-		err = d.WriteExtent(ctx, testExtent.MapTo(0))
-		r.NoError(err)
+		var sa stallingLocal
 
-		t.Log("closing disk")
-		r.NoError(d.Close(ctx))
+		sa.Dir = tmpdir
 
-		t.Log("reopening disk")
-		d, err = NewDisk(ctx, log, tmpdir)
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa), WithoutReadCache())
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
 		r.NoError(err)
 
-		extentEqual(t, testExtent, d2)
+		r.NoError(d.CloseSegment(ctx))
 
-		err = d.WriteExtent(ctx, testExtent2.MapTo(0))
-		r.NoError(err)
+		sa.stalled.Store(true)
+		defer sa.stalled.Store(false)
 
-		d3, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-		r.NoError(err)
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
 
-		extentEqual(t, testExtent2, d3)
+		start := time.Now()
+
+		_, err = d.ReadExtent(NewContext(tctx), Extent{LBA: 0, Blocks: 1})
+		r.ErrorIs(err, context.DeadlineExceeded)
+
+		r.Less(time.Since(start), time.Second)
 	})
 
-	t.Run("writes written out to an segment", func(t *testing.T) {
+	t.Run("reads directly into a caller's buffer", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		var ur UlidRecall
-
-		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(ur.Gen))
+		d, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(47))
-		r.NoError(err)
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
 
-		t.Log("closing disk")
-		r.NoError(d.Close(ctx))
+		check := func() {
+			buf := make([]byte, 2*BlockSize)
 
-		t.Log("reopening disk")
-		f, err := os.Open(filepath.Join(tmpdir, "segments", "segment."+ur.First().String()))
-		r.NoError(err)
+			err := d.ReadExtentIntoBuffer(ctx, Extent{LBA: 0, Blocks: 2}, buf)
+			r.NoError(err)
 
-		defer f.Close()
+			blockEqual(t, testRandX, buf[:BlockSize])
+			blockEqual(t, testExtent, buf[BlockSize:])
 
-		br := bufio.NewReader(f)
+			err = d.ReadExtentIntoBuffer(ctx, Extent{LBA: 0, Blocks: 1}, buf[:BlockSize])
+			r.NoError(err)
 
-		var cnt uint32
-		err = binary.Read(br, binary.BigEndian, &cnt)
-		r.NoError(err)
+			blockEqual(t, testRandX, buf[:BlockSize])
+		}
 
-		r.Equal(uint32(1), cnt)
+		check()
 
-		var hdrLen uint32
-		err = binary.Read(br, binary.BigEndian, &hdrLen)
-		r.NoError(err)
+		r.NoError(d.CloseSegment(ctx))
 
-		r.Equal(uint32(0xe), hdrLen)
+		check()
 
-		lba, err := binary.ReadUvarint(br)
-		r.NoError(err)
+		err = d.ReadExtentIntoBuffer(ctx, Extent{LBA: 0, Blocks: 2}, make([]byte, BlockSize))
+		r.ErrorIs(err, ErrBufferSize)
+	})
 
-		r.Equal(uint64(47), lba)
+	t.Run("reads into caller provided range data", func(t *testing.T) {
+		r := require.New(t)
 
-		blocks, err := binary.ReadUvarint(br)
+		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-		r.Equal(uint64(1), blocks)
-
-		blkSize, err := binary.ReadUvarint(br)
+		d, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d.Close(ctx)
 
-		r.Equal(uint64(0x28), blkSize)
-
-		offset, err := binary.ReadUvarint(br)
-		r.NoError(err)
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(1)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(2)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(3)))
 
-		r.Equal(uint64(6), offset)
+		rng := Extent{LBA: 0, Blocks: 5}
 
-		rawSize, err := binary.ReadUvarint(br)
+		expected, err := d.ReadExtent(ctx, rng)
 		r.NoError(err)
 
-		r.Equal(uint64(BlockSize), rawSize)
-
-		_, err = f.Seek(int64(uint64(hdrLen)+offset), io.SeekStart)
-		r.NoError(err)
+		// Left over data from a previous use is overwritten, holes included.
+		data := NewRangeData(ctx, rng)
+		for i := range data.WriteData() {
+			data.WriteData()[i] = 0xff
+		}
 
-		view := make([]byte, BlockSize)
+		r.NoError(d.ReadExtentIntoData(ctx, rng, data))
+		r.Equal(expected.ReadData(), data.ReadData())
 
-		buf := make([]byte, blkSize)
+		err = d.ReadExtentIntoData(ctx, Extent{LBA: 0, Blocks: 4}, data)
+		r.ErrorIs(err, ErrInvalidRangeData)
+	})
 
-		_, err = io.ReadFull(f, buf)
-		r.NoError(err)
+	t.Run("rejects range data that doesn't match its extent", func(t *testing.T) {
+		r := require.New(t)
 
-		sz, err := lz4decode.UncompressBlock(buf, view, nil)
+		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-		view = view[:sz]
-
-		blockEqual(t, testData, view)
-
-		g, err := os.Open(filepath.Join(tmpdir, "volumes", "default", "segments"))
+		d, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d.Close(ctx)
 
-		defer g.Close()
+		short := RangeData{Extent: Extent{LBA: 0, Blocks: 2}, data: testRandX}
+		long := RangeData{Extent: Extent{LBA: 0, Blocks: 1}, data: make(RawBlocks, 2*BlockSize)}
+		missing := RangeData{Extent: Extent{LBA: 0, Blocks: 1}}
 
-		gbr := bufio.NewReader(g)
+		for _, bad := range []RangeData{short, long, missing} {
+			r.ErrorIs(d.WriteExtent(ctx, bad), ErrInvalidRangeData)
+			r.ErrorIs(d.WriteExtents(ctx, []RangeData{testRandX.MapTo(5), bad}), ErrInvalidRangeData)
 
-		var iseg SegmentId
+			_, err = d.ReadExtentInto(ctx, bad)
+			r.ErrorIs(err, ErrInvalidRangeData)
+		}
 
-		_, err = gbr.Read(iseg[:])
+		// Nothing from the rejected batches was written.
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 6})
 		r.NoError(err)
-
-		r.Equal(ulid.ULID(iseg), ur.First())
+		r.True(isEmpty(data.ReadData()))
 	})
 
-	t.Run("segments that can't be compressed are flagged", func(t *testing.T) {
+	t.Run("reads that bypass the cache leave it untouched", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		var ur UlidRecall
-
-		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(ur.Gen))
+		d, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testRandX.MapTo(47))
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
 		r.NoError(err)
 
-		r.NoError(d.Close(ctx))
+		r.NoError(d.CloseSegment(ctx))
 
-		f, err := os.Open(filepath.Join(tmpdir, "segments", "segment."+ur.First().String()))
+		err = d.WriteExtent(ctx, testExtent.MapTo(10))
 		r.NoError(err)
 
-		defer f.Close()
+		big := make([]byte, 4*BlockSize)
 
-		br := bufio.NewReader(f)
+		_, err = io.ReadFull(rand.Reader, big)
+		r.NoError(err)
 
-		var cnt uint32
-		err = binary.Read(br, binary.BigEndian, &cnt)
+		err = d.WriteExtent(ctx, MapRangeData(Extent{20, 4}, big))
 		r.NoError(err)
 
-		r.Equal(uint32(1), cnt)
+		r.NoError(d.CloseSegment(ctx))
 
-		var hdrLen uint32
-		err = binary.Read(br, binary.BigEndian, &hdrLen)
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
 		r.NoError(err)
 
-		r.Equal(uint32(4+10), hdrLen)
+		extentEqual(t, testRandX, d2)
+
+		rc := d.er.rangeCache.(*RangeCache)
 
-		lba, err := binary.ReadUvarint(br)
+		cached := rc.lru.Keys()
+		r.NotEmpty(cached)
+
+		d2, err = d.ReadExtentWithOptions(ctx, Extent{LBA: 10, Blocks: 1}, ReadOptions{BypassCache: true})
 		r.NoError(err)
 
-		r.Equal(uint64(47), lba)
+		extentEqual(t, testExtent, d2)
 
-		bloccks, err := binary.ReadUvarint(br)
+		d2, err = d.ReadExtentWithOptions(ctx, Extent{LBA: 21, Blocks: 2}, ReadOptions{BypassCache: true})
 		r.NoError(err)
 
-		r.Equal(uint64(1), bloccks)
+		blockEqual(t, d2.ReadData(), big[BlockSize:3*BlockSize])
 
-		blkSize, err := binary.ReadUvarint(br)
+		r.Equal(cached, rc.lru.Keys())
+	})
+
+	t.Run("places the caches in the configured directories", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-		r.Equal(uint64(BlockSize), blkSize)
+		var (
+			path     = filepath.Join(tmpdir, "disk")
+			writeDir = filepath.Join(tmpdir, "nvme")
+			readDir  = filepath.Join(tmpdir, "hdd")
+		)
 
-		offset, err := binary.ReadUvarint(br)
+		r.NoError(os.Mkdir(path, 0755))
+
+		d, err := NewDisk(ctx, log, path, WithWriteCacheDir(writeDir), WithReadCacheDir(readDir))
 		r.NoError(err)
+		defer d.Close(ctx)
 
-		r.Equal(uint64(6), offset)
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		r.NoError(err)
 
-		_, err = f.Seek(int64(uint64(hdrLen)+offset), io.SeekStart)
+		written, err := filepath.Glob(filepath.Join(writeDir, "writecache.*"))
 		r.NoError(err)
+		r.Len(written, 1)
 
-		view := make([]byte, blkSize)
+		_, err = os.Stat(filepath.Join(readDir, "readcache"))
+		r.NoError(err)
 
-		_, err = io.ReadFull(f, view)
+		inPath, err := filepath.Glob(filepath.Join(path, "*cache*"))
 		r.NoError(err)
+		r.Empty(inPath)
 
-		blockEqual(t, testRand, view)
+		r.NoError(d.Close(ctx))
 
-		d2, err := NewDisk(ctx, log, tmpdir)
+		d, err = NewDisk(ctx, log, path, WithWriteCacheDir(writeDir), WithReadCacheDir(readDir))
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		x1, err := d2.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
 		r.NoError(err)
 
-		extentEqual(t, testRandX, x1)
+		extentEqual(t, testRandX, data)
 	})
 
-	t.Run("empty blocks are flagged specially", func(t *testing.T) {
+	t.Run("removes the write caches of flushed segments", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		var ur UlidRecall
-
-		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(ur.Gen))
+		d, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testEmptyX.MapTo(47))
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
 		r.NoError(err)
 
-		r.NoError(d.Close(ctx))
+		// Keep a copy of the write cache as if we'd stopped before removing
+		// it after the flush.
+		cachePath := d.writeCachePath(d.curSeq)
 
-		f, err := os.Open(filepath.Join(tmpdir, "segments", "segment."+ur.First().String()))
+		cache, err := os.ReadFile(cachePath)
 		r.NoError(err)
 
-		defer f.Close()
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
 
-		br := bufio.NewReader(f)
+		r.NoError(os.WriteFile(cachePath, cache, 0644))
 
-		var cnt uint32
-		err = binary.Read(br, binary.BigEndian, &cnt)
+		before, err := d.sa.ListSegments(ctx, d.volName)
 		r.NoError(err)
 
-		r.Equal(uint32(1), cnt)
-
-		var hdrLen uint32
-		err = binary.Read(br, binary.BigEndian, &hdrLen)
+		d, err = NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d.Close(ctx)
 
-		r.Equal(uint32(3+10), hdrLen)
+		_, err = os.Stat(cachePath)
+		r.True(os.IsNotExist(err))
 
-		lba, err := binary.ReadUvarint(br)
+		r.NoError(d.Close(ctx))
+
+		after, err := d.sa.ListSegments(ctx, d.volName)
 		r.NoError(err)
 
-		r.Equal(uint64(47), lba)
+		r.Equal(before, after)
+	})
 
-		blocks, err := binary.ReadUvarint(br)
+	t.Run("keeps filling the write cache after a crash", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-		r.Equal(uint64(1), blocks)
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
 
-		blkSize, err := binary.ReadUvarint(br)
+		for lba := LBA(0); lba < 4; lba++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(lba)))
+		}
+
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 4, Blocks: 2}))
+		r.NoError(d.SyncWriteCache())
+
+		before := d.Stats()
+
+		// Restart without closing the first disk.
+		d2, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d2.Close(ctx)
 
-		r.Equal(uint64(0), blkSize)
+		r.Equal(before.WriteCacheBytes, d2.Stats().WriteCacheBytes)
+		r.Equal(before.WriteCacheEntries, d2.Stats().WriteCacheEntries)
+		r.Equal(before.WriteCacheBlocks, d2.Stats().WriteCacheBlocks)
 
-		offset, err := binary.ReadUvarint(br)
+		r.NoError(d2.WriteExtent(ctx, testExtent.MapTo(6)))
+
+		r.Equal(before.WriteCacheEntries+1, d2.Stats().WriteCacheEntries)
+		r.Greater(d2.Stats().WriteCacheBytes, before.WriteCacheBytes)
+
+		data, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 7})
 		r.NoError(err)
 
-		r.Equal(uint64(5), offset)
+		blockEqual(t, testRandX, data.ReadData()[3*BlockSize:4*BlockSize])
+		r.True(emptyBytes(data.ReadData()[4*BlockSize : 6*BlockSize]))
+		blockEqual(t, testExtent, data.ReadData()[6*BlockSize:])
 	})
 
-	t.Run("reads empty from a previous empty write", func(t *testing.T) {
+	t.Run("reports segments that keep failing to flush", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
+		sa := &failingLocal{LocalFileAccess: LocalFileAccess{Dir: tmpdir}}
+		sa.failing.Store(true)
+
+		type flushErr struct {
+			seg SegmentId
+			err error
+		}
+
+		reported := make(chan flushErr, 1)
+
+		d, err := NewDisk(ctx, log, tmpdir,
+			WithSegmentAccess(sa),
+			WithFlushErrorHandler(func(seg SegmentId, err error) {
+				reported <- flushErr{seg, err}
+			}),
+		)
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testEmptyX.MapTo(0))
-		r.NoError(err)
+		d.flushRetryDelay = time.Millisecond
 
-		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
 		r.NoError(err)
 
-		r.True(isEmpty(data.RawBlocks().BlockView(0)))
+		seg := d.curSeq
 
-		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		closed := make(chan error, 1)
+		go func() {
+			closed <- d.CloseSegment(ctx)
+		}()
+
+		select {
+		case fe := <-reported:
+			r.Equal(seg, fe.seg)
+			r.ErrorContains(fe.err, "backend unavailable")
+		case <-time.After(10 * time.Second):
+			r.FailNow("flush error handler wasn't called")
+		}
+
+		// The flush is still retried, so the data isn't lost.
+		sa.failing.Store(false)
+
+		r.NoError(<-closed)
+
+		segments, err := sa.ListSegments(ctx, d.volName)
 		r.NoError(err)
+		r.Equal([]SegmentId{seg}, segments)
 
-		r.True(isEmpty(data.RawBlocks().BlockView(0)))
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testRandX, data)
 
+		// The segment written by the retry must be intact when read back.
 		r.NoError(d.Close(ctx))
+		r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
 
-		d, err = NewDisk(ctx, log, tmpdir)
+		d, err = NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		copy(data.RawBlocks().BlockView(0), testRand)
+		meta, ok := d.s.Metadata(seg)
+		r.True(ok)
+		r.NotEmpty(meta.WriterId)
 
 		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
 		r.NoError(err)
 
-		r.True(isEmpty(data.RawBlocks().BlockView(0)))
+		extentEqual(t, testRandX, data)
 	})
 
-	t.Run("can access blocks from the log", func(t *testing.T) {
+	t.Run("writes to clear blocks don't corrupt the cache", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
@@ -615,16 +740,1042 @@ func TestLSVD(t *testing.T) {
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(d.WriteExtent(ctx, testEmptyX.MapTo(47)))
+
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
 		r.NoError(err)
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testRandX, d2)
+	})
+
+	t.Run("stale reads aren't returned", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(0))
+		r.NoError(err)
+
+		t.Log("closing disk")
+		r.NoError(d.Close(ctx))
+
+		t.Log("reopening disk")
+		d, err = NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
 		r.NoError(err)
 
 		extentEqual(t, testExtent, d2)
+
+		err = d.WriteExtent(ctx, testExtent2.MapTo(0))
+		r.NoError(err)
+
+		d3, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testExtent2, d3)
+	})
+
+	t.Run("writes written out to an segment", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		var ur UlidRecall
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(ur.Gen))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(err)
+
+		t.Log("closing disk")
+		r.NoError(d.Close(ctx))
+
+		t.Log("reopening disk")
+		f, err := os.Open(filepath.Join(tmpdir, "segments", "segment."+ur.First().String()))
+		r.NoError(err)
+
+		defer f.Close()
+
+		br := bufio.NewReader(f)
+
+		var cnt uint32
+		err = binary.Read(br, binary.BigEndian, &cnt)
+		r.NoError(err)
+
+		r.Equal(uint32(1), cnt)
+
+		var hdrLen uint32
+		err = binary.Read(br, binary.BigEndian, &hdrLen)
+		r.NoError(err)
+
+		r.Equal(uint32(0xe)+segmentMetadataSize(t, d), hdrLen)
+
+		lba, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(47), lba)
+
+		blocks, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(1), blocks)
+
+		blkSize, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(0x28), blkSize)
+
+		// The only extent's data starts the body.
+		offset, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(0), offset)
+
+		rawSize, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(BlockSize), rawSize)
+
+		_, err = f.Seek(int64(uint64(hdrLen)+offset), io.SeekStart)
+		r.NoError(err)
+
+		view := make([]byte, BlockSize)
+
+		buf := make([]byte, blkSize)
+
+		_, err = io.ReadFull(f, buf)
+		r.NoError(err)
+
+		sz, err := lz4decode.UncompressBlock(buf, view, nil)
+		r.NoError(err)
+
+		view = view[:sz]
+
+		blockEqual(t, testData, view)
+
+		g, err := os.Open(filepath.Join(tmpdir, "volumes", "default", "segments"))
+		r.NoError(err)
+
+		defer g.Close()
+
+		gbr := bufio.NewReader(g)
+
+		var iseg SegmentId
+
+		_, err = gbr.Read(iseg[:])
+		r.NoError(err)
+
+		r.Equal(ulid.ULID(iseg), ur.First())
+	})
+
+	t.Run("segments that can't be compressed are flagged", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		var ur UlidRecall
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(ur.Gen))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testRandX.MapTo(47))
+		r.NoError(err)
+
+		r.NoError(d.Close(ctx))
+
+		f, err := os.Open(filepath.Join(tmpdir, "segments", "segment."+ur.First().String()))
+		r.NoError(err)
+
+		defer f.Close()
+
+		br := bufio.NewReader(f)
+
+		var cnt uint32
+		err = binary.Read(br, binary.BigEndian, &cnt)
+		r.NoError(err)
+
+		r.Equal(uint32(1), cnt)
+
+		var hdrLen uint32
+		err = binary.Read(br, binary.BigEndian, &hdrLen)
+		r.NoError(err)
+
+		r.Equal(uint32(4+10)+segmentMetadataSize(t, d), hdrLen)
+
+		lba, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(47), lba)
+
+		bloccks, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(1), bloccks)
+
+		blkSize, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(BlockSize), blkSize)
+
+		// The only extent's data starts the body.
+		offset, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(0), offset)
+
+		_, err = f.Seek(int64(uint64(hdrLen)+offset), io.SeekStart)
+		r.NoError(err)
+
+		view := make([]byte, blkSize)
+
+		_, err = io.ReadFull(f, view)
+		r.NoError(err)
+
+		blockEqual(t, testRand, view)
+
+		d2, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		x1, err := d2.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testRandX, x1)
+	})
+
+	t.Run("empty blocks are flagged specially", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		var ur UlidRecall
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(ur.Gen))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testEmptyX.MapTo(47))
+		r.NoError(err)
+
+		r.NoError(d.Close(ctx))
+
+		f, err := os.Open(filepath.Join(tmpdir, "segments", "segment."+ur.First().String()))
+		r.NoError(err)
+
+		defer f.Close()
+
+		br := bufio.NewReader(f)
+
+		var cnt uint32
+		err = binary.Read(br, binary.BigEndian, &cnt)
+		r.NoError(err)
+
+		r.Equal(uint32(1), cnt)
+
+		var hdrLen uint32
+		err = binary.Read(br, binary.BigEndian, &hdrLen)
+		r.NoError(err)
+
+		r.Equal(uint32(3+10)+segmentMetadataSize(t, d), hdrLen)
+
+		lba, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(47), lba)
+
+		blocks, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(1), blocks)
+
+		blkSize, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(0), blkSize)
+
+		offset, err := binary.ReadUvarint(br)
+		r.NoError(err)
+
+		r.Equal(uint64(0), offset)
+	})
+
+	t.Run("writing zeros doesn't grow the body", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		r.NoError(err)
+
+		body := d.curOC.BodySize()
+
+		zeros := NewRangeData(ctx, Extent{1, 256})
+		clear(zeros.WriteData())
+
+		err = d.WriteExtent(ctx, zeros)
+		r.NoError(err)
+
+		// Only the header logging the range is added, not its data.
+		r.Less(d.curOC.BodySize()-body, 16)
+
+		// Zeros over previously written data replace it.
+		err = d.WriteExtent(ctx, testEmptyX.MapTo(0))
+		r.NoError(err)
+
+		r.Less(d.curOC.BodySize()-body, 32)
+
+		check := func() {
+			data, err := d.ReadExtent(ctx, Extent{0, 257})
+			r.NoError(err)
+
+			r.True(data.EmptyP())
+		}
+
+		check()
+
+		r.NoError(d.CloseSegment(ctx))
+
+		check()
+	})
+
+	t.Run("returns the counts of written and empty blocks", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		zeros := NewRangeData(ctx, Extent{1, 4})
+		clear(zeros.WriteData())
+
+		counts, err := d.WriteExtentCounted(ctx, zeros)
+		r.NoError(err)
+
+		r.Equal(WriteCounts{EmptyBlocks: 4}, counts)
+
+		counts, err = d.WriteExtentCounted(ctx, testRandX.MapTo(0))
+		r.NoError(err)
+
+		r.Equal(WriteCounts{Blocks: 1}, counts)
+
+		data := NewRangeData(ctx, Extent{10, 2})
+		_, err = io.ReadFull(rand.Reader, data.WriteData())
+		r.NoError(err)
+
+		counts, err = d.WriteExtentsCounted(ctx, []RangeData{
+			data,
+			zeros,
+			testRandX.MapTo(20),
+			testEmptyX.MapTo(30),
+		})
+		r.NoError(err)
+
+		r.Equal(WriteCounts{Blocks: 3, EmptyBlocks: 5}, counts)
+	})
+
+	t.Run("reads empty from a previous empty write", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testEmptyX.MapTo(0))
+		r.NoError(err)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		r.True(isEmpty(data.RawBlocks().BlockView(0)))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		r.True(isEmpty(data.RawBlocks().BlockView(0)))
+
+		r.NoError(d.Close(ctx))
+
+		d, err = NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		copy(data.RawBlocks().BlockView(0), testRand)
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		r.True(isEmpty(data.RawBlocks().BlockView(0)))
+	})
+
+	t.Run("can access blocks from the log", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(err)
+
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testExtent, d2)
+	})
+
+	t.Run("can access blocks from the log when the check isn't active", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(err)
+
+		err = d.CloseSegment(ctx)
+		r.NoError(err)
+
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		r.NoError(err)
+
+		blockEqual(t, d2.RawBlocks().BlockView(0), testExtent[:BlockSize])
+	})
+
+	t.Run("rebuilds the LBA mappings", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(err)
+
+		d.lba2pba.m.Clear()
+
+		err = d.CloseSegment(ctx)
+		r.NoError(err)
+
+		d.lba2pba.m.Clear()
+
+		r.NoError(d.rebuildFromSegments(ctx))
+		r.NotZero(d.lba2pba.Len())
+
+		_, ok := d.lba2pba.m.Get(47)
+		r.True(ok)
+
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		r.NoError(err)
+
+		blockEqual(t, d2.RawBlocks().BlockView(0), testData)
+	})
+
+	t.Run("serializes the lba to pba mapping", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(err)
+
+		err = d.CloseSegment(ctx)
+		r.NoError(err)
+
+		sh, err := d.segmentsHash(ctx)
+		r.NoError(err)
+
+		r.NoError(d.saveLBAMap(ctx))
+
+		f, err := os.Open(filepath.Join(tmpdir, "head.map"))
+		r.NoError(err)
+
+		defer f.Close()
+
+		m, hdr, err := processLBAMap(log, f)
+		r.NoError(err)
+
+		_, ok := m.m.Get(47)
+		r.True(ok)
+
+		r.Equal(sh, hdr.SegmentsHash)
+	})
+
+	t.Run("loads a serialized map larger than the bulk load batch", func(t *testing.T) {
+		r := require.New(t)
+
+		defer func(n int) { lbaMapBulkLoad = n }(lbaMapBulkLoad)
+		lbaMapBulkLoad = 2
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		for _, lba := range []LBA{0, 10, 20, 30, 40} {
+			r.NoError(d.WriteExtent(ctx, testExtent.MapTo(lba)))
+		}
+
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.saveLBAMap(ctx))
+
+		f, err := os.Open(filepath.Join(tmpdir, "head.map"))
+		r.NoError(err)
+
+		defer f.Close()
+
+		m, _, err := processLBAMap(log, f)
+		r.NoError(err)
+
+		r.Equal(d.lba2pba.Len(), m.Len())
+		r.Equal(d.lba2pba.Snapshot(), m.Snapshot())
+		r.NoError(m.Validate(log))
+	})
+
+	t.Run("reuses serialized lba to pba map on start", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(err)
+
+		r.NoError(d.Close(ctx))
+
+		d2, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		r.NotZero(d2.lba2pba.Len())
+	})
+
+	t.Run("replays logs into l2p map if need be on load", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		r.NoError(err)
+
+		err = d.CloseSegment(ctx)
+		r.NoError(err)
+
+		r.NoError(d.saveLBAMap(ctx))
+
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(48)))
+
+		t.Log("reloading disk hot")
+
+		d.er.Close()
+
+		disk2, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer disk2.Close(ctx)
+
+		d2, err := disk2.ReadExtent(ctx, Extent{48, 1})
+		r.NoError(err)
+
+		blockEqual(t, testExtent2, d2.ReadData())
+	})
+
+	t.Run("with multiple blocks", func(t *testing.T) {
+		t.Run("writes are returned by next read", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			data := NewRangeData(ctx, Extent{0, 2})
+			ds := data.WriteData()
+			copy(ds, testData)
+			copy(ds[BlockSize:], testData)
+
+			err = d.WriteExtent(ctx, data)
+			r.NoError(err)
+
+			d2, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+			r.NoError(err)
+
+			blockEqual(t, d2.RawBlocks().BlockView(0), testData)
+
+			d3, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+			r.NoError(err)
+
+			blockEqual(t, d3.RawBlocks().BlockView(0), testData)
+		})
+
+		t.Run("reads can return multiple blocks", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			data := NewRangeData(ctx, Extent{0, 2})
+			copy(data.RawBlocks().BlockView(0), testData)
+			copy(data.RawBlocks().BlockView(1), testData)
+
+			err = d.WriteExtent(ctx, data)
+			r.NoError(err)
+
+			d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 2})
+			r.NoError(err)
+
+			blockEqual(t, d2.RawBlocks().BlockView(0), testData)
+			blockEqual(t, d2.RawBlocks().BlockView(1), testData)
+
+			d3, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+
+			blockEqual(t, d3.RawBlocks().BlockView(0), testData)
+			blockEqual(t, d2.RawBlocks().BlockView(1), testData)
+		})
+
+	})
+
+	t.Run("writes to the same block return the most recent", func(t *testing.T) {
+		t.Run("in the same instance", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			err = d.WriteExtent(ctx, testExtent.MapTo(0))
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
+			r.NoError(err)
+
+			d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+
+			extentEqual(t, testExtent2, d2)
+		})
+
+		t.Run("in a different instance", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			err = d.WriteExtent(ctx, testExtent.MapTo(0))
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
+			r.NoError(err)
+
+			r.NoError(d.Close(ctx))
+
+			t.Log("reopening disk")
+
+			d2, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d2.Close(ctx)
+
+			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+
+			extentEqual(t, testExtent2, x2)
+		})
+
+		t.Run("in a when recovering active", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent.MapTo(0))
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
+			r.NoError(err)
+
+			d.er.Close()
+
+			d2, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d2.Close(ctx)
+
+			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+
+			extentEqual(t, testExtent2, x2)
+		})
+
+		t.Run("across segments", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			err = d.WriteExtent(ctx, testExtent.MapTo(0))
+			r.NoError(err)
+
+			err = d.CloseSegment(ctx)
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
+			r.NoError(err)
+
+			r.NoError(d.Close(ctx))
+
+			d2, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d2.Close(ctx)
+
+			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+
+			extentEqual(t, testExtent2, x2)
+		})
+
+		t.Run("across segments without a lba map", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			err = d.WriteExtent(ctx, testExtent.MapTo(0))
+			r.NoError(err)
+
+			err = d.CloseSegment(ctx)
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
+			r.NoError(err)
+
+			r.NoError(d.Close(ctx))
+
+			r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
+
+			d2, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d2.Close(ctx)
+
+			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+
+			extentEqual(t, testExtent2, x2)
+		})
+
+		t.Run("across and within segments without a lba map", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			err = d.WriteExtent(ctx, testExtent.MapTo(0))
+			r.NoError(err)
+
+			err = d.CloseSegment(ctx)
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
+			r.NoError(err)
+
+			err = d.WriteExtent(ctx, testExtent3.MapTo(0))
+			r.NoError(err)
+
+			r.NoError(d.Close(ctx))
+
+			r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
+
+			d2, err := NewDisk(ctx, log, tmpdir)
+			r.NoError(err)
+			defer d2.Close(ctx)
+
+			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			r.NoError(err)
+
+			extentEqual(t, testExtent3, x2)
+		})
+	})
+
+	t.Run("tracks segment usage data", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(0))
+		r.NoError(err)
+
+		err = d.WriteExtent(ctx, testExtent2.MapTo(1))
+		r.NoError(err)
+
+		s1 := SegmentId(d.curSeq)
+		err = d.CloseSegment(ctx)
+		r.NoError(err)
+
+		r.Len(d.s.segments, 1)
+
+		stats, ok := d.s.segments[s1]
+		r.True(ok)
+
+		r.Equal(uint64(2), stats.Used)
+
+		err = d.WriteExtent(ctx, testExtent3.MapTo(0))
+		r.NoError(err)
+
+		err = d.CloseSegment(ctx)
+		r.NoError(err)
+
+		r.Len(d.s.segments, 2)
+
+		r.Equal(uint64(1), stats.Used)
+	})
+
+	t.Run("zero blocks works like an empty write", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		r.NoError(err)
+
+		err = d.ZeroBlocks(ctx, Extent{0, 1})
+		r.NoError(err)
+
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		//r.Nil(d2.ReadData(), "data shouldn't be allocated")
+		//r.True(d2.EmptyP())
+
+		data := d2.RawBlocks().BlockView(0)
+
+		r.True(isEmpty(data))
+	})
+
+	t.Run("coalesces contiguous zeroed ranges", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		// Zero 1GB in the 4MB pieces discards tend to arrive in.
+		const (
+			total = (1024 * 1024 * 1024) / BlockSize
+			piece = (4 * 1024 * 1024) / BlockSize
+		)
+
+		for lba := LBA(0); lba < total; lba += piece {
+			r.NoError(d.ZeroBlocks(ctx, Extent{LBA: lba, Blocks: piece}))
+		}
+
+		r.LessOrEqual(d.curOC.Entries(), 6)
+
+		r.NoError(d.CloseSegment(ctx))
+
+		// Extents are capped at MaxBlocks, so 1GB takes at least 5.
+		r.LessOrEqual(d.lba2pba.Len(), 5)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 2})
+		r.NoError(err)
+		r.True(isEmpty(data.ReadData()))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: total - 1, Blocks: 1})
+		r.NoError(err)
+		r.True(isEmpty(data.ReadData()))
+	})
+
+	t.Run("doesn't coalesce zeroed ranges across a write", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 0, Blocks: 10}))
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 5, Blocks: 10}))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(7)))
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 15, Blocks: 5}))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(20)))
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 21, Blocks: 5}))
+
+		r.Equal(5, d.curOC.Entries())
+
+		check := func() {
+			data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 26})
+			r.NoError(err)
+
+			for i := 0; i < 26; i++ {
+				blk := data.ReadData()[i*BlockSize : (i+1)*BlockSize]
+				if i == 7 || i == 20 {
+					r.Equal(testRand, blk, "block %d", i)
+				} else {
+					r.True(isEmpty(blk), "block %d", i)
+				}
+			}
+		}
+
+		check()
+
+		r.NoError(d.CloseSegment(ctx))
+
+		check()
+	})
+
+	t.Run("reads the new data after an overwrite", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		// Reading puts the data in the read cache.
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testRandX, data)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testExtent, data)
+
+		r.NoError(d.CloseSegment(ctx))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testExtent, data)
 	})
 
-	t.Run("can access blocks from the log when the check isn't active", func(t *testing.T) {
+	t.Run("trims ranges larger than an extent", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
@@ -635,396 +1786,481 @@ func TestLSVD(t *testing.T) {
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(47))
-		r.NoError(err)
+		far := LBA(MaxBlocks + 10)
 
-		err = d.CloseSegment(ctx)
-		r.NoError(err)
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(far)))
+		r.NoError(d.CloseSegment(ctx))
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		for _, lba := range []LBA{0, far} {
+			data, err := d.ReadExtent(ctx, Extent{LBA: lba, Blocks: 1})
+			r.NoError(err)
+			extentEqual(t, testRandX, data)
+		}
+
+		r.NoError(d.Trim(ctx, Extent{LBA: 0, Blocks: 2 * MaxBlocks}))
+
+		check := func() {
+			for _, lba := range []LBA{0, far, 2*MaxBlocks - 1} {
+				data, err := d.ReadExtent(ctx, Extent{LBA: lba, Blocks: 1})
+				r.NoError(err)
+				r.True(isEmpty(data.ReadData()), "lba %d", lba)
+			}
+		}
+
+		check()
+
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.resolveSegmentAccess(Extent{LBA: 0, Blocks: 2 * MaxBlocks})
 		r.NoError(err)
+		r.NotEmpty(pes)
 
-		blockEqual(t, d2.RawBlocks().BlockView(0), testExtent[:BlockSize])
+		for _, pe := range pes {
+			r.LessOrEqual(pe.Extent.Blocks, uint32(MaxBlocks))
+		}
+
+		check()
 	})
 
-	t.Run("rebuilds the LBA mappings", func(t *testing.T) {
+	t.Run("trimming hides data that is still being flushed", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
+		var sa slowLocal
+
+		sa.Dir = tmpdir
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa), WithMaxConcurrentFlushes(2))
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(47))
-		r.NoError(err)
+		sa.wait = make(chan struct{})
 
-		d.lba2pba.m.Clear()
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
 
-		err = d.CloseSegment(ctx)
+		_, err = d.closeSegmentAsync(ctx)
 		r.NoError(err)
 
-		d.lba2pba.m.Clear()
-
-		r.NoError(d.rebuildFromSegments(ctx))
-		r.NotZero(d.lba2pba.Len())
+		r.Len(d.prevCache.Load(), 1)
 
-		_, ok := d.lba2pba.m.Get(47)
-		r.True(ok)
+		r.NoError(d.Trim(ctx, Extent{LBA: 0, Blocks: 1}))
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
 		r.NoError(err)
+		r.True(isEmpty(data.ReadData()))
 
-		blockEqual(t, d2.RawBlocks().BlockView(0), testData)
+		close(sa.wait)
+
+		r.NoError(d.CloseSegment(ctx))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		r.True(isEmpty(data.ReadData()))
 	})
 
-	t.Run("serializes the lba to pba mapping", func(t *testing.T) {
+	t.Run("can use the write cache while currently uploading", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
+		var sa slowLocal
+
+		sa.Dir = tmpdir
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa))
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(47))
-		r.NoError(err)
+		sa.wait = make(chan struct{})
+		defer close(sa.wait)
 
-		err = d.CloseSegment(ctx)
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
 		r.NoError(err)
 
-		sh, err := d.segmentsHash(ctx)
+		_, err = d.closeSegmentAsync(ctx)
 		r.NoError(err)
 
-		r.NoError(d.saveLBAMap(ctx))
-
-		f, err := os.Open(filepath.Join(tmpdir, "head.map"))
-		r.NoError(err)
+		time.Sleep(100 * time.Millisecond)
 
-		defer f.Close()
+		r.True(sa.waiting.Load())
 
-		m, hdr, err := processLBAMap(log, f)
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
 		r.NoError(err)
 
-		_, ok := m.m.Get(47)
-		r.True(ok)
-
-		r.Equal(sh, hdr.SegmentsHash)
+		extentEqual(t, testRandX, d2)
 	})
 
-	t.Run("reuses serialized lba to pba map on start", func(t *testing.T) {
+	t.Run("reads partly from both write caches and an segment", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
+		var sa slowLocal
+
+		sa.Dir = tmpdir
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa))
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(47))
+		data := NewRangeData(ctx, Extent{0, 10})
+		_, err = io.ReadFull(rand.Reader, data.WriteData())
 		r.NoError(err)
 
-		r.NoError(d.Close(ctx))
+		err = d.WriteExtent(ctx, data)
+		r.NoError(err)
 
-		d2, err := NewDisk(ctx, log, tmpdir)
+		err = d.CloseSegment(ctx)
 		r.NoError(err)
 
-		r.NotZero(d2.lba2pba.Len())
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		r.NoError(err)
+
+		sa.wait = make(chan struct{})
+		defer close(sa.wait)
+
+		_, err = d.closeSegmentAsync(ctx)
+		r.NoError(err)
+
+		time.Sleep(100 * time.Millisecond)
+
+		r.True(sa.waiting.Load())
+
+		err = d.WriteExtent(ctx, testExtent.MapTo(1))
+		r.NoError(err)
+
+		t.Log("performing read")
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 4})
+		r.NoError(err)
+
+		blockEqual(t, testRandX, d2.ReadData()[:BlockSize])
+		blockEqual(t, testExtent, d2.ReadData()[BlockSize:BlockSize*2])
+		blockEqual(t,
+			data.ReadData()[BlockSize*2:BlockSize*4],
+			d2.ReadData()[BlockSize*2:BlockSize*4],
+		)
 	})
 
-	t.Run("replays logs into l2p map if need be on load", func(t *testing.T) {
+	t.Run("blocks writes when flushes can't keep up", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
+		var sa slowLocal
+
+		sa.Dir = tmpdir
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa), WithMaxConcurrentFlushes(1))
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(47))
-		r.NoError(err)
+		sa.wait = make(chan struct{})
 
-		err = d.CloseSegment(ctx)
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
 		r.NoError(err)
 
-		r.NoError(d.saveLBAMap(ctx))
-
-		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(48)))
+		_, err = d.closeSegmentAsync(ctx)
+		r.NoError(err)
 
-		t.Log("reloading disk hot")
+		time.Sleep(100 * time.Millisecond)
 
-		d.er.Close()
+		r.True(sa.waiting.Load())
 
-		disk2, err := NewDisk(ctx, log, tmpdir)
+		data := NewRangeData(ctx, Extent{1, FlushThreshHold / BlockSize})
+		_, err = io.ReadFull(rand.Reader, data.WriteData())
 		r.NoError(err)
-		defer disk2.Close(ctx)
 
-		d2, err := disk2.ReadExtent(ctx, Extent{48, 1})
-		r.NoError(err)
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
 
-		blockEqual(t, testExtent2, d2.ReadData())
-	})
+		err = d.WriteExtent(tctx, data)
+		r.ErrorIs(err, context.DeadlineExceeded)
 
-	t.Run("with multiple blocks", func(t *testing.T) {
-		t.Run("writes are returned by next read", func(t *testing.T) {
-			r := require.New(t)
+		r.Len(d.prevCache.Load(), 1)
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+		close(sa.wait)
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d.Close(ctx)
+		err = d.WriteExtent(ctx, testExtent.MapTo(0))
+		r.NoError(err)
 
-			data := NewRangeData(ctx, Extent{0, 2})
-			ds := data.WriteData()
-			copy(ds, testData)
-			copy(ds[BlockSize:], testData)
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
 
-			err = d.WriteExtent(ctx, data)
-			r.NoError(err)
+		extentEqual(t, testExtent, d2)
 
-			d2, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
-			r.NoError(err)
+		d2, err = d.ReadExtent(ctx, data.Extent)
+		r.NoError(err)
 
-			blockEqual(t, d2.RawBlocks().BlockView(0), testData)
+		r.Equal(data.ReadData(), d2.ReadData())
+	})
 
-			d3, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
-			r.NoError(err)
+	t.Run("publishes the segment before a write that fills it returns", func(t *testing.T) {
+		r := require.New(t)
 
-			blockEqual(t, d3.RawBlocks().BlockView(0), testData)
-		})
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-		t.Run("reads can return multiple blocks", func(t *testing.T) {
-			r := require.New(t)
+		d, err := NewDisk(ctx, log, tmpdir, WithSynchronousFlush())
+		r.NoError(err)
+		defer d.Close(ctx)
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+		data := NewRangeData(ctx, Extent{0, FlushThreshHold / BlockSize})
+		_, err = io.ReadFull(rand.Reader, data.WriteData())
+		r.NoError(err)
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d.Close(ctx)
+		r.NoError(d.WriteExtent(ctx, data))
 
-			data := NewRangeData(ctx, Extent{0, 2})
-			copy(data.RawBlocks().BlockView(0), testData)
-			copy(data.RawBlocks().BlockView(1), testData)
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 1)
 
-			err = d.WriteExtent(ctx, data)
-			r.NoError(err)
+		pes, err := d.resolveSegmentAccess(data.Extent)
+		r.NoError(err)
+		r.Len(pes, 1)
+		r.Equal(segs[0], pes[0].Segment)
 
-			d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 2})
-			r.NoError(err)
+		r.Empty(d.prevCache.Load())
+	})
 
-			blockEqual(t, d2.RawBlocks().BlockView(0), testData)
-			blockEqual(t, d2.RawBlocks().BlockView(1), testData)
+	t.Run("a synchronous flush stops waiting when the write is canceled", func(t *testing.T) {
+		r := require.New(t)
 
-			d3, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-			r.NoError(err)
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-			blockEqual(t, d3.RawBlocks().BlockView(0), testData)
-			blockEqual(t, d2.RawBlocks().BlockView(1), testData)
-		})
+		var sa slowLocal
 
-	})
+		sa.Dir = tmpdir
 
-	t.Run("writes to the same block return the most recent", func(t *testing.T) {
-		t.Run("in the same instance", func(t *testing.T) {
-			r := require.New(t)
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa), WithSynchronousFlush())
+		r.NoError(err)
+		defer d.Close(ctx)
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+		sa.wait = make(chan struct{})
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d.Close(ctx)
+		data := NewRangeData(ctx, Extent{0, FlushThreshHold / BlockSize})
+		_, err = io.ReadFull(rand.Reader, data.WriteData())
+		r.NoError(err)
 
-			err = d.WriteExtent(ctx, testExtent.MapTo(0))
-			r.NoError(err)
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
 
-			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
-			r.NoError(err)
+		err = d.WriteExtent(tctx, data)
+		r.ErrorIs(err, context.DeadlineExceeded)
 
-			d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-			r.NoError(err)
+		// The flush carries on in the background.
+		close(sa.wait)
 
-			extentEqual(t, testExtent2, d2)
-		})
+		r.Eventually(func() bool {
+			segs, err := d.sa.ListSegments(ctx, d.volName)
+			return err == nil && len(segs) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
 
-		t.Run("in a different instance", func(t *testing.T) {
-			r := require.New(t)
+	t.Run("reads from the newest of several pending write caches", func(t *testing.T) {
+		r := require.New(t)
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d.Close(ctx)
+		var sa slowLocal
 
-			err = d.WriteExtent(ctx, testExtent.MapTo(0))
-			r.NoError(err)
+		sa.Dir = tmpdir
 
-			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
-			r.NoError(err)
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa), WithMaxConcurrentFlushes(2))
+		r.NoError(err)
+		defer d.Close(ctx)
 
-			r.NoError(d.Close(ctx))
+		sa.wait = make(chan struct{})
+		defer close(sa.wait)
 
-			t.Log("reopening disk")
+		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		r.NoError(err)
 
-			d2, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d2.Close(ctx)
+		err = d.WriteExtent(ctx, testRandX.MapTo(1))
+		r.NoError(err)
 
-			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-			r.NoError(err)
+		_, err = d.closeSegmentAsync(ctx)
+		r.NoError(err)
 
-			extentEqual(t, testExtent2, x2)
-		})
+		err = d.WriteExtent(ctx, testExtent.MapTo(0))
+		r.NoError(err)
 
-		t.Run("in a when recovering active", func(t *testing.T) {
-			r := require.New(t)
+		_, err = d.closeSegmentAsync(ctx)
+		r.NoError(err)
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+		r.Len(d.prevCache.Load(), 2)
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 2})
+		r.NoError(err)
 
-			err = d.WriteExtent(ctx, testExtent.MapTo(0))
-			r.NoError(err)
+		blockEqual(t, testExtent, d2.ReadData()[:BlockSize])
+		blockEqual(t, testRandX, d2.ReadData()[BlockSize:])
+	})
 
-			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
-			r.NoError(err)
+	t.Run("fills a failed read from the write cache of the segment", func(t *testing.T) {
+		r := require.New(t)
 
-			d.er.Close()
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-			d2, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d2.Close(ctx)
+		sa := newMemAccess()
 
-			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-			r.NoError(err)
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa), WithoutReadCache())
+		r.NoError(err)
+		defer d.Close(ctx)
 
-			extentEqual(t, testExtent2, x2)
-		})
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
 
-		t.Run("across segments", func(t *testing.T) {
-			r := require.New(t)
+		// Flush the write cache by hand, stopping where the map points at
+		// the segment but the write cache is still held.
+		seg := d.curSeq
+		oc := d.curOC
+		oc.segment = seg
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+		r.NoError(d.prevCache.Add(ctx, oc))
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d.Close(ctx)
+		d.curOC, err = d.newSegmentCreator()
+		r.NoError(err)
 
-			err = d.WriteExtent(ctx, testExtent.MapTo(0))
-			r.NoError(err)
+		entries, stats, err := oc.Flush(ctx, d.sa, seg)
+		r.NoError(err)
 
-			err = d.CloseSegment(ctx)
-			r.NoError(err)
+		d.s.Create(seg, stats)
+		r.NoError(d.lba2pba.UpdateBatch(log, entries, seg, d.s))
 
-			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
-			r.NoError(err)
+		// Newer than the segment's data, so it must not be used to fill it.
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(0)))
 
-			r.NoError(d.Close(ctx))
+		sa.mu.Lock()
+		delete(sa.segments, seg)
+		sa.mu.Unlock()
 
-			d2, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d2.Close(ctx)
+		rng := Extent{LBA: 0, Blocks: 2}
 
-			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-			r.NoError(err)
+		pes, err := d.resolveSegmentAccess(rng)
+		r.NoError(err)
+		r.Len(pes, 2)
 
-			extentEqual(t, testExtent2, x2)
-		})
+		data := NewRangeData(ctx, rng)
 
-		t.Run("across segments without a lba map", func(t *testing.T) {
-			r := require.New(t)
+		for _, pe := range pes {
+			r.Equal(seg, pe.Segment)
+			r.NoError(d.readPartialExtent(ctx, &pe, []Extent{rng}, rng, data, false))
+		}
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+		blockEqual(t, testRandX, data.ReadData()[:BlockSize])
+		blockEqual(t, testExtent, data.ReadData()[BlockSize:])
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d.Close(ctx)
+		d.prevCache.Remove(oc)
+		r.NoError(oc.Close())
 
-			err = d.WriteExtent(ctx, testExtent.MapTo(0))
-			r.NoError(err)
+		r.Error(d.readPartialExtent(ctx, &pes[0], []Extent{rng}, rng, data, false))
+	})
 
-			err = d.CloseSegment(ctx)
-			r.NoError(err)
+	t.Run("supports writing multiple ranges at once", func(t *testing.T) {
+		r := require.New(t)
 
-			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
-			r.NoError(err)
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-			r.NoError(d.Close(ctx))
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
 
-			r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
+		err = d.WriteExtents(ctx, []RangeData{
+			testRandX.MapTo(0),
+			testRandX.MapTo(47),
+		})
+		r.NoError(err)
 
-			d2, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d2.Close(ctx)
+		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
 
-			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-			r.NoError(err)
+		extentEqual(t, testRandX, d2)
+		r.NoError(err)
 
-			extentEqual(t, testExtent2, x2)
-		})
+		d3, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		r.NoError(err)
 
-		t.Run("across and within segments without a lba map", func(t *testing.T) {
-			r := require.New(t)
+		extentEqual(t, testRandX, d3)
+		r.NoError(err)
+	})
 
-			tmpdir, err := os.MkdirTemp("", "lsvd")
-			r.NoError(err)
-			defer os.RemoveAll(tmpdir)
+	t.Run("reports the segment multiple ranges are written to", func(t *testing.T) {
+		r := require.New(t)
 
-			d, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d.Close(ctx)
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-			err = d.WriteExtent(ctx, testExtent.MapTo(0))
-			r.NoError(err)
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
 
-			err = d.CloseSegment(ctx)
-			r.NoError(err)
+		first, err := d.WriteExtentsPlaced(ctx, []RangeData{
+			testRandX.MapTo(0),
+			testRandX.MapTo(47),
+		})
+		r.NoError(err)
+		r.False(first.Flushed)
+		r.Equal(2, first.Blocks)
 
-			err = d.WriteExtent(ctx, testExtent2.MapTo(0))
-			r.NoError(err)
+		// Filling the segment starts its flush, so these land in the same
+		// segment as the first writes.
+		big := NewRangeData(ctx, Extent{100, FlushThreshHold / BlockSize})
+		_, err = io.ReadFull(rand.Reader, big.WriteData())
+		r.NoError(err)
 
-			err = d.WriteExtent(ctx, testExtent3.MapTo(0))
-			r.NoError(err)
+		second, err := d.WriteExtentsPlaced(ctx, []RangeData{big})
+		r.NoError(err)
+		r.True(second.Flushed)
+		r.Equal(first.Segment, second.Segment)
 
-			r.NoError(d.Close(ctx))
+		third, err := d.WriteExtentsPlaced(ctx, []RangeData{testExtent.MapTo(1)})
+		r.NoError(err)
+		r.False(third.Flushed)
+		r.NotEqual(first.Segment, third.Segment)
 
-			r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
+		r.NoError(d.CloseSegment(ctx))
 
-			d2, err := NewDisk(ctx, log, tmpdir)
-			r.NoError(err)
-			defer d2.Close(ctx)
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Equal([]SegmentId{first.Segment, third.Segment}, segs)
 
-			x2, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		for _, x := range []struct {
+			ext Extent
+			seg SegmentId
+		}{
+			{Extent{0, 1}, first.Segment},
+			{Extent{47, 1}, first.Segment},
+			{big.Extent, first.Segment},
+			{Extent{1, 1}, third.Segment},
+		} {
+			pes, err := d.resolveSegmentAccess(x.ext)
 			r.NoError(err)
-
-			extentEqual(t, testExtent3, x2)
-		})
+			r.Len(pes, 1)
+			r.Equal(x.seg, pes[0].Segment)
+		}
 	})
 
-	t.Run("tracks segment usage data", func(t *testing.T) {
+	t.Run("collapses a contiguous incompressible region in the map", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
@@ -1035,97 +2271,120 @@ func TestLSVD(t *testing.T) {
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(0))
-		r.NoError(err)
+		const blocks = 4 * maxCombinedBlocks
 
-		err = d.WriteExtent(ctx, testExtent2.MapTo(1))
+		region := make([]byte, blocks*BlockSize)
+		_, err = io.ReadFull(rand.Reader, region)
 		r.NoError(err)
 
-		s1 := SegmentId(d.curSeq)
-		err = d.CloseSegment(ctx)
-		r.NoError(err)
+		for lba := LBA(0); lba < blocks; lba += 4 {
+			data := region[int(lba)*BlockSize : int(lba+4)*BlockSize]
+			r.NoError(d.WriteExtent(ctx, MapRangeData(Extent{lba, 4}, data)))
+		}
 
-		r.Len(d.s.segments, 1)
+		// Compressed and empty extents are kept apart from the region.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(blocks)))
+		r.NoError(d.ZeroBlocks(ctx, Extent{blocks + 1, 4}))
 
-		stats, ok := d.s.segments[s1]
-		r.True(ok)
+		r.NoError(d.CloseSegment(ctx))
 
-		r.Equal(uint64(2), stats.Used)
+		r.Equal(6, d.lba2pba.Len())
 
-		err = d.WriteExtent(ctx, testExtent3.MapTo(0))
+		got, err := d.ReadExtent(ctx, Extent{0, blocks})
 		r.NoError(err)
+		r.Equal(region, got.ReadData())
 
-		err = d.CloseSegment(ctx)
+		// A read across the entries.
+		got, err = d.ReadExtent(ctx, Extent{maxCombinedBlocks - 2, 4})
 		r.NoError(err)
+		r.Equal(region[(maxCombinedBlocks-2)*BlockSize:(maxCombinedBlocks+2)*BlockSize], got.ReadData())
 
-		r.Len(d.s.segments, 2)
-
-		r.Equal(uint64(1), stats.Used)
+		got, err = d.ReadExtent(ctx, Extent{blocks, 1})
+		r.NoError(err)
+		extentEqual(t, testExtent, got)
 	})
 
-	t.Run("zero blocks works like an empty write", func(t *testing.T) {
+	t.Run("collapses the map no further than the max extent size", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
+		d, err := NewDisk(ctx, log, tmpdir, WithMaxExtentSize(4*BlockSize))
 		r.NoError(err)
 		defer d.Close(ctx)
 
-		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		region := make([]byte, 16*BlockSize)
+		_, err = io.ReadFull(rand.Reader, region)
 		r.NoError(err)
 
-		err = d.ZeroBlocks(ctx, Extent{0, 1})
-		r.NoError(err)
+		for lba := LBA(0); lba < 16; lba += 2 {
+			data := region[int(lba)*BlockSize : int(lba+2)*BlockSize]
+			r.NoError(d.WriteExtent(ctx, MapRangeData(Extent{lba, 2}, data)))
+		}
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
-		r.NoError(err)
+		r.NoError(d.CloseSegment(ctx))
 
-		//r.Nil(d2.ReadData(), "data shouldn't be allocated")
-		//r.True(d2.EmptyP())
+		// Pairs of writes are merged up to the 4 blocks extents are capped at.
+		r.Equal(4, d.lba2pba.Len())
 
-		data := d2.RawBlocks().BlockView(0)
+		for i := d.lba2pba.LockedIterator(); i.Valid(); i.Next() {
+			r.LessOrEqual(i.Value().Live.Blocks, uint32(4))
+		}
 
-		r.True(isEmpty(data))
+		got, err := d.ReadExtent(ctx, Extent{0, 16})
+		r.NoError(err)
+		r.Equal(region, got.ReadData())
 	})
 
-	t.Run("can use the write cache while currently uploading", func(t *testing.T) {
+	t.Run("rejects IO once detached", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		var sa slowLocal
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
 
-		sa.Dir = tmpdir
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
 
-		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa))
+		_, err = d.ReadExtent(ctx, Extent{0, 1})
 		r.NoError(err)
-		defer d.Close(ctx)
 
-		sa.wait = make(chan struct{})
-		defer close(sa.wait)
+		r.NoError(d.Detach(ctx))
 
-		err = d.WriteExtent(ctx, testRandX.MapTo(0))
-		r.NoError(err)
+		r.ErrorIs(d.WriteExtent(ctx, testRandX.MapTo(1)), ErrDetached)
+		r.ErrorIs(d.WriteExtents(ctx, []RangeData{testRandX.MapTo(1)}), ErrDetached)
+		r.ErrorIs(d.ZeroBlocks(ctx, Extent{1, 1}), ErrDetached)
+		r.ErrorIs(d.Trim(ctx, Extent{1, 1}), ErrDetached)
+		r.ErrorIs(d.CloseSegment(ctx), ErrDetached)
+		r.ErrorIs(d.SyncWriteCache(), ErrDetached)
 
-		_, err = d.closeSegmentAsync(ctx)
-		r.NoError(err)
+		_, err = d.ReadExtent(ctx, Extent{0, 1})
+		r.ErrorIs(err, ErrDetached)
 
-		time.Sleep(100 * time.Millisecond)
+		// Stats still report what the disk did before detaching.
+		r.Greater(d.Stats().ReadCacheBlocks, 0.0)
 
-		r.True(sa.waiting.Load())
+		infos, err := d.ListSegmentInfo(ctx)
+		r.NoError(err)
+		r.Len(infos, 1)
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(d.Close(ctx))
+
+		// The volume was flushed for the next disk to attach to.
+		d2, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d2.Close(ctx)
 
-		extentEqual(t, testRandX, d2)
+		data, err := d2.ReadExtent(ctx, Extent{0, 1})
+		r.NoError(err)
+		extentEqual(t, testRandX, data)
 	})
 
-	t.Run("reads partly from both write caches and an segment", func(t *testing.T) {
+	t.Run("close saves what it can before the deadline", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
@@ -1138,74 +2397,131 @@ func TestLSVD(t *testing.T) {
 
 		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa))
 		r.NoError(err)
-		defer d.Close(ctx)
 
-		data := NewRangeData(ctx, Extent{0, 10})
-		_, err = io.ReadFull(rand.Reader, data.WriteData())
+		sa.wait = make(chan struct{})
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer scancel()
+
+		start := time.Now()
+
+		err = d.Close(sctx)
+		r.Less(time.Since(start), time.Second)
+
+		r.ErrorIs(err, context.DeadlineExceeded)
+
+		var cerr *CloseError
+		r.ErrorAs(err, &cerr)
+		r.Empty(cerr.Completed)
+
+		// The flush is still running, so the map isn't saved.
+		_, err = os.Stat(filepath.Join(tmpdir, "head.map"))
+		r.ErrorIs(err, os.ErrNotExist)
+
+		// Let the flush finish before the volume is reopened.
+		close(sa.wait)
+		d.wg.Wait()
+
+		d2, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d2.Close(ctx)
 
-		err = d.WriteExtent(ctx, data)
+		data, err := d2.ReadExtent(ctx, Extent{0, 1})
 		r.NoError(err)
+		extentEqual(t, testRandX, data)
+	})
 
-		err = d.CloseSegment(ctx)
+	t.Run("a detach cut short keeps reporting what didn't complete", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
 
-		err = d.WriteExtent(ctx, testRandX.MapTo(0))
+		var sa slowLocal
+
+		sa.Dir = tmpdir
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa))
 		r.NoError(err)
 
 		sa.wait = make(chan struct{})
-		defer close(sa.wait)
 
-		_, err = d.closeSegmentAsync(ctx)
-		r.NoError(err)
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
 
-		time.Sleep(100 * time.Millisecond)
+		sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer scancel()
 
-		r.True(sa.waiting.Load())
+		err = d.Detach(sctx)
+		r.ErrorIs(err, context.DeadlineExceeded)
 
-		err = d.WriteExtent(ctx, testExtent.MapTo(1))
-		r.NoError(err)
+		var cerr *CloseError
+		r.ErrorAs(err, &cerr)
 
-		t.Log("performing read")
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 4})
+		// Retrying doesn't claim the detach succeeded.
+		r.Equal(err, d.Detach(ctx))
+		r.Equal(err, d.Close(ctx))
+
+		r.ErrorIs(d.WriteExtent(ctx, testRandX.MapTo(1)), ErrDetached)
+
+		close(sa.wait)
+		d.wg.Wait()
+
+		d2, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d2.Close(ctx)
 
-		blockEqual(t, testRandX, d2.ReadData()[:BlockSize])
-		blockEqual(t, testExtent, d2.ReadData()[BlockSize:BlockSize*2])
-		blockEqual(t,
-			data.ReadData()[BlockSize*2:BlockSize*4],
-			d2.ReadData()[BlockSize*2:BlockSize*4],
-		)
+		data, err := d2.ReadExtent(ctx, Extent{0, 1})
+		r.NoError(err)
+		extentEqual(t, testRandX, data)
 	})
 
-	t.Run("supports writing multiple ranges at once", func(t *testing.T) {
+	t.Run("close doesn't save a map missing a segment being applied", func(t *testing.T) {
 		r := require.New(t)
 
 		tmpdir, err := os.MkdirTemp("", "lsvd")
 		r.NoError(err)
 		defer os.RemoveAll(tmpdir)
 
-		d, err := NewDisk(ctx, log, tmpdir)
-		r.NoError(err)
-		defer d.Close(ctx)
+		sa := &stallAfterAppend{
+			appended: make(chan struct{}),
+			wait:     make(chan struct{}),
+		}
 
-		err = d.WriteExtents(ctx, []RangeData{
-			testRandX.MapTo(0),
-			testRandX.MapTo(47),
-		})
-		r.NoError(err)
+		sa.Dir = tmpdir
 
-		d2, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
 		r.NoError(err)
 
-		extentEqual(t, testRandX, d2)
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		_, err = d.closeSegmentAsync(ctx)
 		r.NoError(err)
 
-		d3, err := d.ReadExtent(ctx, Extent{LBA: 47, Blocks: 1})
+		// The segment is listed, but the map hasn't been updated for it.
+		<-sa.appended
+
+		sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer scancel()
+
+		err = d.Close(sctx)
+		r.ErrorIs(err, context.DeadlineExceeded)
+
+		_, err = os.Stat(filepath.Join(tmpdir, "head.map"))
+		r.ErrorIs(err, os.ErrNotExist)
+
+		close(sa.wait)
+		d.wg.Wait()
+
+		d2, err := NewDisk(ctx, log, tmpdir)
 		r.NoError(err)
+		defer d2.Close(ctx)
 
-		extentEqual(t, testRandX, d3)
+		data, err := d2.ReadExtent(ctx, Extent{0, 1})
 		r.NoError(err)
+		extentEqual(t, testRandX, data)
 	})
 
 	t.Run("supports reading blocks from a read-only higher layer", func(t *testing.T) {
@@ -1455,6 +2771,232 @@ func TestLSVD(t *testing.T) {
 		extentEqual(t, testExtent, data2)
 	})
 
+	t.Run("bounded reads past the end return an error", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithBoundedReads())
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		d.size = 10 * BlockSize
+
+		_, err = d.ReadExtent(ctx, Extent{LBA: 10, Blocks: 1})
+		r.ErrorIs(err, ErrOutOfRange)
+
+		_, err = d.ReadExtent(ctx, Extent{LBA: 100, Blocks: 4})
+		r.ErrorIs(err, ErrOutOfRange)
+	})
+
+	t.Run("bounded reads that straddle the end are zero filled", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithBoundedReads())
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		d.size = 10 * BlockSize
+
+		err = d.WriteExtent(ctx, testRandX.MapTo(9))
+		r.NoError(err)
+
+		// Data written past the end is never returned.
+		err = d.WriteExtent(ctx, testRandX.MapTo(10))
+		r.NoError(err)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 8, Blocks: 4})
+		r.NoError(err)
+
+		n := data.ReadData()
+		r.True(isEmpty(n[:BlockSize]))
+		blockEqual(t, testRandX, n[BlockSize:BlockSize*2])
+		r.True(isEmpty(n[BlockSize*2:]))
+
+		r.NoError(d.CloseSegment(ctx))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 9, Blocks: 2})
+		r.NoError(err)
+
+		n = data.ReadData()
+		blockEqual(t, testRandX, n[:BlockSize])
+		r.True(isEmpty(n[BlockSize:]))
+	})
+
+	t.Run("unbounded reads past the end return zeros", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		d.size = 10 * BlockSize
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 100, Blocks: 1})
+		r.NoError(err)
+
+		r.True(isEmpty(data.ReadData()))
+	})
+
+	t.Run("segment ids stay monotonic when the clock goes backwards", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		now := time.Now()
+		clk := newFakeClock(now)
+
+		d, err := NewDisk(ctx, log, tmpdir,
+			WithEntropy(mrand.New(mrand.NewSource(1))),
+			WithClock(clk),
+		)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		first := d.curSeq
+		r.Equal(ulid.Timestamp(now), ulid.ULID(first).Time())
+
+		for _, delta := range []time.Duration{0, -time.Hour, time.Second, -time.Minute} {
+			now = now.Add(delta)
+			clk.Set(now)
+
+			seq, err := d.nextSeq()
+			r.NoError(err)
+
+			r.Equal(1, ulid.ULID(seq).Compare(ulid.ULID(d.curSeq)), "at %s", delta)
+			d.curSeq = seq
+		}
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 1)
+	})
+
+	t.Run("later segments win after the clock goes backwards", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		var out lockedBuffer
+
+		tlog := &logger.LabLogger{Logger: slog.New(slog.NewTextHandler(&out, nil))}
+
+		now := time.Now()
+		clk := newFakeClock(now)
+
+		d, err := NewDisk(ctx, tlog, tmpdir, WithClock(clk))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NotContains(out.String(), "clock is behind")
+
+		clk.Set(now.Add(-time.Hour))
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		r.Contains(out.String(), "clock is behind")
+
+		r.NoError(d.rebuildFromSegments(ctx))
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testRandX, data)
+	})
+
+	t.Run("rejects SeqGen ids that are not increasing", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		start := time.Now()
+
+		seq := ulid.MustNew(ulid.Timestamp(start), ulid.DefaultEntropy())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSeqGen(func() ulid.ULID {
+			return seq
+		}))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		_, err = d.nextSeq()
+		r.ErrorIs(err, ErrNonMonotonicSeq)
+
+		seq = ulid.MustNew(ulid.Timestamp(start.Add(-time.Second)), ulid.DefaultEntropy())
+
+		_, err = d.nextSeq()
+		r.ErrorIs(err, ErrNonMonotonicSeq)
+
+		seq = ulid.MustNew(ulid.Timestamp(start.Add(time.Second)), ulid.DefaultEntropy())
+
+		next, err := d.nextSeq()
+		r.NoError(err)
+		r.Equal(SegmentId(seq), next)
+	})
+}
+
+// lockedBuffer is a bytes.Buffer that can be written to by several
+// goroutines, such as the output of a logger.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.Write(b)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.String()
+}
+
+// stallAfterAppend holds up a flush once it has listed its segment, before
+// the disk's map is updated for it.
+type stallAfterAppend struct {
+	LocalFileAccess
+	appended chan struct{}
+	wait     chan struct{}
+}
+
+func (s *stallAfterAppend) AppendToSegments(ctx context.Context, volume string, seg SegmentId) error {
+	err := s.LocalFileAccess.AppendToSegments(ctx, volume, seg)
+	if err != nil {
+		return err
+	}
+
+	close(s.appended)
+	<-s.wait
+
+	return nil
 }
 
 type slowLocal struct {
@@ -1493,6 +3035,56 @@ func (s *slowLocal) UploadSegment(ctx context.Context, seg SegmentId, f *os.File
 	return s.LocalFileAccess.UploadSegment(ctx, seg, f)
 }
 
+type failingLocal struct {
+	LocalFileAccess
+	failing atomic.Bool
+}
+
+func (f *failingLocal) UploadSegment(ctx context.Context, seg SegmentId, fd *os.File) error {
+	if f.failing.Load() {
+		return errors.New("backend unavailable")
+	}
+
+	return f.LocalFileAccess.UploadSegment(ctx, seg, fd)
+}
+
+// stallingLocal serves segments whose reads stall while +stalled+ is set,
+// until the context of the read is done.
+type stallingLocal struct {
+	LocalFileAccess
+	stalled atomic.Bool
+}
+
+func (s *stallingLocal) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	sr, err := s.LocalFileAccess.OpenSegment(ctx, seg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stallingReader{SegmentReader: sr, stalled: &s.stalled}, nil
+}
+
+type stallingReader struct {
+	SegmentReader
+	stalled *atomic.Bool
+}
+
+func (s *stallingReader) ReadAt(b []byte, off int64) (int, error) {
+	return s.ReadAtContext(context.Background(), b, off)
+}
+
+func (s *stallingReader) ReadAtContext(ctx context.Context, b []byte, off int64) (int, error) {
+	if s.stalled.Load() {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	return s.SegmentReader.ReadAt(b, off)
+}
+
 func emptyBytesI(b []byte) bool {
 	for _, x := range b {
 		if x != 0 {
@@ -1502,6 +3094,132 @@ func emptyBytesI(b []byte) bool {
 
 	return true
 }
+func BenchmarkReadExtentIntoBuffer(b *testing.B) {
+	log := logger.New(logger.Error)
+
+	ctx := NewContext(context.Background())
+	defer ctx.Close()
+
+	tmpdir, err := os.MkdirTemp("", "lsvd")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpdir)
+
+	d, err := NewDisk(ctx, log, tmpdir)
+	require.NoError(b, err)
+	defer d.Close(ctx)
+
+	rng := Extent{LBA: 0, Blocks: 16}
+
+	for i := LBA(0); i < LBA(rng.Blocks); i++ {
+		require.NoError(b, d.WriteExtent(ctx, testRandX.MapTo(i)))
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_, err := d.ReadExtent(ctx, rng)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx.Reset()
+		}
+	})
+
+	b.Run("buffer", func(b *testing.B) {
+		b.ReportAllocs()
+
+		buf := make([]byte, rng.ByteSize())
+
+		for i := 0; i < b.N; i++ {
+			err := d.ReadExtentIntoBuffer(ctx, rng, buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx.Reset()
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+
+		pool := sync.Pool{
+			New: func() any {
+				data := MapRangeData(rng, make([]byte, rng.ByteSize()))
+				return &data
+			},
+		}
+
+		for i := 0; i < b.N; i++ {
+			data := pool.Get().(*RangeData)
+
+			err := d.ReadExtentIntoData(ctx, rng, *data)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			pool.Put(data)
+
+			ctx.Reset()
+		}
+	})
+}
+
+// BenchmarkReadExtentIntoData compares ReadExtent, which allocates the range
+// data of each read, with reading into one RangeData reused across reads.
+func BenchmarkReadExtentIntoData(b *testing.B) {
+	log := logger.New(logger.Error)
+
+	ctx := NewContext(context.Background())
+	defer ctx.Close()
+
+	tmpdir, err := os.MkdirTemp("", "lsvd")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpdir)
+
+	d, err := NewDisk(ctx, log, tmpdir)
+	require.NoError(b, err)
+	defer d.Close(ctx)
+
+	rng := Extent{LBA: 0, Blocks: 16}
+
+	for i := LBA(0); i < LBA(rng.Blocks); i++ {
+		require.NoError(b, d.WriteExtent(ctx, testRandX.MapTo(i)))
+	}
+
+	require.NoError(b, d.CloseSegment(ctx))
+
+	b.Run("allocated", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_, err := d.ReadExtent(ctx, rng)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx.Reset()
+		}
+	})
+
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+
+		data := MapRangeData(rng, make([]byte, rng.ByteSize()))
+
+		for i := 0; i < b.N; i++ {
+			err := d.ReadExtentIntoData(ctx, rng, data)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			ctx.Reset()
+		}
+	})
+}
+
 func BenchmarkEmptyInline(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		emptyBytesI(emptyBlock)
@@ -9,125 +9,292 @@ import (
 	dto "github.com/prometheus/client_model/go"
 )
 
-var (
-	blocksWritten = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_blocks_written",
-		Help: "The total number of blocks written",
-	})
-
-	blocksRead = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_blocks_read",
-		Help: "The total number of blocks read",
-	})
-
-	blocksReadLatency = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "lsvd_blocks_read_time",
-		Help:    "The total number of blocks read",
-		Buckets: prometheus.DefBuckets,
-	})
-
-	blocksWriteLatency = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "lsvd_blocks_write_time",
-		Help:    "The total number of blocks read",
-		Buckets: prometheus.DefBuckets,
-	})
-
-	iops = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_iops",
-		Help: "The total number of iops",
-	})
-
-	segmentsWritten = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_segments_written",
-		Help: "The total number of segments written",
-	})
-
-	writtenBytes = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_extent_bytes_written",
-		Help: "The total number of bytes written for extents",
-	})
-
-	segmentsBytes = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_segments_bytes_written",
-		Help: "The total number of segments bytes written",
-	})
-
-	segmentTime = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "lsvd_segments_upload_time",
-		Help:    "The total number of segments bytes written",
-		Buckets: prometheus.DefBuckets,
-	})
-
-	segmentTotalTime = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_segments_processing_time",
-		Help: "The total time spend processing segments",
-	})
-
-	openSegments = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "lsvd_segments_open",
-		Help: "The total number of open segments",
-	})
-
-	extentCacheMiss = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_extent_cache_miss",
-		Help: "Number of times the extent cache did not contain the entry",
-	})
-
-	extentCacheHits = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_extent_cache_hits",
-		Help: "Number of times the extent cache contained the entry",
-	})
-
-	readProcessing = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_read_processing",
-		Help: "How many additional seconds is used by processing read requests",
-	})
-
-	compressionOverhead = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_compression_read_overhead",
-		Help: "How many additional seconds is added by decompressing on reads",
-	})
-
-	sendfileResponses = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_responses_sendfile",
-		Help: "How many responses are replied to with sendfile",
-	})
-
-	writeResponses = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_responses_write",
-		Help: "How many responses are replied to with write",
-	})
-
-	inflateCache = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_cache_inflate",
-		Help: "How often values from the cache are inflated to memory",
-	})
-
-	extents = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "lsvd_active_extents",
-		Help: "How many entries are in the extent map",
-	})
-
-	extentUpdates = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_extent_updates",
-		Help: "How many times the extent map has been updated",
-	})
-
-	dataDensity = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "lsvd_data_density",
-		Help: "What percent of the stored data is used",
-	})
-
-	gcCount = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_gc_cycles",
-		Help: "How many times the GC has run",
-	})
-
-	gcTime = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "lsvd_gc_time",
-		Help: "How many seconds the GC has run for",
-	})
-)
+// Metrics holds the collectors that a Disk reports into. Each Disk can be
+// given its own Metrics via WithMetrics so that multiple disks in the same
+// process report independently. To label the metrics per volume, wrap the
+// registerer with prometheus.WrapRegistererWith before calling NewMetrics.
+type Metrics struct {
+	blocksWritten      prometheus.Counter
+	blocksRead         prometheus.Counter
+	blocksReadLatency  prometheus.Histogram
+	blocksWriteLatency prometheus.Histogram
+	iops               prometheus.Counter
+
+	segmentsWritten  prometheus.Counter
+	writtenBytes     prometheus.Counter
+	segmentsBytes    prometheus.Counter
+	segmentTime      prometheus.Histogram
+	segmentTotalTime prometheus.Counter
+	openSegments     prometheus.Gauge
+	segmentCleanups  prometheus.Counter
+
+	writeCacheBytes   prometheus.Gauge
+	writeCacheEntries prometheus.Gauge
+	writeCacheBlocks  prometheus.Gauge
+
+	logicalBytes  prometheus.Counter
+	physicalBytes prometheus.Counter
+	storageRatio  prometheus.Histogram
+
+	extentCacheMiss prometheus.Counter
+	extentCacheHits prometheus.Counter
+
+	readSegments      prometheus.Histogram
+	readCacheBlocks   prometheus.Counter
+	readBackendBlocks prometheus.Counter
+	readExtentBytes   prometheus.Counter
+
+	readCacheFull       prometheus.Gauge
+	readCacheFullEvents prometheus.Counter
+
+	unknownFlagHoles prometheus.Counter
+
+	coldReads     prometheus.Counter
+	coldReadBytes prometheus.Histogram
+
+	readProcessing      prometheus.Counter
+	compressionOverhead prometheus.Counter
+
+	compressBlockTime   prometheus.Histogram
+	decompressBlockTime prometheus.Histogram
+
+	sendfileResponses prometheus.Counter
+	writeResponses    prometheus.Counter
+	inflateCache      prometheus.Counter
+
+	extents       prometheus.Gauge
+	extentUpdates prometheus.Counter
+	dataDensity   prometheus.Gauge
+
+	gcCount prometheus.Counter
+	gcTime  prometheus.Counter
+}
+
+// NewMetrics creates a new set of collectors and registers them with reg.
+// If reg is nil, the collectors are not registered anywhere, which gives
+// a Metrics that is never exported.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	f := promauto.With(reg)
+
+	return &Metrics{
+		blocksWritten: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_blocks_written",
+			Help: "The total number of blocks written",
+		}),
+
+		blocksRead: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_blocks_read",
+			Help: "The total number of blocks read",
+		}),
+
+		blocksReadLatency: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_blocks_read_time",
+			Help:    "The total number of blocks read",
+			Buckets: prometheus.DefBuckets,
+		}),
+
+		blocksWriteLatency: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_blocks_write_time",
+			Help:    "The total number of blocks read",
+			Buckets: prometheus.DefBuckets,
+		}),
+
+		iops: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_iops",
+			Help: "The total number of iops",
+		}),
+
+		segmentsWritten: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_segments_written",
+			Help: "The total number of segments written",
+		}),
+
+		segmentCleanups: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_segment_cleanups",
+			Help: "The total number of passes removing deleted segments",
+		}),
+
+		writtenBytes: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_extent_bytes_written",
+			Help: "The total number of bytes written for extents",
+		}),
+
+		segmentsBytes: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_segments_bytes_written",
+			Help: "The total number of segments bytes written",
+		}),
+
+		segmentTime: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_segments_upload_time",
+			Help:    "The total number of segments bytes written",
+			Buckets: prometheus.DefBuckets,
+		}),
+
+		segmentTotalTime: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_segments_processing_time",
+			Help: "The total time spend processing segments",
+		}),
+
+		openSegments: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lsvd_segments_open",
+			Help: "The total number of open segments",
+		}),
+
+		writeCacheBytes: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lsvd_write_cache_bytes",
+			Help: "The size of the body of the current write cache, which is flushed at the flush threshold",
+		}),
+
+		writeCacheEntries: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lsvd_write_cache_entries",
+			Help: "How many extents have been written to the current write cache",
+		}),
+
+		writeCacheBlocks: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lsvd_write_cache_blocks",
+			Help: "How many blocks have been written to the current write cache",
+		}),
+
+		logicalBytes: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_logical_bytes_written",
+			Help: "The total number of bytes of blocks written to segments",
+		}),
+
+		physicalBytes: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_physical_bytes_stored",
+			Help: "The total number of bytes stored for segments, including headers",
+		}),
+
+		storageRatio: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_segment_storage_ratio",
+			Help:    "The ratio of physical bytes stored to logical bytes written per segment",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 12),
+		}),
+
+		extentCacheMiss: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_extent_cache_miss",
+			Help: "Number of times the extent cache did not contain the entry",
+		}),
+
+		extentCacheHits: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_extent_cache_hits",
+			Help: "Number of times the extent cache contained the entry",
+		}),
+
+		readSegments: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_read_segments",
+			Help:    "How many distinct segments a read is served from",
+			Buckets: prometheus.LinearBuckets(0, 1, 10),
+		}),
+
+		readCacheBlocks: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_read_cache_blocks",
+			Help: "The total number of blocks read served from the write caches",
+		}),
+
+		readBackendBlocks: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_read_backend_blocks",
+			Help: "The total number of blocks read served from segments",
+		}),
+
+		readExtentBytes: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_read_extent_bytes",
+			Help: "The total number of bytes of segment data read to serve reads, against lsvd_read_backend_blocks it's the read amplification",
+		}),
+
+		readProcessing: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_read_processing",
+			Help: "How many additional seconds is used by processing read requests",
+		}),
+
+		compressionOverhead: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_compression_read_overhead",
+			Help: "How many additional seconds is added by decompressing on reads",
+		}),
+
+		compressBlockTime: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_compress_block_seconds",
+			Help:    "How many seconds compressing an extent took per block of it, when writing",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 2, 16),
+		}),
+
+		decompressBlockTime: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_decompress_block_seconds",
+			Help:    "How many seconds decompressing an extent took per block of it, when reading",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 2, 16),
+		}),
+
+		sendfileResponses: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_responses_sendfile",
+			Help: "How many responses are replied to with sendfile",
+		}),
+
+		writeResponses: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_responses_write",
+			Help: "How many responses are replied to with write",
+		}),
+
+		inflateCache: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_cache_inflate",
+			Help: "How often values from the cache are inflated to memory",
+		}),
+
+		extents: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lsvd_active_extents",
+			Help: "How many entries are in the extent map",
+		}),
+
+		extentUpdates: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_extent_updates",
+			Help: "How many times the extent map has been updated",
+		}),
+
+		dataDensity: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lsvd_data_density",
+			Help: "What percent of the stored data is used",
+		}),
+
+		gcCount: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_gc_cycles",
+			Help: "How many times the GC has run",
+		}),
+
+		gcTime: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_gc_time",
+			Help: "How many seconds the GC has run for",
+		}),
+
+		readCacheFull: f.NewGauge(prometheus.GaugeOpts{
+			Name: "lsvd_read_cache_full",
+			Help: "1 while the read cache has stopped saving data because its disk is full",
+		}),
+
+		readCacheFullEvents: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_read_cache_full_events",
+			Help: "How many times the read cache stopped saving data because its disk was full",
+		}),
+
+		unknownFlagHoles: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_unknown_flag_holes",
+			Help: "How many extents with unknown flags were read as zeros",
+		}),
+
+		coldReads: f.NewCounter(prometheus.CounterOpts{
+			Name: "lsvd_cold_reads",
+			Help: "How many reads missed every cache and read from segment storage",
+		}),
+
+		coldReadBytes: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lsvd_cold_read_bytes",
+			Help:    "How many bytes each cold read read from segment storage",
+			Buckets: prometheus.ExponentialBuckets(BlockSize, 4, 8),
+		}),
+	}
+}
+
+// defaultMetrics is used by any Disk that isn't given its own Metrics. It is
+// registered with the prometheus default registerer.
+var defaultMetrics = NewMetrics(prometheus.DefaultRegisterer)
 
 func counterValue(c prometheus.Counter) int64 {
 	var m dto.Metric
@@ -160,6 +327,18 @@ func timeTotalValue(c prometheus.Histogram) time.Duration {
 	return time.Duration(m.Histogram.GetSampleSum() * float64(time.Second))
 }
 
+func histogramAvg(c prometheus.Histogram) float64 {
+	var m dto.Metric
+	c.Write(&m)
+
+	samples := m.Histogram.GetSampleCount()
+	if samples == 0 {
+		return 0
+	}
+
+	return m.Histogram.GetSampleSum() / float64(samples)
+}
+
 func timeAvgValue(c prometheus.Histogram) time.Duration {
 	var m dto.Metric
 	c.Write(&m)
@@ -172,27 +351,73 @@ func timeAvgValue(c prometheus.Histogram) time.Duration {
 	return time.Duration(m.Histogram.GetSampleSum()*float64(time.Second)) / time.Duration(samples)
 }
 
+// observeCodec records how long compressing or decompressing +size+ bytes
+// took, per block of them, in +h+.
+func observeCodec(h prometheus.Histogram, start time.Time, size int) {
+	blocks := max(size/BlockSize, 1)
+	h.Observe(time.Since(start).Seconds() / float64(blocks))
+}
+
+// recordSegment tracks how much storage a flushed segment used compared to
+// the data written into it.
+func (m *Metrics) recordSegment(stats *SegmentStats) {
+	logical := stats.Blocks * BlockSize
+
+	m.logicalBytes.Add(float64(logical))
+	m.physicalBytes.Add(float64(stats.TotalBytes))
+
+	if logical > 0 {
+		m.storageRatio.Observe(float64(stats.TotalBytes) / float64(logical))
+	}
+}
+
+// writeAmplification returns the physical bytes stored per logical byte
+// written over all segments flushed so far.
+func (m *Metrics) writeAmplification() float64 {
+	logical := counterValue(m.logicalBytes)
+	if logical == 0 {
+		return 0
+	}
+
+	return float64(counterValue(m.physicalBytes)) / float64(logical)
+}
+
+// LogMetrics logs the metrics collected by disks that were not given their
+// own Metrics.
 func LogMetrics(log logger.Logger) {
+	defaultMetrics.Log(log)
+}
+
+// Log outputs the current values of the metrics to log.
+func (m *Metrics) Log(log logger.Logger) {
 	log.Info("disk stats",
-		"written-bytes", counterValue(writtenBytes),
-		"segment-bytes", counterValue(segmentsBytes),
-		"segments", counterValue(segmentsWritten),
-		"total-segment-process-time", counterAsDuration(segmentTotalTime),
-		"extent-cache-hits", counterValue(extentCacheHits),
-		"extent-cache-misses", counterValue(extentCacheMiss),
-		"sendfile-responses", counterValue(sendfileResponses),
-		"write-responses", counterValue(writeResponses),
-		"cache-inflates", counterValue(inflateCache),
-		"data-density", gaugeValue(dataDensity),
+		"written-bytes", counterValue(m.writtenBytes),
+		"segment-bytes", counterValue(m.segmentsBytes),
+		"segments", counterValue(m.segmentsWritten),
+		"write-amplification", m.writeAmplification(),
+		"total-segment-process-time", counterAsDuration(m.segmentTotalTime),
+		"extent-cache-hits", counterValue(m.extentCacheHits),
+		"extent-cache-misses", counterValue(m.extentCacheMiss),
+		"sendfile-responses", counterValue(m.sendfileResponses),
+		"write-responses", counterValue(m.writeResponses),
+		"cache-inflates", counterValue(m.inflateCache),
+		"data-density", gaugeValue(m.dataDensity),
+		"write-cache-bytes", gaugeValue(m.writeCacheBytes),
 	)
 
 	log.Info("client stats",
-		"iops", counterValue(iops),
-		"blocks-written", counterValue(blocksWritten),
-		"blocks-read", counterValue(blocksRead),
-		"block-write-latency", timeAvgValue(blocksWriteLatency),
-		"block-read-latency", timeAvgValue(blocksReadLatency),
-		"compression-overhead", counterAsSeconds(compressionOverhead),
-		"read-processing", counterAsSeconds(readProcessing),
+		"iops", counterValue(m.iops),
+		"blocks-written", counterValue(m.blocksWritten),
+		"blocks-read", counterValue(m.blocksRead),
+		"block-write-latency", timeAvgValue(m.blocksWriteLatency),
+		"block-read-latency", timeAvgValue(m.blocksReadLatency),
+		"compression-overhead", counterAsSeconds(m.compressionOverhead),
+		"compress-block-time", timeAvgValue(m.compressBlockTime),
+		"decompress-block-time", timeAvgValue(m.decompressBlockTime),
+		"read-processing", counterAsSeconds(m.readProcessing),
+		"read-segments", histogramAvg(m.readSegments),
+		"read-cache-blocks", counterValue(m.readCacheBlocks),
+		"read-backend-blocks", counterValue(m.readBackendBlocks),
+		"cold-reads", counterValue(m.coldReads),
 	)
 }
@@ -0,0 +1,293 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	log := logger.New(logger.Trace)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	t.Run("disks report into separate metrics", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		tmpdir2, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir2)
+
+		m1 := NewMetrics(prometheus.NewRegistry())
+		m2 := NewMetrics(prometheus.NewRegistry())
+
+		d1, err := NewDisk(ctx, log, tmpdir, WithMetrics(m1))
+		r.NoError(err)
+		defer d1.Close(ctx)
+
+		d2, err := NewDisk(ctx, log, tmpdir2, WithMetrics(m2))
+		r.NoError(err)
+		defer d2.Close(ctx)
+
+		err = d1.WriteExtent(ctx, testRandX.MapTo(0))
+		r.NoError(err)
+
+		err = d1.WriteExtent(ctx, testRandX.MapTo(1))
+		r.NoError(err)
+
+		_, err = d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		r.Equal(int64(2), counterValue(m1.iops))
+		r.Equal(int64(2), counterValue(m1.blocksWritten))
+		r.Equal(int64(0), counterValue(m1.blocksRead))
+
+		r.Equal(int64(1), counterValue(m2.iops))
+		r.Equal(int64(0), counterValue(m2.blocksWritten))
+		r.Equal(int64(1), counterValue(m2.blocksRead))
+	})
+
+	t.Run("tracks the storage ratio of flushed segments", func(t *testing.T) {
+		r := require.New(t)
+
+		flush := func(data RawBlocks) *Metrics {
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			m := NewMetrics(prometheus.NewRegistry())
+
+			d, err := NewDisk(ctx, log, tmpdir, WithMetrics(m))
+			r.NoError(err)
+			defer d.Close(ctx)
+
+			for i := 0; i < 20; i++ {
+				r.NoError(d.WriteExtent(ctx, data.MapTo(LBA(i))))
+			}
+
+			r.NoError(d.CloseSegment(ctx))
+
+			return m
+		}
+
+		compressible := flush(testExtent)
+		incompressible := flush(testRandX)
+
+		ratio := func(m *Metrics) float64 {
+			var dm dto.Metric
+			m.storageRatio.Write(&dm)
+			r.Equal(uint64(1), dm.Histogram.GetSampleCount())
+			return dm.Histogram.GetSampleSum()
+		}
+
+		r.Equal(int64(20*BlockSize), counterValue(compressible.logicalBytes))
+		r.Equal(int64(20*BlockSize), counterValue(incompressible.logicalBytes))
+
+		r.Less(counterValue(compressible.physicalBytes), counterValue(incompressible.physicalBytes))
+
+		r.Less(ratio(compressible), 0.5)
+		r.Greater(ratio(incompressible), 0.9)
+
+		r.InDelta(ratio(compressible), compressible.writeAmplification(), 0.0001)
+	})
+
+	t.Run("tracks how many segments reads are served from", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		for i := 0; i < 3; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		r.NoError(d.Close(ctx))
+
+		// Reopen so that only the reads below are recorded.
+		m := NewMetrics(prometheus.NewRegistry())
+
+		d, err = NewDisk(ctx, log, tmpdir, WithMetrics(m))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		_, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 4})
+		r.NoError(err)
+
+		stats := d.Stats()
+		r.NotZero(stats.ColdReadBytes)
+
+		r.Equal(DiskStats{
+			ReadSegments:      3,
+			ReadBackendBlocks: 3,
+			ColdReads:         1,
+			ColdReadBytes:     stats.ColdReadBytes,
+		}, stats)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+
+		_, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 4})
+		r.NoError(err)
+
+		stats = d.Stats()
+		r.InDelta(2.9, stats.ReadSegments, 0.0001)
+		r.InDelta(0.1, stats.ReadCacheBlocks, 0.0001)
+		r.InDelta(2.9, stats.ReadBackendBlocks, 0.0001)
+
+		var dm dto.Metric
+		m.readSegments.Write(&dm)
+		r.Equal(uint64(2), dm.Histogram.GetSampleCount())
+		r.Equal(float64(5), dm.Histogram.GetSampleSum())
+
+		r.Equal(int64(1), counterValue(m.readCacheBlocks))
+		r.Equal(int64(5), counterValue(m.readBackendBlocks))
+	})
+
+	t.Run("counts reads that miss every cache as cold", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
+
+		m := NewMetrics(prometheus.NewRegistry())
+
+		d, err = NewDisk(ctx, log, tmpdir, WithMetrics(m))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		// Nothing is in the read cache of a freshly attached disk.
+		_, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		r.Equal(int64(1), d.Stats().ColdReads)
+		r.GreaterOrEqual(d.Stats().ColdReadBytes, float64(BlockSize))
+		r.Equal(int64(1), counterValue(m.coldReads))
+
+		// Now it is.
+		_, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		// And the write cache isn't cold either.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+
+		_, err = d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+		r.NoError(err)
+
+		r.Equal(int64(1), d.Stats().ColdReads)
+
+		var dm dto.Metric
+		m.coldReadBytes.Write(&dm)
+		r.Equal(uint64(1), dm.Histogram.GetSampleCount())
+	})
+
+	t.Run("tracks the occupancy of the write cache", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		m := NewMetrics(prometheus.NewRegistry())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithMetrics(m))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		for i := 0; i < 4; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+		}
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(10)))
+
+		body := d.curOC.BodySize()
+		r.Greater(body, 4*BlockSize)
+
+		r.Equal(float64(body), gaugeValue(m.writeCacheBytes))
+		r.Equal(float64(5), gaugeValue(m.writeCacheEntries))
+		r.Equal(float64(5), gaugeValue(m.writeCacheBlocks))
+
+		stats := d.Stats()
+		r.Equal(int64(body), stats.WriteCacheBytes)
+		r.Equal(int64(5), stats.WriteCacheEntries)
+		r.Equal(int64(5), stats.WriteCacheBlocks)
+
+		r.NoError(d.CloseSegment(ctx))
+
+		r.Zero(gaugeValue(m.writeCacheBytes))
+		r.Zero(gaugeValue(m.writeCacheEntries))
+		r.Zero(gaugeValue(m.writeCacheBlocks))
+		r.Zero(d.Stats().WriteCacheBytes)
+	})
+
+	t.Run("times compressing and decompressing blocks", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		m := NewMetrics(prometheus.NewRegistry())
+
+		d, err := NewDisk(ctx, log, tmpdir, WithMetrics(m))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		samples := func(h prometheus.Histogram) uint64 {
+			var dm dto.Metric
+			h.Write(&dm)
+			return dm.Histogram.GetSampleCount()
+		}
+
+		for i := 0; i < 4; i++ {
+			r.NoError(d.WriteExtent(ctx, testExtent.MapTo(LBA(i))))
+		}
+
+		r.Equal(uint64(4), samples(m.compressBlockTime))
+		r.Zero(samples(m.decompressBlockTime))
+
+		r.NoError(d.CloseSegment(ctx))
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		r.Equal(testData, data.ReadData())
+
+		r.NotZero(samples(m.decompressBlockTime))
+
+		stats := d.Stats()
+		r.Positive(stats.CompressBlockTime)
+		r.Positive(stats.DecompressBlockTime)
+	})
+
+	t.Run("unregistered metrics still count", func(t *testing.T) {
+		r := require.New(t)
+
+		m := NewMetrics(nil)
+		m.iops.Inc()
+
+		r.Equal(int64(1), counterValue(m.iops))
+	})
+}
@@ -0,0 +1,570 @@
+package lsvd
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/pkg/errors"
+)
+
+// How long to wait before retrying a change that failed to replicate.
+const defaultMirrorRetryDelay = 10 * time.Second
+
+// MirrorAccess copies every change made to a primary SegmentAccess to one or
+// more secondaries, so that they can take over if the primary is lost. Changes
+// are applied to the primary before returning and then queued for each
+// secondary, which Run applies in order, retrying each until it succeeds.
+// Reads are served by the primary.
+//
+// Segments and metadata are copied from the primary when their turn comes
+// rather than kept in memory, so a secondary only ever receives the latest
+// version of them. Status reports how far behind each secondary is.
+type MirrorAccess struct {
+	log         logger.Logger
+	primary     SegmentAccess
+	secondaries []*mirrorSecondary
+
+	fallback   bool
+	retryDelay time.Duration
+
+	now func() time.Time
+}
+
+var (
+	_ SegmentAccess   = (*MirrorAccess)(nil)
+	_ SegmentStreamer = (*MirrorAccess)(nil)
+)
+
+type MirrorOption func(m *MirrorAccess)
+
+// MirrorReadFallback causes segments that can't be opened on the primary to
+// be opened on the first secondary that has them instead. Segments are never
+// changed once written, so a secondary's copy is as good as the primary's.
+func MirrorReadFallback() MirrorOption {
+	return func(m *MirrorAccess) {
+		m.fallback = true
+	}
+}
+
+// MirrorRetryDelay sets how long to wait before retrying a change that failed
+// to replicate to a secondary.
+func MirrorRetryDelay(d time.Duration) MirrorOption {
+	return func(m *MirrorAccess) {
+		m.retryDelay = d
+	}
+}
+
+// MirrorStatus reports how far a secondary is behind the primary.
+type MirrorStatus struct {
+	// How many changes are waiting to be applied.
+	Pending int
+
+	// How long the oldest pending change has been waiting.
+	Lag time.Duration
+
+	// The error from the last attempt to apply a change, which is cleared once
+	// one succeeds.
+	LastError error
+
+	// How many attempts to apply a change have failed in total.
+	Failures int
+}
+
+type mirrorOpKind int
+
+const (
+	mirrorInitContainer mirrorOpKind = iota
+	mirrorInitVolume
+	mirrorCopySegment
+	mirrorRemoveSegment
+	mirrorAppendToSegments
+	mirrorRemoveSegmentFromVolume
+	mirrorCopyMetadata
+	mirrorUpdateVolumeInfo
+)
+
+type mirrorOp struct {
+	kind   mirrorOpKind
+	vol    string
+	info   VolumeInfo
+	seg    SegmentId
+	name   string
+	queued time.Time
+}
+
+type mirrorSecondary struct {
+	sa SegmentAccess
+
+	mu       sync.Mutex
+	queue    []mirrorOp
+	lastErr  error
+	failures int
+
+	// Signaled when a change is queued.
+	wake chan struct{}
+
+	// Closed and replaced whenever a change is applied.
+	applied chan struct{}
+}
+
+// NewMirrorAccess returns a MirrorAccess that mirrors +primary+ to
+// +secondaries+. Nothing is replicated until Run is called.
+func NewMirrorAccess(log logger.Logger, primary SegmentAccess, secondaries []SegmentAccess, opts ...MirrorOption) (*MirrorAccess, error) {
+	if len(secondaries) == 0 {
+		return nil, errors.New("mirror access requires at least one secondary")
+	}
+
+	m := &MirrorAccess{
+		log:        log,
+		primary:    primary,
+		retryDelay: defaultMirrorRetryDelay,
+		now:        time.Now,
+	}
+
+	for _, sa := range secondaries {
+		m.secondaries = append(m.secondaries, &mirrorSecondary{
+			sa:      sa,
+			wake:    make(chan struct{}, 1),
+			applied: make(chan struct{}),
+		})
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m, nil
+}
+
+func (m *MirrorAccess) enqueue(op mirrorOp) {
+	op.queued = m.now()
+
+	for _, s := range m.secondaries {
+		s.mu.Lock()
+		s.queue = append(s.queue, op)
+		s.mu.Unlock()
+
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Status returns the replication status of each secondary, in the order they
+// were given.
+func (m *MirrorAccess) Status() []MirrorStatus {
+	now := m.now()
+
+	var out []MirrorStatus
+
+	for _, s := range m.secondaries {
+		s.mu.Lock()
+
+		st := MirrorStatus{
+			Pending:   len(s.queue),
+			LastError: s.lastErr,
+			Failures:  s.failures,
+		}
+
+		if len(s.queue) > 0 {
+			st.Lag = now.Sub(s.queue[0].queued)
+		}
+
+		s.mu.Unlock()
+
+		out = append(out, st)
+	}
+
+	return out
+}
+
+// Sync waits until every change made so far has been applied to all the
+// secondaries.
+func (m *MirrorAccess) Sync(ctx context.Context) error {
+	for _, s := range m.secondaries {
+		for {
+			s.mu.Lock()
+			pending := len(s.queue)
+			applied := s.applied
+			s.mu.Unlock()
+
+			if pending == 0 {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-applied:
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run applies the queued changes to the secondaries until +ctx+ is canceled.
+func (m *MirrorAccess) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for i, s := range m.secondaries {
+		wg.Add(1)
+
+		go func(i int, s *mirrorSecondary) {
+			defer wg.Done()
+			m.replicate(ctx, i, s)
+		}(i, s)
+	}
+
+	wg.Wait()
+}
+
+func (m *MirrorAccess) replicate(ctx context.Context, idx int, s *mirrorSecondary) {
+	for {
+		s.mu.Lock()
+		empty := len(s.queue) == 0
+		var op mirrorOp
+		if !empty {
+			op = s.queue[0]
+		}
+		s.mu.Unlock()
+
+		if empty {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+
+		err := m.apply(ctx, s.sa, op)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			m.log.Warn("error replicating to secondary, will retry",
+				"secondary", idx, "error", err)
+
+			s.mu.Lock()
+			s.lastErr = err
+			s.failures++
+			s.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(m.retryDelay):
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		s.queue = s.queue[1:]
+		s.lastErr = nil
+		close(s.applied)
+		s.applied = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
+
+func (m *MirrorAccess) apply(ctx context.Context, sa SegmentAccess, op mirrorOp) error {
+	switch op.kind {
+	case mirrorInitContainer:
+		return sa.InitContainer(ctx)
+	case mirrorInitVolume:
+		return sa.InitVolume(ctx, &op.info)
+	case mirrorCopySegment:
+		return m.copySegment(ctx, sa, op.seg)
+	case mirrorRemoveSegment:
+		err := sa.RemoveSegment(ctx, op.seg)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	case mirrorAppendToSegments:
+		return sa.AppendToSegments(ctx, op.vol, op.seg)
+	case mirrorRemoveSegmentFromVolume:
+		return sa.RemoveSegmentFromVolume(ctx, op.vol, op.seg)
+	case mirrorCopyMetadata:
+		return m.copyMetadata(ctx, sa, op.vol, op.name)
+	case mirrorUpdateVolumeInfo:
+		if vu, ok := sa.(VolumeInfoUpdater); ok {
+			return vu.UpdateVolumeInfo(ctx, &op.info)
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown mirror operation: %d", op.kind)
+	}
+}
+
+func (m *MirrorAccess) copySegment(ctx context.Context, sa SegmentAccess, seg SegmentId) error {
+	rc, _, err := StreamSegment(ctx, m.primary, seg)
+	if err != nil {
+		// Removed since it was written, which is replicated next.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrapf(err, "reading segment %s from primary", seg)
+	}
+
+	defer rc.Close()
+
+	w, err := sa.WriteSegment(ctx, seg)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// repairSegment replaces the bytes of +seg+ at +off+ on the primary with
+// +data+, read from a secondary. The rest of the primary's copy is kept, so
+// that damage elsewhere in the secondary's copy isn't spread to it.
+func (m *MirrorAccess) repairSegment(ctx context.Context, seg SegmentId, off int64, data []byte) error {
+	var body []byte
+
+	rc, _, err := StreamSegment(ctx, m.primary, seg)
+	switch {
+	case err == nil:
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "reading segment %s from primary", seg)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return errors.Wrapf(err, "reading segment %s from primary", seg)
+	}
+
+	if end := off + int64(len(data)); int64(len(body)) < end {
+		body = append(body, make([]byte, end-int64(len(body)))...)
+	}
+
+	copy(body[off:], data)
+
+	w, err := m.primary.WriteSegment(ctx, seg)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (m *MirrorAccess) copyMetadata(ctx context.Context, sa SegmentAccess, vol, name string) error {
+	rc, err := m.primary.ReadMetadata(ctx, vol, name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrapf(err, "reading metadata %s from primary", name)
+	}
+
+	defer rc.Close()
+
+	w, err := sa.WriteMetadata(ctx, vol, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (m *MirrorAccess) InitContainer(ctx context.Context) error {
+	err := m.primary.InitContainer(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.enqueue(mirrorOp{kind: mirrorInitContainer})
+
+	return nil
+}
+
+func (m *MirrorAccess) InitVolume(ctx context.Context, vol *VolumeInfo) error {
+	err := m.primary.InitVolume(ctx, vol)
+	if err != nil {
+		return err
+	}
+
+	m.enqueue(mirrorOp{kind: mirrorInitVolume, info: *vol})
+
+	return nil
+}
+
+// UpdateVolumeInfo updates the info of +vol+ on the primary, and then on the
+// secondaries in the background.
+func (m *MirrorAccess) UpdateVolumeInfo(ctx context.Context, vol *VolumeInfo) error {
+	vu, ok := m.primary.(VolumeInfoUpdater)
+	if !ok {
+		return nil
+	}
+
+	err := vu.UpdateVolumeInfo(ctx, vol)
+	if err != nil {
+		return err
+	}
+
+	m.enqueue(mirrorOp{kind: mirrorUpdateVolumeInfo, info: *vol})
+
+	return nil
+}
+
+func (m *MirrorAccess) ListVolumes(ctx context.Context) ([]string, error) {
+	return m.primary.ListVolumes(ctx)
+}
+
+func (m *MirrorAccess) GetVolumeInfo(ctx context.Context, vol string) (*VolumeInfo, error) {
+	return m.primary.GetVolumeInfo(ctx, vol)
+}
+
+func (m *MirrorAccess) ListSegments(ctx context.Context, vol string) ([]SegmentId, error) {
+	return m.primary.ListSegments(ctx, vol)
+}
+
+func (m *MirrorAccess) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	sr, err := m.primary.OpenSegment(ctx, seg)
+	if err == nil || !m.fallback {
+		return sr, err
+	}
+
+	for i, s := range m.secondaries {
+		ssr, serr := s.sa.OpenSegment(ctx, seg)
+		if serr == nil {
+			m.log.Warn("unable to open segment on primary, using secondary",
+				"segment", seg, "secondary", i, "error", err)
+			return ssr, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (m *MirrorAccess) StreamSegment(ctx context.Context, seg SegmentId) (io.ReadCloser, int64, error) {
+	rc, size, err := StreamSegment(ctx, m.primary, seg)
+	if err == nil || !m.fallback {
+		return rc, size, err
+	}
+
+	for i, s := range m.secondaries {
+		src, ssize, serr := StreamSegment(ctx, s.sa, seg)
+		if serr == nil {
+			m.log.Warn("unable to stream segment from primary, using secondary",
+				"segment", seg, "secondary", i, "error", err)
+			return src, ssize, nil
+		}
+	}
+
+	return nil, 0, err
+}
+
+// mirrorWriter queues the object it wrote to be copied to the secondaries
+// once it's been written to the primary.
+type mirrorWriter struct {
+	io.WriteCloser
+	done func()
+}
+
+func (w *mirrorWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err != nil {
+		return err
+	}
+
+	w.done()
+
+	return nil
+}
+
+func (m *MirrorAccess) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteCloser, error) {
+	w, err := m.primary.WriteSegment(ctx, seg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mirrorWriter{WriteCloser: w, done: func() {
+		m.enqueue(mirrorOp{kind: mirrorCopySegment, seg: seg})
+	}}, nil
+}
+
+func (m *MirrorAccess) UploadSegment(ctx context.Context, seg SegmentId, f *os.File) error {
+	err := m.primary.UploadSegment(ctx, seg, f)
+	if err != nil {
+		return err
+	}
+
+	m.enqueue(mirrorOp{kind: mirrorCopySegment, seg: seg})
+
+	return nil
+}
+
+func (m *MirrorAccess) RemoveSegment(ctx context.Context, seg SegmentId) error {
+	err := m.primary.RemoveSegment(ctx, seg)
+	if err != nil {
+		return err
+	}
+
+	m.enqueue(mirrorOp{kind: mirrorRemoveSegment, seg: seg})
+
+	return nil
+}
+
+func (m *MirrorAccess) RemoveSegmentFromVolume(ctx context.Context, vol string, seg SegmentId) error {
+	err := m.primary.RemoveSegmentFromVolume(ctx, vol, seg)
+	if err != nil {
+		return err
+	}
+
+	m.enqueue(mirrorOp{kind: mirrorRemoveSegmentFromVolume, vol: vol, seg: seg})
+
+	return nil
+}
+
+func (m *MirrorAccess) WriteMetadata(ctx context.Context, vol, name string) (io.WriteCloser, error) {
+	w, err := m.primary.WriteMetadata(ctx, vol, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mirrorWriter{WriteCloser: w, done: func() {
+		m.enqueue(mirrorOp{kind: mirrorCopyMetadata, vol: vol, name: name})
+	}}, nil
+}
+
+func (m *MirrorAccess) ReadMetadata(ctx context.Context, vol, name string) (io.ReadCloser, error) {
+	return m.primary.ReadMetadata(ctx, vol, name)
+}
+
+func (m *MirrorAccess) AppendToSegments(ctx context.Context, vol string, seg SegmentId) error {
+	err := m.primary.AppendToSegments(ctx, vol, seg)
+	if err != nil {
+		return err
+	}
+
+	m.enqueue(mirrorOp{kind: mirrorAppendToSegments, vol: vol, seg: seg})
+
+	return nil
+}
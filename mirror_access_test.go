@@ -0,0 +1,301 @@
+package lsvd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableAccess is a memAccess that rejects all writes while failing is
+// set, as if it couldn't be reached.
+type unreachableAccess struct {
+	*memAccess
+	failing atomic.Bool
+}
+
+var errUnreachable = errors.New("backend is unreachable")
+
+func (u *unreachableAccess) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteCloser, error) {
+	if u.failing.Load() {
+		return nil, errUnreachable
+	}
+
+	return u.memAccess.WriteSegment(ctx, seg)
+}
+
+func (u *unreachableAccess) AppendToSegments(ctx context.Context, vol string, seg SegmentId) error {
+	if u.failing.Load() {
+		return errUnreachable
+	}
+
+	return u.memAccess.AppendToSegments(ctx, vol, seg)
+}
+
+func TestMirrorAccess(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	entropy := ulid.Monotonic(ulid.DefaultEntropy(), 0)
+
+	newSeg := func() SegmentId {
+		return SegmentId(ulid.MustNew(ulid.Now(), entropy))
+	}
+
+	setup := func(t *testing.T, secondaries []SegmentAccess, opts ...MirrorOption) (*MirrorAccess, *memAccess) {
+		r := require.New(t)
+
+		primary := newMemAccess()
+
+		opts = append(opts, MirrorRetryDelay(10*time.Millisecond))
+
+		m, err := NewMirrorAccess(log, primary, secondaries, opts...)
+		r.NoError(err)
+
+		rctx, cancel := context.WithCancel(ctx)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.Run(rctx)
+		}()
+
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		r.NoError(m.InitContainer(ctx))
+		r.NoError(m.InitVolume(ctx, &VolumeInfo{Name: "test", Size: 1024}))
+
+		return m, primary
+	}
+
+	write := func(t *testing.T, sa SegmentAccess, seg SegmentId, body string) {
+		w, err := sa.WriteSegment(ctx, seg)
+		require.NoError(t, err)
+
+		_, err = io.WriteString(w, body)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		require.NoError(t, sa.AppendToSegments(ctx, "test", seg))
+	}
+
+	read := func(t *testing.T, sa SegmentAccess, seg SegmentId) string {
+		sr, err := sa.OpenSegment(ctx, seg)
+		require.NoError(t, err)
+		defer sr.Close()
+
+		data, err := io.ReadAll(ToReader(sr))
+		require.NoError(t, err)
+
+		return string(data)
+	}
+
+	t.Run("copies every change to the secondaries", func(t *testing.T) {
+		r := require.New(t)
+
+		secondaries := []*memAccess{newMemAccess(), newMemAccess()}
+
+		m, primary := setup(t, []SegmentAccess{secondaries[0], secondaries[1]})
+
+		var segs []SegmentId
+
+		for i := 0; i < 5; i++ {
+			seg := newSeg()
+			segs = append(segs, seg)
+			write(t, m, seg, fmt.Sprintf("segment %d", i))
+		}
+
+		r.NoError(m.RemoveSegmentFromVolume(ctx, "test", segs[0]))
+		r.NoError(m.RemoveSegment(ctx, segs[0]))
+
+		w, err := m.WriteMetadata(ctx, "test", "head.map")
+		r.NoError(err)
+		fmt.Fprint(w, "map")
+		r.NoError(w.Close())
+
+		r.NoError(m.Sync(ctx))
+
+		expected, err := primary.ListSegments(ctx, "test")
+		r.NoError(err)
+		r.Equal(segs[1:], expected)
+
+		for _, sec := range secondaries {
+			vi, err := sec.GetVolumeInfo(ctx, "test")
+			r.NoError(err)
+			r.Equal(int64(1024), vi.Size)
+
+			listed, err := sec.ListSegments(ctx, "test")
+			r.NoError(err)
+			r.Equal(expected, listed)
+
+			r.False(sec.hasSegment(segs[0]))
+
+			for i, seg := range segs[1:] {
+				r.Equal(fmt.Sprintf("segment %d", i+1), read(t, sec, seg))
+			}
+
+			r.Equal([]byte("map"), sec.volumes["test"].metadata["head.map"])
+		}
+
+		for _, st := range m.Status() {
+			r.Zero(st.Pending)
+			r.NoError(st.LastError)
+		}
+	})
+
+	t.Run("reports a secondary that is behind", func(t *testing.T) {
+		r := require.New(t)
+
+		sec := &unreachableAccess{memAccess: newMemAccess()}
+
+		m, _ := setup(t, []SegmentAccess{sec})
+
+		r.NoError(m.Sync(ctx))
+
+		sec.failing.Store(true)
+
+		seg := newSeg()
+		write(t, m, seg, "segment")
+
+		// Writes and reads aren't held up by the secondary.
+		r.Equal("segment", read(t, m, seg))
+
+		r.Eventually(func() bool {
+			return m.Status()[0].Failures > 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		st := m.Status()[0]
+		r.Equal(2, st.Pending)
+		r.Greater(st.Lag, time.Duration(0))
+		r.ErrorIs(st.LastError, errUnreachable)
+		r.False(sec.hasSegment(seg))
+
+		sctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		r.ErrorIs(m.Sync(sctx), context.DeadlineExceeded)
+
+		sec.failing.Store(false)
+
+		r.NoError(m.Sync(ctx))
+
+		st = m.Status()[0]
+		r.Zero(st.Pending)
+		r.Zero(st.Lag)
+		r.NoError(st.LastError)
+
+		r.Equal("segment", read(t, sec, seg))
+
+		listed, err := sec.ListSegments(ctx, "test")
+		r.NoError(err)
+		r.Equal([]SegmentId{seg}, listed)
+	})
+
+	t.Run("falls back to a secondary when the primary can't be read", func(t *testing.T) {
+		r := require.New(t)
+
+		sec := newMemAccess()
+
+		m, primary := setup(t, []SegmentAccess{sec}, MirrorReadFallback())
+
+		seg := newSeg()
+		write(t, m, seg, "segment")
+
+		r.NoError(m.Sync(ctx))
+
+		// Lose the primary's copy.
+		primary.mu.Lock()
+		delete(primary.segments, seg)
+		primary.mu.Unlock()
+
+		r.Equal("segment", read(t, m, seg))
+
+		rc, _, err := m.StreamSegment(ctx, seg)
+		r.NoError(err)
+
+		data, err := io.ReadAll(rc)
+		r.NoError(err)
+		r.Equal("segment", string(data))
+
+		_, err = m.OpenSegment(ctx, newSeg())
+		r.ErrorIs(err, os.ErrNotExist)
+	})
+
+	t.Run("only reads from the primary by default", func(t *testing.T) {
+		r := require.New(t)
+
+		sec := newMemAccess()
+
+		m, primary := setup(t, []SegmentAccess{sec})
+
+		seg := newSeg()
+		write(t, m, seg, "segment")
+
+		r.NoError(m.Sync(ctx))
+
+		primary.mu.Lock()
+		delete(primary.segments, seg)
+		primary.mu.Unlock()
+
+		_, err := m.OpenSegment(ctx, seg)
+		r.ErrorIs(err, os.ErrNotExist)
+	})
+
+	t.Run("requires a secondary", func(t *testing.T) {
+		_, err := NewMirrorAccess(log, newMemAccess(), nil)
+		require.Error(t, err)
+	})
+
+	t.Run("backs a disk", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		sec := newMemAccess()
+
+		m, _ := setup(t, []SegmentAccess{sec})
+
+		gctx := NewContext(ctx)
+
+		d, err := NewDisk(gctx, log, tmpdir, WithSegmentAccess(m))
+		r.NoError(err)
+
+		for i := 0; i < 5; i++ {
+			r.NoError(d.WriteExtent(gctx, testRandX.MapTo(LBA(i))))
+			r.NoError(d.CloseSegment(gctx))
+		}
+
+		r.NoError(d.Close(gctx))
+		r.NoError(m.Sync(ctx))
+
+		// A disk using only the secondary sees the same data.
+		tmpdir2, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir2)
+
+		d2, err := NewDisk(gctx, log, tmpdir2, WithSegmentAccess(sec))
+		r.NoError(err)
+		defer d2.Close(gctx)
+
+		data, err := d2.ReadExtent(gctx, Extent{LBA: 0, Blocks: 5})
+		r.NoError(err)
+
+		for i := 0; i < 5; i++ {
+			r.Equal(testRand, data.ReadData()[i*BlockSize:(i+1)*BlockSize])
+		}
+	})
+}
@@ -68,7 +68,26 @@ func logBlocks(log logger.Logger, msg string, idx LBA, data []byte) {
 
 func (n *nbdWrapper) Idle() {}
 
+// blockAligned reports if a request of +size+ bytes at +off+ covers
+// only whole blocks.
+func blockAligned(off, size int64) bool {
+	return off%BlockSize == 0 && size%BlockSize == 0
+}
+
+// coveringExtent returns the extent of the whole blocks that contain
+// the request of +size+ bytes at +off+.
+func coveringExtent(off, size int64) Extent {
+	start := off / BlockSize
+	end := (off + size + BlockSize - 1) / BlockSize
+
+	return Extent{LBA: LBA(start), Blocks: uint32(end - start)}
+}
+
 func (n *nbdWrapper) ReadAt(b []byte, off int64) (int, error) {
+	if !blockAligned(off, int64(len(b))) {
+		return n.readUnaligned(b, off)
+	}
+
 	blk := LBA(off / BlockSize)
 	blocks := uint32(len(b) / BlockSize)
 
@@ -87,25 +106,55 @@ func (n *nbdWrapper) ReadAt(b []byte, off int64) (int, error) {
 		return 0, err
 	}
 
-	data := MapRangeData(ext, b)
-
-	cps, err := n.d.ReadExtentInto(n.ctx, data)
+	err = n.d.ReadExtentIntoBuffer(n.ctx, ext, b)
 	if err != nil {
 		n.log.Error("nbd read-at error", "error", err, "block", blk)
 		return 0, err
 	}
 
-	if cps.fd != nil {
-		err = FillFromeCache(b, []CachePosition{cps})
-		if err != nil {
-			return 0, err
-		}
+	return len(b), nil
+}
+
+// readUnaligned reads the blocks covering the request and copies out
+// the requested bytes.
+func (n *nbdWrapper) readUnaligned(b []byte, off int64) (int, error) {
+	defer n.ctx.Reset()
+
+	ext := coveringExtent(off, int64(len(b)))
+
+	n.log.Debug("nbd unaligned read-at", "size", len(b), "offset", off, "extent", ext)
+
+	err := n.flushPendingWrite()
+	if err != nil {
+		return 0, err
 	}
 
+	data, err := n.d.ReadExtent(n.ctx, ext)
+	if err != nil {
+		n.log.Error("nbd read-at error", "error", err, "extent", ext)
+		return 0, err
+	}
+
+	copy(b, data.ReadData()[off%BlockSize:])
+
 	return len(b), nil
 }
 
 func (n *nbdWrapper) ReadIntoConn(b []byte, off int64, output *os.File) (bool, error) {
+	if !blockAligned(off, int64(len(b))) {
+		_, err := n.readUnaligned(b, off)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = output.Write(b)
+		if err != nil {
+			n.log.Error("error sending data via write(2)", "error", err)
+		}
+
+		return true, nil
+	}
+
 	defer n.buf.Reset()
 	defer n.ctx.Reset()
 
@@ -143,7 +192,7 @@ func (n *nbdWrapper) ReadIntoConn(b []byte, off int64, output *os.File) (bool, e
 	left := len(b)
 
 	if cps.fd == nil {
-		writeResponses.Inc()
+		n.d.metrics.writeResponses.Inc()
 
 		off := 0
 		for left > 0 {
@@ -168,7 +217,7 @@ func (n *nbdWrapper) ReadIntoConn(b []byte, off int64, output *os.File) (bool, e
 	}
 
 	rfd := cps.fd.Fd()
-	sendfileResponses.Inc()
+	n.d.metrics.sendfileResponses.Inc()
 
 	off = cps.off
 
@@ -255,6 +304,10 @@ func (n *nbdWrapper) queueTrim(ext Extent) bool {
 func (n *nbdWrapper) WriteAt(b []byte, off int64) (int, error) {
 	n.log.Debug("nbd write-at", "size", len(b), "offset", off)
 
+	if !blockAligned(off, int64(len(b))) {
+		return n.writeUnaligned(b, off)
+	}
+
 	defer n.buf.Reset()
 	defer n.ctx.Reset()
 
@@ -289,7 +342,42 @@ func (n *nbdWrapper) WriteAt(b []byte, off int64) (int, error) {
 	return len(b), nil
 }
 
+// writeUnaligned performs a read-modify-write of the blocks covering
+// the request.
+func (n *nbdWrapper) writeUnaligned(b []byte, off int64) (int, error) {
+	defer n.ctx.Reset()
+
+	ext := coveringExtent(off, int64(len(b)))
+
+	n.log.Debug("nbd unaligned write-at", "size", len(b), "offset", off, "extent", ext)
+
+	err := n.flushPendingWrite()
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := n.d.ReadExtent(n.ctx, ext)
+	if err != nil {
+		n.log.Error("nbd write-at error", "error", err, "extent", ext)
+		return 0, err
+	}
+
+	copy(data.WriteData()[off%BlockSize:], b)
+
+	err = n.d.WriteExtent(n.ctx, data)
+	if err != nil {
+		n.log.Error("nbd write-at error", "error", err, "extent", ext)
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
 func (n *nbdWrapper) ZeroAt(off, size int64) error {
+	if !blockAligned(off, size) {
+		return n.zeroUnaligned(off, size)
+	}
+
 	blk := LBA(off / BlockSize)
 
 	defer n.buf.Reset()
@@ -307,8 +395,7 @@ func (n *nbdWrapper) ZeroAt(off, size int64) error {
 
 	// We're sent trim sizes FAR larger than the write sizes, which
 	// can create extents that have more than 2^16 blocks in one extent.
-	// For optimization, we want to keep the max blocks in an extent under
-	// 2^16, so we'll break this up.
+	// Trim breaks those up for us.
 
 	if numBlocks > MaxBlocks {
 		n.log.Debug("detected very large trim request, breaking up into smaller extents")
@@ -318,18 +405,7 @@ func (n *nbdWrapper) ZeroAt(off, size int64) error {
 			return err
 		}
 
-		for numBlocks > MaxBlocks {
-			err := n.d.ZeroBlocks(n.ctx, Extent{blk, MaxBlocks})
-			if err != nil {
-				n.log.Error("nbd write-at error", "error", err, "block", blk)
-				return err
-			}
-
-			blk += MaxBlocks
-			numBlocks -= MaxBlocks
-		}
-
-		err = n.d.ZeroBlocks(n.ctx, Extent{blk, numBlocks})
+		err = n.d.Trim(n.ctx, Extent{blk, numBlocks})
 		if err != nil {
 			n.log.Error("nbd write-at error", "error", err, "block", blk)
 			return err
@@ -360,10 +436,50 @@ func (n *nbdWrapper) ZeroAt(off, size int64) error {
 	return nil
 }
 
-func (n *nbdWrapper) Trim(off, size int64) error {
+// zeroUnaligned zeros the partial blocks at the edges of the request with
+// a read-modify-write, and the whole blocks between them with ZeroBlocks.
+func (n *nbdWrapper) zeroUnaligned(off, size int64) error {
+	if head := off % BlockSize; head != 0 {
+		sz := min(size, BlockSize-head)
+
+		_, err := n.writeUnaligned(emptyBlock[:sz], off)
+		if err != nil {
+			return err
+		}
+
+		off += sz
+		size -= sz
+	}
+
+	if tail := size % BlockSize; tail != 0 {
+		_, err := n.writeUnaligned(emptyBlock[:tail], off+size-tail)
+		if err != nil {
+			return err
+		}
+
+		size -= tail
+	}
+
+	if size == 0 {
+		return nil
+	}
+
 	return n.ZeroAt(off, size)
 }
 
+// Trim discards the whole blocks within the request. Partial blocks at
+// the edges are left as is, as trimmed data doesn't have to read back as zeros.
+func (n *nbdWrapper) Trim(off, size int64) error {
+	start := (off + BlockSize - 1) / BlockSize * BlockSize
+	end := (off + size) / BlockSize * BlockSize
+
+	if end <= start {
+		return nil
+	}
+
+	return n.ZeroAt(start, end-start)
+}
+
 func RoundToBlockSize(sz int64) int64 {
 	diff := sz % BlockSize
 	if diff == 0 {
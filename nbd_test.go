@@ -1,13 +1,17 @@
 package lsvd
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"io"
+	"net"
 	"os"
 	"testing"
 
 	"github.com/lab47/lsvd/logger"
+	"github.com/lab47/lsvd/pkg/nbd"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sys/unix"
 )
@@ -130,4 +134,243 @@ func TestNBD(t *testing.T) {
 
 		r.Equal(Extent{0, 2}, b.pendingTrim)
 	})
+
+	t.Run("handles unaligned reads and writes", func(t *testing.T) {
+		r := require.New(t)
+
+		dir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(dir)
+
+		d, err := NewDisk(ctx, log, dir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		b := NBDWrapper(ctx, log, d)
+
+		n, err := b.WriteAt(testRand, 0)
+		r.NoError(err)
+		r.Equal(len(testRand), n)
+
+		// Straddles the first and second blocks.
+		n, err = b.WriteAt([]byte("hello world"), BlockSize-5)
+		r.NoError(err)
+		r.Equal(11, n)
+
+		buf := make([]byte, 20)
+		n, err = b.ReadAt(buf, BlockSize-10)
+		r.NoError(err)
+		r.Equal(20, n)
+
+		r.Equal([]byte(testRand[BlockSize-10:BlockSize-5]), buf[:5])
+		r.Equal([]byte("hello world"), buf[5:16])
+		r.Equal(make([]byte, 4), buf[16:])
+
+		block := make([]byte, BlockSize)
+		_, err = b.ReadAt(block, 0)
+		r.NoError(err)
+
+		r.Equal([]byte(testRand[:BlockSize-5]), block[:BlockSize-5])
+		r.Equal([]byte("hello"), block[BlockSize-5:])
+
+		r.NoError(b.ZeroAt(10, BlockSize*2))
+
+		_, err = b.ReadAt(block, 0)
+		r.NoError(err)
+
+		r.Equal([]byte(testRand[:10]), block[:10])
+		r.True(isEmpty(block[10:]))
+
+		_, err = b.ReadAt(block, BlockSize)
+		r.NoError(err)
+		r.True(isEmpty(block))
+	})
+
+	t.Run("trim only discards whole blocks", func(t *testing.T) {
+		r := require.New(t)
+
+		dir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(dir)
+
+		d, err := NewDisk(ctx, log, dir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		b := NBDWrapper(ctx, log, d)
+
+		for i := 0; i < 3; i++ {
+			_, err = b.WriteAt(testRand, int64(i*BlockSize))
+			r.NoError(err)
+		}
+
+		r.NoError(b.Trim(10, BlockSize*2))
+
+		buf := make([]byte, BlockSize*3)
+		_, err = b.ReadAt(buf, 0)
+		r.NoError(err)
+
+		r.Equal([]byte(testRand), buf[:BlockSize])
+		r.True(isEmpty(buf[BlockSize : BlockSize*2]))
+		r.Equal([]byte(testRand), buf[BlockSize*2:])
+	})
+
+	t.Run("serves a disk over the nbd protocol", func(t *testing.T) {
+		r := require.New(t)
+
+		dir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(dir)
+
+		d, err := NewDisk(ctx, log, dir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		d.size = 64 * BlockSize
+
+		server, client := net.Pipe()
+		defer client.Close()
+
+		done := make(chan error, 1)
+
+		go func() {
+			defer server.Close()
+
+			done <- nbd.Handle(log, server, []*nbd.Export{
+				{
+					Name:        "default",
+					BackendOpen: &NBDBackendOpen{Ctx: ctx, Log: log, Disk: d},
+				},
+			}, nil)
+		}()
+
+		c := &testNBDClient{t: t, conn: client}
+
+		r.Equal(uint64(d.size), c.open("default"))
+
+		c.request(nbd.TRANSMISSION_TYPE_REQUEST_WRITE, BlockSize+100, testRand)
+		c.request(nbd.TRANSMISSION_TYPE_REQUEST_FLUSH, 0, nil)
+
+		data := c.read(BlockSize+100, BlockSize)
+		r.Equal([]byte(testRand), data)
+
+		c.request(nbd.TRANSMISSION_TYPE_REQUEST_WRITEZ, BlockSize+200, make([]byte, 100))
+
+		data = c.read(BlockSize+100, BlockSize)
+		r.Equal([]byte(testRand[:100]), data[:100])
+		r.True(isEmpty(data[100:200]))
+		r.Equal([]byte(testRand[200:]), data[200:])
+
+		c.request(nbd.TRANSMISSION_TYPE_REQUEST_DISC, 0, nil)
+
+		r.NoError(<-done)
+	})
+}
+
+// testNBDClient speaks just enough of the NBD protocol to drive
+// nbd.Handle in tests.
+type testNBDClient struct {
+	t      *testing.T
+	conn   net.Conn
+	handle uint64
+}
+
+func (c *testNBDClient) open(name string) uint64 {
+	r := require.New(c.t)
+
+	var hdr nbd.NegotiationNewstyleHeader
+	r.NoError(binary.Read(c.conn, binary.BigEndian, &hdr))
+	r.Equal(nbd.NEGOTIATION_MAGIC_OPTION, hdr.OptionMagic)
+
+	r.NoError(binary.Write(c.conn, binary.BigEndian, uint32(1)))
+
+	var opt bytes.Buffer
+	binary.Write(&opt, binary.BigEndian, uint32(len(name)))
+	opt.WriteString(name)
+	binary.Write(&opt, binary.BigEndian, uint16(0))
+
+	r.NoError(binary.Write(c.conn, binary.BigEndian, nbd.NegotiationOptionHeader{
+		OptionMagic: nbd.NEGOTIATION_MAGIC_OPTION,
+		ID:          nbd.NEGOTIATION_ID_OPTION_GO,
+		Length:      uint32(opt.Len()),
+	}))
+
+	_, err := c.conn.Write(opt.Bytes())
+	r.NoError(err)
+
+	var size uint64
+
+	for {
+		var rep nbd.NegotiationReplyHeader
+		r.NoError(binary.Read(c.conn, binary.BigEndian, &rep))
+
+		if rep.Type == nbd.NEGOTIATION_TYPE_REPLY_ACK {
+			return size
+		}
+
+		r.Equal(nbd.NEGOTIATION_TYPE_REPLY_INFO, rep.Type)
+
+		body := make([]byte, rep.Length)
+		_, err := io.ReadFull(c.conn, body)
+		r.NoError(err)
+
+		if binary.BigEndian.Uint16(body) == nbd.NEGOTIATION_TYPE_INFO_EXPORT {
+			size = binary.BigEndian.Uint64(body[2:])
+		}
+	}
+}
+
+func (c *testNBDClient) send(typ uint16, off int64, length int, data []byte) {
+	r := require.New(c.t)
+
+	c.handle++
+
+	r.NoError(binary.Write(c.conn, binary.BigEndian, nbd.TransmissionRequestHeader{
+		RequestMagic: nbd.TRANSMISSION_MAGIC_REQUEST,
+		Type:         typ,
+		Handle:       c.handle,
+		Offset:       uint64(off),
+		Length:       uint32(length),
+	}))
+
+	if data != nil {
+		_, err := c.conn.Write(data)
+		r.NoError(err)
+	}
+}
+
+func (c *testNBDClient) reply() {
+	r := require.New(c.t)
+
+	var rep nbd.TransmissionReplyHeader
+	r.NoError(binary.Read(c.conn, binary.BigEndian, &rep))
+
+	r.Equal(nbd.TRANSMISSION_MAGIC_REPLY, rep.ReplyMagic)
+	r.Equal(uint32(0), rep.Error)
+	r.Equal(c.handle, rep.Handle)
+}
+
+func (c *testNBDClient) request(typ uint16, off int64, data []byte) {
+	switch typ {
+	case nbd.TRANSMISSION_TYPE_REQUEST_WRITE:
+		c.send(typ, off, len(data), data)
+	case nbd.TRANSMISSION_TYPE_REQUEST_DISC:
+		c.send(typ, off, 0, nil)
+		return
+	default:
+		c.send(typ, off, len(data), nil)
+	}
+
+	c.reply()
+}
+
+func (c *testNBDClient) read(off int64, length int) []byte {
+	c.send(nbd.TRANSMISSION_TYPE_REQUEST_READ, off, length, nil)
+	c.reply()
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(c.conn, data)
+	require.NoError(c.t, err)
+
+	return data
 }
@@ -1,18 +1,68 @@
 package lsvd
 
-import "github.com/oklog/ulid/v2"
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
 
 type opts struct {
 	sa         SegmentAccess
 	volName    string
 	autoCreate bool
 	seqGen     func() ulid.ULID
+	entropy    io.Reader
+	tagSegs    bool
+	clock      Clock
 	afterNS    func(SegmentId)
+	onFlushErr func(SegmentId, error)
 	lowers     []*Disk
 	ro         bool
 	useZstd    bool
+	noCache    bool
+	compRatio  float64
+	metrics    *Metrics
+
+	noCompression bool
+	maxExtent     int
+	zeroRun       int
+
+	writeCacheDir string
+	readCacheDir  string
+
+	openSegments int
+
+	boundedReads        bool
+	unknownFlagsAsHoles bool
+	rangedReads         bool
+	writerId            string
 
 	autoGC bool
+
+	maxFlushes    int
+	maxFlushBytes int64
+	syncFlush     bool
+	idleFlush     time.Duration
+
+	compaction *CompactionPolicy
+
+	refreshInterval time.Duration
+
+	checkpointSegments int
+	checkpointInterval time.Duration
+
+	cleanupInterval time.Duration
+	cleanupWorkers  int
+
+	writeCacheFsync         FsyncPolicy
+	writeCacheFsyncInterval time.Duration
+
+	dedup        bool
+	dedupEntries int
+
+	logLevels map[string]slog.Level
 }
 
 type Option func(o *opts)
@@ -47,6 +97,16 @@ func AfterNewSegment(f func(SegmentId)) Option {
 	}
 }
 
+// WithFlushErrorHandler calls +f+ when flushing a segment keeps failing. The
+// flush is still retried afterwards, since giving up would lose the data in
+// the write cache, so +f+ is where to alarm or stop accepting writes. It's
+// called on its own goroutine so that it doesn't hold up the flush.
+func WithFlushErrorHandler(f func(SegmentId, error)) Option {
+	return func(o *opts) {
+		o.onFlushErr = f
+	}
+}
+
 func ReadOnly() Option {
 	return func(o *opts) {
 		o.ro = true
@@ -65,6 +125,286 @@ func WithZstd() Option {
 	}
 }
 
+// WithCompressionMinRatio sets the smallest compression ratio (raw size over
+// compressed size) an extent must reach to be stored compressed. Extents that
+// don't reach it are stored uncompressed, and once enough extents in a row
+// miss it, compression isn't attempted for a while. It defaults to
+// DefaultCompressionMinRatio.
+func WithCompressionMinRatio(ratio float64) Option {
+	return func(o *opts) {
+		o.compRatio = ratio
+	}
+}
+
+// WithoutCompression stores every extent uncompressed rather than compressing
+// those that compress well, for hosts where CPU is scarcer than storage.
+// Empty extents are still detected and stored without data.
+func WithoutCompression() Option {
+	return func(o *opts) {
+		o.noCompression = true
+	}
+}
+
+// WithMaxExtentSize sets the largest extent in bytes that writes are stored
+// as, larger writes being split into several extents. Smaller extents keep
+// the buffers reads stage data in small, at the cost of more entries in the
+// extent map. It's rounded down to whole blocks and defaults to
+// DefaultMaxExtentSize.
+func WithMaxExtentSize(size int) Option {
+	return func(o *opts) {
+		o.maxExtent = size
+	}
+}
+
+// WithZeroRunSplit stores the data of a write between runs of at least
+// +blocks+ zero blocks as extents of their own, each compressed as a unit,
+// and the runs as empty extents, rather than storing and compressing the
+// whole write as one extent. Shorter runs of zeros stay in the extent around
+// them, so a fragmented write isn't broken into many tiny extents. It's off
+// by default.
+func WithZeroRunSplit(blocks int) Option {
+	return func(o *opts) {
+		o.zeroRun = blocks
+	}
+}
+
+// WithSegmentCleanup sets how often, give or take a quarter, segments that
+// are no longer used are removed from storage, rather than after every flush,
+// and how many are removed at once. They default to DefaultCleanupInterval
+// and DefaultCleanupWorkers.
+func WithSegmentCleanup(interval time.Duration, workers int) Option {
+	return func(o *opts) {
+		o.cleanupInterval = interval
+		o.cleanupWorkers = workers
+	}
+}
+
+// WithWriteCacheFsync sets when the write cache is synced to disk. With
+// FsyncOnClose, the default, it's synced on SyncWriteCache, such as when the
+// guest flushes. FsyncNever leaves it to the OS, and FsyncOnInterval syncs
+// writes in the background every +interval+ instead, with SyncWriteCache
+// waiting for neither.
+func WithWriteCacheFsync(policy FsyncPolicy, interval time.Duration) Option {
+	return func(o *opts) {
+		o.writeCacheFsync = policy
+		o.writeCacheFsyncInterval = interval
+	}
+}
+
+// WithWriteCacheDir places the write cache files, which every write goes
+// through, in +dir+ rather than in the disk's path, such as on a faster device.
+func WithWriteCacheDir(dir string) Option {
+	return func(o *opts) {
+		o.writeCacheDir = dir
+	}
+}
+
+// WithReadCacheDir places the read cache in +dir+ rather than in the disk's
+// path, such as on a larger device.
+func WithReadCacheDir(dir string) Option {
+	return func(o *opts) {
+		o.readCacheDir = dir
+	}
+}
+
+// WithoutReadCache disables caching the segment data that is read, so every
+// read goes to the SegmentAccess. This helps workloads with little locality,
+// such as backup scans, that would only churn the cache.
+func WithoutReadCache() Option {
+	return func(o *opts) {
+		o.noCache = true
+	}
+}
+
+// WithMaxConcurrentFlushes limits how many closed segments can be waiting
+// to be flushed at once. Once the limit is reached, writes that fill the
+// current segment block until a flush finishes. It defaults to 1.
+func WithMaxConcurrentFlushes(n int) Option {
+	return func(o *opts) {
+		o.maxFlushes = n
+	}
+}
+
+// WithMaxPendingFlushBytes limits the total size of the closed segments
+// waiting to be flushed, on top of WithMaxConcurrentFlushes' limit on their
+// number. While flushes fail, such as when the backend is unreachable, the
+// pending segments are held so they can still be read and retried, and once
+// either limit is reached writes that fill the current segment block until a
+// flush finishes. The data held is then at most +n+ plus the current segment,
+// which is flushed at FlushThreshHold. A single segment larger than +n+ is
+// still flushed, on its own. It defaults to 0, no limit beyond the number.
+func WithMaxPendingFlushBytes(n int64) Option {
+	return func(o *opts) {
+		o.maxFlushBytes = n
+	}
+}
+
+// WithSynchronousFlush makes a write that fills the current segment wait
+// until the segment has been uploaded, added to the volume, and applied to
+// the disk's map before returning. Writes that fill a segment take as long as
+// the upload, in exchange for the segment being fully published once they
+// return.
+func WithSynchronousFlush() Option {
+	return func(o *opts) {
+		o.syncFlush = true
+	}
+}
+
+// WithIdleFlush flushes the write cache once no write has arrived for
+// +idle+, rather than leaving writes that didn't fill a segment only on local
+// disk until more writes do. It bounds how long a write can go without being
+// stored in a segment on a disk that's idle. An empty write cache is never
+// flushed.
+func WithIdleFlush(idle time.Duration) Option {
+	return func(o *opts) {
+		o.idleFlush = idle
+	}
+}
+
+// WithBoundedReads causes reads that begin at or past the end of the volume
+// to return ErrOutOfRange, and reads that straddle the end to be clamped
+// with the tail zero filled. Without it, any LBA can be read and returns
+// zeros if never written.
+func WithBoundedReads() Option {
+	return func(o *opts) {
+		o.boundedReads = true
+	}
+}
+
+// UnknownFlagsAsHoles causes an extent whose flags can't be read, which
+// otherwise fails the whole read with ErrUnknownExtentFlag, to be read as
+// zeros instead. Each one is logged and counted, so that as much of a damaged
+// volume as possible can be recovered.
+func UnknownFlagsAsHoles() Option {
+	return func(o *opts) {
+		o.unknownFlagsAsHoles = true
+	}
+}
+
+// RangedReads reads only the blocks a read wants of an uncompressed extent,
+// straight into the read's destination, rather than the whole extent via a
+// buffer. This cuts the data read for small reads of large extents, such as
+// those written by large sequential writes. Compressed extents are still read
+// whole, as they can only be uncompressed whole. It applies to the extents of
+// the disk it's set on, not those of its lower layers.
+func RangedReads() Option {
+	return func(o *opts) {
+		o.rangedReads = true
+	}
+}
+
+// WithOpenSegments sets how many segments are kept open for reading, the
+// least recently read being closed beyond that. Opening a segment can take a
+// request to the store, such as S3's check that it exists, so volumes that
+// read from many segments at once benefit from more. It defaults to
+// DefaultOpenSegments.
+func WithOpenSegments(n int) Option {
+	return func(o *opts) {
+		o.openSegments = n
+	}
+}
+
+// WithWriterId sets the identity recorded in the metadata of segments
+// written by the disk. It defaults to the hostname.
+func WithWriterId(id string) Option {
+	return func(o *opts) {
+		o.writerId = id
+	}
+}
+
+// WithMetrics configures the disk to report into m rather than the
+// default, process wide metrics.
+func WithMetrics(m *Metrics) Option {
+	return func(o *opts) {
+		o.metrics = m
+	}
+}
+
+// WithEntropy sets the source of randomness for segment ids. The disk
+// wraps it in its own monotonic reader. It defaults to crypto/rand.
+func WithEntropy(r io.Reader) Option {
+	return func(o *opts) {
+		o.entropy = r
+	}
+}
+
+// WithVolumeTaggedSegments puts a tag derived from the volume's name into
+// the random bits of the segment ids the disk generates, so that a segment no
+// volume lists anymore can still be attributed to the one that wrote it, see
+// AttributeSegments. The ids are ordinary ULIDs either way, so volumes can
+// switch it on and off freely. It doesn't apply to ids from WithSeqGen.
+func WithVolumeTaggedSegments() Option {
+	return func(o *opts) {
+		o.tagSegs = true
+	}
+}
+
+// WithClock sets the clock the disk uses to tell time and wait. It defaults
+// to the system clock.
+func WithClock(c Clock) Option {
+	return func(o *opts) {
+		o.clock = c
+	}
+}
+
+// WithCompactionPolicy has the disk check +p+ periodically and compact its
+// segments when it calls for it.
+func WithCompactionPolicy(p CompactionPolicy) Option {
+	return func(o *opts) {
+		o.compaction = &p
+	}
+}
+
+// WithRefreshInterval has a read-only disk call Refresh every +d+, so that it
+// picks up the segments flushed by the volume's writer.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(o *opts) {
+		o.refreshInterval = d
+	}
+}
+
+// WithCheckpoints has the disk save its LBA map after every +segments+
+// flushed segments and every +interval+ that a segment was flushed in,
+// rather than only when it's closed. Reopening a disk that wasn't closed
+// then only has to read the segments flushed since the last checkpoint.
+// Either can be 0 to only checkpoint on the other.
+func WithCheckpoints(segments int, interval time.Duration) Option {
+	return func(o *opts) {
+		o.checkpointSegments = segments
+		o.checkpointInterval = interval
+	}
+}
+
+// WithDedup stores data that the volume already stores only once. Extents
+// are identified by the SHA-256 of their data, so data is found again when
+// it's written as the same extents, such as when cloning an image. An index
+// of up to +entries+ extents, DefaultDedupEntries if 0, is kept for it, and
+// saved along with the LBA map when the disk is closed.
+//
+// Duplicates within a segment share its data. Those of data in another
+// segment are recorded as references to it, which keep that segment until
+// GC moves the data into a new segment. Segments with references can't be
+// read by versions before SegmentFormatVersion 2.
+func WithDedup(entries int) Option {
+	return func(o *opts) {
+		o.dedup = true
+		o.dedupEntries = entries
+	}
+}
+
+// WithLogLevel sets the level that the disk logs at for +subsystem+, one of
+// LogRead, LogWrite, LogFlush, LogGC or LogCache. The subsystems otherwise
+// log at the level of the disk's logger.
+func WithLogLevel(subsystem string, level slog.Level) Option {
+	return func(o *opts) {
+		if o.logLevels == nil {
+			o.logLevels = map[string]slog.Level{}
+		}
+
+		o.logLevels[subsystem] = level
+	}
+}
+
 var EnableAutoGC = func(o *opts) {
 	o.autoGC = true
 }
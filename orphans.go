@@ -0,0 +1,108 @@
+package lsvd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/pkg/errors"
+)
+
+// SweepOrphanSegments removes the segments in +sa+ that aren't listed by any
+// volume, live or soft deleted, such as those left behind when a writer
+// crashed after uploading a segment but before adding it to the volume. Only
+// segments created more than +grace+ ago are removed, so that segments still
+// being uploaded and added by a running writer are left alone. It returns the segments that were removed.
+func SweepOrphanSegments(ctx context.Context, log logger.Logger, sa SegmentAccess, grace time.Duration) ([]SegmentId, error) {
+	lister, ok := sa.(SegmentLister)
+	if !ok {
+		return nil, fmt.Errorf("segment access %T can't list all segments", sa)
+	}
+
+	referenced, err := referencedSegments(ctx, sa)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := lister.ListAllSegments(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing all segments")
+	}
+
+	owners, err := AttributeSegments(ctx, sa, all)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-grace)
+
+	var removed []SegmentId
+
+	for _, seg := range all {
+		if _, ok := referenced[seg]; ok {
+			continue
+		}
+
+		if !seg.Time().Before(cutoff) {
+			continue
+		}
+
+		log.Info("removing orphaned segment", "segment", seg, "created-at", seg.Time(), "volume", owners[seg])
+
+		err := sa.RemoveSegment(ctx, seg)
+		if err != nil {
+			return removed, errors.Wrapf(err, "removing segment %s", seg)
+		}
+
+		removed = append(removed, seg)
+	}
+
+	return removed, nil
+}
+
+// AttributeSegments returns the volume each of +segments+ was probably
+// written by, going by the tag WithVolumeTaggedSegments puts into segment
+// ids. It considers the volumes in +sa+, live or soft deleted. Segments
+// whose tag matches no volume are left out, as are those that match more than
+// one. Segments written without tags match a volume only by rare chance, so
+// the result is a hint for reporting, not a basis for removing anything.
+func AttributeSegments(ctx context.Context, sa SegmentAccess, segments []SegmentId) (map[SegmentId]string, error) {
+	volumes, err := sa.ListVolumes(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing volumes")
+	}
+
+	if vt, ok := sa.(VolumeTrash); ok {
+		trashed, err := vt.ListTrashedVolumes(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing trashed volumes")
+		}
+
+		for _, tv := range trashed {
+			volumes = append(volumes, tv.Name)
+		}
+	}
+
+	tags := map[uint32]string{}
+	ambiguous := map[uint32]bool{}
+
+	for _, vol := range volumes {
+		tag := VolumeTag(vol)
+		if other, ok := tags[tag]; ok && other != vol {
+			ambiguous[tag] = true
+		}
+		tags[tag] = vol
+	}
+
+	owners := map[SegmentId]string{}
+
+	for _, seg := range segments {
+		tag := seg.VolumeTag()
+		if vol, ok := tags[tag]; ok && !ambiguous[tag] {
+			owners[seg] = vol
+		}
+	}
+
+	return owners, nil
+}
@@ -0,0 +1,130 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweepOrphanSegments(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	writeSegment := func(t *testing.T, sa SegmentAccess, created time.Time) SegmentId {
+		seg := SegmentId(ulid.MustNew(ulid.Timestamp(created), ulid.DefaultEntropy()))
+
+		w, err := sa.WriteSegment(ctx, seg)
+		require.NoError(t, err)
+
+		_, err = w.Write(testRand)
+		require.NoError(t, err)
+
+		require.NoError(t, w.Close())
+
+		return seg
+	}
+
+	t.Run("removes old segments no volume refers to", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		sa := &LocalFileAccess{Dir: tmpdir}
+		r.NoError(sa.InitContainer(ctx))
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "a"}))
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "b"}))
+
+		old := time.Now().Add(-48 * time.Hour)
+
+		inA := writeSegment(t, sa, old)
+		r.NoError(sa.AppendToSegments(ctx, "a", inA))
+
+		inB := writeSegment(t, sa, old)
+		r.NoError(sa.AppendToSegments(ctx, "b", inB))
+
+		orphan := writeSegment(t, sa, old)
+		recent := writeSegment(t, sa, time.Now())
+
+		removed, err := SweepOrphanSegments(ctx, log, sa, 24*time.Hour)
+		r.NoError(err)
+
+		r.Equal([]SegmentId{orphan}, removed)
+
+		_, err = sa.OpenSegment(ctx, orphan)
+		r.ErrorIs(err, os.ErrNotExist)
+
+		for _, seg := range []SegmentId{inA, inB, recent} {
+			f, err := sa.OpenSegment(ctx, seg)
+			r.NoError(err)
+			f.Close()
+		}
+	})
+
+	t.Run("attributes orphans to the volume that wrote them", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		sa := &LocalFileAccess{Dir: tmpdir}
+
+		dctx := NewContext(ctx)
+
+		d, err := NewDisk(dctx, log, tmpdir,
+			WithSegmentAccess(sa),
+			WithVolumeName("a"),
+			WithVolumeTaggedSegments(),
+		)
+		r.NoError(err)
+		defer d.Close(dctx)
+
+		for i := 0; i < 3; i++ {
+			r.NoError(d.WriteExtent(dctx, testRandX.MapTo(LBA(i*10))))
+			r.NoError(d.CloseSegment(dctx))
+		}
+
+		written, err := sa.ListSegments(ctx, "a")
+		r.NoError(err)
+		r.Len(written, 3)
+
+		for i, seg := range written {
+			r.True(seg.TaggedFor("a"))
+
+			if i > 0 {
+				r.True(ulid.ULID(seg).Compare(ulid.ULID(written[i-1])) > 0)
+			}
+		}
+
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "b"}))
+
+		// Left behind by the disk as if it crashed before adding it.
+		orphan := written[len(written)-1]
+		r.NoError(sa.RemoveSegmentFromVolume(ctx, "a", orphan))
+
+		untagged := writeSegment(t, sa, time.Now())
+
+		owners, err := AttributeSegments(ctx, sa, []SegmentId{orphan, untagged})
+		r.NoError(err)
+
+		r.Equal("a", owners[orphan])
+
+		_, ok := owners[untagged]
+		r.Equal(untagged.TaggedFor("a") || untagged.TaggedFor("b"), ok)
+	})
+
+	t.Run("requires listing all segments", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := SweepOrphanSegments(ctx, log, newMemAccess(), time.Hour)
+		r.Error(err)
+	})
+}
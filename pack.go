@@ -2,9 +2,12 @@ package lsvd
 
 import (
 	"context"
-	"path/filepath"
 )
 
+// The most blocks of uncompressed data combined into a single extent, since
+// reading any part of an extent reads it whole.
+const maxCombinedBlocks = 100
+
 type Packer struct {
 	d *Disk
 	m *ExtentMap
@@ -15,10 +18,10 @@ type Packer struct {
 func (p *Packer) iterateExtents(ctx *Context) error {
 	var live RangeData
 
-	sb := NewSegmentBuilder()
+	sb := p.d.newSegmentBuilder()
 
-	path := filepath.Join(p.d.path, "writecache."+p.segId.String())
-	err := sb.OpenWrite(path, p.d.log)
+	path := p.d.writeCachePath(p.segId)
+	err := sb.OpenWrite(path, p.d.logs.gc)
 	if err != nil {
 		return err
 	}
@@ -28,7 +31,7 @@ func (p *Packer) iterateExtents(ctx *Context) error {
 
 	for i := p.m.Iterator(); i.Valid(); i.Next() {
 
-		d.log.Debug("packing extent", "extent", i.Value().Live)
+		d.logs.gc.Debug("packing extent", "extent", i.Value().Live)
 		data, err := d.ReadExtent(ctx, i.Value().Live)
 		if err != nil {
 			return err
@@ -43,9 +46,9 @@ func (p *Packer) iterateExtents(ctx *Context) error {
 		if live.Last()+1 == i.Key() {
 			live = live.Append(data)
 
-			if live.Blocks >= 100 {
-				d.log.Debug("writing packed extent (big)", "extent", live.Extent)
-				_, _, err := sb.WriteExtent(d.log, live.View())
+			if live.Blocks >= maxCombinedBlocks {
+				d.logs.gc.Debug("writing packed extent (big)", "extent", live.Extent)
+				_, _, err := sb.WriteExtent(d.logs.gc, live.View())
 				if err != nil {
 					return err
 				}
@@ -53,8 +56,8 @@ func (p *Packer) iterateExtents(ctx *Context) error {
 				ctx.ResetTo(marker)
 			}
 		} else {
-			d.log.Debug("writing packed extent (disjoint)", "extent", live.Extent)
-			_, _, err := sb.WriteExtent(d.log, live.View())
+			d.logs.gc.Debug("writing packed extent (disjoint)", "extent", live.Extent)
+			_, _, err := sb.WriteExtent(d.logs.gc, live.View())
 			if err != nil {
 				return err
 			}
@@ -68,15 +71,15 @@ func (p *Packer) iterateExtents(ctx *Context) error {
 				return err
 			}
 
-			sb.Close(p.d.log)
+			sb.Close(p.d.logs.gc)
 
-			sb = NewSegmentBuilder()
+			sb = p.d.newSegmentBuilder()
 		}
 	}
 
 	if live.Blocks > 0 {
-		d.log.Debug("writing packed extent (final)", "extent", live.Extent)
-		_, _, err := sb.WriteExtent(d.log, live.View())
+		d.logs.gc.Debug("writing packed extent (final)", "extent", live.Extent)
+		_, _, err := sb.WriteExtent(d.logs.gc, live.View())
 		if err != nil {
 			return err
 		}
@@ -86,22 +89,22 @@ func (p *Packer) iterateExtents(ctx *Context) error {
 }
 
 func (p *Packer) flushSegment(ctx context.Context, sb *SegmentBuilder) error {
-	defer sb.Close(p.d.log)
+	defer sb.Close(p.d.logs.gc)
 
 	d := p.d
 
 	sid := p.segId
 
-	d.log.Debug("creating packed segment", "id", sid)
+	d.logs.gc.Debug("creating packed segment", "id", sid)
 
-	locs, stats, err := sb.Flush(ctx, d.log, d.sa, sid, d.volName)
+	locs, stats, err := sb.Flush(ctx, d.logs.gc, d.sa, sid, d.volName)
 	if err != nil {
 		return err
 	}
 
 	d.s.Create(sid, stats)
 
-	err = p.m.UpdateBatch(d.log, locs, sid, d.s)
+	err = p.m.UpdateBatch(d.logs.gc, locs, sid, d.s)
 	if err != nil {
 		return err
 	}
@@ -118,7 +121,7 @@ func (p *Packer) Pack(gctx context.Context) error {
 	p.segId = seg
 
 	for seg, stats := range p.d.s.segments {
-		p.d.log.Trace("pre-pack segment", "segment", seg, "used", stats.Used)
+		p.d.logs.gc.Trace("pre-pack segment", "segment", seg, "used", stats.Used)
 	}
 
 	ctx := NewContext(gctx)
@@ -130,7 +133,7 @@ func (p *Packer) Pack(gctx context.Context) error {
 
 	err = p.removeOldSegments(gctx)
 	for seg, stats := range p.d.s.segments {
-		p.d.log.Trace("post-pack segment", "segment", seg, "used", stats.Used)
+		p.d.logs.gc.Trace("post-pack segment", "segment", seg, "used", stats.Used)
 	}
 
 	return err
@@ -143,27 +146,31 @@ func (p *Packer) removeOldSegments(ctx context.Context) error {
 	}
 
 	for _, seg := range segments {
-		p.d.log.Debug("removing dead segment", "id", seg)
+		p.d.logs.gc.Debug("removing dead segment", "id", seg)
 		err := p.d.removeSegmentIfPossible(ctx, seg)
 		if err != nil {
 			return err
 		}
 
-		p.d.s.SetDeleted(seg, p.d.log)
+		p.d.s.SetDeleted(seg, p.d.logs.gc)
 	}
 
-	p.d.log.Debug("removed dead segments", "count", len(segments))
+	p.d.logs.gc.Debug("removed dead segments", "count", len(segments))
 
 	return nil
 }
 
 func (d *Disk) Pack(ctx context.Context) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
 	err := d.CloseSegment(ctx)
 	if err != nil {
 		return err
 	}
 
-	d.log.Trace("beginning pack process")
+	d.logs.gc.Trace("beginning pack process")
 
 	packer := &Packer{d: d, m: d.lba2pba}
 	return packer.Pack(ctx)
@@ -27,6 +27,8 @@
 package treemap
 
 import (
+	"unsafe"
+
 	"golang.org/x/exp/constraints"
 )
 
@@ -126,6 +128,16 @@ func (t *TreeMap[Key, Value]) allocNode() *node[Key, Value] {
 	return &t.nodes[idx]
 }
 
+// MemoryUsage returns the approximate bytes held by the tree's nodes,
+// including the ones allocated ahead or kept for reuse.
+func (t *TreeMap[Key, Value]) MemoryUsage() int {
+	var n node[Key, Value]
+
+	nodes := t.count + len(t.freelist) + cap(t.nodes) - len(t.nodes)
+
+	return nodes*int(unsafe.Sizeof(n)) + cap(t.freelist)*int(unsafe.Sizeof(&n))
+}
+
 // Del deletes the value.
 // Complexity: O(log N).
 func (t *TreeMap[Key, Value]) Del(key Key) {
@@ -153,6 +165,80 @@ func (t *TreeMap[Key, Value]) Clear() {
 	t.endNode.left = nil
 }
 
+// BuildSorted replaces the contents of the map with +keys+ and their
+// +values+, building the tree directly from them rather than inserting each.
+// The keys must be strictly ascending; if they aren't, or the lengths don't
+// match, the map is left as is and false is returned.
+// Complexity: O(N).
+func (t *TreeMap[Key, Value]) BuildSorted(keys []Key, values []Value) bool {
+	if len(keys) != len(values) {
+		return false
+	}
+
+	for i := 1; i < len(keys); i++ {
+		if !t.keyCompare(keys[i-1], keys[i]) {
+			return false
+		}
+	}
+
+	t.Clear()
+	t.freelist = nil
+	t.nodes = nil
+
+	if len(keys) == 0 {
+		return true
+	}
+
+	nodes := make([]node[Key, Value], len(keys))
+	for i := range nodes {
+		nodes[i].key = keys[i]
+		nodes[i].value = values[i]
+		nodes[i].isBlack = true
+	}
+
+	// Splitting at the middle leaves every level full but the deepest, so
+	// coloring just its nodes red keeps the black heights equal.
+	red := 0
+	for (2<<red)-1 <= len(nodes) {
+		red++
+	}
+
+	root := buildBalanced(nodes, 0, red)
+	root.parent = t.endNode
+	t.endNode.left = root
+
+	t.beginNode = &nodes[0]
+	t.count = len(nodes)
+	t.nodes = nodes
+
+	return true
+}
+
+func buildBalanced[Key, Value any](
+	nodes []node[Key, Value], depth, red int,
+) *node[Key, Value] {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	mid := len(nodes) / 2
+	x := &nodes[mid]
+
+	x.isBlack = depth != red
+
+	x.left = buildBalanced(nodes[:mid], depth+1, red)
+	if x.left != nil {
+		x.left.parent = x
+	}
+
+	x.right = buildBalanced(nodes[mid+1:], depth+1, red)
+	if x.right != nil {
+		x.right.parent = x
+	}
+
+	return x
+}
+
 // Get retrieves a value from a map for specified key and reports if it exists.
 // Complexity: O(log N).
 func (t *TreeMap[Key, Value]) Get(id Key) (Value, bool) {
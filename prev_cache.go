@@ -1,45 +1,131 @@
 package lsvd
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
-// PreviousCache manages holding onto a single segment creator as
-// the previous cache.
+// PreviousCache manages holding onto the segment creators that have been
+// closed but not yet flushed, up to a limit, so they can still be read from.
+// The limit is on how many are held and, optionally, on the total size of
+// their bodies. Add waits for room, so that while flushes can't complete,
+// such as during a backend outage, writers are held up rather than the
+// pending data growing without bound.
 type PreviousCache struct {
-	prevCacheMu   sync.Mutex
-	prevCacheCond *sync.Cond
-	prevCache     *SegmentCreator
+	mu     sync.Mutex
+	max    int
+	caches []*SegmentCreator
+	freed  chan struct{}
+
+	// The body size of each of caches when it was added, their total, and
+	// the limit on it, 0 meaning no limit.
+	sizes    []int64
+	bytes    int64
+	maxBytes int64
+
+	// Held for reading while the segment creators are read from, so that
+	// Remove can wait for the reads of the one it removes to finish.
+	readers sync.RWMutex
+}
+
+func NewPreviousCache(max int) *PreviousCache {
+	if max < 1 {
+		max = 1
+	}
+
+	return &PreviousCache{
+		max:   max,
+		freed: make(chan struct{}),
+	}
+}
+
+// Load returns the held segment creators, newest first.
+func (p *PreviousCache) Load() []*SegmentCreator {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]*SegmentCreator, len(p.caches))
+	for i, sc := range p.caches {
+		out[len(out)-1-i] = sc
+	}
+
+	return out
 }
 
-func NewPreviousCache() *PreviousCache {
-	p := &PreviousCache{}
-	p.prevCacheCond = sync.NewCond(&p.prevCacheMu)
+// Acquire returns the held segment creators, newest first, like Load, but
+// they can be read from until +release+ is called even if they're removed in
+// the meantime. Remove waits for release, which is what lets the caller of
+// Remove close the one removed.
+func (p *PreviousCache) Acquire() (caches []*SegmentCreator, release func()) {
+	p.readers.RLock()
 
-	return p
+	return p.Load(), p.readers.RUnlock
 }
 
-func (p *PreviousCache) Load() *SegmentCreator {
-	p.prevCacheMu.Lock()
-	defer p.prevCacheMu.Unlock()
+// Bytes returns the total body size of the held segment creators.
+func (p *PreviousCache) Bytes() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	return p.prevCache
+	return p.bytes
 }
 
-func (p *PreviousCache) Clear() {
-	p.prevCacheMu.Lock()
-	defer p.prevCacheMu.Unlock()
+// Remove drops +sc+, freeing its slot. It returns once no read that
+// acquired +sc+ is still running, so +sc+ can then be closed.
+func (p *PreviousCache) Remove(sc *SegmentCreator) {
+	p.mu.Lock()
+
+	for i, x := range p.caches {
+		if x == sc {
+			p.bytes -= p.sizes[i]
+			p.caches = append(p.caches[:i], p.caches[i+1:]...)
+			p.sizes = append(p.sizes[:i], p.sizes[i+1:]...)
+			break
+		}
+	}
+
+	close(p.freed)
+	p.freed = make(chan struct{})
 
-	p.prevCache = nil
+	p.mu.Unlock()
 
-	p.prevCacheCond.Signal()
+	// Reads acquired after this point can't see sc, so it's only the ones
+	// already running that are waited for.
+	p.readers.Lock()
+	p.readers.Unlock()
 }
 
-func (p *PreviousCache) SetWhenClear(sc *SegmentCreator) {
-	p.prevCacheMu.Lock()
-	defer p.prevCacheMu.Unlock()
+// Add holds onto +sc+, waiting until there is a free slot and room for its
+// body or +ctx+ is canceled. A segment creator larger than the byte limit
+// is still added once nothing else is held, so it can't wait forever.
+func (p *PreviousCache) Add(ctx context.Context, sc *SegmentCreator) error {
+	size := int64(sc.BodySize())
+
+	for {
+		p.mu.Lock()
+		if p.hasRoom(size) {
+			p.caches = append(p.caches, sc)
+			p.sizes = append(p.sizes, size)
+			p.bytes += size
+			p.mu.Unlock()
+			return nil
+		}
+
+		freed := p.freed
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-freed:
+		}
+	}
+}
 
-	for p.prevCache != nil {
-		p.prevCacheCond.Wait()
+func (p *PreviousCache) hasRoom(size int64) bool {
+	if len(p.caches) >= p.max {
+		return false
 	}
 
-	p.prevCache = sc
+	return p.maxBytes <= 0 || len(p.caches) == 0 || p.bytes+size <= p.maxBytes
 }
@@ -0,0 +1,330 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviousCache(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	t.Run("holds a bounded amount of data while flushes fail", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		sa := &unreachableAccess{memAccess: newMemAccess()}
+
+		const limit = 10_000
+
+		d, err := NewDisk(ctx, log, tmpdir,
+			WithSegmentAccess(sa),
+			WithMaxConcurrentFlushes(8),
+			WithMaxPendingFlushBytes(limit),
+		)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		d.flushRetryDelay = 10 * time.Millisecond
+
+		sa.failing.Store(true)
+
+		var held int
+
+		for i := 0; i < 5; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+
+			tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			_, err := d.closeSegmentAsync(tctx)
+			cancel()
+
+			if err != nil {
+				r.ErrorIs(err, context.DeadlineExceeded)
+				break
+			}
+
+			held++
+		}
+
+		// Each segment is a little over a block, so only 2 fit.
+		r.Equal(2, held)
+
+		stats := d.Stats()
+		r.Equal(2, stats.PendingFlushes)
+		r.LessOrEqual(stats.PendingFlushBytes, int64(limit))
+		r.Greater(stats.PendingFlushBytes, int64(2*BlockSize))
+
+		// What's held can still be read while the flushes are retried.
+		for i := 0; i < 3; i++ {
+			data, err := d.ReadExtent(ctx, Extent{LBA: LBA(i), Blocks: 1})
+			r.NoError(err)
+			blockEqual(t, testRandX, data.ReadData())
+		}
+
+		sa.failing.Store(false)
+
+		r.Eventually(func() bool {
+			return d.prevCache.Bytes() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		r.Empty(d.prevCache.Load())
+
+		r.NoError(d.CloseSegment(ctx))
+
+		segs, err := sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 3)
+	})
+
+	t.Run("queues more flushes than other events while flushes fail", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		sa := &unreachableAccess{memAccess: newMemAccess()}
+
+		const flushes = controllerEventSlots + 5
+
+		d, err := NewDisk(ctx, log, tmpdir,
+			WithSegmentAccess(sa),
+			WithMaxConcurrentFlushes(flushes),
+		)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		d.flushRetryDelay = 10 * time.Millisecond
+
+		sa.failing.Store(true)
+
+		// The controller retries the first flush, so the rest wait in the
+		// events channel.
+		queued := make(chan error, 1)
+
+		go func() {
+			for i := 0; i < flushes; i++ {
+				err := d.WriteExtent(ctx, testRandX.MapTo(LBA(i)))
+				if err == nil {
+					_, err = d.closeSegmentAsync(ctx)
+				}
+
+				if err != nil {
+					queued <- err
+					return
+				}
+			}
+
+			queued <- nil
+		}()
+
+		select {
+		case err := <-queued:
+			r.NoError(err)
+		case <-time.After(5 * time.Second):
+			r.FailNow("queueing a flush waited on the controller")
+		}
+
+		r.Equal(flushes, d.Stats().PendingFlushes)
+
+		sa.failing.Store(false)
+
+		r.Eventually(func() bool {
+			return len(d.prevCache.Load()) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		segs, err := sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, flushes)
+	})
+
+	t.Run("flushes a segment it was given even if the context is done", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithMaxConcurrentFlushes(16))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		// There's room for each segment, so they're all taken, and then
+		// have to be flushed rather than left held.
+		for i := 0; i < 10; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+
+			ch, err := d.closeSegmentAsync(cctx)
+			r.NoError(err)
+			r.NotNil(ch)
+		}
+
+		r.Eventually(func() bool {
+			return len(d.prevCache.Load()) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 10)
+	})
+
+	t.Run("adds a segment over the limit when nothing else is held", func(t *testing.T) {
+		r := require.New(t)
+
+		p := NewPreviousCache(4)
+		p.maxBytes = 1
+
+		sc := &SegmentCreator{builder: &SegmentBuilder{offset: BlockSize}}
+
+		tctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+
+		r.NoError(p.Add(tctx, sc))
+		r.Equal(int64(BlockSize), p.Bytes())
+
+		p.Remove(sc)
+		r.Zero(p.Bytes())
+	})
+	t.Run("never misses data while it's being flushed", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		var sa slowLocal
+
+		sa.Dir = tmpdir
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		// Older data for the LBA, which a read that missed the newer data
+		// would return.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		sa.wait = make(chan struct{})
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		ch, err := d.closeSegmentAsync(ctx)
+		r.NoError(err)
+
+		var (
+			stop              atomic.Bool
+			reads, bad        atomic.Int64
+			fromPrev, fromSeg atomic.Bool
+		)
+
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+
+			rctx := NewContext(context.Background())
+			defer rctx.Close()
+
+			for !stop.Load() {
+				rctx.Reset()
+
+				data, trace, err := d.ReadExtentTraced(rctx, Extent{LBA: 0, Blocks: 1})
+				if err != nil || !bytes.Equal(testRandX, data.ReadData()) {
+					bad.Add(1)
+					continue
+				}
+
+				reads.Add(1)
+
+				if e, ok := trace.Source(0); ok {
+					switch e.Source {
+					case ReadFromPrevCache:
+						fromPrev.Store(true)
+					case ReadFromExtentCache, ReadFromSegment:
+						fromSeg.Store(true)
+					}
+				}
+			}
+		}()
+
+		// The upload is held up, so the reads are served by the write cache
+		// being flushed.
+		r.Eventually(fromPrev.Load, 5*time.Second, time.Millisecond)
+		r.False(fromSeg.Load())
+
+		close(sa.wait)
+
+		select {
+		case res := <-ch:
+			r.NoError(res.Error)
+		case <-time.After(5 * time.Second):
+			r.FailNow("segment was not flushed")
+		}
+
+		r.Empty(d.prevCache.Load())
+
+		// And then by the segment it was published as.
+		r.Eventually(fromSeg.Load, 5*time.Second, time.Millisecond)
+
+		stop.Store(true)
+		<-done
+
+		r.Zero(bad.Load())
+		r.NotZero(reads.Load())
+	})
+
+	t.Run("waits for reads of a segment creator to finish removing it", func(t *testing.T) {
+		r := require.New(t)
+
+		p := NewPreviousCache(4)
+
+		sc := &SegmentCreator{builder: &SegmentBuilder{}}
+
+		r.NoError(p.Add(ctx, sc))
+
+		caches, release := p.Acquire()
+		r.Equal([]*SegmentCreator{sc}, caches)
+
+		removed := make(chan struct{})
+
+		go func() {
+			defer close(removed)
+			p.Remove(sc)
+		}()
+
+		r.Never(func() bool {
+			select {
+			case <-removed:
+				return true
+			default:
+				return false
+			}
+		}, 100*time.Millisecond, 10*time.Millisecond)
+
+		// It's no longer handed out, only waiting on the read.
+		r.Empty(p.Load())
+
+		release()
+
+		select {
+		case <-removed:
+		case <-time.After(5 * time.Second):
+			r.FailNow("remove didn't return after the read was released")
+		}
+	})
+}
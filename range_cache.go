@@ -5,17 +5,83 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/lab47/lsvd/logger"
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
+// ReadCache serves reads of segment data for the ExtentReader, possibly from
+// a local copy of it.
+type ReadCache interface {
+	ReadAt(ctx context.Context, seg SegmentId, buf []byte, off int64) (int, error)
+
+	// CachePositions returns where the data is kept in local files so that
+	// it can be served without copying it. A cache that doesn't keep local
+	// files returns none.
+	CachePositions(ctx context.Context, seg SegmentId, total, off int64, ret []CachePosition) ([]CachePosition, error)
+
+	// Warm loads +spans+ into the cache ahead of them being read, fetching
+	// up to +workers+ pieces of them at once, and returns how many bytes it
+	// fetched. Data that's already cached isn't fetched again.
+	Warm(ctx context.Context, spans []segmentSpan, workers int) (int64, error)
+
+	Close() error
+}
+
+// segmentSpan is a range of the bytes of a segment.
+type segmentSpan struct {
+	seg  SegmentId
+	off  int64
+	size int64
+}
+
+var _ ReadCache = (*RangeCache)(nil)
+
+// noReadCache is a ReadCache that reads directly from the segments every
+// time, for workloads with too little locality to benefit from caching.
+type noReadCache struct {
+	fetch   func(ctx context.Context, seg SegmentId, data []byte, off int64) error
+	metrics *Metrics
+}
+
+func (n *noReadCache) ReadAt(ctx context.Context, seg SegmentId, buf []byte, off int64) (int, error) {
+	n.metrics.extentCacheMiss.Inc()
+
+	err := n.fetch(ctx, seg, buf, off)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+func (n *noReadCache) CachePositions(ctx context.Context, seg SegmentId, total, off int64, ret []CachePosition) ([]CachePosition, error) {
+	return ret[:0], nil
+}
+
+func (n *noReadCache) Warm(ctx context.Context, spans []segmentSpan, workers int) (int64, error) {
+	return 0, nil
+}
+
+func (n *noReadCache) Close() error {
+	return nil
+}
+
 type rangeCacheKey struct {
 	Seg   SegmentId
 	Chunk int64
 }
 
+// RangeCache keeps chunks of segment data in a local file. If the file
+// can't grow because its disk is full, the cache stops saving chunks for
+// rangeCacheFullDelay and serves the chunks it doesn't have straight from
+// the segments meanwhile, so reads keep working.
 type RangeCache struct {
+	log   logger.Logger
 	path  string
 	f     *os.File
 	chunk int64
@@ -24,16 +90,41 @@ type RangeCache struct {
 
 	lru *lru.Cache[rangeCacheKey, int64]
 
+	// The end of the slots used so far, and slots whose write failed and
+	// that are free to be used again.
+	end  int64
+	free []int64
+
+	// Set while the disk is full, until the time to try saving chunks again.
+	fullUntil time.Time
+
 	chunkBuf []byte
 
 	cacheRegion []byte
+
+	metrics *Metrics
+
+	// Used to save chunks and tell the time, replaced in tests.
+	writeAt func(b []byte, off int64) (int, error)
+	now     func() time.Time
 }
 
+// How long a RangeCache stops saving chunks for when its disk is full.
+const rangeCacheFullDelay = time.Minute
+
 type RangeCacheOptions struct {
 	Path      string
 	ChunkSize int64
 	MaxSize   int64
 	Fetch     func(ctx context.Context, seg SegmentId, data []byte, off int64) error
+
+	// Metrics to report cache hits and misses into. If nil, the default
+	// metrics are used.
+	Metrics *Metrics
+
+	// Where to log when the cache's disk fills up. If nil, a logger at the
+	// Info level is used.
+	Log logger.Logger
 }
 
 func NewRangeCache(opts RangeCacheOptions) (*RangeCache, error) {
@@ -53,6 +144,10 @@ func NewRangeCache(opts RangeCacheOptions) (*RangeCache, error) {
 		return nil, err
 	}
 
+	if opts.Metrics == nil {
+		opts.Metrics = defaultMetrics
+	}
+
 	fd := f.Fd()
 
 	data, err := unix.Mmap(int(fd), 0, int(opts.MaxSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
@@ -60,7 +155,12 @@ func NewRangeCache(opts RangeCacheOptions) (*RangeCache, error) {
 		return nil, err
 	}
 
+	if opts.Log == nil {
+		opts.Log = logger.New(logger.Info)
+	}
+
 	rc := &RangeCache{
+		log:   opts.Log,
 		path:  opts.Path,
 		f:     f,
 		chunk: opts.ChunkSize,
@@ -71,6 +171,11 @@ func NewRangeCache(opts RangeCacheOptions) (*RangeCache, error) {
 		chunkBuf: make([]byte, opts.ChunkSize),
 
 		cacheRegion: data,
+
+		metrics: opts.Metrics,
+
+		writeAt: f.WriteAt,
+		now:     time.Now,
 	}
 
 	return rc, nil
@@ -104,21 +209,21 @@ func (r *RangeCache) ReadAt(ctx context.Context, seg SegmentId, buf []byte, off
 		ok, mem := r.memChunk(seg, chunk)
 
 		if !ok {
-			extentCacheMiss.Inc()
+			r.metrics.extentCacheMiss.Inc()
 
 			err := r.fetch(ctx, seg, chunkData, chunk*r.chunk)
 			if err != nil {
 				return 0, err
 			}
 
-			_, err = r.saveChunk(seg, chunk, chunkData)
+			_, _, err = r.trySaveChunk(seg, chunk, chunkData)
 			if err != nil {
 				return 0, err
 			}
 
 			mem = chunkData
 		} else {
-			extentCacheHits.Inc()
+			r.metrics.extentCacheHits.Inc()
 		}
 
 		copied := copy(buf, mem[innerOff:])
@@ -168,19 +273,27 @@ func (r *RangeCache) CachePositions(ctx context.Context, seg SegmentId, total, o
 
 		off, ok := r.lru.Get(rangeCacheKey{seg, chunk})
 		if ok {
-			extentCacheHits.Inc()
+			r.metrics.extentCacheHits.Inc()
 		} else {
-			extentCacheMiss.Inc()
+			r.metrics.extentCacheMiss.Inc()
 
 			err := r.fetch(ctx, seg, chunkData, chunk*r.chunk)
 			if err != nil {
 				return nil, err
 			}
 
-			off, err = r.saveChunk(seg, chunk, chunkData)
+			var saved bool
+
+			off, saved, err = r.trySaveChunk(seg, chunk, chunkData)
 			if err != nil {
 				return nil, err
 			}
+
+			// Without a local copy to point at, the caller reads the data
+			// with ReadAt instead.
+			if !saved {
+				return ret[:0], nil
+			}
 		}
 
 		ret = append(ret, CachePosition{
@@ -198,6 +311,108 @@ func (r *RangeCache) CachePositions(ctx context.Context, seg SegmentId, total, o
 	return ret, nil
 }
 
+// Warm fetches the chunks of +spans+ that aren't cached concurrently, and
+// saves them one at a time as they arrive. The chunks that are cached
+// already are marked as recently used instead, so that warming them keeps
+// them from being evicted.
+func (r *RangeCache) Warm(ctx context.Context, spans []segmentSpan, workers int) (int64, error) {
+	var missing []rangeCacheKey
+
+	seen := map[rangeCacheKey]struct{}{}
+
+	for _, sp := range spans {
+		if sp.size <= 0 {
+			continue
+		}
+
+		for chunk := sp.off / r.chunk; chunk <= (sp.off+sp.size-1)/r.chunk; chunk++ {
+			key := rangeCacheKey{sp.seg, chunk}
+
+			if _, ok := seen[key]; ok {
+				continue
+			}
+
+			seen[key] = struct{}{}
+
+			if _, ok := r.lru.Get(key); !ok {
+				missing = append(missing, key)
+			}
+		}
+	}
+
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	// Fetches use ctx so the bytes they read are attributed to it, while
+	// stop only ends starting new ones once one fails.
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type fetched struct {
+		key  rangeCacheKey
+		data []byte
+		err  error
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, max(workers, 1))
+		results = make(chan fetched)
+	)
+
+	go func() {
+		defer close(results)
+
+		for _, key := range missing {
+			select {
+			case <-stop.Done():
+			case sem <- struct{}{}:
+				wg.Add(1)
+				go func(key rangeCacheKey) {
+					defer wg.Done()
+					defer func() { <-sem }()
+
+					data := make([]byte, r.chunk)
+					err := r.fetch(ctx, key.Seg, data, key.Chunk*r.chunk)
+
+					results <- fetched{key: key, data: data, err: err}
+				}(key)
+			}
+		}
+
+		wg.Wait()
+	}()
+
+	var (
+		total int64
+		err   error
+	)
+
+	for res := range results {
+		if err != nil {
+			continue
+		}
+
+		if res.err != nil {
+			err = errors.Wrapf(res.err, "fetching chunk %d of segment %s", res.key.Chunk, res.key.Seg)
+			cancel()
+			continue
+		}
+
+		_, _, serr := r.trySaveChunk(res.key.Seg, res.key.Chunk, res.data)
+		if serr != nil {
+			err = serr
+			cancel()
+			continue
+		}
+
+		total += int64(len(res.data))
+	}
+
+	return total, err
+}
+
 func (r *RangeCache) memChunk(seg SegmentId, chunk int64) (bool, []byte) {
 	off, ok := r.lru.Get(rangeCacheKey{seg, chunk})
 	if !ok {
@@ -225,41 +440,79 @@ func (r *RangeCache) readChunk(seg SegmentId, chunk int64, data []byte) (bool, e
 	return true, nil
 }
 
-func (r *RangeCache) saveChunk(seg SegmentId, chunk int64, data []byte) (int64, error) {
-	if r.lru.Len() < int(r.max) {
-		off, err := r.f.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return 0, err
-		}
-
-		n, err := r.f.Write(data)
-		if err != nil {
-			return 0, err
+// trySaveChunk saves +data+ as +chunk+ of +seg+ unless the cache's disk is
+// full, reporting if it did. Running out of space isn't an error: it stops
+// the cache from saving chunks for a while instead.
+func (r *RangeCache) trySaveChunk(seg SegmentId, chunk int64, data []byte) (int64, bool, error) {
+	if !r.fullUntil.IsZero() {
+		if r.now().Before(r.fullUntil) {
+			return 0, false, nil
 		}
 
-		if n != len(data) {
-			return 0, io.ErrShortWrite
-		}
+		r.fullUntil = time.Time{}
+		r.metrics.readCacheFull.Set(0)
+		r.log.Info("retrying saving data to the read cache", "path", r.path)
+	}
 
-		r.lru.Add(rangeCacheKey{seg, chunk}, off)
-		return off, nil
+	off, err := r.saveChunk(seg, chunk, data)
+	if err == nil {
+		return off, true, nil
 	}
 
-	_, off, ok := r.lru.RemoveOldest()
-	if !ok {
-		return 0, fmt.Errorf("misused lru is empty")
+	if !errors.Is(err, unix.ENOSPC) && !errors.Is(err, unix.EDQUOT) {
+		return 0, false, err
 	}
 
-	n, err := r.f.WriteAt(data, off)
+	r.fullUntil = r.now().Add(rangeCacheFullDelay)
+	r.metrics.readCacheFull.Set(1)
+	r.metrics.readCacheFullEvents.Inc()
+	r.log.Warn("read cache disk is full, reading directly from segments",
+		"path", r.path, "retry-in", rangeCacheFullDelay, "error", err)
+
+	return 0, false, nil
+}
+
+func (r *RangeCache) saveChunk(seg SegmentId, chunk int64, data []byte) (int64, error) {
+	off, err := r.allocSlot()
 	if err != nil {
 		return 0, err
 	}
 
-	if n != len(data) {
-		return 0, io.ErrShortWrite
+	n, err := r.writeAt(data, off)
+	if err == nil && n != len(data) {
+		err = io.ErrShortWrite
+	}
+
+	if err != nil {
+		// What the slot holds is unknown now, but it can be written again.
+		r.free = append(r.free, off)
+		return 0, err
 	}
 
 	r.lru.Add(rangeCacheKey{seg, chunk}, off)
 
 	return off, nil
 }
+
+// allocSlot returns where in the file to save a chunk, evicting the least
+// recently used chunk once the file is as large as it can be.
+func (r *RangeCache) allocSlot() (int64, error) {
+	if l := len(r.free); l > 0 {
+		off := r.free[l-1]
+		r.free = r.free[:l-1]
+		return off, nil
+	}
+
+	if r.end < r.max*r.chunk {
+		off := r.end
+		r.end += r.chunk
+		return off, nil
+	}
+
+	_, off, ok := r.lru.RemoveOldest()
+	if !ok {
+		return 0, fmt.Errorf("misused lru is empty")
+	}
+
+	return off, nil
+}
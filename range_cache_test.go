@@ -2,10 +2,14 @@ package lsvd
 
 import (
 	"context"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/lab47/lsvd/logger"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 var nullSeg SegmentId
@@ -208,4 +212,174 @@ func TestRangeCache(t *testing.T) {
 
 		r.Equal(int64(10), sz.Size())
 	})
+
+	// diskFull fails writes the way a full disk does.
+	diskFull := func(b []byte, off int64) (int, error) {
+		return 0, &os.PathError{Op: "write", Path: "readcache", Err: unix.ENOSPC}
+	}
+
+	t.Run("serves reads from the backend while its disk is full", func(t *testing.T) {
+		r := require.New(t)
+		path := filepath.Join(t.TempDir(), "blah")
+
+		var fetchCalls int
+
+		ctx := context.TODO()
+
+		m := NewMetrics(nil)
+
+		rc, err := NewRangeCache(
+			RangeCacheOptions{
+				Path:      path,
+				MaxSize:   100,
+				ChunkSize: 10,
+				Metrics:   m,
+				Fetch: func(ctx context.Context, seg SegmentId, data []byte, off int64) error {
+					fetchCalls++
+
+					for i := range data {
+						data[i] = byte(off) + byte(i)
+					}
+
+					return nil
+				},
+			},
+		)
+		r.NoError(err)
+
+		defer rc.Close()
+
+		now := time.Now()
+		rc.now = func() time.Time { return now }
+
+		var writes int
+
+		rc.writeAt = func(b []byte, off int64) (int, error) {
+			writes++
+			return diskFull(b, off)
+		}
+
+		read := func(off int64) {
+			buf := make([]byte, 3)
+			n, err := rc.ReadAt(ctx, nullSeg, buf, off)
+			r.NoError(err)
+			r.Equal(3, n)
+			r.Equal([]byte{byte(off), byte(off + 1), byte(off + 2)}, buf)
+		}
+
+		read(12)
+		r.Equal(1, fetchCalls)
+		r.Equal(1, writes)
+
+		r.Equal(float64(1), gaugeValue(m.readCacheFull))
+		r.Equal(int64(1), counterValue(m.readCacheFullEvents))
+
+		// Nothing is saved meanwhile, so every read goes to the backend.
+		read(12)
+		read(22)
+		r.Equal(3, fetchCalls)
+		r.Equal(1, writes)
+		r.Equal(0, rc.lru.Len())
+
+		cps, err := rc.CachePositions(ctx, nullSeg, 3, 32, make([]CachePosition, 0, 1))
+		r.NoError(err)
+		r.Empty(cps)
+
+		// Once space frees up, chunks are saved again.
+		now = now.Add(rangeCacheFullDelay)
+		rc.writeAt = rc.f.WriteAt
+
+		read(12)
+		read(12)
+		r.Equal(5, fetchCalls)
+		r.Equal(1, rc.lru.Len())
+
+		r.Equal(float64(0), gaugeValue(m.readCacheFull))
+		r.Equal(int64(1), counterValue(m.readCacheFullEvents))
+	})
+
+	t.Run("reuses the slot of a failed write", func(t *testing.T) {
+		r := require.New(t)
+		path := filepath.Join(t.TempDir(), "blah")
+
+		ctx := context.TODO()
+
+		rc, err := NewRangeCache(
+			RangeCacheOptions{
+				Path:      path,
+				MaxSize:   20,
+				ChunkSize: 10,
+				Metrics:   NewMetrics(nil),
+				Fetch: func(ctx context.Context, seg SegmentId, data []byte, off int64) error {
+					data[0] = byte(off)
+					return nil
+				},
+			},
+		)
+		r.NoError(err)
+
+		defer rc.Close()
+
+		now := time.Now()
+		rc.now = func() time.Time { return now }
+
+		rc.writeAt = diskFull
+
+		buf := make([]byte, 1)
+		_, err = rc.ReadAt(ctx, nullSeg, buf, 0)
+		r.NoError(err)
+
+		now = now.Add(rangeCacheFullDelay)
+		rc.writeAt = rc.f.WriteAt
+
+		for i := int64(0); i < 4; i++ {
+			_, err = rc.ReadAt(ctx, nullSeg, buf, i*10)
+			r.NoError(err)
+			r.Equal(byte(i*10), buf[0])
+		}
+
+		r.Equal(2, rc.lru.Len())
+
+		sz, err := rc.f.Stat()
+		r.NoError(err)
+
+		r.Equal(int64(20), sz.Size())
+	})
+
+	t.Run("a disk keeps reading while its read cache is full", func(t *testing.T) {
+		r := require.New(t)
+
+		log := logger.New(logger.Info)
+
+		ctx := NewContext(context.Background())
+
+		tmpdir := t.TempDir()
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(d.Close(ctx))
+
+		// Reopen the disk so that nothing is cached.
+		d, err = NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		rc, ok := d.er.rangeCache.(*RangeCache)
+		r.True(ok)
+
+		rc.writeAt = diskFull
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testRandX, data)
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+		r.NoError(err)
+		extentEqual(t, testExtent, data)
+
+		r.Zero(rc.lru.Len())
+	})
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"slices"
+
+	"github.com/pkg/errors"
 )
 
 type (
@@ -17,6 +19,20 @@ type (
 	}
 )
 
+// ErrInvalidRangeData is returned for a RangeData whose data isn't the size
+// of its extent.
+var ErrInvalidRangeData = errors.New("range data doesn't match its extent")
+
+// validate checks that the data of +e+ covers exactly its extent, so that
+// it's safe to read or write the blocks of the extent through it.
+func (e *RangeData) validate() error {
+	if len(e.data) != e.ByteSize() {
+		return errors.Wrapf(ErrInvalidRangeData, "extent %s is %d bytes, data is %d", e.Extent, e.ByteSize(), len(e.data))
+	}
+
+	return nil
+}
+
 const (
 	smallRangeBlocks = 20
 	smallRange       = BlockSize * smallRangeBlocks
@@ -8,6 +8,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -16,6 +19,14 @@ import (
 	"github.com/pkg/errors"
 )
 
+// How many segments are read and parsed concurrently while rebuilding
+// the LBA map.
+const rebuildWorkers = 8
+
+// ErrTruncatedSegment is returned when a segment holds less data than its
+// header describes, such as when an upload was interrupted.
+var ErrTruncatedSegment = errors.New("segment is shorter than its header describes")
+
 func (d *Disk) rebuildFromSegments(ctx context.Context) error {
 	for idx, ld := range d.readDisks {
 		// We don't populate from... ourselves.
@@ -31,8 +42,134 @@ func (d *Disk) rebuildFromSegments(ctx context.Context) error {
 		return err
 	}
 
-	for _, ent := range entries {
-		err := d.rebuildFromSegment(ctx, ent)
+	return d.rebuildSegments(ctx, entries, rebuildWorkers)
+}
+
+type parsedSegment struct {
+	meta    SegmentMetadata
+	extents []ExtentHeader
+
+	// Extents whose data is stored in earlier segments, see WithDedup.
+	refs []segmentRef
+
+	// The size of the segment, as reported by the storage if it can,
+	// otherwise the size its header describes.
+	size int64
+
+	err error
+}
+
+// rebuildSegments applies the extents in each of the segments to the LBA map.
+// The segments are read and parsed by up to +workers+ goroutines, but are
+// always applied in the order of +entries+ so that later segments win.
+//
+// A segment from an older generation than one before it was flushed by a
+// fenced writer after a newer one attached, so it's quarantined.
+func (d *Disk) rebuildSegments(ctx context.Context, entries []SegmentId, workers int) error {
+	var latest uint64
+
+	if workers <= 1 {
+		for _, seg := range entries {
+			ps, err := d.readSegmentExtents(ctx, seg)
+			if err != nil {
+				if errors.Is(err, ErrTruncatedSegment) {
+					d.quarantineSegment(seg, err)
+					continue
+				}
+
+				return err
+			}
+
+			if fencedSegment(ps.meta, &latest) {
+				d.quarantineSegment(seg, errors.Wrapf(ErrFenced, "segment from generation %d", ps.meta.Generation))
+				continue
+			}
+
+			err = d.applySegmentExtents(seg, ps)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+	defer cancel()
+
+	results := make([]chan parsedSegment, len(entries))
+	for i := range results {
+		results[i] = make(chan parsedSegment, 1)
+	}
+
+	// window bounds how many parsed segments can be waiting to be applied,
+	// so that we don't hold every segment's extents in memory at once.
+	var (
+		work   = make(chan int)
+		window = make(chan struct{}, workers*2)
+	)
+
+	go func() {
+		defer close(work)
+
+		for i := range entries {
+			select {
+			case <-ctx.Done():
+				return
+			case window <- struct{}{}:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case work <- i:
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range work {
+				ps, err := d.readSegmentExtents(ctx, entries[idx])
+				ps.err = err
+				results[idx] <- ps
+			}
+		}()
+	}
+
+	for i, seg := range entries {
+		var ps parsedSegment
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ps = <-results[i]:
+		}
+
+		<-window
+
+		if ps.err != nil {
+			if errors.Is(ps.err, ErrTruncatedSegment) {
+				d.quarantineSegment(seg, ps.err)
+				continue
+			}
+
+			return ps.err
+		}
+
+		if fencedSegment(ps.meta, &latest) {
+			d.quarantineSegment(seg, errors.Wrapf(ErrFenced, "segment from generation %d", ps.meta.Generation))
+			continue
+		}
+
+		err := d.applySegmentExtents(seg, ps)
 		if err != nil {
 			return err
 		}
@@ -41,12 +178,72 @@ func (d *Disk) rebuildFromSegments(ctx context.Context) error {
 	return nil
 }
 
-func (d *Disk) rebuildFromSegment(ctx context.Context, seg SegmentId) error {
+// quarantineSegment skips a segment that can't be used during a rebuild. It's
+// left in the volume's segment list so that it can be inspected.
+func (d *Disk) quarantineSegment(seg SegmentId, err error) {
+	d.log.Error("quarantining segment, its data will not be used", "segment", seg, "error", err)
+}
+
+// truncatedErr converts the errors from reading past the end of a segment
+// into ErrTruncatedSegment.
+func truncatedErr(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.Wrapf(ErrTruncatedSegment, "reading header: %s", err)
+	}
+
+	return err
+}
+
+// checkSegmentSize returns ErrTruncatedSegment if +f+ holds less than
+// +expected+ bytes. Otherwise it returns the size of +f+, or +expected+ if
+// +f+ can't report its size.
+func checkSegmentSize(f SegmentReader, expected int64) (int64, error) {
+	if sr, ok := f.(SizedSegmentReader); ok {
+		size, err := sr.Size()
+		if err != nil {
+			return 0, err
+		}
+
+		if size < expected {
+			return 0, errors.Wrapf(ErrTruncatedSegment, "expected %d bytes, found %d", expected, size)
+		}
+
+		return size, nil
+	}
+
+	if expected == 0 {
+		return 0, nil
+	}
+
+	// Otherwise check that the last byte is there.
+	var last [1]byte
+
+	_, err := f.ReadAt(last[:], expected-1)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, errors.Wrapf(ErrTruncatedSegment, "expected %d bytes", expected)
+		}
+
+		return 0, err
+	}
+
+	return expected, nil
+}
+
+// readSegmentExtents reads the header of +seg+, returning its metadata, its
+// size, and the extents it contains with their offsets adjusted to be
+// relative to the start of the segment.
+func (d *Disk) readSegmentExtents(ctx context.Context, seg SegmentId) (parsedSegment, error) {
+	var (
+		meta SegmentMetadata
+		refs []segmentRef
+	)
+
 	d.log.Info("rebuilding mappings from segment", "id", seg)
 
 	f, err := d.sa.OpenSegment(ctx, seg)
 	if err != nil {
-		return err
+		return parsedSegment{}, err
 	}
 
 	defer f.Close()
@@ -57,27 +254,76 @@ func (d *Disk) rebuildFromSegment(ctx context.Context, seg SegmentId) error {
 
 	err = hdr.Read(br)
 	if err != nil {
-		return err
+		return parsedSegment{}, truncatedErr(err)
 	}
 
 	d.log.Debug("extent header info", "count", hdr.ExtentCount, "data-begin", hdr.DataOffset)
 
-	stats := &SegmentStats{}
+	extents := make([]ExtentHeader, 0, hdr.ExtentCount)
 
-	d.s.Create(seg, stats)
+	// The segment header itself is 8 bytes.
+	consumed := uint32(8)
 
 	for i := uint32(0); i < hdr.ExtentCount; i++ {
 		var eh ExtentHeader
 
-		_, err := eh.Read(br)
+		n, err := eh.Read(br)
 		if err != nil {
-			return err
+			return parsedSegment{}, truncatedErr(err)
 		}
 
-		stats.Blocks += uint64(eh.Blocks)
+		consumed += uint32(n)
 
 		eh.Offset += hdr.DataOffset
 
+		extents = append(extents, eh)
+	}
+
+	// Anything between the extent headers and the data are sections.
+	if consumed < hdr.DataOffset {
+		data := make([]byte, hdr.DataOffset-consumed)
+
+		_, err = io.ReadFull(br, data)
+		if err != nil {
+			return parsedSegment{}, truncatedErr(err)
+		}
+
+		meta, refs, err = readSegmentSections(data)
+		if err != nil {
+			if errors.Is(err, ErrSegmentTooNew) || errors.Is(err, errBadReferences) {
+				return parsedSegment{}, errors.Wrapf(err, "reading segment %s", seg)
+			}
+
+			d.log.Warn("unable to decode segment metadata", "segment", seg, "error", err)
+			meta = SegmentMetadata{}
+		}
+	}
+
+	expected := int64(hdr.DataOffset)
+
+	for _, eh := range extents {
+		expected = max(expected, int64(eh.Offset)+int64(eh.Size))
+	}
+
+	size, err := checkSegmentSize(f, expected)
+	if err != nil {
+		return parsedSegment{}, err
+	}
+
+	return parsedSegment{meta: meta, extents: extents, refs: refs, size: size}, nil
+}
+
+func (d *Disk) applySegmentExtents(seg SegmentId, ps parsedSegment) error {
+	stats := &SegmentStats{
+		TotalBytes:      uint64(ps.size),
+		SegmentMetadata: ps.meta,
+	}
+
+	d.s.Create(seg, stats)
+
+	for _, eh := range ps.extents {
+		stats.Blocks += uint64(eh.Blocks)
+
 		affected, err := d.lba2pba.Update(d.log, ExtentLocation{
 			ExtentHeader: eh,
 			Segment:      seg,
@@ -92,11 +338,54 @@ func (d *Disk) rebuildFromSegment(ctx context.Context, seg SegmentId) error {
 	// Now reset the stats for our seg to the correct ones.
 	d.s.Create(seg, stats)
 
+	if len(ps.refs) == 0 {
+		return nil
+	}
+
+	// References come after the segment's own extents, as that's the order
+	// the flush that wrote them mapped them in.
+	var refSegs []SegmentId
+
+	for _, ref := range ps.refs {
+		// A segment is only removed once everything referring to it has been
+		// overwritten, so a later segment maps the extent again.
+		if !d.s.AddReference(ref.Segment, uint64(ref.Blocks)) {
+			d.log.Debug("skipping reference to removed segment", "segment", seg, "ref", ref.Segment)
+			continue
+		}
+
+		affected, err := d.lba2pba.Update(d.log, ExtentLocation{
+			ExtentHeader: ref.ExtentHeader,
+			Segment:      ref.Segment,
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		d.s.UpdateUsage(d.log, seg, affected)
+
+		if !slices.Contains(refSegs, ref.Segment) {
+			refSegs = append(refSegs, ref.Segment)
+		}
+	}
+
+	d.s.SetRefs(seg, refSegs)
+
 	return nil
 }
 
 func (d *Disk) restoreWriteCache(ctx context.Context) error {
-	entries, err := filepath.Glob(filepath.Join(d.path, "writecache.*"))
+	err := d.removeFlushedWriteCaches(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "removing flushed write caches")
+	}
+
+	err = d.removeTransactionCaches()
+	if err != nil {
+		return errors.Wrapf(err, "removing unfinished transactions")
+	}
+
+	entries, err := filepath.Glob(filepath.Join(d.writeCacheDir, "writecache.*"))
 	if err != nil {
 		return err
 	}
@@ -117,53 +406,141 @@ func (d *Disk) restoreWriteCache(ctx context.Context) error {
 	return nil
 }
 
-func (d *Disk) restoreWriteCacheFile(ctx context.Context, path string) error {
-	oc, err := NewSegmentCreator(d.log, d.volName, path)
+// removeFlushedWriteCaches removes the write cache files whose segment is
+// already in the volume, which are left behind if we stop after flushing a
+// segment but before removing its write cache. Restoring them would only
+// flush the same data again.
+func (d *Disk) removeFlushedWriteCaches(ctx context.Context) error {
+	entries, err := filepath.Glob(filepath.Join(d.writeCacheDir, "writecache.*"))
 	if err != nil {
 		return err
 	}
 
-	d.curSeq, err = d.nextSeq()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	segments, err := d.sa.ListSegments(ctx, d.volName)
 	if err != nil {
 		return err
 	}
 
-	d.curOC = oc
+	flushed := map[SegmentId]struct{}{}
+	for _, seg := range segments {
+		flushed[seg] = struct{}{}
+	}
+
+	for _, ent := range entries {
+		id, err := ulid.Parse(strings.TrimPrefix(filepath.Base(ent), "writecache."))
+		if err != nil {
+			continue
+		}
+
+		if _, ok := flushed[SegmentId(id)]; !ok {
+			continue
+		}
+
+		d.log.Info("removing write cache of flushed segment", "path", ent, "segment", SegmentId(id))
+
+		err = os.Remove(ent)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (d *Disk) saveLBAMap(ctx context.Context) error {
-	f, err := os.Create(filepath.Join(d.path, "head.map"))
+// restoreWriteCacheFile makes the write cache at +path+ the current one, so
+// that new writes are added to it as if we'd never stopped. It's flushed with
+// a new segment id though, so that it sorts after any segment written since
+// it was started.
+func (d *Disk) restoreWriteCacheFile(ctx context.Context, path string) error {
+	oc, err := newSegmentCreator(d.log, d.volName, path, d.metrics)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	oc.builder.meta = d.segmentMetadata()
+	oc.builder.compRatio = d.compRatio
+	oc.builder.noCompression = d.noCompression
+	oc.builder.maxExtent = d.maxExtent
+	oc.builder.zeroRun = d.zeroRun
+	oc.builder.dedup = d.dedup
+
+	d.curSeq, err = d.nextSeq()
+	if err != nil {
+		return err
+	}
+
+	d.curOC = oc
+	d.recordWriteCache()
+
+	return nil
+}
 
-	sh, err := d.segmentsHash(ctx)
+func (d *Disk) saveLBAMap(ctx context.Context) error {
+	segments, err := d.sa.ListSegments(ctx, d.volName)
 	if err != nil {
 		return errors.Wrapf(err, "calculating segments hash")
 	}
 
 	hdr := &lbaCacheMapHeader{
-		CreatedAt:    time.Now(),
-		SegmentsHash: sh,
+		CreatedAt:    d.clock.Now(),
+		SegmentsHash: hashSegments(segments),
+		Segments:     len(segments),
+		LastSegment:  newestSegment(segments),
+		Generation:   d.generation,
 		Stats:        make(map[string]segmentStats),
 	}
 
+	// A flush that Close gave up on may still be updating the segments.
+	d.s.segmentsMu.Lock()
+
 	for seg, stats := range d.s.segments {
-		if stats.deleted {
+		// A deleted segment with references is kept until the segments they
+		// point to go, see Segments.removable.
+		if stats.deleted && len(stats.refs) == 0 {
 			continue
 		}
 
 		hdr.Stats[seg.String()] = segmentStats{
-			Size: stats.Size,
-			Used: stats.Used,
+			Size:  stats.Size,
+			Used:  stats.Used,
+			Bytes: stats.Bytes,
+			Meta:  stats.SegmentMetadata,
+			Refs:  stats.refs,
 		}
 	}
 
-	return saveLBAMap(d.lba2pba, f, hdr)
+	d.s.segmentsMu.Unlock()
+
+	// The map is replaced only once it's completely written, so that a crash
+	// while checkpointing leaves the previous one.
+	f, err := os.CreateTemp(d.path, "head.map.*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = saveLBAMap(d.lba2pba, f, hdr)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(d.path, "head.map"))
 }
 
 func (d *Disk) segmentsHash(ctx context.Context) (string, error) {
@@ -172,12 +549,28 @@ func (d *Disk) segmentsHash(ctx context.Context) (string, error) {
 		return "", err
 	}
 
+	return hashSegments(segments), nil
+}
+
+func newestSegment(segments []SegmentId) SegmentId {
+	var newest SegmentId
+
+	for _, seg := range segments {
+		if ulid.ULID(seg).Compare(ulid.ULID(newest)) > 0 {
+			newest = seg
+		}
+	}
+
+	return newest
+}
+
+func hashSegments(segments []SegmentId) string {
 	h := sha256.New()
 	for _, s := range segments {
 		h.Write(s[:])
 	}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 func (d *Disk) loadLBAMap(ctx context.Context) (bool, error) {
@@ -194,7 +587,7 @@ func (d *Disk) loadLBAMap(ctx context.Context) (bool, error) {
 
 	d.log.Debug("reloading lba map from head.map")
 
-	sh, err := d.segmentsHash(ctx)
+	segments, err := d.sa.ListSegments(ctx, d.volName)
 	if err != nil {
 		return false, errors.Wrapf(err, "calculating segments hash")
 	}
@@ -204,18 +597,60 @@ func (d *Disk) loadLBAMap(ctx context.Context) (bool, error) {
 		return false, err
 	}
 
-	if hdr.SegmentsHash != sh {
-		d.log.Warn("ignoring out of date head.map",
+	m.metrics = d.metrics
+
+	// The map reflects the volume's first hdr.Segments segments, the ones
+	// after were flushed since it was saved.
+	saved := hdr.Segments
+	if saved == 0 {
+		saved = len(segments)
+	}
+
+	var (
+		newer []SegmentId
+		gone  map[SegmentId]struct{}
+	)
+
+	if saved <= len(segments) && hashSegments(segments[:saved]) == hdr.SegmentsHash {
+		newer = segments[saved:]
+	} else {
+		var ok bool
+
+		newer, gone, ok = segmentsAfter(hdr, segments)
+		if !ok {
+			d.log.Warn("ignoring out of date head.map",
+				"created-at", hdr.CreatedAt,
+				"last-segment", hdr.LastSegment,
+			)
+
+			return false, nil
+		}
+
+		if _, ok := gone[hdr.LastSegment]; ok {
+			d.log.Info("last segment in head.map has been removed", "segment", hdr.LastSegment)
+		}
+
+		d.log.Info("reusing out of date head.map",
 			"created-at", hdr.CreatedAt,
-			"expected", sh,
-			"actual", hdr.SegmentsHash,
+			"last-segment", hdr.LastSegment,
+			"removed", len(gone),
+		)
+	}
+
+	// A map from a newer generation was saved by a writer that attached after
+	// us, so it can't describe the volume as we're writing it.
+	if hdr.Generation > d.generation {
+		d.log.Warn("ignoring head.map from a newer generation",
+			"generation", d.generation,
+			"map-generation", hdr.Generation,
 		)
 
 		return false, nil
 	}
 
-	d.log.Info("validated cached lba map", "created-at", hdr.CreatedAt, "hash", sh)
+	d.log.Info("validated cached lba map", "created-at", hdr.CreatedAt, "hash", hdr.SegmentsHash, "generation", hdr.Generation)
 
+	m.maxCoalesce = d.lba2pba.maxCoalesce
 	d.lba2pba = m
 
 	var total, used uint64
@@ -227,17 +662,27 @@ func (d *Disk) loadLBAMap(ctx context.Context) (bool, error) {
 			continue
 		}
 
+		seg := SegmentId(id)
+
+		if _, ok := gone[seg]; ok {
+			continue
+		}
+
 		total += stats.Size
 		used += stats.Used
 
-		seg := SegmentId(id)
-
 		d.s.Create(seg, &SegmentStats{
-			Blocks: stats.Size,
+			Blocks:          stats.Size,
+			TotalBytes:      stats.Bytes,
+			SegmentMetadata: stats.Meta,
 		})
 
 		d.log.Trace("initialized segment", "segment", seg, "size", stats.Size, "used", stats.Used)
 		d.s.SetSegment(seg, stats.Size, stats.Used)
+
+		if len(stats.Refs) > 0 {
+			d.s.SetRefs(seg, stats.Refs)
+		}
 	}
 
 	d.log.Info("initialized segments from LBA cache",
@@ -249,18 +694,95 @@ func (d *Disk) loadLBAMap(ctx context.Context) (bool, error) {
 
 	d.lba2pba = m
 
+	// A segment is only removed once its data is dead or copied into a
+	// newer segment, so replaying the newer segments normally replaces
+	// these ranges anyway.
+	if len(gone) > 0 {
+		dropped := m.RemoveSegments(gone)
+		d.log.Info("dropped ranges of removed segments", "segments", len(gone), "extents", len(dropped))
+	}
+
+	if len(newer) > 0 {
+		d.log.Info("replaying segments flushed after the LBA map was saved", "segments", len(newer))
+
+		err = d.rebuildSegments(ctx, newer, rebuildWorkers)
+		if err != nil {
+			return false, errors.Wrapf(err, "replaying segments")
+		}
+	}
+
 	return true, nil
 }
 
 type segmentStats struct {
-	Size uint64 `json:"used" cbor:"1,keyasint"`
-	Used uint64 `json:"size" cbor:"2,keyasint"`
+	Size uint64          `json:"used" cbor:"1,keyasint"`
+	Used uint64          `json:"size" cbor:"2,keyasint"`
+	Meta SegmentMetadata `json:"meta" cbor:"3,keyasint"`
+
+	Bytes uint64 `json:"bytes,omitempty" cbor:"4,keyasint,omitempty"`
+
+	// The segments that the segment's references point to.
+	Refs []SegmentId `json:"refs,omitempty" cbor:"5,keyasint,omitempty"`
 }
 
 type lbaCacheMapHeader struct {
 	CreatedAt    time.Time               `json:"created_at" cbor:"created_at"`
 	SegmentsHash string                  `json:"segments_hash" cbor:"segments_hash"`
 	Stats        map[string]segmentStats `json:"segment_stats" cbor:"segment_stats"`
+	Generation   uint64                  `json:"generation,omitempty" cbor:"generation,omitempty"`
+
+	// How many of the volume's segments, in order, the map reflects and
+	// SegmentsHash covers. Maps saved before checkpointing cover them all.
+	Segments int `json:"segments,omitempty" cbor:"segments,omitempty"`
+
+	// The newest of those segments. When segments have since been removed,
+	// so SegmentsHash no longer matches, the map is brought up to date by
+	// replaying the segments newer than it, see segmentsAfter.
+	LastSegment SegmentId `json:"last_segment,omitempty" cbor:"last_segment,omitempty"`
+}
+
+// segmentsAfter works out how to bring a map saved as of hdr.LastSegment up
+// to date with the volume's +segments+. It returns the segments to replay,
+// those newer than hdr.LastSegment, and the segments the map has that have
+// since been removed, which may include hdr.LastSegment itself. It reports
+// false if the map can't be brought up to date, such as when it has no
+// LastSegment or a segment at least as old as it isn't in the map.
+func segmentsAfter(hdr *lbaCacheMapHeader, segments []SegmentId) ([]SegmentId, map[SegmentId]struct{}, bool) {
+	if !hdr.LastSegment.Valid() {
+		return nil, nil, false
+	}
+
+	var newer []SegmentId
+
+	listed := make(map[SegmentId]struct{}, len(segments))
+
+	for _, seg := range segments {
+		listed[seg] = struct{}{}
+
+		if ulid.ULID(seg).Compare(ulid.ULID(hdr.LastSegment)) > 0 {
+			newer = append(newer, seg)
+			continue
+		}
+
+		if _, ok := hdr.Stats[seg.String()]; !ok {
+			return nil, nil, false
+		}
+	}
+
+	gone := make(map[SegmentId]struct{})
+
+	for s := range hdr.Stats {
+		id, err := ulid.Parse(s)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := listed[SegmentId(id)]; !ok {
+			gone[SegmentId(id)] = struct{}{}
+		}
+	}
+
+	return newer, gone, true
 }
 
 func saveLBAMap(m *ExtentMap, f io.Writer, hdr *lbaCacheMapHeader) error {
@@ -273,10 +795,8 @@ func saveLBAMap(m *ExtentMap, f io.Writer, hdr *lbaCacheMapHeader) error {
 		return err
 	}
 
-	for it := m.LockedIterator(); it.Valid(); it.Next() {
-		cur := it.Value()
-
-		err := enc.Encode(cur)
+	for _, pe := range m.Snapshot() {
+		err := enc.Encode(pe)
 		if err != nil {
 			return err
 		}
@@ -285,6 +805,10 @@ func saveLBAMap(m *ExtentMap, f io.Writer, hdr *lbaCacheMapHeader) error {
 	return nil
 }
 
+// lbaMapBulkLoad is how many entries of a saved lba map are buffered to
+// build its tree in one go.
+var lbaMapBulkLoad = 1 << 20
+
 func processLBAMap(log logger.Logger, f io.Reader) (*ExtentMap, *lbaCacheMapHeader, error) {
 	m := NewExtentMap()
 
@@ -298,6 +822,14 @@ func processLBAMap(log logger.Logger, f io.Reader) (*ExtentMap, *lbaCacheMapHead
 		return nil, nil, err
 	}
 
+	// The map was saved in order, so the first batch of it is built in one
+	// go. Buffering is capped so that a large map isn't held twice over;
+	// entries past the cap are inserted as they're read.
+	var (
+		pes    []PartialExtent
+		loaded bool
+	)
+
 	for {
 		var (
 			pba PartialExtent
@@ -314,7 +846,21 @@ func processLBAMap(log logger.Logger, f io.Reader) (*ExtentMap, *lbaCacheMapHead
 
 		// log.Trace("read from lba map", "extent", pba.Live, "flag", pba.Flags)
 
-		m.set(pba)
+		if loaded {
+			m.set(pba)
+			continue
+		}
+
+		pes = append(pes, pba)
+
+		if len(pes) == lbaMapBulkLoad {
+			m.load(pes)
+			pes, loaded = nil, true
+		}
+	}
+
+	if !loaded {
+		m.load(pes)
 	}
 
 	return m, &hdr, nil
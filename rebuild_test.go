@@ -0,0 +1,513 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func dumpLBAMap(t testing.TB, d *Disk) []byte {
+	var buf bytes.Buffer
+
+	err := saveLBAMap(d.lba2pba, &buf, &lbaCacheMapHeader{})
+	require.NoError(t, err)
+
+	return buf.Bytes()
+}
+
+func writeSmallSegments(t testing.TB, ctx *Context, d *Disk, count int) {
+	r := require.New(t)
+
+	for i := 0; i < count; i++ {
+		data := NewRangeData(ctx, Extent{LBA(i * 3), 5})
+		_, err := io.ReadFull(rand.Reader, data.WriteData())
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, data))
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA(i * 7), 2}))
+		r.NoError(d.CloseSegment(ctx))
+	}
+}
+
+// writeRawSegment writes a segment containing testRand at LBA 0, with
+// +sections+ stored between the extent header and the data.
+func writeRawSegment(t testing.TB, sa SegmentAccess, seg SegmentId, sections []byte) {
+	r := require.New(t)
+
+	ctx := context.Background()
+
+	var hdr bytes.Buffer
+
+	eh := ExtentHeader{
+		Extent: Extent{LBA: 0, Blocks: 1},
+		Size:   BlockSize,
+	}
+
+	_, err := eh.Write(&hdr)
+	r.NoError(err)
+
+	hdr.Write(sections)
+
+	w, err := sa.WriteSegment(ctx, seg)
+	r.NoError(err)
+
+	r.NoError(SegmentHeader{
+		ExtentCount: 1,
+		DataOffset:  uint32(hdr.Len() + 8),
+	}.Write(w))
+
+	_, err = w.Write(hdr.Bytes())
+	r.NoError(err)
+
+	_, err = w.Write(testRand)
+	r.NoError(err)
+
+	r.NoError(w.Close())
+
+	r.NoError(sa.AppendToSegments(ctx, "default", seg))
+}
+
+func TestRebuild(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	t.Run("parallel rebuild matches serial rebuild", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		writeSmallSegments(t, ctx, d, 50)
+
+		// Stop the background controller so it doesn't race with the
+		// maps being swapped out below.
+		r.NoError(d.Close(ctx))
+
+		entries, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(entries, 50)
+
+		d.lba2pba = NewExtentMap()
+		d.s = NewSegments()
+
+		r.NoError(d.rebuildSegments(ctx, entries, 1))
+
+		serial := dumpLBAMap(t, d)
+		serialUsage := d.s.Usage()
+
+		d.lba2pba = NewExtentMap()
+		d.s = NewSegments()
+
+		r.NoError(d.rebuildSegments(ctx, entries, 8))
+
+		r.Equal(serial, dumpLBAMap(t, d))
+		r.Equal(serialUsage, d.s.Usage())
+	})
+
+	t.Run("segment metadata is recorded and rebuilt", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithWriterId("writer-a"))
+		r.NoError(err)
+
+		before := time.Now()
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		entries, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(entries, 1)
+
+		meta, ok := d.s.Metadata(entries[0])
+		r.True(ok)
+		r.Equal("writer-a", meta.WriterId)
+		r.WithinDuration(before, meta.CreatedAt, time.Minute)
+
+		r.Len(d.s.WrittenBy("writer-a"), 1)
+		r.Len(d.s.CreatedBefore(before.Add(-time.Hour)), 0)
+		r.Len(d.s.CreatedBefore(time.Now().Add(time.Hour)), 1)
+
+		r.NoError(d.Close(ctx))
+		r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
+
+		d, err = NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		meta, ok = d.s.Metadata(entries[0])
+		r.True(ok)
+		r.Equal("writer-a", meta.WriterId)
+		r.WithinDuration(before, meta.CreatedAt, time.Minute)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testRandX, data)
+	})
+
+	t.Run("segments without metadata use the id's time", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		sa := &LocalFileAccess{Dir: tmpdir}
+		r.NoError(sa.InitContainer(ctx))
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "default"}))
+
+		created := time.Now().Add(-48 * time.Hour)
+		seg := SegmentId(ulid.MustNew(ulid.Timestamp(created), ulid.DefaultEntropy()))
+
+		// Write out a segment the way it was done before metadata.
+		writeRawSegment(t, sa, seg, nil)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		meta, ok := d.s.Metadata(seg)
+		r.True(ok)
+		r.Equal(seg.Time(), meta.CreatedAt)
+		r.Empty(meta.WriterId)
+
+		r.Equal([]SegmentId{seg}, d.s.CreatedBefore(time.Now().Add(-24*time.Hour)))
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		extentEqual(t, testRandX, data)
+	})
+
+	t.Run("reads segment sections", func(t *testing.T) {
+		meta := SegmentMetadata{
+			CreatedAt: time.Now().Truncate(time.Second),
+			WriterId:  "writer-a",
+		}
+
+		var encoded bytes.Buffer
+		require.NoError(t, meta.encode(&encoded))
+
+		withUnknown := func(minVersion uint64) []byte {
+			var buf bytes.Buffer
+			require.NoError(t, writeSegmentSections(&buf, &meta))
+			writeSegmentSection(&buf, 99, minVersion, []byte("from the future"))
+			return buf.Bytes()
+		}
+
+		setup := func(t *testing.T, sections []byte) (string, SegmentId) {
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			require.NoError(t, err)
+			t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+			sa := &LocalFileAccess{Dir: tmpdir}
+			require.NoError(t, sa.InitContainer(ctx))
+			require.NoError(t, sa.InitVolume(ctx, &VolumeInfo{Name: "default"}))
+
+			seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+			writeRawSegment(t, sa, seg, sections)
+
+			return tmpdir, seg
+		}
+
+		for name, sections := range map[string][]byte{
+			"skipping unknown sections":         withUnknown(0),
+			"skipping sections of this version": withUnknown(SegmentFormatVersion),
+			"from before sections existed":      encoded.Bytes(),
+		} {
+			t.Run(name, func(t *testing.T) {
+				r := require.New(t)
+
+				tmpdir, seg := setup(t, sections)
+
+				d, err := NewDisk(ctx, log, tmpdir)
+				r.NoError(err)
+				defer d.Close(ctx)
+
+				got, ok := d.s.Metadata(seg)
+				r.True(ok)
+				r.Equal("writer-a", got.WriterId)
+				r.True(meta.CreatedAt.Equal(got.CreatedAt))
+
+				data, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+				r.NoError(err)
+
+				extentEqual(t, testRandX, data)
+			})
+		}
+
+		t.Run("refusing sections that require a newer version", func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, _ := setup(t, withUnknown(SegmentFormatVersion+1))
+
+			_, err := NewDisk(ctx, log, tmpdir)
+			r.ErrorIs(err, ErrSegmentTooNew)
+		})
+	})
+
+	t.Run("quarantines truncated segments", func(t *testing.T) {
+		for _, keep := range []int64{4, 64, -BlockSize} {
+			t.Run(fmt.Sprintf("keeping %d bytes", keep), func(t *testing.T) {
+				r := require.New(t)
+
+				tmpdir, err := os.MkdirTemp("", "lsvd")
+				r.NoError(err)
+				defer os.RemoveAll(tmpdir)
+
+				d, err := NewDisk(ctx, log, tmpdir)
+				r.NoError(err)
+
+				r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+				r.NoError(d.CloseSegment(ctx))
+
+				data := NewRangeData(ctx, Extent{10, 4})
+				_, err = io.ReadFull(rand.Reader, data.WriteData())
+				r.NoError(err)
+
+				r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+				r.NoError(d.WriteExtent(ctx, data))
+				r.NoError(d.CloseSegment(ctx))
+
+				r.NoError(d.Close(ctx))
+				r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
+
+				entries, err := d.sa.ListSegments(ctx, d.volName)
+				r.NoError(err)
+				r.Len(entries, 2)
+
+				path := filepath.Join(tmpdir, "segments", "segment."+entries[1].String())
+
+				size := keep
+				if size < 0 {
+					fi, err := os.Stat(path)
+					r.NoError(err)
+
+					size += fi.Size()
+				}
+
+				r.NoError(os.Truncate(path, size))
+
+				d, err = NewDisk(ctx, log, tmpdir)
+				r.NoError(err)
+				defer d.Close(ctx)
+
+				_, ok := d.s.Metadata(entries[1])
+				r.False(ok)
+
+				got, err := d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+				r.NoError(err)
+
+				extentEqual(t, testRandX, got)
+
+				got, err = d.ReadExtent(ctx, Extent{LBA: 10, Blocks: 4})
+				r.NoError(err)
+
+				r.True(got.EmptyP())
+			})
+		}
+	})
+
+	t.Run("replays only the segments flushed after the last checkpoint", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithCheckpoints(2, 0))
+		r.NoError(err)
+
+		for lba := LBA(0); lba < 3; lba++ {
+			if lba == 2 {
+				// The first two segments have been checkpointed.
+				r.Eventually(func() bool {
+					_, err := os.Stat(filepath.Join(tmpdir, "head.map"))
+					return err == nil
+				}, 5*time.Second, 10*time.Millisecond)
+			}
+
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(lba)))
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		segments, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segments, 3)
+
+		// Restart without closing the first disk.
+		sa := &openCountingLocal{LocalFileAccess: LocalFileAccess{Dir: tmpdir}}
+
+		d2, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
+		r.NoError(err)
+		defer d2.Close(ctx)
+
+		r.Equal(segments[2:], sa.opened)
+
+		data, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 3})
+		r.NoError(err)
+
+		for i := 0; i < 3; i++ {
+			r.Equal(testRand, data.ReadData()[i*BlockSize:(i+1)*BlockSize])
+		}
+
+		r.Len(d2.s.segments, 3)
+	})
+
+	for _, removed := range []int{0, 1} {
+		name := "replays the segments after the map's last segment once an older one is removed"
+		if removed == 1 {
+			name = "replays the segments after the map's last segment once it's removed"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir, WithCheckpoints(2, 0))
+			r.NoError(err)
+
+			var segments []SegmentId
+
+			for lba := LBA(0); lba < 2; lba++ {
+				segments = append(segments, SegmentId(d.curSeq))
+
+				r.NoError(d.WriteExtent(ctx, testRandX.MapTo(lba)))
+				r.NoError(d.CloseSegment(ctx))
+			}
+
+			r.Eventually(func() bool {
+				_, err := os.Stat(filepath.Join(tmpdir, "head.map"))
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// Overwriting all of a segment gets it removed.
+			latest := SegmentId(d.curSeq)
+
+			r.NoError(d.WriteExtent(ctx, testExtent.MapTo(LBA(removed))))
+			r.NoError(d.CloseSegment(ctx))
+
+			r.Eventually(func() bool {
+				listed, err := d.sa.ListSegments(ctx, d.volName)
+				return err == nil && len(listed) == 2
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// Restart without closing the first disk.
+			sa := &openCountingLocal{LocalFileAccess: LocalFileAccess{Dir: tmpdir}}
+
+			d2, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
+			r.NoError(err)
+			defer d2.Close(ctx)
+
+			r.Equal([]SegmentId{latest}, sa.opened)
+
+			r.NotContains(d2.s.segments, segments[removed])
+			r.Contains(d2.s.segments, segments[1-removed])
+			r.Contains(d2.s.segments, latest)
+
+			for lba := LBA(0); lba < 2; lba++ {
+				expected := testRandX
+				if lba == LBA(removed) {
+					expected = testExtent
+				}
+
+				data, err := d2.ReadExtent(ctx, Extent{LBA: lba, Blocks: 1})
+				r.NoError(err)
+				extentEqual(t, expected, data)
+			}
+		})
+	}
+}
+
+// openCountingLocal records the segments that are opened.
+type openCountingLocal struct {
+	LocalFileAccess
+
+	mu     sync.Mutex
+	opened []SegmentId
+}
+
+func (l *openCountingLocal) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	l.mu.Lock()
+	l.opened = append(l.opened, seg)
+	l.mu.Unlock()
+
+	return l.LocalFileAccess.OpenSegment(ctx, seg)
+}
+
+type latentLocal struct {
+	LocalFileAccess
+	latency time.Duration
+}
+
+func (l *latentLocal) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	time.Sleep(l.latency)
+	return l.LocalFileAccess.OpenSegment(ctx, seg)
+}
+
+func BenchmarkRebuildFromSegments(b *testing.B) {
+	log := logger.New(logger.Error)
+
+	ctx := NewContext(context.Background())
+	defer ctx.Close()
+
+	tmpdir, err := os.MkdirTemp("", "lsvd")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpdir)
+
+	sa := &latentLocal{
+		LocalFileAccess: LocalFileAccess{Dir: tmpdir},
+		latency:         time.Millisecond,
+	}
+
+	d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
+	require.NoError(b, err)
+
+	writeSmallSegments(b, ctx, d, 500)
+
+	require.NoError(b, d.Close(ctx))
+
+	entries, err := d.sa.ListSegments(ctx, d.volName)
+	require.NoError(b, err)
+
+	for _, workers := range []int{1, rebuildWorkers} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d.lba2pba = NewExtentMap()
+				d.s = NewSegments()
+
+				err := d.rebuildSegments(ctx, entries, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
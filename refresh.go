@@ -0,0 +1,111 @@
+package lsvd
+
+import (
+	"context"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+)
+
+// ErrNotReadOnly is returned by Refresh on a disk that can be written to,
+// which is the only one writing its volume's segments.
+var ErrNotReadOnly = errors.New("disk is not read-only")
+
+// Refresh applies the segments added to the volume since the disk last saw
+// its segment list, so that a read-only disk sees what the volume's writer
+// has flushed since. Writes still in the writer's write cache aren't visible
+// until it flushes them. Reads can run meanwhile, and may see the volume as
+// of before or after any of the new segments.
+//
+// Segments the writer has removed since are dropped along with any ranges
+// still mapped to them. The writer only removes segments whose data is dead
+// or was copied into a newer segment, which the listing then includes, so
+// normally the new segments have replaced every such range already.
+func (d *Disk) Refresh(ctx context.Context) error {
+	if !d.readOnly {
+		return ErrNotReadOnly
+	}
+
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+
+	entries, err := d.sa.ListSegments(ctx, d.volName)
+	if err != nil {
+		return errors.Wrapf(err, "listing segments of volume %s", d.volName)
+	}
+
+	newest, meta := d.s.Newest()
+	latest := meta.Generation
+
+	var applied int
+
+	listed := make(map[SegmentId]struct{}, len(entries))
+
+	for _, seg := range entries {
+		listed[seg] = struct{}{}
+
+		if ulid.ULID(seg).Compare(ulid.ULID(newest)) <= 0 {
+			continue
+		}
+
+		ps, err := d.readSegmentExtents(ctx, seg)
+		if err != nil {
+			if errors.Is(err, ErrTruncatedSegment) {
+				d.quarantineSegment(seg, err)
+				continue
+			}
+
+			return err
+		}
+
+		if fencedSegment(ps.meta, &latest) {
+			d.quarantineSegment(seg, errors.Wrapf(ErrFenced, "segment from generation %d", ps.meta.Generation))
+			continue
+		}
+
+		err = d.applySegmentExtents(seg, ps)
+		if err != nil {
+			return err
+		}
+
+		applied++
+	}
+
+	gone := make(map[SegmentId]struct{})
+
+	for _, seg := range d.s.LiveSegments() {
+		if _, ok := listed[seg]; !ok {
+			gone[seg] = struct{}{}
+		}
+	}
+
+	var dropped []PartialExtent
+
+	if len(gone) > 0 {
+		dropped = d.lba2pba.RemoveSegments(gone)
+
+		for seg := range gone {
+			d.s.SetDeleted(seg, d.log)
+			d.EvictSegment(seg)
+		}
+	}
+
+	if applied > 0 || len(gone) > 0 {
+		d.log.Debug("refreshed segments", "volume", d.volName,
+			"applied", applied, "removed", len(gone), "dropped-extents", len(dropped))
+		d.metrics.dataDensity.Set(d.s.Usage())
+	}
+
+	return nil
+}
+
+// scheduleRefresh returns when the disk should next be refreshed, or nil if
+// it isn't refreshed periodically.
+func (c *Controller) scheduleRefresh() <-chan time.Time {
+	if c.d.refreshInterval <= 0 {
+		return nil
+	}
+
+	return c.d.clock.After(c.d.refreshInterval)
+}
@@ -0,0 +1,196 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefresh(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	tempDir := func(t *testing.T) string {
+		dir, err := os.MkdirTemp("", "lsvd")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+
+	read := func(t *testing.T, d *Disk, lba LBA) RangeData {
+		data, err := d.ReadExtent(ctx, Extent{LBA: lba, Blocks: 1})
+		require.NoError(t, err)
+		return data
+	}
+
+	t.Run("a read-only disk sees the writer's segments after a refresh", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		w, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer w.Close(ctx)
+
+		r.NoError(w.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(w.CloseSegment(ctx))
+
+		ro, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa), ReadOnly())
+		r.NoError(err)
+		defer ro.Close(ctx)
+
+		extentEqual(t, testRandX, read(t, ro, 0))
+
+		r.ErrorIs(ro.WriteExtent(ctx, testExtent.MapTo(2)), ErrReadOnly)
+		r.ErrorIs(ro.ZeroBlocks(ctx, Extent{LBA: 2, Blocks: 1}), ErrReadOnly)
+
+		// Attaching read-only doesn't fence the writer.
+		r.NoError(w.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(w.WriteExtent(ctx, testExtent2.MapTo(1)))
+		r.NoError(w.CloseSegment(ctx))
+
+		extentEqual(t, testRandX, read(t, ro, 0))
+
+		empty := read(t, ro, 1)
+		r.True(isEmpty(empty.ReadData()))
+
+		r.NoError(ro.Refresh(ctx))
+
+		extentEqual(t, testExtent, read(t, ro, 0))
+		extentEqual(t, testExtent2, read(t, ro, 1))
+
+		// Nothing new to apply.
+		r.NoError(ro.Refresh(ctx))
+		extentEqual(t, testExtent2, read(t, ro, 1))
+
+		r.ErrorIs(w.Refresh(ctx), ErrNotReadOnly)
+	})
+
+	t.Run("converges after the writer compacts its segments", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		w, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer w.Close(ctx)
+
+		r.NoError(w.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(w.CloseSegment(ctx))
+
+		r.NoError(w.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(w.CloseSegment(ctx))
+
+		ro, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa), ReadOnly())
+		r.NoError(err)
+		defer ro.Close(ctx)
+
+		r.ErrorIs(ro.Pack(ctx), ErrReadOnly)
+
+		r.NoError(w.WriteExtent(ctx, testExtent2.MapTo(2)))
+		r.NoError(w.WriteExtent(ctx, testExtent3.MapTo(0)))
+		r.NoError(w.CloseSegment(ctx))
+
+		r.NoError(w.Pack(ctx))
+
+		// Pack only marks the old segments deleted, the next close removes
+		// them from the volume.
+		r.NoError(w.CloseSegment(ctx))
+
+		segs, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Len(segs, 1)
+
+		r.NoError(ro.Refresh(ctx))
+
+		r.ElementsMatch(segs, ro.s.LiveSegments())
+
+		extentEqual(t, testExtent3, read(t, ro, 0))
+		extentEqual(t, testExtent, read(t, ro, 1))
+		extentEqual(t, testExtent2, read(t, ro, 2))
+
+		for lba := LBA(0); lba < 3; lba++ {
+			pes, err := ro.lba2pba.Resolve(log, Extent{LBA: lba, Blocks: 1}, nil)
+			r.NoError(err)
+			r.Len(pes, 1)
+			r.Equal(segs[0], pes[0].Segment)
+		}
+	})
+
+	t.Run("drops ranges mapped to removed segments", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		w, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer w.Close(ctx)
+
+		r.NoError(w.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(w.CloseSegment(ctx))
+
+		r.NoError(w.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(w.CloseSegment(ctx))
+
+		segs, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Len(segs, 2)
+
+		ro, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa), ReadOnly())
+		r.NoError(err)
+		defer ro.Close(ctx)
+
+		r.NoError(sa.RemoveSegmentFromVolume(ctx, "default", segs[0]))
+		r.NoError(sa.RemoveSegment(ctx, segs[0]))
+
+		r.NoError(ro.Refresh(ctx))
+
+		r.Equal([]SegmentId{segs[1]}, ro.s.LiveSegments())
+
+		empty := read(t, ro, 0)
+		r.True(isEmpty(empty.ReadData()))
+
+		extentEqual(t, testExtent, read(t, ro, 1))
+	})
+
+	t.Run("refreshes periodically", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: tempDir(t)}
+
+		w, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa))
+		r.NoError(err)
+		defer w.Close(ctx)
+
+		clk := newFakeClock(time.Now())
+
+		ro, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(sa), ReadOnly(),
+			WithClock(clk), WithRefreshInterval(time.Minute))
+		r.NoError(err)
+		defer ro.Close(ctx)
+
+		r.NoError(w.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(w.CloseSegment(ctx))
+
+		r.Eventually(func() bool {
+			clk.Add(time.Minute)
+
+			data, err := ro.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+			return err == nil && !isEmpty(data.ReadData())
+		}, 5*time.Second, 10*time.Millisecond)
+
+		extentEqual(t, testExtent, read(t, ro, 0))
+	})
+
+	t.Run("requires a read-only disk to refresh periodically", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := NewDisk(ctx, log, tempDir(t), WithRefreshInterval(time.Minute))
+		r.Error(err)
+	})
+}
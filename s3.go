@@ -7,16 +7,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/lab47/lsvd/logger"
 	"github.com/oklog/ulid/v2"
 	"github.com/pkg/errors"
@@ -27,49 +36,322 @@ type S3Access struct {
 	uploader *manager.Uploader
 	bucket   string
 
+	// Prepended to every key, so that the bucket can be shared.
+	prefix string
+
+	skipExistenceCheck bool
+
+	// The storage class segments are written with, or empty for the bucket's
+	// default.
+	storageClass types.StorageClass
+
+	// How buckets are addressed, and the region to use rather than the
+	// config's when set.
+	pathStyle bool
+	region    string
+
+	// Applied to the options of the client after the defaults.
+	clientOpts []func(*s3.Options)
+
 	mu sync.Mutex
 }
 
-func NewS3Access(log logger.Logger, host, bucket string, cfg aws.Config) (*S3Access, error) {
-	sc := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UsePathStyle = true
-		o.BaseEndpoint = &host
+// ErrObjectArchived is returned when reading an object whose storage class
+// requires it to be restored before it can be read, such as Glacier Flexible
+// Retrieval.
+var ErrObjectArchived = errors.New("object is archived and must be restored before it can be read")
+
+// isArchived reports if a read failed because the object is archived.
+func isArchived(err error) bool {
+	var serr smithy.APIError
+	return errors.As(err, &serr) && serr.ErrorCode() == "InvalidObjectState"
+}
+
+type S3Option func(s *S3Access)
+
+// WithKeyPrefix stores everything under +prefix+ in the bucket, such as
+// "lsvd/prod/segments/..." for "lsvd/prod".
+func WithKeyPrefix(prefix string) S3Option {
+	return func(s *S3Access) {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+
+		s.prefix = prefix
+	}
+}
+
+// WithSkipExistenceCheck opens segments without first checking that they
+// exist, saving a request per open. Segments are opened because the volume
+// lists them, so they should exist; if one doesn't, the first read from it
+// fails instead. The size of the segment is then only requested if Size is
+// called.
+func WithSkipExistenceCheck() S3Option {
+	return func(s *S3Access) {
+		s.skipExistenceCheck = true
+	}
+}
+
+// WithStorageClass writes segments with the S3 storage class +class+, such as
+// "STANDARD_IA" or "GLACIER_IR", to store cold volumes more cheaply. Volume
+// metadata is read every time a volume is opened, so it's always left in the
+// bucket's default class.
+func WithStorageClass(class string) S3Option {
+	return func(s *S3Access) {
+		s.storageClass = types.StorageClass(class)
+	}
+}
+
+// ErrInvalidS3Endpoint is returned by NewS3Access when the host can't be
+// used to address the bucket as configured.
+var ErrInvalidS3Endpoint = errors.New("invalid S3 endpoint")
+
+// WithPathStyle sets if buckets are addressed in the path of the URL, as
+// "host/bucket/key", or in the host, as "bucket.host/key".
+//
+// Path style is the default, as MinIO and Ceph RGW only address buckets in
+// the host when they're set up with a domain for it (MINIO_DOMAIN and
+// rgw_dns_name). AWS supports both but is phasing out path style, and
+// Cloudflare R2 and other providers that route on the bucket's host name
+// need it turned off.
+func WithPathStyle(pathStyle bool) S3Option {
+	return func(s *S3Access) {
+		s.pathStyle = pathStyle
+	}
+}
+
+// WithRegion signs requests for +region+ rather than the config's region.
+// AWS needs the bucket's region. Cloudflare R2 expects "auto", while MinIO
+// and Ceph accept any region unless one was configured, "us-east-1" being
+// the usual choice.
+func WithRegion(region string) S3Option {
+	return func(s *S3Access) {
+		s.region = region
+	}
+}
+
+// WithEndpointResolver resolves the endpoint of each request with +r+ rather
+// than from the host, for stores that need more than a fixed URL.
+func WithEndpointResolver(r s3.EndpointResolverV2) S3Option {
+	return func(s *S3Access) {
+		s.clientOpts = append(s.clientOpts, func(o *s3.Options) {
+			o.EndpointResolverV2 = r
+		})
+	}
+}
+
+// WithCredentials signs requests with the credentials from +p+ rather than
+// those in the config.
+func WithCredentials(p aws.CredentialsProvider) S3Option {
+	return func(s *S3Access) {
+		s.clientOpts = append(s.clientOpts, func(o *s3.Options) {
+			o.Credentials = p
+		})
+	}
+}
+
+// WithConnectionPool keeps up to +maxIdle+ connections to the store open
+// between requests, closing those idle for longer than +idleTimeout+. The SDK
+// keeps 10 by default, so that a disk reading from more segments at once
+// than that opens new connections for many of its reads. It replaces the
+// HTTP client of the config with one of the SDK's own.
+func WithConnectionPool(maxIdle int, idleTimeout time.Duration) S3Option {
+	return func(s *S3Access) {
+		client := awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+			t.MaxIdleConns = max(t.MaxIdleConns, maxIdle)
+			t.MaxIdleConnsPerHost = maxIdle
+			t.IdleConnTimeout = idleTimeout
+		})
+
+		s.clientOpts = append(s.clientOpts, func(o *s3.Options) {
+			o.HTTPClient = client
+		})
+	}
+}
+
+// NewS3Access accesses +bucket+ at +host+, or at AWS when +host+ is empty,
+// using the region and credentials in +cfg+.
+func NewS3Access(log logger.Logger, host, bucket string, cfg aws.Config, opts ...S3Option) (*S3Access, error) {
+	s := &S3Access{
+		bucket:    bucket,
+		pathStyle: true,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := validateS3Endpoint(host, bucket, s.pathStyle)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sc = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = s.pathStyle
+
+		if host != "" {
+			o.BaseEndpoint = &host
+		}
+
+		if s.region != "" {
+			o.Region = s.region
+		}
+	}, func(o *s3.Options) {
+		for _, f := range s.clientOpts {
+			f(o)
+		}
+	})
+
+	s.uploader = manager.NewUploader(s.sc)
+
+	return s, nil
+}
+
+// validateS3Endpoint checks that +host+ can address +bucket+ in the path or,
+// without +pathStyle+, in the host. An empty host is AWS, which supports
+// either.
+func validateS3Endpoint(host, bucket string, pathStyle bool) error {
+	if host == "" {
+		return nil
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidS3Endpoint, "parsing host %q: %s", host, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Wrapf(ErrInvalidS3Endpoint, "host %q must be an http or https URL", host)
+	}
+
+	if pathStyle {
+		return nil
+	}
+
+	if net.ParseIP(u.Hostname()) != nil {
+		return errors.Wrapf(ErrInvalidS3Endpoint, "host %q is an IP address, which the bucket can't be added to, use path style", host)
+	}
+
+	// The bucket's host name wouldn't match a wildcard certificate for the
+	// host.
+	if u.Scheme == "https" && strings.Contains(bucket, ".") {
+		return errors.Wrapf(ErrInvalidS3Endpoint, "bucket %q contains a dot, which https to %q can't be used with, use path style", bucket, host)
+	}
+
+	return nil
+}
+
+// NewS3AccessStatic is NewS3Access using the access key +accessKey+ and its
+// secret +secretKey+.
+func NewS3AccessStatic(log logger.Logger, host, bucket, region, accessKey, secretKey string, opts ...S3Option) (*S3Access, error) {
+	cfg := aws.Config{
+		Region:      region,
+		Credentials: credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
+	}
+
+	return NewS3Access(log, host, bucket, cfg, opts...)
+}
+
+// NewS3AccessFromProfile is NewS3Access using the credentials of +profile+
+// in the shared AWS config and credentials files, including any role it
+// assumes. With no profile, the default chain is used, which also covers the
+// environment and the IAM role of an EC2 instance or ECS task.
+func NewS3AccessFromProfile(ctx context.Context, log logger.Logger, host, bucket, region, profile string, opts ...S3Option) (*S3Access, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, func(lo *config.LoadOptions) error {
+		lo.Region = region
+		lo.SharedConfigProfile = profile
+		return nil
 	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading AWS config for profile %q", profile)
+	}
+
+	return NewS3Access(log, host, bucket, cfg, opts...)
+}
 
-	up := manager.NewUploader(sc)
-	return &S3Access{
-		sc:       sc,
-		bucket:   bucket,
-		uploader: up,
-	}, nil
+func (s *S3Access) segmentKey(seg SegmentId) string {
+	return s.prefix + "segments/segment." + ulid.ULID(seg).String()
 }
 
+func (s *S3Access) volumeKey(vol, name string) string {
+	return s.prefix + filepath.Join("volumes", vol, name)
+}
+
+// The most of a response to a range read that's read past the range so
+// that its connection can be reused.
+const maxResponseDrain = 64 * 1024
+
 type S3ObjectReader struct {
 	ctx context.Context
 	sc  *s3.Client
 	buk string
 	key string
 	seg SegmentId
+
+	mu    sync.Mutex
+	size  int64
+	sized bool
 }
 
+var _ ContextSegmentReader = (*S3ObjectReader)(nil)
+
 func (s *S3ObjectReader) Close() error {
 	return nil
 }
 
+// Size returns the size of the object when it was opened, or when Size is
+// first called if it was opened without checking it exists.
+func (s *S3ObjectReader) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sized {
+		return s.size, nil
+	}
+
+	out, err := s.sc.HeadObject(s.ctx, &s3.HeadObjectInput{
+		Bucket: &s.buk,
+		Key:    &s.key,
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "requesting size of segment %s", s.seg)
+	}
+
+	s.size = aws.ToInt64(out.ContentLength)
+	s.sized = true
+
+	return s.size, nil
+}
+
+// ReadAt reads using the context the segment was opened with.
 func (s *S3ObjectReader) ReadAt(dest []byte, off int64) (int, error) {
+	return s.ReadAtContext(s.ctx, dest, off)
+}
+
+func (s *S3ObjectReader) ReadAtContext(ctx context.Context, dest []byte, off int64) (int, error) {
 	rng := fmt.Sprintf("bytes=%d-%d", off, int(off)+len(dest)-1)
 
-	r, err := s.sc.GetObject(s.ctx, &s3.GetObjectInput{
+	r, err := s.sc.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &s.buk,
 		Key:    &s.key,
 		Range:  &rng,
 	})
 	if err != nil {
+		if isArchived(err) {
+			return 0, errors.Wrapf(ErrObjectArchived, "segment %s", s.seg)
+		}
+
 		return 0, errors.Wrapf(err, "request range %s", rng)
 	}
 
 	defer r.Body.Close()
 
+	// A store that ignores the range sends more than was asked for, which has
+	// to be read for the connection to be reused. Past a point, reconnecting
+	// is cheaper.
+	defer io.CopyN(io.Discard, r.Body, maxResponseDrain)
+
 	n, err := io.ReadFull(r.Body, dest)
 	if err != nil {
 		if n > 0 {
@@ -85,10 +367,22 @@ func (s *S3ObjectReader) ReadAt(dest []byte, off int64) (int, error) {
 }
 
 func (s *S3Access) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
-	key := "segments/segment." + ulid.ULID(seg).String()
+	key := s.segmentKey(seg)
+
+	or := &S3ObjectReader{
+		sc:  s.sc,
+		ctx: ctx,
+		seg: seg,
+		buk: s.bucket,
+		key: key,
+	}
+
+	if s.skipExistenceCheck {
+		return or, nil
+	}
 
 	// Validate the segment exists.
-	_, err := s.sc.HeadObject(ctx, &s3.HeadObjectInput{
+	out, err := s.sc.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: &s.bucket,
 		Key:    &key,
 	})
@@ -96,17 +390,64 @@ func (s *S3Access) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReade
 		return nil, errors.Wrapf(err, "attempting to open segment %s", seg)
 	}
 
-	return &S3ObjectReader{
-		sc:  s.sc,
-		ctx: ctx,
-		seg: seg,
-		buk: s.bucket,
-		key: key,
-	}, nil
+	or.size = aws.ToInt64(out.ContentLength)
+	or.sized = true
+
+	return or, nil
+}
+
+// SegmentSize returns the size of +seg+ from a HeadObject request.
+func (s *S3Access) SegmentSize(ctx context.Context, seg SegmentId) (int64, error) {
+	key := s.segmentKey(seg)
+
+	out, err := s.sc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if s.isNotFound(err) {
+			return 0, os.ErrNotExist
+		}
+
+		return 0, errors.Wrapf(err, "requesting size of segment %s", seg)
+	}
+
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+// StreamSegment fetches the whole segment in a single request, rather than
+// the range requests made by the reader from OpenSegment.
+func (s *S3Access) StreamSegment(ctx context.Context, seg SegmentId) (io.ReadCloser, int64, error) {
+	key := s.segmentKey(seg)
+
+	out, err := s.sc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if s.isNoSuchKey(err) {
+			return nil, 0, os.ErrNotExist
+		}
+
+		if isArchived(err) {
+			return nil, 0, errors.Wrapf(ErrObjectArchived, "segment %s", seg)
+		}
+
+		return nil, 0, errors.Wrapf(err, "attempting to stream segment %s", seg)
+	}
+
+	return out.Body, aws.ToInt64(out.ContentLength), nil
 }
 
 func (s *S3Access) ListSegments(ctx context.Context, vol string) ([]SegmentId, error) {
-	name := filepath.Join("volumes", vol, "segments")
+	segments, _, err := s.readSegments(ctx, vol)
+	return segments, err
+}
+
+// readSegments returns the segments of +vol+ along with the ETag of the
+// object they were read from, which is empty if there is no such object.
+func (s *S3Access) readSegments(ctx context.Context, vol string) ([]SegmentId, string, error) {
+	name := s.volumeKey(vol, "segments")
 
 	out, err := s.sc.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &s.bucket,
@@ -114,14 +455,69 @@ func (s *S3Access) ListSegments(ctx context.Context, vol string) ([]SegmentId, e
 	})
 	if err != nil {
 		if s.isNoSuchKey(err) {
-			return nil, nil
+			return nil, "", nil
 		}
-		return nil, err
+		return nil, "", err
 	}
 
 	defer out.Body.Close()
 
-	return ReadSegments(out.Body)
+	segments, err := ReadSegments(out.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return segments, aws.ToString(out.ETag), nil
+}
+
+// How many times a change to a volume's segment list is retried when it
+// conflicts with a change made by another writer.
+const segmentsUpdateRetries = 10
+
+// updateSegments applies +update+ to the segment list of +vol+. The list is
+// only replaced if it hasn't changed since it was read, otherwise the update is
+// retried against the new list, so that concurrent changes, such as a flush
+// adding a segment while GC removes another, aren't lost.
+func (s *S3Access) updateSegments(ctx context.Context, vol string, update func([]SegmentId) []SegmentId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := s.volumeKey(vol, "segments")
+
+	for i := 0; i < segmentsUpdateRetries; i++ {
+		segments, etag, err := s.readSegments(ctx, vol)
+		if err != nil {
+			return err
+		}
+
+		segments = update(segments)
+
+		var buf bytes.Buffer
+
+		for _, seg := range segments {
+			buf.Write(seg[:])
+		}
+
+		cond := smithyhttp.SetHeaderValue("If-None-Match", "*")
+		if etag != "" {
+			cond = smithyhttp.SetHeaderValue("If-Match", etag)
+		}
+
+		_, err = s.sc.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &s.bucket,
+			Key:    &name,
+			Body:   bytes.NewReader(buf.Bytes()),
+		}, s3.WithAPIOptions(cond))
+		if err == nil {
+			return nil
+		}
+
+		if !s.isConflict(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("segment list of volume %s changed during %d attempts to update it", vol, segmentsUpdateRetries)
 }
 
 type mdWriter struct {
@@ -183,14 +579,15 @@ func (s *S3Access) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteClo
 		ctx:    ctx,
 	}
 
-	key := "segments/segment." + ulid.ULID(seg).String()
+	key := s.segmentKey(seg)
 
 	go func() {
 		defer cancel()
 		_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
-			Bucket: &s.bucket,
-			Key:    &key,
-			Body:   r,
+			Bucket:       &s.bucket,
+			Key:          &key,
+			Body:         r,
+			StorageClass: s.storageClass,
 		})
 		bg.err = err
 	}()
@@ -199,11 +596,12 @@ func (s *S3Access) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteClo
 }
 
 func (s *S3Access) UploadSegment(ctx context.Context, seg SegmentId, f *os.File) error {
-	key := "segments/segment." + ulid.ULID(seg).String()
+	key := s.segmentKey(seg)
 	_, err := s.sc.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &s.bucket,
-		Key:    &key,
-		Body:   f,
+		Bucket:       &s.bucket,
+		Key:          &key,
+		Body:         f,
+		StorageClass: s.storageClass,
 	})
 
 	return err
@@ -214,7 +612,7 @@ func (s *S3Access) WriteMetadata(ctx context.Context, volName, name string) (io.
 	mw.ctx = ctx
 	mw.sc = s.uploader
 	mw.bucket = s.bucket
-	mw.key = filepath.Join("volumes", volName, name)
+	mw.key = s.volumeKey(volName, name)
 
 	return &mw, nil
 }
@@ -224,8 +622,36 @@ func (s *S3Access) isNoSuchKey(err error) bool {
 	return errors.As(err, &serr) && serr.ErrorCode() == "NoSuchKey"
 }
 
+// isNotFound reports if a HeadObject request failed because the object
+// doesn't exist. Having no body, those don't carry the NoSuchKey code.
+func (s *S3Access) isNotFound(err error) bool {
+	var nf *types.NotFound
+	if errors.As(err, &nf) {
+		return true
+	}
+
+	var serr smithy.APIError
+	return errors.As(err, &serr) && serr.ErrorCode() == "NotFound"
+}
+
+// isConflict reports if a conditional request failed because the object was
+// changed by another request.
+func (s *S3Access) isConflict(err error) bool {
+	var serr smithy.APIError
+	if !errors.As(err, &serr) {
+		return false
+	}
+
+	switch serr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *S3Access) ReadMetadata(ctx context.Context, volName, name string) (io.ReadCloser, error) {
-	key := filepath.Join("volumes", volName, name)
+	key := s.volumeKey(volName, name)
 
 	out, err := s.sc.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &s.bucket,
@@ -244,7 +670,7 @@ func (s *S3Access) ReadMetadata(ctx context.Context, volName, name string) (io.R
 }
 
 func (s *S3Access) RemoveSegment(ctx context.Context, seg SegmentId) error {
-	key := "segments/segment." + ulid.ULID(seg).String()
+	key := s.segmentKey(seg)
 
 	_, err := s.sc.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: &s.bucket,
@@ -255,57 +681,59 @@ func (s *S3Access) RemoveSegment(ctx context.Context, seg SegmentId) error {
 }
 
 func (s *S3Access) RemoveSegmentFromVolume(ctx context.Context, vol string, seg SegmentId) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.updateSegments(ctx, vol, func(segments []SegmentId) []SegmentId {
+		return slices.DeleteFunc(segments, func(si SegmentId) bool { return si == seg })
+	})
+}
 
-	segments, err := s.ListSegments(ctx, vol)
-	if err != nil {
-		return err
-	}
+// The most keys S3 accepts in one DeleteObjects request.
+const maxDeleteObjects = 1000
 
-	segments = slices.DeleteFunc(segments, func(si SegmentId) bool { return si == seg })
+// RemoveSegments removes +segs+ with as few DeleteObjects requests as
+// possible.
+func (s *S3Access) RemoveSegments(ctx context.Context, segs []SegmentId) error {
+	for len(segs) > 0 {
+		batch := segs[:min(len(segs), maxDeleteObjects)]
+		segs = segs[len(batch):]
 
-	var buf bytes.Buffer
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, seg := range batch {
+			objects[i].Key = aws.String(s.segmentKey(seg))
+		}
 
-	for _, seg := range segments {
-		buf.Write(seg[:])
+		out, err := s.sc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &s.bucket,
+			Delete: &types.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "removing %d segments", len(batch))
+		}
+
+		// Each object can fail on its own, report the first.
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("removing %s: %s: %s", aws.ToString(e.Key), aws.ToString(e.Code), aws.ToString(e.Message))
+		}
 	}
 
-	name := filepath.Join("volumes", vol, "segments")
+	return nil
+}
 
-	_, err = s.sc.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &s.bucket,
-		Key:    &name,
-		Body:   bytes.NewReader(buf.Bytes()),
+// RemoveSegmentsFromVolume removes +segs+ from the segments of +vol+ in one
+// update of the list.
+func (s *S3Access) RemoveSegmentsFromVolume(ctx context.Context, vol string, segs []SegmentId) error {
+	return s.updateSegments(ctx, vol, func(segments []SegmentId) []SegmentId {
+		return withoutSegments(segments, segs)
 	})
-	return err
 }
 
 func (s *S3Access) AppendToSegments(ctx context.Context, vol string, seg SegmentId) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	segments, err := s.ListSegments(ctx, vol)
-	if err != nil {
-		return err
-	}
-
-	segments = append(segments, seg)
-
-	var buf bytes.Buffer
-
-	for _, seg := range segments {
-		buf.Write(seg[:])
-	}
-
-	name := filepath.Join("volumes", vol, "segments")
-
-	_, err = s.sc.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &s.bucket,
-		Key:    &name,
-		Body:   bytes.NewReader(buf.Bytes()),
+	return s.updateSegments(ctx, vol, func(segments []SegmentId) []SegmentId {
+		return append(segments, seg)
 	})
-	return err
 }
 
 func (s *S3Access) InitContainer(ctx context.Context) error {
@@ -313,7 +741,12 @@ func (s *S3Access) InitContainer(ctx context.Context) error {
 }
 
 func (s *S3Access) InitVolume(ctx context.Context, vol *VolumeInfo) error {
-	key := filepath.Join("volumes", vol.Name, "info.json")
+	err := ValidateVolumeName(vol.Name)
+	if err != nil {
+		return err
+	}
+
+	key := s.volumeKey(vol.Name, "info.json")
 
 	data, err := json.Marshal(vol)
 	if err != nil {
@@ -329,8 +762,51 @@ func (s *S3Access) InitVolume(ctx context.Context, vol *VolumeInfo) error {
 	return err
 }
 
+// UpdateVolumeInfo replaces the info of an existing volume.
+func (s *S3Access) UpdateVolumeInfo(ctx context.Context, vol *VolumeInfo) error {
+	return s.InitVolume(ctx, vol)
+}
+
+// ListAllSegments returns every segment in the bucket.
+func (s *S3Access) ListAllSegments(ctx context.Context) ([]SegmentId, error) {
+	prefix := s.prefix + "segments/segment."
+
+	var (
+		token    *string
+		segments []SegmentId
+	)
+
+	for {
+		out, err := s.sc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &s.bucket,
+			Prefix:            &prefix,
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range out.Contents {
+			id, err := ulid.Parse((*obj.Key)[len(prefix):])
+			if err != nil {
+				continue
+			}
+
+			segments = append(segments, SegmentId(id))
+		}
+
+		if out.IsTruncated != nil && *out.IsTruncated {
+			token = out.NextContinuationToken
+		} else {
+			break
+		}
+	}
+
+	return segments, nil
+}
+
 func (s *S3Access) ListVolumes(ctx context.Context) ([]string, error) {
-	prefix := "volumes/"
+	prefix := s.prefix + "volumes/"
 
 	var (
 		token   *string
@@ -357,6 +833,15 @@ func (s *S3Access) ListVolumes(ctx context.Context) ([]string, error) {
 				key = key[:idx]
 			}
 
+			if key == trashDir {
+				continue
+			}
+
+			// Not a volume we could have created.
+			if ValidateVolumeName(key) != nil {
+				continue
+			}
+
 			if _, ok := seen[key]; !ok {
 				seen[key] = struct{}{}
 				volumes = append(volumes, key)
@@ -372,8 +857,21 @@ func (s *S3Access) ListVolumes(ctx context.Context) ([]string, error) {
 	return volumes, nil
 }
 
+var _ VolumeInfoLister = (*S3Access)(nil)
+
+// ListVolumeInfos returns the info of every volume, reading their info
+// objects concurrently.
+func (s *S3Access) ListVolumeInfos(ctx context.Context) ([]VolumeInfo, error) {
+	vols, err := s.ListVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return readVolumeInfos(ctx, vols, s.GetVolumeInfo)
+}
+
 func (s *S3Access) GetVolumeInfo(ctx context.Context, vol string) (*VolumeInfo, error) {
-	key := filepath.Join("volumes", vol, "info.json")
+	key := s.volumeKey(vol, "info.json")
 
 	out, err := s.sc.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &s.bucket,
@@ -397,4 +895,243 @@ func (s *S3Access) GetVolumeInfo(ctx context.Context, vol string) (*VolumeInfo,
 	return &vi, nil
 }
 
-var _ SegmentAccess = (*S3Access)(nil)
+// listKeys returns the keys of every object whose key starts with +prefix+.
+func (s *S3Access) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		token *string
+		keys  []string
+	)
+
+	for {
+		out, err := s.sc.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &s.bucket,
+			Prefix:            &prefix,
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range out.Contents {
+			keys = append(keys, *obj.Key)
+		}
+
+		if out.IsTruncated != nil && *out.IsTruncated {
+			token = out.NextContinuationToken
+		} else {
+			break
+		}
+	}
+
+	return keys, nil
+}
+
+// copyObjects copies each of +keys+, which all start with +from+, to the same
+// key under +to+. S3 can't rename objects, so moving them is done by copying
+// and then removing the originals.
+func (s *S3Access) copyObjects(ctx context.Context, keys []string, from, to string) error {
+	for _, key := range keys {
+		dest := to + key[len(from):]
+		source := url.PathEscape(s.bucket) + "/" + url.PathEscape(key)
+
+		_, err := s.sc.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     &s.bucket,
+			Key:        &dest,
+			CopySource: &source,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "copying %s to %s", key, dest)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Access) removeObjects(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		_, err := s.sc.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "removing %s", key)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Access) trashedVolumeKey(vol, name string) string {
+	return s.volumeKey(trashDir+"/"+vol, name)
+}
+
+// SoftDeleteVolume moves the objects of +vol+ under the trash. The deletion
+// time is written last, so a volume only counts as trashed, and can only be
+// purged, once all of its objects have been copied.
+func (s *S3Access) SoftDeleteVolume(ctx context.Context, vol string) error {
+	from := s.volumeKey(vol, "") + "/"
+	to := s.trashedVolumeKey(vol, "") + "/"
+
+	keys, err := s.listKeys(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return errors.Wrapf(os.ErrNotExist, "volume %s", vol)
+	}
+
+	existing, err := s.listKeys(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) != 0 {
+		return fmt.Errorf("volume %s is already in the trash", vol)
+	}
+
+	err = s.copyObjects(ctx, keys, from, to)
+	if err != nil {
+		return err
+	}
+
+	key := s.trashedVolumeKey(vol, deletedAtName)
+
+	_, err = s.sc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		Body:   strings.NewReader(time.Now().Format(deletedAtStamp)),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.removeObjects(ctx, keys)
+}
+
+func (s *S3Access) RestoreVolume(ctx context.Context, vol string) error {
+	from := s.trashedVolumeKey(vol, "") + "/"
+	to := s.volumeKey(vol, "") + "/"
+
+	_, err := s.readDeletedAt(ctx, vol)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.listKeys(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) != 0 {
+		return fmt.Errorf("volume %s already exists", vol)
+	}
+
+	keys, err := s.listKeys(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	// Remove the deletion time last, so a restore that fails part way still
+	// leaves the volume in the trash.
+	marker := s.trashedVolumeKey(vol, deletedAtName)
+	keys = slices.DeleteFunc(keys, func(k string) bool { return k == marker })
+
+	err = s.copyObjects(ctx, keys, from, to)
+	if err != nil {
+		return err
+	}
+
+	return s.removeObjects(ctx, append(keys, marker))
+}
+
+func (s *S3Access) readDeletedAt(ctx context.Context, vol string) (time.Time, error) {
+	key := s.trashedVolumeKey(vol, deletedAtName)
+
+	out, err := s.sc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if s.isNoSuchKey(err) {
+			return time.Time{}, errors.Wrapf(ErrVolumeNotTrashed, "volume %s", vol)
+		}
+
+		return time.Time{}, err
+	}
+
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ts, err := time.Parse(deletedAtStamp, string(data))
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "parsing deletion time of volume %s", vol)
+	}
+
+	return ts, nil
+}
+
+// ListTrashedVolumes returns the volumes in the trash. Those still being
+// moved there don't have a deletion time yet and are left out.
+func (s *S3Access) ListTrashedVolumes(ctx context.Context) ([]TrashedVolume, error) {
+	prefix := s.volumeKey(trashDir, "") + "/"
+
+	keys, err := s.listKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []TrashedVolume
+
+	for _, key := range keys {
+		vol, ok := strings.CutSuffix(key[len(prefix):], "/"+deletedAtName)
+		if !ok || strings.Contains(vol, "/") {
+			continue
+		}
+
+		ts, err := s.readDeletedAt(ctx, vol)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, TrashedVolume{Name: vol, DeletedAt: ts})
+	}
+
+	return out, nil
+}
+
+func (s *S3Access) ListTrashedSegments(ctx context.Context, vol string) ([]SegmentId, error) {
+	return s.ListSegments(ctx, trashDir+"/"+vol)
+}
+
+func (s *S3Access) PurgeVolume(ctx context.Context, vol string) error {
+	_, err := s.readDeletedAt(ctx, vol)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.listKeys(ctx, s.trashedVolumeKey(vol, "")+"/")
+	if err != nil {
+		return err
+	}
+
+	// Remove the deletion time last, so a purge that fails part way is
+	// picked up again by the next one.
+	marker := s.trashedVolumeKey(vol, deletedAtName)
+	keys = slices.DeleteFunc(keys, func(k string) bool { return k == marker })
+
+	return s.removeObjects(ctx, append(keys, marker))
+}
+
+var (
+	_ SegmentAccess       = (*S3Access)(nil)
+	_ SegmentStreamer     = (*S3Access)(nil)
+	_ VolumeTrash         = (*S3Access)(nil)
+	_ VolumeInfoUpdater   = (*S3Access)(nil)
+	_ SegmentBatchRemover = (*S3Access)(nil)
+	_ SegmentSizer        = (*S3Access)(nil)
+)
@@ -0,0 +1,102 @@
+//go:build minio
+
+package lsvd
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// Run against a MinIO server with:
+//
+//	go test -tags minio -run TestMinIO
+//
+// MINIO_URL defaults to http://localhost:9000, and MINIO_ACCESS_KEY and
+// MINIO_SECRET_KEY to MinIO's defaults. Addressing the bucket in the host is
+// only tested if MINIO_DOMAIN is set, as MinIO only supports it when it's
+// started with the same MINIO_DOMAIN.
+func TestMinIO(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	env := func(name, def string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+
+		return def
+	}
+
+	host := env("MINIO_URL", "http://localhost:9000")
+	access := env("MINIO_ACCESS_KEY", "minioadmin")
+	secret := env("MINIO_SECRET_KEY", "minioadmin")
+
+	bucket := "lsvdtest"
+
+	roundTrip := func(t *testing.T, opts ...S3Option) {
+		r := require.New(t)
+
+		s, err := NewS3AccessStatic(log, host, bucket, "us-east-1", access, secret, opts...)
+		r.NoError(err)
+
+		s.sc.CreateBucket(ctx, &s3.CreateBucketInput{
+			Bucket: &bucket,
+		})
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		w, err := s.WriteSegment(ctx, seg)
+		r.NoError(err)
+
+		_, err = w.Write([]byte("this is a segment"))
+		r.NoError(err)
+		r.NoError(w.Close())
+
+		defer s.RemoveSegment(ctx, seg)
+
+		sr, err := s.OpenSegment(ctx, seg)
+		r.NoError(err)
+
+		buf := make([]byte, 7)
+
+		n, err := sr.ReadAt(buf, 10)
+		r.NoError(err)
+		r.Equal("segment", string(buf[:n]))
+
+		rc, _, err := s.StreamSegment(ctx, seg)
+		r.NoError(err)
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		r.NoError(err)
+		r.Equal("this is a segment", string(data))
+	}
+
+	t.Run("reads and writes with the bucket in the path", func(t *testing.T) {
+		roundTrip(t)
+	})
+
+	t.Run("reads and writes with the bucket in the host", func(t *testing.T) {
+		if os.Getenv("MINIO_DOMAIN") == "" {
+			t.Skip("MINIO_DOMAIN isn't set")
+		}
+
+		roundTrip(t, WithPathStyle(false))
+	})
+
+	t.Run("reads and writes via an endpoint resolver", func(t *testing.T) {
+		u, err := url.Parse(host)
+		require.NoError(t, err)
+
+		roundTrip(t, WithEndpointResolver(hostResolver{host: u.Host}))
+	})
+}
@@ -1,16 +1,27 @@
 package lsvd
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
 	"github.com/lab47/lsvd/logger"
 	"github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/require"
@@ -85,6 +96,41 @@ func TestS3(t *testing.T) {
 		r.Equal("this is a segment", string(buf[:n]))
 	})
 
+	t.Run("can stream a segment", func(t *testing.T) {
+		r := require.New(t)
+
+		seg, err := ulid.New(ulid.Now(), monoRead)
+		r.NoError(err)
+
+		objName := "segments/segment." + ulid.ULID(seg).String()
+
+		_, err = sc.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &bucketName,
+			Key:    &objName,
+			Body:   strings.NewReader("this is a segment"),
+		})
+		r.NoError(err)
+
+		defer sc.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucketName,
+			Key:    &objName,
+		})
+
+		s, err := NewS3Access(log, host, bucketName, cfg)
+		r.NoError(err)
+
+		rc, size, err := StreamSegment(ctx, s, SegmentId(seg))
+		r.NoError(err)
+
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		r.NoError(err)
+
+		r.Equal("this is a segment", string(data))
+		r.Equal(int64(len(data)), size)
+	})
+
 	t.Run("can write a segment", func(t *testing.T) {
 		r := require.New(t)
 
@@ -180,6 +226,102 @@ func TestS3(t *testing.T) {
 		r.Equal(expected, segs)
 	})
 
+	t.Run("removes a segment from the volume", func(t *testing.T) {
+		r := require.New(t)
+
+		var segs []SegmentId
+
+		s, err := NewS3Access(log, host, bucketName, cfg)
+		r.NoError(err)
+
+		objName := "volumes/removal/segments"
+
+		defer sc.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucketName,
+			Key:    &objName,
+		})
+
+		for i := 0; i < 3; i++ {
+			seg, err := ulid.New(ulid.Now(), monoRead)
+			r.NoError(err)
+
+			segs = append(segs, SegmentId(seg))
+
+			err = s.AppendToSegments(ctx, "removal", SegmentId(seg))
+			r.NoError(err)
+		}
+
+		r.NoError(s.RemoveSegmentFromVolume(ctx, "removal", segs[1]))
+
+		listed, err := s.ListSegments(ctx, "removal")
+		r.NoError(err)
+
+		r.Equal([]SegmentId{segs[0], segs[2]}, listed)
+	})
+
+	t.Run("concurrent changes to the segment list aren't lost", func(t *testing.T) {
+		r := require.New(t)
+
+		objName := "volumes/concurrent/segments"
+
+		defer sc.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucketName,
+			Key:    &objName,
+		})
+
+		const writers = 4
+
+		var (
+			wg    sync.WaitGroup
+			added [writers][]SegmentId
+			errs  = make(chan error, writers)
+		)
+
+		// Separate S3Access values don't share a lock, like separate processes.
+		for w := 0; w < writers; w++ {
+			s, err := NewS3Access(log, host, bucketName, cfg)
+			r.NoError(err)
+
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				for i := 0; i < 5; i++ {
+					seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+					added[w] = append(added[w], seg)
+
+					err := s.AppendToSegments(ctx, "concurrent", seg)
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+
+				errs <- s.RemoveSegmentFromVolume(ctx, "concurrent", added[w][0])
+			}(w)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			r.NoError(err)
+		}
+
+		var expected []SegmentId
+		for _, segs := range added {
+			expected = append(expected, segs[1:]...)
+		}
+
+		s, err := NewS3Access(log, host, bucketName, cfg)
+		r.NoError(err)
+
+		listed, err := s.ListSegments(ctx, "concurrent")
+		r.NoError(err)
+
+		r.ElementsMatch(expected, listed)
+	})
+
 	t.Run("accesses metadata", func(t *testing.T) {
 		r := require.New(t)
 
@@ -208,4 +350,809 @@ func TestS3(t *testing.T) {
 
 		r.Equal("this is metadata\n", string(data))
 	})
+
+	t.Run("keeps everything under the key prefix", func(t *testing.T) {
+		r := require.New(t)
+
+		s, err := NewS3Access(log, host, bucketName, cfg, WithKeyPrefix("lsvd/prod"))
+		r.NoError(err)
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), monoRead))
+
+		r.NoError(s.InitVolume(ctx, &VolumeInfo{Name: "prefixed", Size: 1024}))
+
+		w, err := s.WriteSegment(ctx, seg)
+		r.NoError(err)
+
+		_, err = io.WriteString(w, "this is a segment")
+		r.NoError(err)
+		r.NoError(w.Close())
+
+		r.NoError(s.AppendToSegments(ctx, "prefixed", seg))
+
+		keys := []string{
+			"lsvd/prod/segments/segment." + seg.String(),
+			"lsvd/prod/volumes/prefixed/info.json",
+			"lsvd/prod/volumes/prefixed/segments",
+		}
+
+		defer func() {
+			for _, key := range keys {
+				sc.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: &bucketName,
+					Key:    &key,
+				})
+			}
+		}()
+
+		for _, key := range keys {
+			_, err := sc.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: &bucketName,
+				Key:    &key,
+			})
+			r.NoError(err, key)
+		}
+
+		or, err := s.OpenSegment(ctx, seg)
+		r.NoError(err)
+
+		data, err := io.ReadAll(ToReader(or))
+		r.NoError(err)
+		r.Equal("this is a segment", string(data))
+
+		segs, err := s.ListSegments(ctx, "prefixed")
+		r.NoError(err)
+		r.Equal([]SegmentId{seg}, segs)
+
+		vols, err := s.ListVolumes(ctx)
+		r.NoError(err)
+		r.Equal([]string{"prefixed"}, vols)
+
+		all, err := s.ListAllSegments(ctx)
+		r.NoError(err)
+		r.Equal([]SegmentId{seg}, all)
+
+		// Without the prefix, none of it is visible.
+		plain, err := NewS3Access(log, host, bucketName, cfg)
+		r.NoError(err)
+
+		_, err = plain.OpenSegment(ctx, seg)
+		r.Error(err)
+
+		vols, err = plain.ListVolumes(ctx)
+		r.NoError(err)
+		r.NotContains(vols, "prefixed")
+	})
+
+	t.Run("soft deletes and restores a volume", func(t *testing.T) {
+		r := require.New(t)
+
+		s, err := NewS3Access(log, host, bucketName, cfg, WithKeyPrefix("trash-test"))
+		r.NoError(err)
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), monoRead))
+
+		r.NoError(s.InitVolume(ctx, &VolumeInfo{Name: "trashed", Size: 1024}))
+		r.NoError(s.AppendToSegments(ctx, "trashed", seg))
+
+		defer func() {
+			s.SoftDeleteVolume(ctx, "trashed")
+			s.PurgeVolume(ctx, "trashed")
+		}()
+
+		r.NoError(s.SoftDeleteVolume(ctx, "trashed"))
+
+		vols, err := s.ListVolumes(ctx)
+		r.NoError(err)
+		r.NotContains(vols, "trashed")
+
+		trashed, err := s.ListTrashedVolumes(ctx)
+		r.NoError(err)
+		r.Len(trashed, 1)
+		r.Equal("trashed", trashed[0].Name)
+
+		segs, err := s.ListTrashedSegments(ctx, "trashed")
+		r.NoError(err)
+		r.Equal([]SegmentId{seg}, segs)
+
+		r.NoError(s.RestoreVolume(ctx, "trashed"))
+
+		vols, err = s.ListVolumes(ctx)
+		r.NoError(err)
+		r.Contains(vols, "trashed")
+
+		segs, err = s.ListSegments(ctx, "trashed")
+		r.NoError(err)
+		r.Equal([]SegmentId{seg}, segs)
+
+		vi, err := s.GetVolumeInfo(ctx, "trashed")
+		r.NoError(err)
+		r.Equal(int64(1024), vi.Size)
+
+		trashed, err = s.ListTrashedVolumes(ctx)
+		r.NoError(err)
+		r.Empty(trashed)
+	})
+}
+
+func TestS3Keys(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	keys := func(opts ...S3Option) (string, string) {
+		s, err := NewS3Access(log, "http://localhost", "bucket", aws.Config{}, opts...)
+		require.NoError(t, err)
+
+		return s.segmentKey(seg), s.volumeKey("vol", "info.json")
+	}
+
+	t.Run("uses the default layout without a prefix", func(t *testing.T) {
+		sk, vk := keys()
+		require.Equal(t, "segments/segment."+seg.String(), sk)
+		require.Equal(t, "volumes/vol/info.json", vk)
+	})
+
+	t.Run("puts every key under the prefix", func(t *testing.T) {
+		for _, prefix := range []string{"lsvd/prod", "lsvd/prod/", "/lsvd/prod/"} {
+			sk, vk := keys(WithKeyPrefix(prefix))
+			require.Equal(t, "lsvd/prod/segments/segment."+seg.String(), sk, prefix)
+			require.Equal(t, "lsvd/prod/volumes/vol/info.json", vk, prefix)
+		}
+	})
+}
+
+// fakeS3 serves objects from memory to an s3.Client, counting the HeadObject
+// requests made and recording the storage class objects are put with. Reads
+// of the keys in archived fail as they do for objects in Glacier.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	classes  map[string]string
+	archived map[string]bool
+	heads    int
+}
+
+func (f *fakeS3) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Path style, so the key follows the bucket.
+	_, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+
+	resp := &http.Response{
+		Request:    req,
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+
+	if req.Method == http.MethodPut {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.objects == nil {
+			f.objects = map[string][]byte{}
+			f.classes = map[string]string{}
+		}
+
+		f.objects[key] = data
+		f.classes[key] = req.Header.Get("X-Amz-Storage-Class")
+
+		return resp, nil
+	}
+
+	f.mu.Lock()
+	data, ok := f.objects[key]
+	archived := f.archived[key]
+	if req.Method == http.MethodHead {
+		f.heads++
+	}
+	f.mu.Unlock()
+
+	if ok && archived && req.Method == http.MethodGet {
+		resp.StatusCode = http.StatusForbidden
+		resp.Header.Set("Content-Type", "application/xml")
+		resp.Body = io.NopCloser(strings.NewReader(
+			"<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>"))
+		return resp, nil
+	}
+
+	if !ok {
+		resp.StatusCode = http.StatusNotFound
+		return resp, nil
+	}
+
+	if req.Method == http.MethodGet {
+		start, end := 0, len(data)-1
+		if rng := req.Header.Get("Range"); rng != "" {
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			end = min(end, len(data)-1)
+			resp.StatusCode = http.StatusPartialContent
+		}
+
+		data = data[start : end+1]
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(data)))
+
+	return resp, nil
+}
+
+// ServeHTTP serves the objects over a real connection, for tests of how
+// connections are used.
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, err := f.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// servedS3 serves +f+ over http, counting the connections made to it.
+func servedS3(t testing.TB, f *fakeS3) (*httptest.Server, *atomic.Int64) {
+	var conns atomic.Int64
+
+	srv := httptest.NewUnstartedServer(f)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return srv, &conns
+}
+
+func TestS3ConnectionPool(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	const readers = 32
+
+	t.Run("reuses connections across rounds of concurrent reads", func(t *testing.T) {
+		r := require.New(t)
+
+		f := &fakeS3{
+			objects: map[string][]byte{
+				"segments/segment." + seg.String(): bytes.Repeat([]byte("segment!"), 1024),
+			},
+		}
+
+		srv, conns := servedS3(t, f)
+
+		cfg := aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider("admin", "password", ""),
+		}
+
+		s, err := NewS3Access(log, srv.URL, "lsvdtest", cfg,
+			WithSkipExistenceCheck(),
+			WithConnectionPool(readers, time.Minute),
+		)
+		r.NoError(err)
+
+		sr, err := s.OpenSegment(ctx, seg)
+		r.NoError(err)
+
+		for round := 0; round < 5; round++ {
+			var wg sync.WaitGroup
+
+			errs := make(chan error, readers)
+
+			for i := 0; i < readers; i++ {
+				wg.Add(1)
+
+				go func(i int) {
+					defer wg.Done()
+
+					buf := make([]byte, 8)
+
+					_, err := sr.ReadAt(buf, int64(i*8))
+					if err == nil && string(buf) != "segment!" {
+						err = fmt.Errorf("read %q", buf)
+					}
+
+					errs <- err
+				}(i)
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				r.NoError(err)
+			}
+		}
+
+		// The SDK's default pool would keep only 10 of them between rounds.
+		r.LessOrEqual(conns.Load(), int64(readers))
+	})
+}
+
+// BenchmarkS3RandomReads reads random ranges of a segment from a local
+// server in parallel, with the SDK's connection pool and a larger one.
+func BenchmarkS3RandomReads(b *testing.B) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	const (
+		segmentSize = 16 * 1024 * 1024
+		readSize    = 64 * 1024
+	)
+
+	data := make([]byte, segmentSize)
+
+	f := &fakeS3{
+		objects: map[string][]byte{
+			"segments/segment." + seg.String(): data,
+		},
+	}
+
+	bench := func(b *testing.B, opts ...S3Option) {
+		srv, conns := servedS3(b, f)
+
+		cfg := aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider("admin", "password", ""),
+		}
+
+		s, err := NewS3Access(log, srv.URL, "lsvdtest", cfg, append(opts, WithSkipExistenceCheck())...)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		sr, err := s.OpenSegment(ctx, seg)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.SetBytes(readSize)
+		b.SetParallelism(8)
+		b.ResetTimer()
+
+		b.RunParallel(func(pb *testing.PB) {
+			buf := make([]byte, readSize)
+			rng := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+
+			for pb.Next() {
+				off := rng.Int63n(segmentSize - readSize)
+
+				_, err := sr.ReadAt(buf, off)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+
+		b.ReportMetric(float64(conns.Load()), "conns")
+	}
+
+	b.Run("default", func(b *testing.B) { bench(b) })
+	b.Run("pooled", func(b *testing.B) { bench(b, WithConnectionPool(256, time.Minute)) })
+}
+
+func TestS3ExistenceCheck(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	setup := func(t *testing.T, opts ...S3Option) (*S3Access, *fakeS3) {
+		f := &fakeS3{
+			objects: map[string][]byte{
+				"segments/segment." + seg.String(): []byte("this is a segment"),
+			},
+		}
+
+		cfg := aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider("admin", "password", ""),
+			HTTPClient:  &http.Client{Transport: f},
+		}
+
+		s, err := NewS3Access(log, "http://localhost:9000", "lsvdtest", cfg, opts...)
+		require.NoError(t, err)
+
+		return s, f
+	}
+
+	read := func(t *testing.T, sr SegmentReader) string {
+		buf := make([]byte, 7)
+
+		n, err := sr.ReadAt(buf, 10)
+		require.NoError(t, err)
+
+		return string(buf[:n])
+	}
+
+	t.Run("checks the segment exists by default", func(t *testing.T) {
+		r := require.New(t)
+
+		s, f := setup(t)
+
+		sr, err := s.OpenSegment(ctx, seg)
+		r.NoError(err)
+		r.Equal(1, f.heads)
+
+		r.Equal("segment", read(t, sr))
+
+		size, err := sr.(SizedSegmentReader).Size()
+		r.NoError(err)
+		r.Equal(int64(17), size)
+		r.Equal(1, f.heads)
+
+		_, err = s.OpenSegment(ctx, SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy())))
+		r.Error(err)
+		r.Equal(2, f.heads)
+	})
+
+	t.Run("reports the size without opening the segment", func(t *testing.T) {
+		r := require.New(t)
+
+		s, f := setup(t, WithSkipExistenceCheck())
+
+		size, err := SegmentSize(ctx, s, seg)
+		r.NoError(err)
+		r.Equal(int64(17), size)
+		r.Equal(1, f.heads)
+
+		_, err = SegmentSize(ctx, s, SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy())))
+		r.ErrorIs(err, os.ErrNotExist)
+	})
+
+	t.Run("can skip the check", func(t *testing.T) {
+		r := require.New(t)
+
+		s, f := setup(t, WithSkipExistenceCheck())
+
+		sr, err := s.OpenSegment(ctx, seg)
+		r.NoError(err)
+		r.Zero(f.heads)
+
+		r.Equal("segment", read(t, sr))
+		r.Zero(f.heads)
+
+		// The size is only requested when it's needed.
+		size, err := sr.(SizedSegmentReader).Size()
+		r.NoError(err)
+		r.Equal(int64(17), size)
+		r.Equal(1, f.heads)
+
+		_, err = sr.(SizedSegmentReader).Size()
+		r.NoError(err)
+		r.Equal(1, f.heads)
+
+		// A missing segment fails on the first read instead.
+		missing, err := s.OpenSegment(ctx, SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy())))
+		r.NoError(err)
+
+		_, err = missing.ReadAt(make([]byte, 7), 0)
+		r.Error(err)
+	})
+}
+
+func TestS3StorageClass(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	setup := func(t *testing.T, opts ...S3Option) (*S3Access, *fakeS3) {
+		f := &fakeS3{}
+
+		cfg := aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider("admin", "password", ""),
+			HTTPClient:  &http.Client{Transport: f},
+		}
+
+		s, err := NewS3Access(log, "http://localhost:9000", "lsvdtest", cfg, opts...)
+		require.NoError(t, err)
+
+		return s, f
+	}
+
+	writeSegment := func(t *testing.T, s *S3Access) SegmentId {
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		w, err := s.WriteSegment(ctx, seg)
+		require.NoError(t, err)
+
+		_, err = io.WriteString(w, "this is a segment")
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		return seg
+	}
+
+	writeMetadata := func(t *testing.T, s *S3Access) {
+		w, err := s.WriteMetadata(ctx, "default", "head.map")
+		require.NoError(t, err)
+
+		_, err = io.WriteString(w, "map")
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+
+	t.Run("writes segments with the storage class", func(t *testing.T) {
+		r := require.New(t)
+
+		s, f := setup(t, WithStorageClass("GLACIER_IR"))
+
+		seg := writeSegment(t, s)
+
+		tmp, err := os.CreateTemp("", "lsvd")
+		r.NoError(err)
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		_, err = io.WriteString(tmp, "this is another segment")
+		r.NoError(err)
+
+		_, err = tmp.Seek(0, io.SeekStart)
+		r.NoError(err)
+
+		uploaded := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+		r.NoError(s.UploadSegment(ctx, uploaded, tmp))
+
+		writeMetadata(t, s)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		r.Equal("GLACIER_IR", f.classes["segments/segment."+seg.String()])
+		r.Equal("GLACIER_IR", f.classes["segments/segment."+uploaded.String()])
+
+		// Metadata stays in the default class.
+		r.Contains(f.classes, "volumes/default/head.map")
+		r.Empty(f.classes["volumes/default/head.map"])
+	})
+
+	t.Run("uses the bucket's default class otherwise", func(t *testing.T) {
+		r := require.New(t)
+
+		s, f := setup(t)
+
+		seg := writeSegment(t, s)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		r.Contains(f.classes, "segments/segment."+seg.String())
+		r.Empty(f.classes["segments/segment."+seg.String()])
+	})
+
+	t.Run("reports segments that have to be restored", func(t *testing.T) {
+		r := require.New(t)
+
+		s, f := setup(t, WithStorageClass("GLACIER"))
+
+		seg := writeSegment(t, s)
+
+		f.mu.Lock()
+		f.archived = map[string]bool{"segments/segment." + seg.String(): true}
+		f.mu.Unlock()
+
+		sr, err := s.OpenSegment(ctx, seg)
+		r.NoError(err)
+
+		_, err = sr.ReadAt(make([]byte, 7), 0)
+		r.ErrorIs(err, ErrObjectArchived)
+		r.Contains(err.Error(), seg.String())
+
+		_, _, err = s.StreamSegment(ctx, seg)
+		r.ErrorIs(err, ErrObjectArchived)
+	})
+}
+
+// requestRecorder answers every request with an empty object, recording the
+// requests.
+type requestRecorder struct {
+	mu   sync.Mutex
+	reqs []*http.Request
+}
+
+func (rr *requestRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	rr.mu.Lock()
+	rr.reqs = append(rr.reqs, req)
+	rr.mu.Unlock()
+
+	return &http.Response{
+		Request:    req,
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Length": []string{"0"}},
+		Body:       http.NoBody,
+	}, nil
+}
+
+func (rr *requestRecorder) last() *http.Request {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	return rr.reqs[len(rr.reqs)-1]
+}
+
+// hostResolver resolves endpoints as S3 does, then sends them to host.
+type hostResolver struct {
+	host string
+}
+
+func (h hostResolver) ResolveEndpoint(ctx context.Context, p s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	ep, err := s3.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, p)
+	if err != nil {
+		return ep, err
+	}
+
+	ep.URI.Host = h.host
+
+	return ep, nil
+}
+
+func TestS3Addressing(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+	// open opens seg with +s+, returning the request made.
+	open := func(t *testing.T, s *S3Access, rr *requestRecorder) *http.Request {
+		_, err := s.OpenSegment(ctx, seg)
+		require.NoError(t, err)
+
+		return rr.last()
+	}
+
+	static := func(t *testing.T, opts ...S3Option) (*S3Access, *requestRecorder) {
+		rr := &requestRecorder{}
+
+		opts = append(opts, func(s *S3Access) {
+			s.clientOpts = append(s.clientOpts, func(o *s3.Options) {
+				o.HTTPClient = &http.Client{Transport: rr}
+			})
+		})
+
+		s, err := NewS3AccessStatic(log, "http://localhost:9000", "lsvdtest", "us-east-1", "AKID", "SECRET", opts...)
+		require.NoError(t, err)
+
+		return s, rr
+	}
+
+	t.Run("addresses the bucket in the path by default", func(t *testing.T) {
+		r := require.New(t)
+
+		s, rr := static(t)
+
+		req := open(t, s, rr)
+		r.Equal("localhost:9000", req.URL.Host)
+		r.Equal("/lsvdtest/segments/segment."+seg.String(), req.URL.Path)
+	})
+
+	t.Run("can address the bucket in the host", func(t *testing.T) {
+		r := require.New(t)
+
+		s, rr := static(t, WithPathStyle(false))
+
+		req := open(t, s, rr)
+		r.Equal("lsvdtest.localhost:9000", req.URL.Host)
+		r.Equal("/segments/segment."+seg.String(), req.URL.Path)
+	})
+
+	t.Run("signs for the region given", func(t *testing.T) {
+		r := require.New(t)
+
+		s, rr := static(t)
+
+		req := open(t, s, rr)
+		r.Contains(req.Header.Get("Authorization"), "/us-east-1/s3/")
+
+		s, rr = static(t, WithRegion("auto"), WithPathStyle(false))
+
+		req = open(t, s, rr)
+		r.Contains(req.Header.Get("Authorization"), "/auto/s3/")
+		r.Equal("lsvdtest.localhost:9000", req.URL.Host)
+	})
+
+	t.Run("rejects hosts that can't address the bucket", func(t *testing.T) {
+		for _, tc := range []struct {
+			host, bucket string
+			pathStyle    bool
+		}{
+			{"localhost:9000", "lsvdtest", true},
+			{"ftp://localhost:9000", "lsvdtest", true},
+			{"http://127.0.0.1:9000", "lsvdtest", false},
+			{"https://s3.example.com", "lsvd.test", false},
+		} {
+			_, err := NewS3Access(log, tc.host, tc.bucket, aws.Config{}, WithPathStyle(tc.pathStyle))
+			require.ErrorIs(t, err, ErrInvalidS3Endpoint, tc.host)
+		}
+
+		for _, tc := range []struct {
+			host, bucket string
+			pathStyle    bool
+		}{
+			{"", "lsvd.test", false},
+			{"http://127.0.0.1:9000", "lsvdtest", true},
+			{"https://s3.example.com", "lsvd.test", true},
+			{"http://s3.example.com", "lsvd.test", false},
+		} {
+			_, err := NewS3Access(log, tc.host, tc.bucket, aws.Config{}, WithPathStyle(tc.pathStyle))
+			require.NoError(t, err, tc.host)
+		}
+	})
+
+	t.Run("uses the endpoint resolver given", func(t *testing.T) {
+		r := require.New(t)
+
+		s, rr := static(t, WithEndpointResolver(hostResolver{host: "elsewhere:9000"}))
+
+		req := open(t, s, rr)
+		r.Equal("elsewhere:9000", req.URL.Host)
+		r.Equal("/lsvdtest/segments/segment."+seg.String(), req.URL.Path)
+	})
+
+	t.Run("signs with the static keys", func(t *testing.T) {
+		r := require.New(t)
+
+		s, rr := static(t)
+
+		req := open(t, s, rr)
+		r.Contains(req.Header.Get("Authorization"), "Credential=AKID/")
+	})
+
+	t.Run("signs with the credentials given", func(t *testing.T) {
+		r := require.New(t)
+
+		s, rr := static(t, WithCredentials(credentials.NewStaticCredentialsProvider("OTHER", "SECRET", "")))
+
+		req := open(t, s, rr)
+		r.Contains(req.Header.Get("Authorization"), "Credential=OTHER/")
+	})
+
+	t.Run("loads the credentials of a profile", func(t *testing.T) {
+		r := require.New(t)
+
+		dir := t.TempDir()
+
+		path := filepath.Join(dir, "credentials")
+		r.NoError(os.WriteFile(path, []byte("[lsvd]\naws_access_key_id = PROFILE\naws_secret_access_key = SECRET\n"), 0600))
+
+		t.Setenv("AWS_SHARED_CREDENTIALS_FILE", path)
+		t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+
+		rr := &requestRecorder{}
+
+		s, err := NewS3AccessFromProfile(ctx, log, "http://localhost:9000", "lsvdtest", "us-east-1", "lsvd",
+			func(s *S3Access) {
+				s.clientOpts = append(s.clientOpts, func(o *s3.Options) {
+					o.HTTPClient = &http.Client{Transport: rr}
+				})
+			})
+		r.NoError(err)
+
+		req := open(t, s, rr)
+		r.Contains(req.Header.Get("Authorization"), "Credential=PROFILE/")
+	})
 }
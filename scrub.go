@@ -0,0 +1,345 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+// ErrReplicaMismatch is reported by the scrubber when a secondary of a
+// MirrorAccess holds different data for an extent than the primary.
+var ErrReplicaMismatch = errors.New("replica data differs from the primary")
+
+// ScrubConfig configures StartScrubber.
+type ScrubConfig struct {
+	// The most bytes a second the scrubber reads from the segments. 0 means
+	// no limit.
+	BytesPerSecond int64
+
+	// How long to wait after a pass over the volume before starting the
+	// next. 0 stops the scrubber after a single pass.
+	Interval time.Duration
+
+	// Called with each corrupt extent the scrubber finds, from the
+	// scrubber's goroutine.
+	OnCorruption func(ScrubReport)
+}
+
+// ScrubReport describes a corrupt extent found by the scrubber.
+type ScrubReport struct {
+	Extent ExtentLocation
+
+	// Which copy of the extent is corrupt: 0 is the one the disk reads, n is
+	// the nth secondary when the disk uses a MirrorAccess.
+	Replica int
+
+	Err error
+
+	// Set if the disk's copy was rewritten from a secondary that holds
+	// valid data for the extent.
+	Repaired bool
+}
+
+// Scrubber is a running scrubber, see StartScrubber.
+type Scrubber struct {
+	d    *Disk
+	cfg  ScrubConfig
+	done chan struct{}
+
+	// Bytes read that haven't been paced yet.
+	unpaced int64
+}
+
+// Reads are paced once they add up to this much time, to avoid sleeping
+// for every small extent.
+const scrubPaceGranularity = 10 * time.Millisecond
+
+// StartScrubber starts a goroutine that reads back every extent of the
+// volume in the background, reporting those that are corrupt to
+// cfg.OnCorruption. Without checksums for the extents, corruption is data
+// that can't be read in full or, for compressed extents, can't be
+// uncompressed. When the disk uses a MirrorAccess, each secondary's copy is
+// compared as well, and a corrupt primary copy is repaired from the first
+// secondary whose copy is valid.
+//
+// Extents are read directly from the segments, bypassing the read cache, so
+// foreground reads don't lose their cached data. Data already cached from a
+// corrupt copy is served until it's evicted. The scrubber runs until +ctx+
+// is canceled, which must happen before the disk is closed.
+func (d *Disk) StartScrubber(ctx context.Context, cfg ScrubConfig) *Scrubber {
+	s := &Scrubber{
+		d:    d,
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		s.run(ctx)
+	}()
+
+	return s
+}
+
+// Wait blocks until the scrubber stops.
+func (s *Scrubber) Wait() {
+	<-s.done
+}
+
+func (s *Scrubber) run(ctx context.Context) {
+	sctx := NewContext(ctx)
+	defer sctx.Close()
+
+	for {
+		start := s.d.clock.Now()
+
+		n, err := s.pass(sctx)
+		if err != nil {
+			return
+		}
+
+		s.d.log.Info("scrubbed volume", "extents", n, "elapsed", s.d.clock.Now().Sub(start))
+
+		if s.cfg.Interval <= 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.d.clock.After(s.cfg.Interval):
+		}
+	}
+}
+
+// scrubTargets returns the extents stored by the volume's own segments, in
+// the order they're stored.
+func (d *Disk) scrubTargets() []ExtentLocation {
+	seen := make(map[ExtentLocation]struct{})
+
+	var locs []ExtentLocation
+
+	for i := d.lba2pba.LockedIterator(); i.Valid(); i.Next() {
+		pe := i.Value()
+
+		// Zero extents have no data, and other disks' extents are theirs
+		// to scrub.
+		if pe.Size == 0 || pe.Disk != 0 {
+			continue
+		}
+
+		if _, ok := seen[pe.ExtentLocation]; ok {
+			continue
+		}
+
+		seen[pe.ExtentLocation] = struct{}{}
+		locs = append(locs, pe.ExtentLocation)
+	}
+
+	slices.SortFunc(locs, func(a, b ExtentLocation) int {
+		if c := bytes.Compare(a.Segment[:], b.Segment[:]); c != 0 {
+			return c
+		}
+
+		return int(a.Offset) - int(b.Offset)
+	})
+
+	return locs
+}
+
+// pass scrubs every extent of the volume once, returning how many it read.
+func (s *Scrubber) pass(ctx *Context) (int, error) {
+	locs := s.d.scrubTargets()
+
+	for i, loc := range locs {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+
+		ctx.Reset()
+
+		s.scrubExtent(ctx, loc)
+
+		err := s.pace(ctx, int64(loc.Size))
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(locs), nil
+}
+
+// pace waits as long as reading +n+ more bytes takes within the budget.
+func (s *Scrubber) pace(ctx context.Context, n int64) error {
+	if s.cfg.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	s.unpaced += n
+
+	wait := time.Duration(float64(s.unpaced) / float64(s.cfg.BytesPerSecond) * float64(time.Second))
+	if wait < scrubPaceGranularity {
+		return nil
+	}
+
+	s.unpaced = 0
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.d.clock.After(wait):
+		return nil
+	}
+}
+
+func (s *Scrubber) scrubExtent(ctx *Context, loc ExtentLocation) {
+	d := s.d
+
+	pe := PartialExtent{Live: loc.Extent, ExtentLocation: loc}
+
+	raw := ctx.Allocate(int(loc.Size))
+
+	err := d.er.readRaw(ctx, d.log, &pe, raw, true)
+	if err == nil {
+		err = checkExtentData(ctx, &pe, raw)
+	}
+
+	m, mirrored := d.sa.(*MirrorAccess)
+
+	if err != nil {
+		// Removed by GC since the pass started, which isn't corruption.
+		if ctx.Err() != nil || !d.s.IsLive(loc.Segment) {
+			return
+		}
+
+		rep := ScrubReport{Extent: loc, Err: err}
+
+		if mirrored {
+			rep.Repaired = s.repair(ctx, m, &pe)
+		}
+
+		s.report(rep)
+		return
+	}
+
+	if !mirrored {
+		return
+	}
+
+	buf := ctx.Allocate(int(loc.Size))
+
+	for i, sec := range m.secondaries {
+		err := readSegmentAt(ctx, sec.sa, loc.Segment, buf, int64(loc.Offset))
+		if err != nil {
+			// Likely not replicated yet, which Status reports.
+			d.log.Debug("unable to read extent from secondary", "secondary", i, "segment", loc.Segment, "error", err)
+			continue
+		}
+
+		if !bytes.Equal(raw, buf) {
+			s.report(ScrubReport{
+				Extent:  loc,
+				Replica: i + 1,
+				Err:     errors.Wrapf(ErrReplicaMismatch, "secondary %d", i),
+			})
+		}
+	}
+}
+
+// repair rewrites the primary's copy of +pe+ from the first secondary with
+// a valid copy of it, reporting if one was found.
+func (s *Scrubber) repair(ctx *Context, m *MirrorAccess, pe *PartialExtent) bool {
+	buf := ctx.Allocate(int(pe.Size))
+
+	for i, sec := range m.secondaries {
+		err := readSegmentAt(ctx, sec.sa, pe.Segment, buf, int64(pe.Offset))
+		if err == nil {
+			err = checkExtentData(ctx, pe, buf)
+		}
+
+		if err != nil {
+			s.d.log.Debug("secondary has no valid copy of extent", "secondary", i, "extent", pe, "error", err)
+			continue
+		}
+
+		err = m.repairSegment(ctx, pe.Segment, int64(pe.Offset), buf)
+		if err != nil {
+			s.d.log.Error("error repairing extent from secondary", "secondary", i, "extent", pe, "error", err)
+			return false
+		}
+
+		// A read using the open reader at the same time may fail, but so
+		// would any read of the corrupt data.
+		s.d.er.forgetSegment(pe.Segment)
+
+		s.d.log.Warn("repaired extent from secondary", "secondary", i, "extent", pe)
+
+		return true
+	}
+
+	return false
+}
+
+func (s *Scrubber) report(rep ScrubReport) {
+	s.d.log.Error("scrubber found corrupt extent",
+		"segment", rep.Extent.Segment, "extent", rep.Extent.Extent, "replica", rep.Replica,
+		"repaired", rep.Repaired, "error", rep.Err)
+
+	if s.cfg.OnCorruption != nil {
+		s.cfg.OnCorruption(rep)
+	}
+}
+
+// checkExtentData returns an error if +raw+, the stored data of +pe+, can't
+// be uncompressed.
+func checkExtentData(ctx *Context, pe *PartialExtent, raw []byte) error {
+	if pe.Flags() != FlagLZ4 {
+		return nil
+	}
+
+	dst := ctx.Allocate(int(pe.RawSize))
+
+	n, err := lz4.UncompressBlock(raw, dst)
+	if err != nil {
+		return extentError(errors.Wrapf(ErrDecompress, "%s", err), pe)
+	}
+
+	if n != len(dst) {
+		return extentError(errors.Wrapf(ErrDecompress, "failed to uncompress correctly, %d != %d", n, len(dst)), pe)
+	}
+
+	return nil
+}
+
+// readSegmentAt fills +buf+ with the data of +seg+ in +sa+ at +off+.
+func readSegmentAt(ctx context.Context, sa SegmentAccess, seg SegmentId, buf []byte, off int64) error {
+	sr, err := sa.OpenSegment(ctx, seg)
+	if err != nil {
+		return err
+	}
+
+	defer sr.Close()
+
+	var n int
+
+	if cr, ok := sr.(ContextSegmentReader); ok {
+		n, err = cr.ReadAtContext(ctx, buf, off)
+	} else {
+		n, err = sr.ReadAt(buf, off)
+	}
+
+	if err != nil && !(errors.Is(err, io.EOF) && n == len(buf)) {
+		return err
+	}
+
+	if n != len(buf) {
+		return errors.Wrapf(ErrShortRead, "read %d of %d bytes", n, len(buf))
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrubber(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	tempDir := func(t *testing.T) string {
+		dir, err := os.MkdirTemp("", "lsvd")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return dir
+	}
+
+	// scrub runs a single pass over +d+ and returns what it reported.
+	scrub := func(d *Disk) []ScrubReport {
+		var (
+			mu      sync.Mutex
+			reports []ScrubReport
+		)
+
+		s := d.StartScrubber(ctx, ScrubConfig{
+			OnCorruption: func(rep ScrubReport) {
+				mu.Lock()
+				defer mu.Unlock()
+				reports = append(reports, rep)
+			},
+		})
+		s.Wait()
+
+		return reports
+	}
+
+	// location returns where the data of +lba+ is stored.
+	location := func(t *testing.T, d *Disk, lba LBA) ExtentLocation {
+		pes, err := d.lba2pba.Resolve(d.log, Extent{LBA: lba, Blocks: 1}, nil)
+		require.NoError(t, err)
+		require.Len(t, pes, 1)
+		return pes[0].ExtentLocation
+	}
+
+	// corrupt overwrites the stored data of +loc+ in +data+ with bytes that
+	// can't be uncompressed.
+	corrupt := func(data []byte, loc ExtentLocation) {
+		copy(data[loc.Offset:loc.Offset+loc.Size], bytes.Repeat([]byte{0xff}, int(loc.Size)))
+	}
+
+	t.Run("reports a corrupt block", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir := tempDir(t)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(1)))
+		r.NoError(d.CloseSegment(ctx))
+
+		r.Empty(scrub(d))
+
+		loc := location(t, d, 0)
+		r.Equal(byte(Compressed), loc.Flags())
+
+		path := filepath.Join(tmpdir, "segments", "segment."+ulid.ULID(loc.Segment).String())
+
+		data, err := os.ReadFile(path)
+		r.NoError(err)
+		corrupt(data, loc)
+		r.NoError(os.WriteFile(path, data, 0644))
+
+		reports := scrub(d)
+		r.Len(reports, 1)
+		r.Equal(loc, reports[0].Extent)
+		r.Equal(0, reports[0].Replica)
+		r.False(reports[0].Repaired)
+		r.ErrorIs(reports[0].Err, ErrDecompress)
+	})
+
+	t.Run("reports truncated data", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir := tempDir(t)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		loc := location(t, d, 0)
+
+		path := filepath.Join(tmpdir, "segments", "segment."+ulid.ULID(loc.Segment).String())
+		r.NoError(os.Truncate(path, int64(loc.Offset+loc.Size/2)))
+
+		reports := scrub(d)
+		r.Len(reports, 1)
+		r.Equal(loc, reports[0].Extent)
+		r.ErrorIs(reports[0].Err, ErrShortRead)
+	})
+
+	// mirrored returns a disk using a MirrorAccess with a single secondary,
+	// holding a compressed extent at LBA 0 that was replicated.
+	mirrored := func(t *testing.T) (*Disk, *memAccess, *memAccess) {
+		r := require.New(t)
+
+		primary := newMemAccess()
+		sec := newMemAccess()
+
+		m, err := NewMirrorAccess(log, primary, []SegmentAccess{sec}, MirrorRetryDelay(10*time.Millisecond))
+		r.NoError(err)
+
+		rctx, cancel := context.WithCancel(ctx)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.Run(rctx)
+		}()
+
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		d, err := NewDisk(ctx, log, tempDir(t), WithSegmentAccess(m))
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(m.Sync(ctx))
+
+		return d, primary, sec
+	}
+
+	t.Run("repairs the primary from a mirror secondary", func(t *testing.T) {
+		r := require.New(t)
+
+		d, primary, sec := mirrored(t)
+
+		loc := location(t, d, 0)
+
+		primary.mu.Lock()
+		corrupt(primary.segments[loc.Segment], loc)
+		primary.mu.Unlock()
+
+		reports := scrub(d)
+		r.Len(reports, 1)
+		r.Equal(0, reports[0].Replica)
+		r.True(reports[0].Repaired)
+		r.ErrorIs(reports[0].Err, ErrDecompress)
+
+		r.Equal(sec.segments[loc.Segment], primary.segments[loc.Segment])
+
+		r.Empty(scrub(d))
+	})
+
+	t.Run("reports a secondary that differs from the primary", func(t *testing.T) {
+		r := require.New(t)
+
+		d, primary, sec := mirrored(t)
+
+		loc := location(t, d, 0)
+
+		good := bytes.Clone(primary.segments[loc.Segment])
+
+		sec.mu.Lock()
+		corrupt(sec.segments[loc.Segment], loc)
+		sec.mu.Unlock()
+
+		reports := scrub(d)
+		r.Len(reports, 1)
+		r.Equal(1, reports[0].Replica)
+		r.False(reports[0].Repaired)
+		r.ErrorIs(reports[0].Err, ErrReplicaMismatch)
+
+		r.Equal(good, primary.segments[loc.Segment])
+	})
+
+	t.Run("stops when canceled", func(t *testing.T) {
+		r := require.New(t)
+
+		d, err := NewDisk(ctx, log, tempDir(t))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		for i := 0; i < 4; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i*2))))
+		}
+		r.NoError(d.CloseSegment(ctx))
+
+		sctx, cancel := context.WithCancel(ctx)
+
+		// Slow enough that a pass takes minutes.
+		s := d.StartScrubber(sctx, ScrubConfig{
+			BytesPerSecond: 100,
+			Interval:       time.Hour,
+		})
+
+		cancel()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Wait()
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			r.Fail("scrubber didn't stop")
+		}
+	})
+}
@@ -3,10 +3,12 @@ package lsvd
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"fmt"
 	"io"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
@@ -28,6 +30,11 @@ type SegmentCreator struct {
 	em *ExtentMap
 
 	peScratch []PartialExtent
+
+	metrics *Metrics
+
+	// The id of the segment it's flushed to, set once it's closed.
+	segment SegmentId
 }
 
 type SegmentBuilder struct {
@@ -44,12 +51,54 @@ type SegmentBuilder struct {
 	buf    []byte
 	header bytes.Buffer
 
+	// Used by Flush to copy the data out of the log.
+	bodyR *bufio.Reader
+	bodyW *bufio.Writer
+
+	// Where the data of each of extents is in the body of the flushed
+	// segment, set by Flush.
+	bodyOffsets []uint32
+
+	// Finds data that's already stored when set. keys holds the key of each
+	// extent's data, lining up with extents, with the zero key for extents
+	// that weren't hashed. dups is where Flush found each extent's data
+	// already stored, refs the references it recorded for those in other
+	// segments, and pins the segments of those.
+	dedup *dedupIndex
+	keys  []dedupKey
+	dups  []ExtentLocation
+	refs  []segmentRef
+	pins  []SegmentId
+
+	// Which extents Flush found to be entirely overwritten by later extents
+	// of the segment, and so leaves out of it.
+	superseded []bool
+
 	offset  uint64
 	extents []ExtentHeader
 
 	comp    lz4.Compressor
 	useZstd bool
 
+	// The minimum ratio to keep an extent compressed, 0 means
+	// DefaultCompressionMinRatio. compMisses counts the extents in a row
+	// that didn't reach it, compSkip how many more extents to store without
+	// attempting compression.
+	compRatio  float64
+	compMisses int
+	compSkip   int
+
+	// Stores every extent uncompressed, without attempting compression.
+	noCompression bool
+
+	// The largest extent in bytes that writes are split into, 0 means
+	// DefaultMaxExtentSize.
+	maxExtent int
+
+	// The fewest zero blocks in a row that writes are split at, 0 meaning
+	// they aren't, see WithZeroRunSplit.
+	zeroRun int
+
 	entropy entropy.Estimator
 
 	path      string
@@ -57,14 +106,34 @@ type SegmentBuilder struct {
 	logW      *bufio.Writer
 	curOffset int64
 
+	// Syncs the log as the write cache's FsyncPolicy requires, logF is
+	// synced directly if nil.
+	syncer *fileSyncer
+
 	em *ExtentMap
 
 	peScratch []PartialExtent
 	affected  []ExtentLocation
+
+	metrics *Metrics
+
+	// Written into the segment on Flush, with CreatedAt set then.
+	meta SegmentMetadata
+
+	// Used for CreatedAt, the system clock if nil.
+	clock Clock
 }
 
 const DefaultExtentsSize = 20000
 
+// Estimates of the bytes each extent and the metadata sections add to a
+// segment's header, used to size the header buffer up front. Extent headers
+// are varints, so most take less.
+const (
+	extentHeaderEstimate    = 16
+	segmentSectionsEstimate = 256
+)
+
 var segBuilderPool = sync.Pool{
 	New: func() any {
 		return &SegmentBuilder{
@@ -75,12 +144,25 @@ var segBuilderPool = sync.Pool{
 }
 
 func NewSegmentBuilder() *SegmentBuilder {
+	return newSegmentBuilder(defaultMetrics)
+}
+
+func newSegmentBuilder(m *Metrics) *SegmentBuilder {
 	seg := segBuilderPool.Get().(*SegmentBuilder)
 	seg.Reset()
+	seg.metrics = m
 
 	return seg
 }
 
+func (o *SegmentBuilder) now() time.Time {
+	if o.clock == nil {
+		return time.Now()
+	}
+
+	return o.clock.Now()
+}
+
 func ReturnSegmentBuilder(seg *SegmentBuilder) {
 	segBuilderPool.Put(seg)
 }
@@ -90,22 +172,35 @@ func (s *SegmentBuilder) Reset() {
 	header.Reset()
 
 	*s = SegmentBuilder{
-		peScratch: s.peScratch[:0],
-		extents:   s.extents[:0],
-		affected:  s.affected[:0],
-		buf:       s.buf,
-		header:    header,
+		peScratch:   s.peScratch[:0],
+		extents:     s.extents[:0],
+		affected:    s.affected[:0],
+		buf:         s.buf,
+		header:      header,
+		bodyR:       s.bodyR,
+		bodyW:       s.bodyW,
+		bodyOffsets: s.bodyOffsets[:0],
+		keys:        s.keys[:0],
+		dups:        s.dups[:0],
+		refs:        s.refs[:0],
+		pins:        s.pins[:0],
+		superseded:  s.superseded[:0],
 	}
 }
 
 var histogramBands = []float64{1, 2, 3, 5, 10, 20, 50, 100, 200, 1000}
 
 func NewSegmentCreator(log logger.Logger, vol, path string) (*SegmentCreator, error) {
+	return newSegmentCreator(log, vol, path, defaultMetrics)
+}
+
+func newSegmentCreator(log logger.Logger, vol, path string, m *Metrics) (*SegmentCreator, error) {
 	oc := &SegmentCreator{
 		log:     log,
 		volName: vol,
-		em:      NewExtentMap(),
-		builder: NewSegmentBuilder(),
+		em:      newExtentMap(m),
+		builder: newSegmentBuilder(m),
+		metrics: m,
 	}
 
 	oc.builder.em = oc.em
@@ -136,28 +231,44 @@ func (o *SegmentBuilder) Sync() error {
 		o.logW.Flush()
 	}
 
-	if o.logF != nil {
-		return o.logF.Sync()
+	if o.logF == nil {
+		return nil
 	}
 
-	return nil
+	if o.syncer != nil {
+		return o.syncer.syncFile(o.logF, o.logF.Name())
+	}
+
+	return o.logF.Sync()
 }
 
 func (o *SegmentBuilder) OpenP() bool {
 	return o.logF != nil
 }
 
+// OpenWrite opens the log at +path+ for writing, first restoring the writes
+// already in it so that new ones are added after them, the same as if they
+// had all been written without reopening the log.
 func (o *SegmentBuilder) OpenWrite(path string, log logger.Logger) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
 
 	err = o.readLog(f, log)
 	if err != nil {
+		f.Close()
 		return errors.Wrapf(err, "error reading segment log")
 	}
 
+	// Drop any write that was cut short so the next one follows the last
+	// complete write.
+	err = f.Truncate(int64(o.offset))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
 	o.logF = f
 	o.logW = bufio.NewWriter(f)
 
@@ -169,6 +280,15 @@ func (o *SegmentCreator) TotalBlocks() int {
 }
 
 func (o *SegmentCreator) ZeroBlocks(rng Extent) error {
+	rng, err := o.builder.ZeroBlocks(rng)
+	if err != nil {
+		return err
+	}
+
+	if o.em == nil {
+		o.em = newExtentMap(o.metrics)
+	}
+
 	// The empty size will signal that it's empty blocks.
 	aff, err := o.em.Update(o.log, ExtentLocation{
 		ExtentHeader: ExtentHeader{
@@ -181,17 +301,45 @@ func (o *SegmentCreator) ZeroBlocks(rng Extent) error {
 
 	o.peScratch = aff[:0]
 
-	return o.builder.ZeroBlocks(rng)
+	return nil
+}
+
+// ZeroBlocks records +rng+ as empty, returning the extent that was recorded.
+// If the last extent written is also empty and touches +rng+, it's grown to
+// cover both rather than adding another extent, so that zeroing a large range
+// piece by piece doesn't add an extent per piece. Only the last extent is
+// considered, so a zeroed range is never merged across a later write.
+func (o *SegmentBuilder) ZeroBlocks(rng Extent) (Extent, error) {
+	// Log it like any other write so that it's restored with the write cache.
+	_, n, err := o.writeLog(ExtentHeader{Extent: rng}, nil)
+	if err != nil {
+		return Extent{}, err
+	}
+
+	o.offset += uint64(n)
+	o.totalBlocks += int(rng.Blocks)
+	o.emptyBlocks += int(rng.Blocks)
+
+	return o.addEmpty(rng), nil
 }
 
-func (o *SegmentBuilder) ZeroBlocks(rng Extent) error {
+func (o *SegmentBuilder) addEmpty(rng Extent) Extent {
+	if n := len(o.extents); n > 0 && o.extents[n-1].Size == 0 {
+		last := &o.extents[n-1]
+
+		if merged, ok := last.Extent.Union(rng); ok && merged.Blocks <= MaxBlocks {
+			last.Extent = merged
+			return merged
+		}
+	}
+
 	o.cnt++
 
 	o.extents = append(o.extents, ExtentHeader{
 		Extent: rng,
 	})
 
-	return nil
+	return rng
 }
 
 func (o *SegmentCreator) EmptyP() bool {
@@ -268,11 +416,24 @@ func (o *SegmentBuilder) writeLog(
 		return 0, 0, fmt.Errorf("short write to log: %d != %d", n, len(data))
 	}
 
-	return sz, sz + n, dw.Flush()
+	err = dw.Flush()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if o.syncer != nil && o.syncer.policy == FsyncOnInterval {
+		err = o.syncer.syncFile(o.logF, o.logF.Name())
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return sz, sz + n, nil
 }
 
 // readLog is used to restore the state of the SegmentCreator from the
-// log written to data.
+// log written to data. A write at the end of the log that was cut short is
+// ignored, leaving offset at the end of the last complete one.
 func (o *SegmentBuilder) readLog(f *os.File, log logger.Logger) error {
 	log.Debug("rebuilding memory from log", "path", f.Name())
 
@@ -283,7 +444,13 @@ func (o *SegmentBuilder) readLog(f *os.File, log logger.Logger) error {
 
 		hdrLen, err := eh.Read(br)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) && hdrLen == 0 {
+				break
+			}
+
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Warn("discarding incomplete write at the end of the log",
+					"path", f.Name(), "offset", o.offset)
 				break
 			}
 
@@ -293,30 +460,60 @@ func (o *SegmentBuilder) readLog(f *os.File, log logger.Logger) error {
 
 		log.Debug("read extent header", "extent", eh.Extent, "flags", eh.Flags(), "raw-size", eh.RawSize)
 
-		o.totalBlocks += int(eh.Blocks)
+		if eh.Size == 0 {
+			o.totalBlocks += int(eh.Blocks)
+			o.emptyBlocks += int(eh.Blocks)
 
-		o.cnt++
-
-		if eh.Size > 0 {
-			n, err := br.Discard(int(eh.Size))
+			// Merged the same way as when they were written.
+			aff, err := o.em.Update(log, ExtentLocation{
+				ExtentHeader: ExtentHeader{Extent: o.addEmpty(eh.Extent)},
+			}, o.peScratch[:0])
 			if err != nil {
-				return errors.Wrapf(err, "error copying body, expecting %d, got %d", eh.Size, n)
-			}
-			if n != int(eh.Size) {
-				return fmt.Errorf("short copy: %d != %d", n, eh.Size)
+				return err
 			}
 
-			if eh.RawSize > 0 {
-				o.storageRatio += float64(eh.Size) / float64(eh.RawSize)
-			} else {
-				o.storageRatio += 1
+			o.peScratch = aff
+			o.offset += uint64(hdrLen)
+
+			continue
+		}
+
+		n, err := br.Discard(int(eh.Size))
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				log.Warn("discarding incomplete write at the end of the log",
+					"path", f.Name(), "offset", o.offset)
+				break
 			}
+			return errors.Wrapf(err, "error copying body, expecting %d, got %d", eh.Size, n)
+		}
+		if n != int(eh.Size) {
+			return fmt.Errorf("short copy: %d != %d", n, eh.Size)
+		}
 
-			// Update offset to match where it is in body
-			eh.Offset = uint32(o.offset) + uint32(hdrLen)
-			log.Trace("log rebuild offset", "extent", eh.Extent, "offset", eh.Offset)
+		o.cnt++
+		o.totalBlocks += int(eh.Blocks)
+
+		if eh.Blocks == 1 {
+			o.singleBEs++
 		}
 
+		input := int64(eh.Blocks) * BlockSize
+
+		o.inputBytes += input
+		o.storageBytes += int64(eh.Size)
+		o.storageRatio += float64(eh.Size) / float64(input)
+
+		if eh.RawSize > 0 {
+			o.addToHistogram(float64(input) / float64(eh.Size))
+		} else {
+			o.addToHistogram(1)
+		}
+
+		// Update offset to match where it is in body
+		eh.Offset = uint32(o.offset) + uint32(hdrLen)
+		log.Trace("log rebuild offset", "extent", eh.Extent, "offset", eh.Offset)
+
 		o.extents = append(o.extents, eh)
 
 		aff, err := o.em.Update(log, ExtentLocation{
@@ -361,26 +558,33 @@ func (o *SegmentCreator) FillExtent(ctx *Context, data RangeDataView) ([]Extent,
 			return nil, fmt.Errorf("error calculating subrange")
 		}
 
-		o.log.Trace("calculating relevant ranges",
-			"data", rng,
-			"src", srcRng.Live,
-			"dest", subDest.Extent,
-			"offset", srcRng.Offset,
-		)
+		// Guarded since this is the path for reads that hit the write
+		// cache, and boxing the arguments allocates even when not logged.
+		if o.log.IsTrace() {
+			o.log.Trace("calculating relevant ranges",
+				"data", rng,
+				"src", srcRng.Live,
+				"dest", subDest.Extent,
+				"offset", srcRng.Offset,
+			)
+		}
 
 		ret = append(ret, subDest.Extent)
 
-		// It's a empty range
+		// It's a empty range, and the destination isn't pre-zero'd.
 		if srcRng.Size == 0 {
+			clear(subDest.WriteData())
 			continue
 		}
 
-		o.log.Trace("reading partial from write cache", "rng", srcRng.Live, "dest", subDest.Extent, "flags", srcRng.Flags())
+		if o.log.IsTrace() {
+			o.log.Trace("reading partial from write cache", "rng", srcRng.Live, "dest", subDest.Extent, "flags", srcRng.Flags())
+		}
 
 		var srcData []byte
 
 		switch srcRng.Flags() {
-		case Uncompressed:
+		case FlagUncompressed:
 			if len(o.buf) < int(srcRng.Size) {
 				o.buf = make([]byte, srcRng.Size)
 			}
@@ -388,7 +592,9 @@ func (o *SegmentCreator) FillExtent(ctx *Context, data RangeDataView) ([]Extent,
 			srcData = o.buf[:srcRng.Size]
 
 			offset := srcRng.Offset // + (uint32(subDest.LBA-srcRng.LBA) * BlockSize)
-			o.log.Trace("reading uncompressed from write log", "src", srcRng.Live, "dest", subDest.Extent, "byte-offset", offset)
+			if o.log.IsTrace() {
+				o.log.Trace("reading uncompressed from write log", "src", srcRng.Live, "dest", subDest.Extent, "byte-offset", offset)
+			}
 			n, err := o.builder.logF.ReadAt(srcData, int64(offset))
 			if err != nil {
 				return nil, err
@@ -397,7 +603,7 @@ func (o *SegmentCreator) FillExtent(ctx *Context, data RangeDataView) ([]Extent,
 			if n != len(srcData) {
 				return nil, fmt.Errorf("reading from write log returned wrong number of bytes (%d, %d)", n, subDest.ByteSize())
 			}
-		case Compressed:
+		case FlagLZ4:
 			s := time.Now()
 			origSize := srcRng.Size // Size is the "on-disk" size, ie the compressed size
 
@@ -418,17 +624,23 @@ func (o *SegmentCreator) FillExtent(ctx *Context, data RangeDataView) ([]Extent,
 				return nil, fmt.Errorf("reading from write log returned wrong number of bytes 2 (%d, %d)", n, len(srcData))
 			}
 
-			o.log.Debug("compressed range", "offset", srcRng.Offset)
+			if o.log.IsDebug() {
+				o.log.Debug("compressed range", "offset", srcRng.Offset)
 
-			o.log.Debug("original size of compressed extent", "len", srcRng.RawSize, "comp-size", srcRng.Size)
+				o.log.Debug("original size of compressed extent", "len", srcRng.RawSize, "comp-size", srcRng.Size)
+			}
 
 			uncompData := ctx.Allocate(int(srcRng.RawSize))
 
+			startDecomp := time.Now()
+
 			n, err = lz4.UncompressBlock(srcData, uncompData)
 			if err != nil {
 				return nil, fmt.Errorf("fill-extent: error uncompressing (src=%d, dest=%d): %w", len(srcData), len(uncompData), err)
 			}
 
+			observeCodec(o.metrics.decompressBlockTime, startDecomp, n)
+
 			if n > int(srcRng.RawSize) {
 				o.log.Warn("unusual long write detected", "expected", origSize, "actual", n, "buf-len", len(o.buf))
 			} else if n < int(srcRng.RawSize) {
@@ -438,9 +650,9 @@ func (o *SegmentCreator) FillExtent(ctx *Context, data RangeDataView) ([]Extent,
 			srcData = uncompData
 
 			compTime += time.Since(s)
-		case Empty:
+		case FlagEmpty:
 			// handled above, shouldn't be here.
-			return nil, fmt.Errorf("invalid flag 2, should have size == 0, did not")
+			return nil, fmt.Errorf("invalid flag %d, should have size == 0, did not", FlagEmpty)
 		default:
 			return nil, fmt.Errorf("invalid flag %d", srcRng.Flags())
 		}
@@ -453,31 +665,160 @@ func (o *SegmentCreator) FillExtent(ctx *Context, data RangeDataView) ([]Extent,
 			return nil, fmt.Errorf("error calculating src subrange")
 		}
 
-		o.log.Debug("mapping src range", "rng", subSrc.Extent)
-
 		n := subDest.Copy(subSrc)
 
-		o.log.Debug("copied range", "bytes", n, "blocks", n/BlockSize)
+		if o.log.IsDebug() {
+			o.log.Debug("copied range", "src", subSrc.Extent, "bytes", n, "blocks", n/BlockSize)
+		}
 	}
 
 	e := time.Since(startFill)
 
-	readProcessing.Add(e.Seconds())
-	compressionOverhead.Add(compTime.Seconds())
+	o.metrics.readProcessing.Add(e.Seconds())
+	o.metrics.compressionOverhead.Add(compTime.Seconds())
 
 	o.peScratch = ranges[:0]
 
 	return ret, nil
 }
 
+// WriteCounts reports how the blocks passed to a write were stored.
+type WriteCounts struct {
+	// Blocks whose data was written.
+	Blocks int
+
+	// Blocks that were all zeros and recorded as empty instead.
+	EmptyBlocks int
+}
+
+func (w *WriteCounts) add(o WriteCounts) {
+	w.Blocks += o.Blocks
+	w.EmptyBlocks += o.EmptyBlocks
+}
+
 func (o *SegmentCreator) WriteExtent(ext RangeData) error {
-	_, eh, err := o.builder.WriteExtent(o.log, ext.View())
+	_, err := o.writeExtent(ext)
+	return err
+}
+
+func (o *SegmentCreator) writeExtent(ext RangeData) (WriteCounts, error) {
+	// Guests write zeros often, so record them as an empty extent, the same
+	// as ZeroBlocks, rather than adding them to the body. The data is checked
+	// directly since EmptyP assumes any data that was written to isn't empty.
+	if emptyBytes(ext.data) {
+		return WriteCounts{EmptyBlocks: int(ext.Blocks)}, o.ZeroBlocks(ext.Extent)
+	}
+
+	if o.builder.zeroRun <= 0 {
+		return WriteCounts{Blocks: int(ext.Blocks)}, o.writeData(ext, ext.Extent)
+	}
+
+	var counts WriteCounts
+
+	for _, run := range zeroRuns(ext, o.builder.zeroRun) {
+		var err error
+
+		if run.empty {
+			counts.EmptyBlocks += int(run.Blocks)
+			err = o.ZeroBlocks(run.Extent)
+		} else {
+			counts.Blocks += int(run.Blocks)
+			err = o.writeData(ext, run.Extent)
+		}
+
+		if err != nil {
+			return WriteCounts{}, err
+		}
+	}
+
+	return counts, nil
+}
+
+// writeData writes +rng+ of +ext+. Large writes are stored as several
+// extents so that reading a block of one doesn't have to stage the whole
+// write.
+func (o *SegmentCreator) writeData(ext RangeData, rng Extent) error {
+	limit := uint32(o.builder.maxExtentBlocks())
+
+	for rng.Blocks > 0 {
+		part := rng
+		part.Blocks = min(part.Blocks, limit)
+
+		view, _ := ext.SubRange(part)
+
+		err := o.writeView(view)
+		if err != nil {
+			return err
+		}
+
+		rng.LBA += LBA(part.Blocks)
+		rng.Blocks -= part.Blocks
+	}
+
+	return nil
+}
+
+// writeRun is a part of a write that's either all zeros or data.
+type writeRun struct {
+	Extent
+	empty bool
+}
+
+// zeroRuns splits +ext+ at the runs of at least +minBlocks+ zero blocks,
+// returning the parts in order. Shorter runs are left in the data around
+// them.
+func zeroRuns(ext RangeData, minBlocks int) []writeRun {
+	var (
+		runs  []writeRun
+		data  = ext.ReadData()
+		start = ext.LBA
+		zeros int
+	)
+
+	for i := 0; i < int(ext.Blocks); i++ {
+		if emptyBytes(data[i*BlockSize : (i+1)*BlockSize]) {
+			zeros++
+			continue
+		}
+
+		if zeros >= minBlocks {
+			zeroStart := ext.LBA + LBA(i-zeros)
+
+			if zeroStart > start {
+				runs = append(runs, writeRun{Extent: Extent{LBA: start, Blocks: uint32(zeroStart - start)}})
+			}
+
+			runs = append(runs, writeRun{Extent: Extent{LBA: zeroStart, Blocks: uint32(zeros)}, empty: true})
+			start = ext.LBA + LBA(i)
+		}
+
+		zeros = 0
+	}
+
+	end := ext.LBA + LBA(ext.Blocks)
+
+	if zeros >= minBlocks {
+		zeroStart := end - LBA(zeros)
+
+		if zeroStart > start {
+			runs = append(runs, writeRun{Extent: Extent{LBA: start, Blocks: uint32(zeroStart - start)}})
+		}
+
+		return append(runs, writeRun{Extent: Extent{LBA: zeroStart, Blocks: uint32(zeros)}, empty: true})
+	}
+
+	return append(runs, writeRun{Extent: Extent{LBA: start, Blocks: uint32(end - start)}})
+}
+
+// writeView writes +view+ as a single extent.
+func (o *SegmentCreator) writeView(view RangeDataView) error {
+	_, eh, err := o.builder.WriteExtent(o.log, view)
 	if err != nil {
 		return err
 	}
 
 	if o.em == nil {
-		o.em = NewExtentMap()
+		o.em = newExtentMap(o.metrics)
 	}
 
 	aff, err := o.em.Update(o.log, ExtentLocation{
@@ -497,6 +838,8 @@ type SegmentStats struct {
 	Blocks     uint64
 	TotalBytes uint64
 	DataOffset uint32
+
+	SegmentMetadata
 }
 
 func (o *SegmentCreator) Flush(ctx context.Context,
@@ -519,7 +862,252 @@ func (o *SegmentCreator) Close() error {
 	return err
 }
 
+// setKey records +key+ as the key of the data of the extent at +idx+.
+func (o *SegmentBuilder) setKey(idx int, key dedupKey) {
+	for len(o.keys) < idx {
+		o.keys = append(o.keys, dedupKey{})
+	}
+
+	o.keys = append(o.keys[:idx], key)
+}
+
+// findDups finds the extents whose data is already stored, either by an
+// earlier extent of the segment or in another segment of the volume, filling
+// in o.dups. The segments of the latter are pinned until the builder is
+// closed or Flush runs again.
+//
+// A reference to another segment is applied after the segment's extents when
+// the segment is read back, so only an extent that no later extent of the
+// segment overlaps can become one.
+func (o *SegmentBuilder) findDups(log logger.Logger, seg SegmentId) {
+	o.unpin()
+
+	o.dups = o.dups[:0]
+	o.refs = o.refs[:0]
+
+	if o.dedup == nil {
+		return
+	}
+
+	// The first extent with each key, which stores its data.
+	first := map[dedupKey]int{}
+
+	var bodyOffset uint32
+
+	for i, eh := range o.extents {
+		var dup ExtentLocation
+
+		// Superseded extents aren't stored, so can't be the first of a key.
+		if o.isSuperseded(i) {
+			o.dups = append(o.dups, dup)
+			continue
+		}
+
+		key := dedupKey{}
+		if i < len(o.keys) {
+			key = o.keys[i]
+		}
+
+		if key.Blocks != 0 {
+			if j, ok := first[key]; ok {
+				src := o.extents[j]
+
+				dup = ExtentLocation{
+					ExtentHeader: ExtentHeader{
+						Extent:  eh.Extent,
+						Size:    src.Size,
+						Offset:  o.dups[j].Offset,
+						RawSize: src.RawSize,
+					},
+					Segment: seg,
+				}
+			} else if loc, ok := o.lookupStored(log, key, eh); ok {
+				o.pins = append(o.pins, loc.Segment)
+
+				loc.Extent = eh.Extent
+				dup = loc
+			} else {
+				first[key] = i
+			}
+		}
+
+		// The first extent with a key keeps its body offset in Offset so
+		// that later ones can find it, as o.dup only reports a Segment.
+		if !dup.Segment.Valid() {
+			dup.Offset = bodyOffset
+			bodyOffset += eh.Size
+		}
+
+		o.dups = append(o.dups, dup)
+	}
+}
+
+// findSuperseded finds the extents with data that later extents of the
+// segment entirely overwrite, such as when a block is written twice before
+// the segment is flushed, filling in o.superseded and returning how many
+// there are. Flush leaves them out, header entry and data both. Empty
+// extents are kept, as they take no space in the body.
+func (o *SegmentBuilder) findSuperseded(log logger.Logger) int {
+	o.superseded = o.superseded[:0]
+
+	// Builders used to copy segments don't track what's live.
+	if o.em == nil {
+		return 0
+	}
+
+	var dropped int
+
+	for _, eh := range o.extents {
+		dead := false
+
+		if eh.Size > 0 {
+			pes, err := o.em.Resolve(log, eh.Extent, o.peScratch[:0])
+			if err == nil {
+				dead = !slices.ContainsFunc(pes, func(pe PartialExtent) bool {
+					return pe.Size > 0 && pe.Offset == eh.Offset
+				})
+
+				o.peScratch = pes[:0]
+			}
+		}
+
+		if dead {
+			dropped++
+		}
+
+		o.superseded = append(o.superseded, dead)
+	}
+
+	return dropped
+}
+
+// isSuperseded reports if findSuperseded found the extent at +idx+ to be
+// entirely overwritten.
+func (o *SegmentBuilder) isSuperseded(idx int) bool {
+	return idx < len(o.superseded) && o.superseded[idx]
+}
+
+// lookupStored finds the data of +eh+ in another segment, if it's stored
+// there and no later extent of this segment overlaps +eh+.
+func (o *SegmentBuilder) lookupStored(log logger.Logger, key dedupKey, eh ExtentHeader) (ExtentLocation, bool) {
+	pes, err := o.em.Resolve(log, eh.Extent, o.peScratch[:0])
+	if err != nil {
+		return ExtentLocation{}, false
+	}
+
+	o.peScratch = pes[:0]
+
+	if len(pes) != 1 || pes[0].Live != eh.Extent || pes[0].Offset != eh.Offset {
+		return ExtentLocation{}, false
+	}
+
+	return o.dedup.lookup(key)
+}
+
+// dup returns where the data of the extent at +idx+ was found already stored
+// by findDups.
+func (o *SegmentBuilder) dup(idx int) (ExtentLocation, bool) {
+	if idx >= len(o.dups) || !o.dups[idx].Segment.Valid() {
+		return ExtentLocation{}, false
+	}
+
+	return o.dups[idx], true
+}
+
+func (o *SegmentBuilder) isDup(idx int) bool {
+	_, ok := o.dup(idx)
+	return ok
+}
+
+// refSegments returns the segments that the references recorded by Flush
+// point to.
+func (o *SegmentBuilder) refSegments() []SegmentId {
+	var segs []SegmentId
+
+	for _, ref := range o.refs {
+		if !slices.Contains(segs, ref.Segment) {
+			segs = append(segs, ref.Segment)
+		}
+	}
+
+	return segs
+}
+
+// unpin releases the segments pinned by findDups.
+func (o *SegmentBuilder) unpin() {
+	for _, seg := range o.pins {
+		o.dedup.s.Unpin(seg)
+	}
+
+	o.pins = o.pins[:0]
+}
+
+// bodyOffset returns where the data of the extent at +logOffset+ in the log
+// is in the body of the segment, once it's been flushed.
+func (o *SegmentBuilder) bodyOffset(logOffset uint32) (uint32, bool) {
+	i, ok := slices.BinarySearchFunc(o.extents, logOffset, func(eh ExtentHeader, off uint32) int {
+		return cmp.Compare(eh.Offset, off)
+	})
+	if !ok || i >= len(o.bodyOffsets) {
+		return 0, false
+	}
+
+	return o.bodyOffsets[i], true
+}
+
+// copyBody writes the data of each extent in the log to +w+, in order,
+// returning how many bytes it wrote.
+func (o *SegmentBuilder) copyBody(w io.Writer) (int64, error) {
+	_, err := o.logF.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	if o.bodyR == nil {
+		o.bodyR = bufio.NewReaderSize(o.logF, 64*1024)
+		o.bodyW = bufio.NewWriterSize(w, 64*1024)
+	} else {
+		o.bodyR.Reset(o.logF)
+		o.bodyW.Reset(w)
+	}
+
+	var pos, total int64
+
+	for i, eh := range o.extents {
+		if eh.Size == 0 || o.isDup(i) || o.isSuperseded(i) {
+			continue
+		}
+
+		_, err := o.bodyR.Discard(int(int64(eh.Offset) - pos))
+		if err != nil {
+			return total, errors.Wrapf(err, "skipping to extent at %d in log", eh.Offset)
+		}
+
+		for left := int(eh.Size); left > 0; {
+			data, err := o.bodyR.Peek(min(left, o.bodyR.Size()))
+			if err != nil {
+				return total, errors.Wrapf(err, "copying extent at %d from log", eh.Offset)
+			}
+
+			n, err := o.bodyW.Write(data)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+
+			o.bodyR.Discard(n)
+			left -= n
+		}
+
+		pos = int64(eh.Offset) + int64(eh.Size)
+	}
+
+	return total, o.bodyW.Flush()
+}
+
 func (o *SegmentBuilder) Close(log logger.Logger) error {
+	o.unpin()
+
 	if o.logF != nil {
 		o.logF.Close()
 
@@ -535,11 +1123,81 @@ func (o *SegmentBuilder) Close(log logger.Logger) error {
 
 const entropyLimit = 7.0
 
+// DefaultCompressionMinRatio is the compression ratio an extent has to reach
+// to be stored compressed when WithCompressionMinRatio isn't used.
+const DefaultCompressionMinRatio = 1.5
+
+const (
+	// How many extents in a row have to miss the compression ratio before we
+	// stop attempting compression.
+	compressionMissLimit = 8
+
+	// How many extents are then stored without attempting compression before
+	// we try again.
+	compressionSkipExtents = 64
+)
+
+// tryCompression reports if compression should be attempted for the next
+// extent. It's false while the recent data has been consistently
+// incompressible, sparing the cost of the entropy estimate and lz4, and
+// always when compression is off.
+func (o *SegmentBuilder) tryCompression() bool {
+	if o.noCompression {
+		return false
+	}
+
+	if o.compSkip > 0 {
+		o.compSkip--
+		return false
+	}
+
+	return true
+}
+
+// compressionResult tracks if the last attempted compression was kept.
+func (o *SegmentBuilder) compressionResult(kept bool) {
+	if kept {
+		o.compMisses = 0
+		return
+	}
+
+	o.compMisses++
+
+	if o.compMisses >= compressionMissLimit {
+		o.compMisses = 0
+		o.compSkip = compressionSkipExtents
+	}
+}
+
+// DefaultMaxExtentSize is the largest extent in bytes that writes are split
+// into when WithMaxExtentSize isn't used.
+const DefaultMaxExtentSize = 1024 * 1024
+
+// maxExtentBlocks returns how many blocks an extent written can have at most.
+func (o *SegmentBuilder) maxExtentBlocks() int {
+	return extentBlocks(o.maxExtent)
+}
+
+// extentBlocks returns how many blocks an extent can have at most with a
+// max extent size of +size+ bytes, see WithMaxExtentSize.
+func extentBlocks(size int) int {
+	if size <= 0 {
+		size = DefaultMaxExtentSize
+	}
+
+	return max(size/BlockSize, 1)
+}
+
+func (o *SegmentBuilder) minCompressionRatio() float64 {
+	if o.compRatio > 0 {
+		return o.compRatio
+	}
+
+	return DefaultCompressionMinRatio
+}
+
 func (o *SegmentBuilder) WriteExtent(log logger.Logger, ext RangeDataView) ([]byte, ExtentHeader, error) {
 	extBytes := ext.ByteSize()
-	if o.buf == nil {
-		o.buf = make([]byte, extBytes*2)
-	}
 
 	o.totalBlocks += int(ext.Blocks)
 
@@ -561,35 +1219,23 @@ func (o *SegmentBuilder) WriteExtent(log logger.Logger, ext RangeDataView) ([]by
 		input := ext.ReadData()
 		o.inputBytes += int64(len(input))
 
-		if o.entropy == nil {
-			o.entropy = entropy.NewEstimator()
+		if o.dedup != nil {
+			o.setKey(len(o.extents), newDedupKey(ext))
 		}
 
-		o.entropy.Reset()
-		o.entropy.Write(ext.ReadData())
-
 		var (
 			useCompression bool
 			compressedSize int
 			err            error
 		)
 
-		if o.entropy.Value() <= entropyLimit {
-			bound := lz4.CompressBlockBound(extBytes)
-
-			if len(o.buf) < bound {
-				o.buf = make([]byte, bound)
-			}
-
-			compressedSize, err = o.comp.CompressBlock(ext.ReadData(), o.buf)
+		if o.tryCompression() {
+			useCompression, compressedSize, err = o.compress(ext, extBytes)
 			if err != nil {
 				return nil, eh, err
 			}
 
-			// Only keep compression greater than 1.5x
-			if compressedSize > 0 && ((compressedSize*3)/2) < extBytes {
-				useCompression = true
-			}
+			o.compressionResult(useCompression)
 		}
 
 		if useCompression {
@@ -627,6 +1273,7 @@ func (o *SegmentBuilder) WriteExtent(log logger.Logger, ext RangeDataView) ([]by
 			"raw-size", eh.RawSize,
 			"blocks", eh.Blocks,
 			"offset", eh.Offset,
+			"flags", eh.Flags(),
 		)
 	}
 	o.extents = append(o.extents, eh)
@@ -634,19 +1281,101 @@ func (o *SegmentBuilder) WriteExtent(log logger.Logger, ext RangeDataView) ([]by
 	return data, eh, nil
 }
 
+// compress attempts to compress +ext+ into o.buf, returning if the result
+// reached the minimum ratio and should be stored.
+func (o *SegmentBuilder) compress(ext RangeDataView, extBytes int) (bool, int, error) {
+	if o.entropy == nil {
+		o.entropy = entropy.NewEstimator()
+	}
+
+	o.entropy.Reset()
+	o.entropy.Write(ext.ReadData())
+
+	if o.entropy.Value() > entropyLimit {
+		return false, 0, nil
+	}
+
+	// Leave room for larger extents too, so that a mix of sizes doesn't
+	// resize the buffer each time a larger one comes along.
+	if bound := lz4.CompressBlockBound(extBytes); len(o.buf) < bound {
+		o.buf = make([]byte, max(bound, 2*extBytes))
+	}
+
+	start := time.Now()
+
+	compressedSize, err := o.comp.CompressBlock(ext.ReadData(), o.buf)
+	if err != nil {
+		return false, 0, err
+	}
+
+	observeCodec(o.metrics.compressBlockTime, start, extBytes)
+
+	if compressedSize == 0 {
+		return false, 0, nil
+	}
+
+	ratio := float64(extBytes) / float64(compressedSize)
+
+	return ratio > o.minCompressionRatio(), compressedSize, nil
+}
+
+// Flush uploads the segment as +seg+ and adds it to +volName+. Only the
+// header is built in memory, the body is copied from the log on disk. The
+// log has each extent's header before its data, which only restoring the
+// log needs, so the body holds just the data, back to back, and extents
+// written one after the other are contiguous in the segment too.
 func (o *SegmentBuilder) Flush(ctx context.Context, log logger.Logger,
 	sa SegmentAccess, seg SegmentId, volName string,
 ) ([]ExtentLocation, *SegmentStats, error) {
 	start := time.Now()
 	defer func() {
-		segmentTime.Observe(time.Since(start).Seconds())
+		o.metrics.segmentTime.Observe(time.Since(start).Seconds())
 	}()
 
-	stats := &SegmentStats{}
+	stats := &SegmentStats{
+		SegmentMetadata: o.meta,
+	}
+
+	stats.CreatedAt = o.now()
+
+	// Flush is retried on failure, so start the header over each time.
+	o.header.Reset()
+	o.header.Grow(len(o.extents)*extentHeaderEstimate + segmentSectionsEstimate)
+
+	var bodyOffset uint32
+
+	o.bodyOffsets = o.bodyOffsets[:0]
+
+	dropped := o.findSuperseded(log)
+
+	o.findDups(log, seg)
+
+	for i, blk := range o.extents {
+		if o.isSuperseded(i) {
+			o.bodyOffsets = append(o.bodyOffsets, 0)
+			continue
+		}
+
+		if dup, ok := o.dup(i); ok {
+			if dup.Segment != seg {
+				o.bodyOffsets = append(o.bodyOffsets, 0)
+				o.refs = append(o.refs, segmentRef{
+					ExtentHeader: dup.ExtentHeader,
+					Segment:      dup.Segment,
+				})
+				continue
+			}
+
+			blk = dup.ExtentHeader
+		} else {
+			blk.Offset = bodyOffset
+			bodyOffset += blk.Size
+		}
 
-	for _, blk := range o.extents {
 		stats.Blocks += uint64(blk.Blocks)
 
+		o.bodyOffsets = append(o.bodyOffsets, blk.Offset)
+
 		if log.IsTrace() {
 			log.Trace("writing extent to header", "extent", blk.Extent, "offset", blk.Offset, "blocks", blk.Blocks)
 		}
@@ -657,12 +1386,17 @@ func (o *SegmentBuilder) Flush(ctx context.Context, log logger.Logger,
 		}
 	}
 
+	err := writeSegmentSections(&o.header, &stats.SegmentMetadata, o.refs)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	dataBegin := uint32(o.header.Len() + 8)
 
 	if log.IsDebug() {
 		log.Debug("segment constructed",
 			"header-size", o.header.Len(),
-			"body-size", o.offset,
+			"body-size", bodyOffset,
 			"blocks", len(o.extents),
 		)
 	}
@@ -671,15 +1405,33 @@ func (o *SegmentBuilder) Flush(ctx context.Context, log logger.Logger,
 
 	stats.DataOffset = dataBegin
 
-	writtenBytes.Add(float64(o.inputBytes))
-	segmentsBytes.Add(float64(o.storageBytes))
+	o.metrics.writtenBytes.Add(float64(o.inputBytes))
+	o.metrics.segmentsBytes.Add(float64(o.storageBytes))
 
-	for _, eh := range o.extents {
-		eh.Offset += dataBegin
-		entries = append(entries, ExtentLocation{
+	offset := dataBegin
+
+	for i, eh := range o.extents {
+		if o.isSuperseded(i) {
+			continue
+		}
+
+		loc := ExtentLocation{
 			ExtentHeader: eh,
 			Segment:      seg,
-		})
+		}
+
+		if dup, ok := o.dup(i); ok {
+			loc = dup
+
+			if dup.Segment == seg {
+				loc.Offset += dataBegin
+			}
+		} else {
+			loc.Offset = offset
+			offset += eh.Size
+		}
+
+		entries = append(entries, loc)
 
 		if log.IsTrace() {
 			log.Trace("advertising extent", "extent", eh.Extent, "offset", eh.Offset, "blocks", eh.Blocks)
@@ -700,26 +1452,24 @@ func (o *SegmentBuilder) Flush(ctx context.Context, log logger.Logger,
 	defer f.Close()
 
 	err = SegmentHeader{
-		ExtentCount: uint32(o.cnt),
+		ExtentCount: uint32(o.cnt - len(o.refs) - dropped),
 		DataOffset:  dataBegin,
 	}.Write(f)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	n, err := io.Copy(f, bytes.NewReader(o.header.Bytes()))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	stats.TotalBytes += uint64(n)
+	// The segment header itself is 8 bytes.
+	stats.TotalBytes += 8
 
-	_, err = o.logF.Seek(0, io.SeekStart)
+	hn, err := f.Write(o.header.Bytes())
 	if err != nil {
 		return nil, nil, err
 	}
 
-	n, err = io.Copy(f, o.logF)
+	stats.TotalBytes += uint64(hn)
+
+	n, err := o.copyBody(f)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -728,11 +1478,31 @@ func (o *SegmentBuilder) Flush(ctx context.Context, log logger.Logger,
 
 	f.Seek(0, io.SeekStart)
 
+	err = checkGeneration(ctx, sa, volName, o.meta.Generation)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	err = sa.UploadSegment(ctx, seg, f)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// A newer writer could have attached during the upload, so check again
+	// right before the segment is listed. The check above saves uploading a
+	// segment that's already known to be fenced.
+	err = checkGeneration(ctx, sa, volName, o.meta.Generation)
+	if err != nil {
+		if errors.Is(err, ErrFenced) {
+			rerr := sa.RemoveSegment(ctx, seg)
+			if rerr != nil {
+				log.Warn("error removing segment of a fenced writer", "segment", seg, "error", rerr)
+			}
+		}
+
+		return nil, nil, err
+	}
+
 	err = sa.AppendToSegments(ctx, volName, seg)
 	if err != nil {
 		return nil, nil, err
@@ -740,7 +1510,9 @@ func (o *SegmentBuilder) Flush(ctx context.Context, log logger.Logger,
 
 	log.Info("segment persistent to storage", "segment", seg, "volume", volName,
 		"blocks", stats.Blocks,
-		"size", stats.TotalBytes)
+		"size", stats.TotalBytes,
+		"references", len(o.refs),
+		"superseded", dropped)
 
 	return entries, stats, nil
 }
@@ -4,6 +4,10 @@ import (
 	"context"
 	"io"
 	"os"
+	"slices"
+	"sync"
+
+	"github.com/pkg/errors"
 )
 
 type SegmentReader interface {
@@ -11,9 +15,193 @@ type SegmentReader interface {
 	io.Closer
 }
 
+// ContextSegmentReader is implemented by a SegmentReader that can read using
+// the context of each read, rather than the one it was opened with, so that
+// the deadline of the read applies.
+type ContextSegmentReader interface {
+	SegmentReader
+	ReadAtContext(ctx context.Context, b []byte, off int64) (int, error)
+}
+
+// SizedSegmentReader is implemented by a SegmentReader that can report the
+// size of the segment without reading it.
+type SizedSegmentReader interface {
+	SegmentReader
+	Size() (int64, error)
+}
+
+// SegmentStreamer is implemented by a SegmentAccess that can read a whole
+// segment in one pass more efficiently than via OpenSegment.
+type SegmentStreamer interface {
+	StreamSegment(ctx context.Context, seg SegmentId) (io.ReadCloser, int64, error)
+}
+
+// StreamSegment returns the bytes of +seg+ exactly as stored in +sa+, along
+// with its size, which is -1 if +sa+ can't report it up front. The segment is
+// read as the returned reader is, never held in memory as a whole.
+func StreamSegment(ctx context.Context, sa SegmentAccess, seg SegmentId) (io.ReadCloser, int64, error) {
+	if ss, ok := sa.(SegmentStreamer); ok {
+		return ss.StreamSegment(ctx, seg)
+	}
+
+	sr, err := sa.OpenSegment(ctx, seg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(-1)
+
+	if ssr, ok := sr.(SizedSegmentReader); ok {
+		size, err = ssr.Size()
+		if err != nil {
+			sr.Close()
+			return nil, 0, err
+		}
+	}
+
+	return &segmentStream{Reader: ToReader(sr), Closer: sr}, size, nil
+}
+
+type segmentStream struct {
+	io.Reader
+	io.Closer
+}
+
+// SegmentSizer is implemented by a SegmentAccess that can report the size of
+// a segment without opening it.
+type SegmentSizer interface {
+	SegmentSize(ctx context.Context, seg SegmentId) (int64, error)
+}
+
+var ErrSizeUnknown = errors.New("segment size can't be determined")
+
+// SegmentSize returns the size in bytes of +seg+ as stored in +sa+, or
+// os.ErrNotExist if it isn't stored. If +sa+ isn't a SegmentSizer, the
+// segment is opened to ask its reader, failing with ErrSizeUnknown if the
+// reader can't tell either.
+func SegmentSize(ctx context.Context, sa SegmentAccess, seg SegmentId) (int64, error) {
+	if ss, ok := sa.(SegmentSizer); ok {
+		return ss.SegmentSize(ctx, seg)
+	}
+
+	sr, err := sa.OpenSegment(ctx, seg)
+	if err != nil {
+		return 0, err
+	}
+
+	defer sr.Close()
+
+	ssr, ok := sr.(SizedSegmentReader)
+	if !ok {
+		return 0, errors.Wrapf(ErrSizeUnknown, "segment %s", seg)
+	}
+
+	return ssr.Size()
+}
+
+// SegmentLister is implemented by a SegmentAccess that can list every segment
+// it stores, regardless of which volumes refer to them.
+type SegmentLister interface {
+	ListAllSegments(ctx context.Context) ([]SegmentId, error)
+}
+
+// SegmentBatchRemover is implemented by a SegmentAccess that can remove many
+// segments at once more cheaply than one at a time, such as by rewriting the
+// list of a volume's segments once for all of them.
+type SegmentBatchRemover interface {
+	RemoveSegmentsFromVolume(ctx context.Context, vol string, segs []SegmentId) error
+	RemoveSegments(ctx context.Context, segs []SegmentId) error
+}
+
+// RemoveSegmentsFromVolume removes +segs+ from the segments of +vol+, in one
+// update if +sa+ supports it.
+func RemoveSegmentsFromVolume(ctx context.Context, sa SegmentAccess, vol string, segs []SegmentId) error {
+	if len(segs) == 0 {
+		return nil
+	}
+
+	if br, ok := sa.(SegmentBatchRemover); ok {
+		return br.RemoveSegmentsFromVolume(ctx, vol, segs)
+	}
+
+	for _, seg := range segs {
+		err := sa.RemoveSegmentFromVolume(ctx, vol, seg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveSegments removes +segs+ from +sa+, in as few requests as +sa+
+// supports.
+func RemoveSegments(ctx context.Context, sa SegmentAccess, segs []SegmentId) error {
+	if len(segs) == 0 {
+		return nil
+	}
+
+	if br, ok := sa.(SegmentBatchRemover); ok {
+		return br.RemoveSegments(ctx, segs)
+	}
+
+	for _, seg := range segs {
+		err := sa.RemoveSegment(ctx, seg)
+		if err != nil {
+			return errors.Wrapf(err, "removing segment: %s", seg)
+		}
+	}
+
+	return nil
+}
+
+// withoutSegments returns +segments+ with +remove+ taken out.
+func withoutSegments(segments, remove []SegmentId) []SegmentId {
+	set := make(map[SegmentId]struct{}, len(remove))
+	for _, seg := range remove {
+		set[seg] = struct{}{}
+	}
+
+	return slices.DeleteFunc(segments, func(si SegmentId) bool {
+		_, ok := set[si]
+		return ok
+	})
+}
+
 type VolumeInfo struct {
 	Name string `json:"name"`
 	Size int64  `json:"size"`
+
+	// Incremented each time a writer attaches, see VolumeInfoUpdater.
+	Generation uint64 `json:"generation,omitempty"`
+}
+
+// MaxVolumeNameLength is the longest a volume name can be.
+const MaxVolumeNameLength = 128
+
+// ErrInvalidVolumeName is returned for a volume name that ValidateVolumeName
+// rejects.
+var ErrInvalidVolumeName = errors.New("invalid volume name")
+
+// ValidateVolumeName returns ErrInvalidVolumeName unless +name+ is 1 to
+// MaxVolumeNameLength letters, digits, underscores and dashes. Volume names
+// become part of file paths and object keys, so anything else, such as a
+// slash or "..", could escape the volume's directory or prefix or collide
+// with another volume's.
+func ValidateVolumeName(name string) error {
+	if name == "" || len(name) > MaxVolumeNameLength {
+		return errors.Wrapf(ErrInvalidVolumeName, "%q must be 1 to %d characters", name, MaxVolumeNameLength)
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-':
+		default:
+			return errors.Wrapf(ErrInvalidVolumeName, "%q contains %q, only letters, digits, '_' and '-' are allowed", name, c)
+		}
+	}
+
+	return nil
 }
 
 type SegmentAccess interface {
@@ -34,3 +222,73 @@ type SegmentAccess interface {
 
 	AppendToSegments(ctx context.Context, volume string, seg SegmentId) error
 }
+
+// VolumeInfoLister is implemented by a SegmentAccess that can return the info
+// of every volume in one call, rather than a call to GetVolumeInfo for each
+// of the volumes ListVolumes returns.
+type VolumeInfoLister interface {
+	ListVolumeInfos(ctx context.Context) ([]VolumeInfo, error)
+}
+
+// How many volume infos are read at once by ListVolumeInfos.
+const maxVolumeInfoReads = 16
+
+// ListVolumeInfos returns the info of every volume in +sa+, in the order
+// ListVolumes returns them. If +sa+ isn't a VolumeInfoLister, the infos are
+// read concurrently with GetVolumeInfo.
+func ListVolumeInfos(ctx context.Context, sa SegmentAccess) ([]VolumeInfo, error) {
+	if l, ok := sa.(VolumeInfoLister); ok {
+		return l.ListVolumeInfos(ctx)
+	}
+
+	vols, err := sa.ListVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return readVolumeInfos(ctx, vols, sa.GetVolumeInfo)
+}
+
+// readVolumeInfos calls +get+ for each of +vols+, up to maxVolumeInfoReads at
+// a time, returning the infos in the same order.
+func readVolumeInfos(
+	ctx context.Context,
+	vols []string,
+	get func(ctx context.Context, vol string) (*VolumeInfo, error),
+) ([]VolumeInfo, error) {
+	var (
+		infos = make([]VolumeInfo, len(vols))
+		errs  = make([]error, len(vols))
+
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, maxVolumeInfoReads)
+	)
+
+	for i, vol := range vols {
+		sem <- struct{}{}
+
+		wg.Add(1)
+		go func(i int, vol string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			vi, err := get(ctx, vol)
+			if err != nil {
+				errs[i] = errors.Wrapf(err, "reading info of volume %s", vol)
+				return
+			}
+
+			infos[i] = *vi
+		}(i, vol)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,204 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// listingAccess is a memAccess that lists its volume infos itself.
+type listingAccess struct {
+	*memAccess
+
+	listed bool
+}
+
+func (l *listingAccess) ListVolumeInfos(ctx context.Context) ([]VolumeInfo, error) {
+	l.listed = true
+	return []VolumeInfo{{Name: "listed"}}, nil
+}
+
+func TestListVolumeInfos(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reads the info of each volume", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := newMemAccess()
+
+		var expected []VolumeInfo
+
+		for i, name := range []string{"a", "b", "c"} {
+			vi := VolumeInfo{Name: name, Size: int64(i+1) * 1024 * 1024}
+			r.NoError(sa.InitVolume(ctx, &vi))
+
+			expected = append(expected, vi)
+		}
+
+		infos, err := ListVolumeInfos(ctx, sa)
+		r.NoError(err)
+		r.Equal(expected, infos)
+	})
+
+	t.Run("reports volumes whose info can't be read", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := readVolumeInfos(ctx, []string{"missing"}, newMemAccess().GetVolumeInfo)
+		r.Error(err)
+		r.Contains(err.Error(), "missing")
+	})
+
+	t.Run("uses the access's own listing if it has one", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &listingAccess{memAccess: newMemAccess()}
+
+		infos, err := ListVolumeInfos(ctx, sa)
+		r.NoError(err)
+		r.True(sa.listed)
+		r.Equal([]VolumeInfo{{Name: "listed"}}, infos)
+	})
+}
+
+func TestRemoveSegmentsFromVolume(t *testing.T) {
+	ctx := context.Background()
+
+	// setup adds +n+ segments to volume "test" of +sa+ and returns them.
+	setup := func(t *testing.T, sa SegmentAccess, n int) []SegmentId {
+		r := require.New(t)
+
+		r.NoError(sa.InitContainer(ctx))
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "test"}))
+
+		var segs []SegmentId
+
+		for i := 0; i < n; i++ {
+			seg := SegmentId(ulid.Make())
+			r.NoError(sa.AppendToSegments(ctx, "test", seg))
+
+			segs = append(segs, seg)
+		}
+
+		return segs
+	}
+
+	t.Run("rewrites the list of segments once", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := &LocalFileAccess{Dir: t.TempDir()}
+		segs := setup(t, sa, 20)
+
+		c := countSyncs(sa.fileSyncer())
+
+		r.NoError(RemoveSegmentsFromVolume(ctx, sa, "test", segs[5:]))
+
+		r.Equal(1, c.countMatching("segments.tmp"))
+
+		listed, err := sa.ListSegments(ctx, "test")
+		r.NoError(err)
+		r.Equal(segs[:5], listed)
+	})
+
+	t.Run("removes one at a time without batch support", func(t *testing.T) {
+		r := require.New(t)
+
+		sa := newMemAccess()
+		segs := setup(t, sa, 5)
+
+		r.NoError(RemoveSegmentsFromVolume(ctx, sa, "test", segs[1:4]))
+
+		listed, err := sa.ListSegments(ctx, "test")
+		r.NoError(err)
+		r.Equal([]SegmentId{segs[0], segs[4]}, listed)
+	})
+}
+
+func TestSegmentSize(t *testing.T) {
+	ctx := context.Background()
+
+	data := []byte("this is a segment")
+
+	for name, sa := range map[string]SegmentAccess{
+		"local":  &LocalFileAccess{Dir: t.TempDir()},
+		"memory": newMemAccess(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := require.New(t)
+
+			r.NoError(sa.InitContainer(ctx))
+
+			seg := SegmentId(ulid.Make())
+
+			w, err := sa.WriteSegment(ctx, seg)
+			r.NoError(err)
+
+			_, err = w.Write(data)
+			r.NoError(err)
+			r.NoError(w.Close())
+
+			size, err := SegmentSize(ctx, sa, seg)
+			r.NoError(err)
+			r.Equal(int64(len(data)), size)
+
+			_, err = SegmentSize(ctx, sa, SegmentId(ulid.Make()))
+			r.ErrorIs(err, os.ErrNotExist)
+		})
+	}
+}
+
+func TestValidateVolumeName(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("accepts letters, digits, underscores and dashes", func(t *testing.T) {
+		r := require.New(t)
+
+		for _, name := range []string{"default", "vol-1", "Vol_2", strings.Repeat("a", MaxVolumeNameLength)} {
+			r.NoError(ValidateVolumeName(name), name)
+		}
+	})
+
+	t.Run("rejects names that could escape the volume", func(t *testing.T) {
+		r := require.New(t)
+
+		for _, name := range []string{"", ".", "..", "../x", "a/b", `a\b`, "a.b", "a b", strings.Repeat("a", MaxVolumeNameLength+1)} {
+			r.ErrorIs(ValidateVolumeName(name), ErrInvalidVolumeName, name)
+		}
+	})
+
+	t.Run("isn't created or listed by local storage", func(t *testing.T) {
+		r := require.New(t)
+
+		dir := t.TempDir()
+
+		sa := &LocalFileAccess{Dir: dir}
+		r.NoError(sa.InitContainer(ctx))
+
+		err := sa.InitVolume(ctx, &VolumeInfo{Name: "../escape"})
+		r.ErrorIs(err, ErrInvalidVolumeName)
+
+		_, err = os.Stat(filepath.Join(dir, "escape"))
+		r.ErrorIs(err, os.ErrNotExist)
+
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "good"}))
+		r.NoError(os.MkdirAll(filepath.Join(dir, "volumes", "bad.name"), 0755))
+
+		vols, err := sa.ListVolumes(ctx)
+		r.NoError(err)
+		r.Equal([]string{"good"}, vols)
+	})
+
+	t.Run("can't open a disk with one", func(t *testing.T) {
+		r := require.New(t)
+
+		_, err := NewDisk(NewContext(ctx), logger.New(logger.Info), t.TempDir(),
+			WithVolumeName("a/b"),
+		)
+		r.ErrorIs(err, ErrInvalidVolumeName)
+	})
+}
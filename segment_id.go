@@ -1,6 +1,12 @@
 package lsvd
 
-import "github.com/oklog/ulid/v2"
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
 
 type SegmentId ulid.ULID
 
@@ -8,8 +14,43 @@ func (s SegmentId) String() string {
 	return ulid.ULID(s).String()
 }
 
+// Time returns the timestamp embedded in the segment's ULID.
+func (s SegmentId) Time() time.Time {
+	return ulid.Time(ulid.ULID(s).Time())
+}
+
 func (s SegmentId) Valid() bool {
 	return s != SegmentId{}
 }
 
 const SegmentIdSize = 16
+
+// The volume tag takes the first 4 bytes of the ULID's entropy, right after
+// the 6 bytes of timestamp.
+const volumeTagOffset = 6
+
+// VolumeTag returns the tag that WithVolumeTaggedSegments puts into the
+// segment ids of the volume named +vol+.
+func VolumeTag(vol string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(vol))
+	return h.Sum32()
+}
+
+// VolumeTag returns the bits of the segment id that hold a volume tag. For
+// ids generated without WithVolumeTaggedSegments they're random.
+func (s SegmentId) VolumeTag() uint32 {
+	return binary.BigEndian.Uint32(s[volumeTagOffset:])
+}
+
+// TaggedFor reports if the segment id carries the tag of the volume named
+// +vol+. An untagged id matches a given volume by chance, about one time in
+// four billion.
+func (s SegmentId) TaggedFor(vol string) bool {
+	return s.VolumeTag() == VolumeTag(vol)
+}
+
+func (s SegmentId) withVolumeTag(tag uint32) SegmentId {
+	binary.BigEndian.PutUint32(s[volumeTagOffset:], tag)
+	return s
+}
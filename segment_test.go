@@ -1,13 +1,17 @@
 package lsvd
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,6 +59,133 @@ func TestSegmentCreator(t *testing.T) {
 		r.NoError(err)
 	})
 
+	t.Run("restores zeroed ranges from the log", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "oc")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		path := filepath.Join(tmpdir, "log")
+
+		oc, err := NewSegmentCreator(log, "", path)
+		r.NoError(err)
+
+		for lba := LBA(0); lba < 6; lba++ {
+			r.NoError(oc.WriteExtent(testRandX.MapTo(lba)))
+		}
+
+		r.NoError(oc.WriteExtent(testEmptyX.MapTo(1)))
+		r.NoError(oc.ZeroBlocks(Extent{3, 2}))
+		r.NoError(oc.ZeroBlocks(Extent{5, 1}))
+
+		r.NoError(oc.builder.Sync())
+
+		oc2, err := NewSegmentCreator(log, "", path)
+		r.NoError(err)
+
+		r.Equal(oc.builder.extents, oc2.builder.extents)
+		r.Equal(oc.BodySize(), oc2.BodySize())
+
+		data := NewRangeData(ctx, Extent{0, 6})
+
+		_, err = oc2.FillExtent(ctx, data.View())
+		r.NoError(err)
+
+		for i, empty := range []bool{false, true, false, true, true, true} {
+			blk := data.ReadData()[i*BlockSize : (i+1)*BlockSize]
+			if empty {
+				r.True(emptyBytes(blk), "block %d", i)
+			} else {
+				blockEqual(t, testRandX, blk)
+			}
+		}
+	})
+
+	t.Run("resumes writing to a log that was cut short", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "oc")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		write := func(oc *SegmentCreator, from, to LBA) {
+			for lba := from; lba < to; lba++ {
+				switch lba % 4 {
+				case 0:
+					r.NoError(oc.WriteExtent(testRandX.MapTo(lba)))
+				case 1:
+					r.NoError(oc.WriteExtent(testExtent.MapTo(lba)))
+				case 2:
+					r.NoError(oc.WriteExtent(testEmptyX.MapTo(lba)))
+				default:
+					r.NoError(oc.ZeroBlocks(Extent{lba, 1}))
+				}
+			}
+		}
+
+		// What the log looks like if nothing goes wrong.
+		ref, err := NewSegmentCreator(log, "", filepath.Join(tmpdir, "ref"))
+		r.NoError(err)
+
+		defer ref.Close()
+
+		write(ref, 0, 20)
+
+		path := filepath.Join(tmpdir, "log")
+
+		oc, err := NewSegmentCreator(log, "", path)
+		r.NoError(err)
+
+		write(oc, 0, 12)
+		r.NoError(oc.builder.Sync())
+
+		// Crash partway through writing the next extent, which has data.
+		full, err := os.ReadFile(filepath.Join(tmpdir, "ref"))
+		r.NoError(err)
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		r.NoError(err)
+
+		_, err = f.Write(full[oc.BodySize() : oc.BodySize()+100])
+		r.NoError(err)
+		r.NoError(f.Close())
+
+		oc2, err := NewSegmentCreator(log, "", path)
+		r.NoError(err)
+
+		defer oc2.Close()
+
+		r.Equal(oc.BodySize(), oc2.BodySize())
+
+		write(oc2, 12, 20)
+		r.NoError(oc2.builder.Sync())
+
+		r.Equal(ref.BodySize(), oc2.BodySize())
+		r.Equal(ref.Entries(), oc2.Entries())
+		r.Equal(ref.TotalBlocks(), oc2.TotalBlocks())
+		r.Equal(ref.EmptyBlocks(), oc2.EmptyBlocks())
+		r.Equal(ref.InputBytes(), oc2.InputBytes())
+		r.Equal(ref.StorageBytes(), oc2.StorageBytes())
+		r.Equal(ref.CompressionRateHistogram(), oc2.CompressionRateHistogram())
+		r.Equal(ref.builder.extents, oc2.builder.extents)
+
+		resumed, err := os.ReadFile(path)
+		r.NoError(err)
+
+		r.Equal(full, resumed)
+
+		data := NewRangeData(ctx, Extent{0, 20})
+
+		_, err = oc2.FillExtent(ctx, data.View())
+		r.NoError(err)
+
+		blockEqual(t, testRandX, data.ReadData()[16*BlockSize:17*BlockSize])
+		blockEqual(t, testExtent, data.ReadData()[17*BlockSize:18*BlockSize])
+	})
+
 	t.Run("can serve reads from the write cache", func(t *testing.T) {
 		r := require.New(t)
 
@@ -136,4 +267,576 @@ func TestSegmentCreator(t *testing.T) {
 		r.Equal(Extent{48, 1}, ret[0])
 		r.Equal(Extent{49, 1}, ret[1])
 	})
+	t.Run("stores extents uncompressed below the minimum ratio", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithCompressionMinRatio(1e6))
+		r.NoError(err)
+
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.lba2pba.Resolve(log, Extent{LBA: 1, Blocks: 1}, nil)
+		r.NoError(err)
+		r.Len(pes, 1)
+
+		r.Equal(uint32(0), pes[0].RawSize)
+		r.Equal(uint32(BlockSize), pes[0].Size)
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+		r.NoError(err)
+		r.Equal(testData, data.ReadData())
+	})
+
+	t.Run("stores everything uncompressed without compression", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithoutCompression())
+		r.NoError(err)
+
+		defer d.Close(ctx)
+
+		empty := NewRangeData(ctx, Extent{LBA: 2, Blocks: 1})
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(d.WriteExtent(ctx, empty.View()))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(3)))
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.lba2pba.Resolve(log, Extent{LBA: 1, Blocks: 3}, nil)
+		r.NoError(err)
+		r.Len(pes, 3)
+
+		r.Equal(FlagUncompressed, pes[0].Flags())
+		r.Equal(uint32(BlockSize), pes[0].Size)
+		r.Equal(FlagEmpty, pes[1].Flags())
+		r.Equal(FlagUncompressed, pes[2].Flags())
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 3})
+		r.NoError(err)
+
+		r.Equal(testData, data.ReadData()[:BlockSize])
+		r.True(isEmpty(data.ReadData()[BlockSize : 2*BlockSize]))
+		r.Equal(testRand, data.ReadData()[2*BlockSize:])
+	})
+
+	t.Run("splits large writes into extents no larger than the maximum", func(t *testing.T) {
+		for _, size := range []int{0, 64 * 1024} {
+			r := require.New(t)
+
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			r.NoError(err)
+
+			defer os.RemoveAll(tmpdir)
+
+			d, err := NewDisk(ctx, log, tmpdir, WithMaxExtentSize(size))
+			r.NoError(err)
+
+			defer d.Close(ctx)
+
+			limit := size
+			if limit == 0 {
+				limit = DefaultMaxExtentSize
+			}
+
+			rng := Extent{LBA: 10, Blocks: uint32(2*limit/BlockSize + 3)}
+
+			data := make([]byte, rng.ByteSize())
+			_, err = io.ReadFull(rand.Reader, data)
+			r.NoError(err)
+
+			r.NoError(d.WriteExtent(ctx, MapRangeData(rng, data).View()))
+			r.NoError(d.CloseSegment(ctx))
+
+			pes, err := d.lba2pba.Resolve(log, rng, nil)
+			r.NoError(err)
+			r.Len(pes, 3)
+
+			for _, pe := range pes {
+				r.LessOrEqual(int(pe.Size), limit)
+				r.LessOrEqual(pe.ByteSize(), limit)
+			}
+
+			read, err := d.ReadExtent(ctx, rng)
+			r.NoError(err)
+			r.Equal(data, read.ReadData())
+		}
+	})
+
+	t.Run("splits writes at long runs of zero blocks", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithZeroRunSplit(2))
+		r.NoError(err)
+
+		defer d.Close(ctx)
+
+		// Data, 3 zero blocks, data, a single zero block, data.
+		rng := Extent{LBA: 10, Blocks: 8}
+		data := make([]byte, rng.ByteSize())
+
+		for _, i := range []int{0, 1, 5, 7} {
+			copy(data[i*BlockSize:], testData)
+		}
+
+		counts, err := d.WriteExtentCounted(ctx, MapRangeData(rng, data).View())
+		r.NoError(err)
+		r.Equal(WriteCounts{Blocks: 5, EmptyBlocks: 3}, counts)
+
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.lba2pba.Resolve(log, rng, nil)
+		r.NoError(err)
+		r.Len(pes, 3)
+
+		r.Equal(Extent{LBA: 10, Blocks: 2}, pes[0].Live)
+		r.Equal(FlagLZ4, pes[0].Flags())
+
+		r.Equal(Extent{LBA: 12, Blocks: 3}, pes[1].Live)
+		r.Zero(pes[1].Size)
+
+		// The single zero block stays in the extent around it.
+		r.Equal(Extent{LBA: 15, Blocks: 3}, pes[2].Live)
+		r.Equal(FlagLZ4, pes[2].Flags())
+
+		read, err := d.ReadExtent(ctx, rng)
+		r.NoError(err)
+		r.Equal(data, read.ReadData())
+	})
+
+	t.Run("stops compressing after consistently incompressible data", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "oc")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		oc, err := NewSegmentCreator(log, "", filepath.Join(tmpdir, "log"))
+		r.NoError(err)
+
+		lastHeader := func() ExtentHeader {
+			return oc.builder.extents[len(oc.builder.extents)-1]
+		}
+
+		r.NoError(oc.WriteExtent(testExtent.MapTo(0)))
+		r.NotZero(lastHeader().RawSize)
+
+		var lba LBA = 1
+
+		for i := 0; i < compressionMissLimit; i++ {
+			r.NoError(oc.WriteExtent(testRandX.MapTo(lba)))
+			lba++
+		}
+
+		// Compressible, but stored as is because compression is being skipped.
+		r.NoError(oc.WriteExtent(testExtent.MapTo(lba)))
+		r.Zero(lastHeader().RawSize)
+
+		req := NewRangeData(ctx, Extent{LBA: lba, Blocks: 1})
+
+		_, err = oc.FillExtent(ctx, req.View())
+		r.NoError(err)
+		r.Equal(testData, req.ReadData())
+
+		lba++
+
+		for i := 1; i < compressionSkipExtents; i++ {
+			r.NoError(oc.WriteExtent(testRandX.MapTo(lba)))
+			lba++
+		}
+
+		r.NoError(oc.WriteExtent(testExtent.MapTo(lba)))
+		r.NotZero(lastHeader().RawSize)
+	})
+
+	t.Run("round trips each flag through a segment", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(d.ZeroBlocks(ctx, Extent{2, 1}))
+
+		tests := []struct {
+			lba   LBA
+			flags Flags
+			data  []byte
+		}{
+			{0, FlagUncompressed, testRand},
+			{1, FlagLZ4, testData},
+			{2, FlagEmpty, testEmpty},
+		}
+
+		check := func(em *ExtentMap) {
+			for _, tt := range tests {
+				pes, err := em.Resolve(log, Extent{LBA: tt.lba, Blocks: 1}, nil)
+				r.NoError(err)
+				r.Len(pes, 1)
+
+				r.Equal(tt.flags, pes[0].Flags(), "lba %d", tt.lba)
+
+				data, err := d.ReadExtent(ctx, Extent{LBA: tt.lba, Blocks: 1})
+				r.NoError(err)
+				r.Equal(tt.data, data.ReadData(), "lba %d", tt.lba)
+			}
+		}
+
+		check(d.curOC.em)
+
+		r.NoError(d.CloseSegment(ctx))
+
+		check(d.lba2pba)
+	})
+
+	t.Run("leaves out extents overwritten before the flush", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(1)))
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.lba2pba.Resolve(log, Extent{LBA: 1, Blocks: 1}, nil)
+		r.NoError(err)
+		r.Len(pes, 1)
+
+		path := filepath.Join(tmpdir, "segments", "segment."+pes[0].Segment.String())
+
+		hdr, err := ReadSegmentHeader(path)
+		r.NoError(err)
+		r.Equal(uint32(1), hdr.ExtentCount)
+
+		// Only the data of the second write is in the body.
+		fi, err := os.Stat(path)
+		r.NoError(err)
+		r.Equal(int64(hdr.DataOffset+pes[0].Size), fi.Size())
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 1, Blocks: 1})
+		r.NoError(err)
+		r.Equal(testData2, data.ReadData())
+	})
+
+	t.Run("flushes the data in the log back to back", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "oc")
+		r.NoError(err)
+
+		defer os.RemoveAll(tmpdir)
+
+		path := filepath.Join(tmpdir, "log")
+
+		oc, err := NewSegmentCreator(log, "test", path)
+		r.NoError(err)
+
+		defer oc.Close()
+
+		for lba := LBA(0); lba < 4; lba++ {
+			r.NoError(oc.WriteExtent(testRandX.MapTo(lba)))
+		}
+
+		r.NoError(oc.WriteExtent(testExtent.MapTo(10)))
+		r.NoError(oc.ZeroBlocks(Extent{20, 5}))
+
+		sa := newMemAccess()
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "test"}))
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		_, stats, err := oc.Flush(ctx, sa, seg)
+		r.NoError(err)
+
+		logData, err := os.ReadFile(path)
+		r.NoError(err)
+
+		// The layout as if the whole segment had been built in memory, without
+		// the extent headers the log has between the data.
+		var expected bytes.Buffer
+
+		r.NoError(SegmentHeader{
+			ExtentCount: uint32(oc.Entries()),
+			DataOffset:  stats.DataOffset,
+		}.Write(&expected))
+
+		expected.Write(oc.builder.header.Bytes())
+
+		for _, eh := range oc.builder.extents {
+			expected.Write(logData[eh.Offset : eh.Offset+eh.Size])
+		}
+
+		r.Equal(expected.Bytes(), sa.segments[seg])
+	})
+}
+
+func BenchmarkWriteIncompressible(b *testing.B) {
+	log := logger.New(logger.Info)
+
+	bench := func(b *testing.B, adaptive bool) {
+		tmpdir, err := os.MkdirTemp("", "oc")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer os.RemoveAll(tmpdir)
+
+		oc, err := NewSegmentCreator(log, "", filepath.Join(tmpdir, "log"))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer oc.Close()
+
+		data := testRandX.MapTo(0)
+
+		b.SetBytes(BlockSize)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if !adaptive {
+				oc.builder.compSkip = 0
+			}
+
+			_, _, err := oc.builder.WriteExtent(log, data.View())
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("always-compress", func(b *testing.B) { bench(b, false) })
+	b.Run("adaptive", func(b *testing.B) { bench(b, true) })
+}
+
+func BenchmarkWriteWithoutCompression(b *testing.B) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+	defer ctx.Close()
+
+	// 64k extents of random data, so that compression is tried and never
+	// kept.
+	const blocks = 16
+
+	data := make([]byte, blocks*BlockSize)
+	_, err := io.ReadFull(rand.Reader, data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	bench := func(b *testing.B, options ...Option) {
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, options...)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		defer d.Close(ctx)
+
+		b.SetBytes(int64(len(data)))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			rng := Extent{LBA: LBA(i%1024) * blocks, Blocks: blocks}
+
+			err := d.WriteExtent(ctx, MapRangeData(rng, data).View())
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("compressed", func(b *testing.B) { bench(b) })
+	b.Run("uncompressed", func(b *testing.B) { bench(b, WithoutCompression()) })
+}
+
+// BenchmarkCompressionGrouping reports the storage ratio of compressing each
+// block on its own, each write as a unit, and the data between runs of zeros
+// as units. It uses the first 16MB of the image at $LSVD_BENCH_IMAGE if set,
+// or else generated text with runs of zeros.
+func BenchmarkCompressionGrouping(b *testing.B) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+	defer ctx.Close()
+
+	const writeBlocks = 64
+
+	var image []byte
+
+	if path := os.Getenv("LSVD_BENCH_IMAGE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		image, err = io.ReadAll(io.LimitReader(f, 16*1024*1024))
+		f.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		image = image[:len(image)/(writeBlocks*BlockSize)*writeBlocks*BlockSize]
+	} else {
+		var buf bytes.Buffer
+
+		for blk := 0; blk < 4096; blk++ {
+			start := buf.Len()
+
+			if blk%16 < 5 {
+				buf.Write(make([]byte, BlockSize))
+				continue
+			}
+
+			for line := 0; buf.Len()-start < BlockSize; line++ {
+				fmt.Fprintf(&buf, "option.%d.%d = enabled # set by host %d\n", blk%7, line, blk/64)
+			}
+
+			buf.Truncate(start + BlockSize)
+		}
+
+		image = buf.Bytes()
+	}
+
+	if len(image) == 0 {
+		b.Skip("image is smaller than a write")
+	}
+
+	bench := func(b *testing.B, options ...Option) {
+		var ratio float64
+
+		for i := 0; i < b.N; i++ {
+			tmpdir, err := os.MkdirTemp("", "lsvd")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			d, err := NewDisk(ctx, log, tmpdir, options...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for off := 0; off < len(image); off += writeBlocks * BlockSize {
+				rng := Extent{LBA: LBA(off / BlockSize), Blocks: writeBlocks}
+
+				err := d.WriteExtent(ctx, MapRangeData(rng, image[off:off+rng.ByteSize()]).View())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			ratio = float64(len(image)) / float64(d.curOC.BodySize())
+
+			d.Close(ctx)
+			os.RemoveAll(tmpdir)
+		}
+
+		b.SetBytes(int64(len(image)))
+		b.ReportMetric(ratio, "ratio")
+	}
+
+	b.Run("per-block", func(b *testing.B) { bench(b, WithMaxExtentSize(BlockSize)) })
+	b.Run("per-write", func(b *testing.B) { bench(b) })
+	b.Run("zero-runs", func(b *testing.B) { bench(b, WithZeroRunSplit(4)) })
+}
+
+// discardUploads is a memAccess that drops segment data, so that uploading
+// doesn't count towards the allocations of the segment flushed.
+type discardUploads struct {
+	*memAccess
+}
+
+func (d discardUploads) UploadSegment(ctx context.Context, seg SegmentId, f *os.File) error {
+	_, err := io.Copy(io.Discard, f)
+	return err
+}
+
+func BenchmarkFlushSmallExtents(b *testing.B) {
+	log := logger.New(logger.Warn)
+
+	ctx := NewContext(context.Background())
+
+	tmpdir, err := os.MkdirTemp("", "oc")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdir)
+
+	oc, err := NewSegmentCreator(log, "test", filepath.Join(tmpdir, "log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer oc.Close()
+
+	for lba := LBA(0); lba < 20000; lba += 2 {
+		err = oc.WriteExtent(testExtent.MapTo(lba))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	sa := discardUploads{newMemAccess()}
+
+	err = sa.InitVolume(ctx, &VolumeInfo{Name: "test"})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// Start from an empty header buffer, as a new builder would.
+		oc.builder.header = bytes.Buffer{}
+
+		seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+		_, _, err := oc.Flush(ctx, sa, seg)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -1,9 +1,11 @@
 package lsvd
 
 import (
+	"context"
 	"slices"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/lab47/lsvd/logger"
@@ -33,6 +35,9 @@ func (s *Segments) SegmentIds() []SegmentId {
 }
 
 func (s *Segments) LiveSegments() []SegmentId {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
 	var ret []SegmentId
 
 	for k, s := range s.segments {
@@ -96,9 +101,19 @@ func (s *Segments) Create(segId SegmentId, stats *SegmentStats) {
 	s.segmentsMu.Lock()
 	defer s.segmentsMu.Unlock()
 
+	meta := stats.SegmentMetadata
+
+	// Segments written before metadata was recorded fall back to
+	// the time in their id.
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = segId.Time()
+	}
+
 	s.segments[segId] = &Segment{
-		Size: stats.Blocks,
-		Used: stats.Blocks,
+		Size:            stats.Blocks,
+		Used:            stats.Blocks,
+		Bytes:           stats.TotalBytes,
+		SegmentMetadata: meta,
 	}
 }
 
@@ -106,10 +121,134 @@ func (s *Segments) SetSegment(segId SegmentId, total, used uint64) {
 	s.segmentsMu.Lock()
 	defer s.segmentsMu.Unlock()
 
+	if seg, ok := s.segments[segId]; ok {
+		seg.Size = total
+		seg.Used = used
+		return
+	}
+
 	s.segments[segId] = &Segment{
-		Size: total,
-		Used: used,
+		Size:            total,
+		Used:            used,
+		SegmentMetadata: SegmentMetadata{CreatedAt: segId.Time()},
+	}
+}
+
+// Metadata returns the metadata recorded for the segment.
+func (s *Segments) Metadata(segId SegmentId) (SegmentMetadata, bool) {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	seg, ok := s.segments[segId]
+	if !ok {
+		return SegmentMetadata{}, false
+	}
+
+	return seg.SegmentMetadata, true
+}
+
+// CreatedBefore returns the live segments created before t, oldest first.
+func (s *Segments) CreatedBefore(t time.Time) []SegmentId {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	var ret []SegmentId
+
+	for _, segId := range s.sortedSegments() {
+		seg := s.segments[segId]
+		if seg.deleted {
+			continue
+		}
+
+		if seg.CreatedAt.Before(t) {
+			ret = append(ret, segId)
+		}
+	}
+
+	slices.SortStableFunc(ret, func(a, b SegmentId) int {
+		return s.segments[a].CreatedAt.Compare(s.segments[b].CreatedAt)
+	})
+
+	return ret
+}
+
+// SegmentInfo describes one of the volume's segments, see
+// Disk.ListSegmentInfo.
+type SegmentInfo struct {
+	Id        SegmentId
+	CreatedAt time.Time
+	WriterId  string
+
+	// How many blocks the segment holds, and how many of those are still
+	// live rather than overwritten.
+	TotalBlocks uint64
+	LiveBlocks  uint64
+
+	// The size of the segment in storage, and that size relative to the
+	// blocks it holds, which is below 1 when compression saved space. Both are
+	// 0 if the size isn't known, as for segments loaded from an older head.map.
+	Bytes        uint64
+	StorageRatio float64
+}
+
+// Info returns the info of the live segments, ordered by id.
+func (s *Segments) Info() []SegmentInfo {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	var ret []SegmentInfo
+
+	for _, segId := range s.sortedSegments() {
+		seg := s.segments[segId]
+		if seg.deleted {
+			continue
+		}
+
+		si := SegmentInfo{
+			Id:          segId,
+			CreatedAt:   seg.CreatedAt,
+			WriterId:    seg.WriterId,
+			TotalBlocks: seg.Size,
+			LiveBlocks:  seg.Used,
+			Bytes:       seg.Bytes,
+		}
+
+		if seg.Size > 0 {
+			si.StorageRatio = float64(seg.Bytes) / float64(seg.Size*BlockSize)
+		}
+
+		ret = append(ret, si)
 	}
+
+	return ret
+}
+
+// ListSegmentInfo returns the info of the volume's segments, ordered by id.
+// It only uses what's already tracked about each segment, so no segments are
+// read.
+func (d *Disk) ListSegmentInfo(ctx context.Context) ([]SegmentInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return d.s.Info(), nil
+}
+
+// WrittenBy returns the live segments whose metadata records +writerId+.
+func (s *Segments) WrittenBy(writerId string) []SegmentId {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	var ret []SegmentId
+
+	for _, segId := range s.sortedSegments() {
+		seg := s.segments[segId]
+		if !seg.deleted && seg.WriterId == writerId {
+			ret = append(ret, segId)
+		}
+	}
+
+	return ret
 }
 
 func (s *Segments) CreateOrUpdate(segId SegmentId, usedBlocks uint64) {
@@ -127,6 +266,9 @@ func (s *Segments) CreateOrUpdate(segId SegmentId, usedBlocks uint64) {
 	}
 }
 
+// UpdateUsage removes the blocks in +affected+, which were overwritten by
+// segment +self+, from the used counts of their segments. Any other segment
+// left without used blocks is marked deleted.
 func (s *Segments) UpdateUsage(log logger.Logger, self SegmentId, affected []PartialExtent) {
 	s.segmentsMu.Lock()
 	defer s.segmentsMu.Unlock()
@@ -152,7 +294,22 @@ func (s *Segments) UpdateUsage(log logger.Logger, self SegmentId, affected []Par
 				seg.cleared = append(seg.cleared, rng)
 			}
 
-			seg.Used -= uint64(rng.Blocks)
+			blocks := uint64(rng.Blocks)
+			if blocks > seg.Used {
+				if r.Segment != self {
+					log.Warn("segment usage would drop below zero", "segment", r.Segment, "used", seg.Used, "blocks", blocks)
+				}
+				blocks = seg.Used
+			}
+
+			seg.Used -= blocks
+
+			// Nothing in the segment is live anymore, so it can be removed on
+			// the next cleanup rather than waiting for GC to find it.
+			if seg.Used == 0 && r.Segment != self {
+				log.Debug("segment fully overwritten, marking deleted", "segment", r.Segment)
+				seg.deleted = true
+			}
 		} else {
 			if _, seen := warnedSegments[r.Segment]; !seen {
 				log.Warn("missing segment during usage update", "id", r.Segment.String())
@@ -252,19 +409,125 @@ func (s *Segments) SetDeleted(segId SegmentId, log logger.Logger) {
 	seg, ok := s.segments[segId]
 	if ok {
 		seg.deleted = true
+
+		// Nothing in the map uses it anymore, which Unpin relies on to tell
+		// if the flush that pinned it added uses.
+		if seg.pins > 0 {
+			seg.Used = 0
+		}
 	} else {
 		log.Warn("missing segment to set deleted", "seg", segId)
 	}
 }
 
+// Pin keeps +segId+ from being removed until it's unpinned, for a flush that
+// refers to data in it. It reports false if the segment isn't live. If the
+// segment is deleted while pinned, such as by GC moving the data it held, it's
+// revived on Unpin if the flush added uses of it.
+func (s *Segments) Pin(segId SegmentId) bool {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	seg, ok := s.segments[segId]
+	if !ok || seg.deleted {
+		return false
+	}
+
+	seg.pins++
+
+	return true
+}
+
+// Unpin releases a pin taken by Pin.
+func (s *Segments) Unpin(segId SegmentId) {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	seg, ok := s.segments[segId]
+	if !ok || seg.pins == 0 {
+		return
+	}
+
+	seg.pins--
+
+	if seg.pins == 0 && seg.deleted && seg.Used > 0 {
+		seg.deleted = false
+	}
+}
+
+// AddReference counts the +blocks+ of +segId+ that a reference to its data
+// uses, reviving the segment if overwriting the rest of its data marked it
+// deleted. It reports false if the segment isn't in the volume anymore.
+func (s *Segments) AddReference(segId SegmentId, blocks uint64) bool {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	seg, ok := s.segments[segId]
+	if !ok {
+		return false
+	}
+
+	seg.Used += blocks
+	seg.deleted = false
+
+	return true
+}
+
+// SetRefs records that +segId+ has references to data in +refs+.
+func (s *Segments) SetRefs(segId SegmentId, refs []SegmentId) {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	if seg, ok := s.segments[segId]; ok {
+		seg.refs = refs
+	}
+}
+
+// Referrers returns the segments with references to data in +segId+.
+func (s *Segments) Referrers(segId SegmentId) []SegmentId {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	var ret []SegmentId
+
+	for id, seg := range s.segments {
+		if slices.Contains(seg.refs, segId) {
+			ret = append(ret, id)
+		}
+	}
+
+	return ret
+}
+
+// removable reports if a deleted segment can be removed. A segment with
+// references has to be kept while the segments they point to are live, as
+// reading it is what maps their data again when the map is rebuilt. Once
+// those segments are deleted, everything the references mapped has been
+// overwritten or moved by GC into a newer segment.
+func (s *Segments) removable(seg *Segment) bool {
+	if seg.pins > 0 {
+		return false
+	}
+
+	for _, id := range seg.refs {
+		if ref, ok := s.segments[id]; ok && !ref.deleted {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FindDeleted returns the deleted segments that can be removed, forgetting
+// them.
 func (s *Segments) FindDeleted() []SegmentId {
 	s.segmentsMu.Lock()
 	defer s.segmentsMu.Unlock()
 
 	var toDelete []SegmentId
 
-	for i, s := range s.segments {
-		if s.deleted {
+	for i, seg := range s.segments {
+		if seg.deleted && s.removable(seg) {
 			toDelete = append(toDelete, i)
 		}
 	}
@@ -380,3 +643,34 @@ func (d *Segments) PickSegmentToGC(log logger.Logger, min float64, skip []Segmen
 
 	return smallestId, true, nil
 }
+
+// IsLive reports if +segId+ is one of the live segments of the volume.
+func (s *Segments) IsLive(segId SegmentId) bool {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	seg, ok := s.segments[segId]
+
+	return ok && !seg.deleted
+}
+
+// Newest returns the segment with the greatest id, deleted or not, and its
+// metadata. The id is zero if there are no segments.
+func (s *Segments) Newest() (SegmentId, SegmentMetadata) {
+	s.segmentsMu.Lock()
+	defer s.segmentsMu.Unlock()
+
+	var (
+		newest SegmentId
+		meta   SegmentMetadata
+	)
+
+	for k, seg := range s.segments {
+		if ulid.ULID(k).Compare(ulid.ULID(newest)) > 0 {
+			newest = k
+			meta = seg.SegmentMetadata
+		}
+	}
+
+	return newest, meta
+}
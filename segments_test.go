@@ -0,0 +1,109 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListSegmentInfo(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := NewContext(context.Background())
+
+	r := require.New(t)
+
+	tmpdir, err := os.MkdirTemp("", "lsvd")
+	r.NoError(err)
+	defer os.RemoveAll(tmpdir)
+
+	clk := newFakeClock(time.Now().Truncate(time.Second))
+
+	open := func() *Disk {
+		d, err := NewDisk(ctx, log, tmpdir, WithClock(clk), WithWriterId("writer-1"))
+		r.NoError(err)
+		return d
+	}
+
+	d := open()
+
+	var created []time.Time
+
+	flush := func() {
+		created = append(created, clk.Now())
+		r.NoError(d.CloseSegment(ctx))
+		clk.Add(time.Minute)
+	}
+
+	for i := 0; i < 3; i++ {
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+	}
+	flush()
+
+	r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+	flush()
+
+	r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 10, Blocks: 2}))
+	flush()
+
+	segs, err := d.sa.ListSegments(ctx, d.volName)
+	r.NoError(err)
+	r.Len(segs, 3)
+
+	check := func(infos []SegmentInfo) {
+		r.Len(infos, 3)
+
+		for i, info := range infos {
+			r.Equal(segs[i], info.Id)
+			r.Equal("writer-1", info.WriterId)
+			r.True(created[i].Equal(info.CreatedAt), "expected %s, got %s", created[i], info.CreatedAt)
+
+			fi, err := os.Stat(filepath.Join(tmpdir, "segments", "segment."+ulid.ULID(segs[i]).String()))
+			r.NoError(err)
+			r.Equal(uint64(fi.Size()), info.Bytes)
+		}
+
+		r.Equal(uint64(3), infos[0].TotalBlocks)
+		r.Equal(uint64(2), infos[0].LiveBlocks)
+		r.Greater(infos[0].StorageRatio, 1.0)
+
+		r.Equal(uint64(1), infos[1].TotalBlocks)
+		r.Equal(uint64(1), infos[1].LiveBlocks)
+		r.Less(infos[1].StorageRatio, 1.0)
+
+		r.Equal(uint64(2), infos[2].TotalBlocks)
+		r.Equal(uint64(2), infos[2].LiveBlocks)
+		r.Less(infos[2].StorageRatio, 1.0)
+	}
+
+	infos, err := d.ListSegmentInfo(ctx)
+	r.NoError(err)
+	check(infos)
+
+	r.NoError(d.Close(ctx))
+
+	// From the saved LBA map.
+	d = open()
+
+	infos, err = d.ListSegmentInfo(ctx)
+	r.NoError(err)
+	check(infos)
+
+	r.NoError(d.Close(ctx))
+
+	// Rebuilt from the segments.
+	r.NoError(os.Remove(filepath.Join(tmpdir, "head.map")))
+
+	d = open()
+	defer d.Close(ctx)
+
+	infos, err = d.ListSegmentInfo(ctx)
+	r.NoError(err)
+	check(infos)
+}
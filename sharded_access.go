@@ -0,0 +1,207 @@
+package lsvd
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+)
+
+// ShardedAccess spreads segments over several SegmentAccess backends, such as
+// S3Access instances for different buckets, to get past the throughput
+// limits of any one of them. Each segment is routed to a shard by hashing
+// its id, and the shard records the segment in its own copy of the volume's
+// segment list. ListSegments merges those lists back into a single one. The
+// volume info and metadata, such as the LBA map cache and snapshots, are only
+// kept in the first shard.
+//
+// The number and order of the shards is part of the layout of the volume:
+// changing it changes where segments are routed to. Because every shard
+// lists the segments it holds, ListSegments still returns all of them after
+// such a change, but OpenSegment and RemoveSegment will look for them in the
+// wrong shard. To change the shards, move each segment listed by a shard
+// whose id now routes elsewhere to its new shard (WriteSegment and
+// AppendToSegments there, then RemoveSegmentFromVolume and RemoveSegment
+// on the old one) before opening the volume with the new shards.
+type ShardedAccess struct {
+	shards []SegmentAccess
+}
+
+var (
+	_ SegmentAccess       = (*ShardedAccess)(nil)
+	_ SegmentBatchRemover = (*ShardedAccess)(nil)
+	_ SegmentSizer        = (*ShardedAccess)(nil)
+)
+
+func NewShardedAccess(shards ...SegmentAccess) (*ShardedAccess, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("sharded access requires at least one shard")
+	}
+
+	return &ShardedAccess{shards: shards}, nil
+}
+
+// ShardFor returns the index of the shard that holds +seg+.
+func (s *ShardedAccess) ShardFor(seg SegmentId) int {
+	h := fnv.New32a()
+	h.Write(seg[:])
+
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *ShardedAccess) shard(seg SegmentId) SegmentAccess {
+	return s.shards[s.ShardFor(seg)]
+}
+
+func (s *ShardedAccess) primary() SegmentAccess {
+	return s.shards[0]
+}
+
+func (s *ShardedAccess) InitContainer(ctx context.Context) error {
+	for i, sa := range s.shards {
+		err := sa.InitContainer(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "initializing shard %d", i)
+		}
+	}
+
+	return nil
+}
+
+func (s *ShardedAccess) InitVolume(ctx context.Context, vol *VolumeInfo) error {
+	for i, sa := range s.shards {
+		err := sa.InitVolume(ctx, vol)
+		if err != nil {
+			return errors.Wrapf(err, "initializing volume on shard %d", i)
+		}
+	}
+
+	return nil
+}
+
+// UpdateVolumeInfo updates the info of +vol+ on every shard that supports it.
+func (s *ShardedAccess) UpdateVolumeInfo(ctx context.Context, vol *VolumeInfo) error {
+	for i, sa := range s.shards {
+		vu, ok := sa.(VolumeInfoUpdater)
+		if !ok {
+			continue
+		}
+
+		err := vu.UpdateVolumeInfo(ctx, vol)
+		if err != nil {
+			return errors.Wrapf(err, "updating volume on shard %d", i)
+		}
+	}
+
+	return nil
+}
+
+func (s *ShardedAccess) ListVolumes(ctx context.Context) ([]string, error) {
+	return s.primary().ListVolumes(ctx)
+}
+
+func (s *ShardedAccess) GetVolumeInfo(ctx context.Context, vol string) (*VolumeInfo, error) {
+	return s.primary().GetVolumeInfo(ctx, vol)
+}
+
+// ListSegments returns the segments of +vol+ across all the shards, ordered
+// by id, which is the order they were written in.
+func (s *ShardedAccess) ListSegments(ctx context.Context, vol string) ([]SegmentId, error) {
+	var out []SegmentId
+
+	for i, sa := range s.shards {
+		segments, err := sa.ListSegments(ctx, vol)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing segments on shard %d", i)
+		}
+
+		out = append(out, segments...)
+	}
+
+	slices.SortFunc(out, func(a, b SegmentId) int {
+		return ulid.ULID(a).Compare(ulid.ULID(b))
+	})
+
+	return slices.Compact(out), nil
+}
+
+func (s *ShardedAccess) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	return s.shard(seg).OpenSegment(ctx, seg)
+}
+
+func (s *ShardedAccess) StreamSegment(ctx context.Context, seg SegmentId) (io.ReadCloser, int64, error) {
+	return StreamSegment(ctx, s.shard(seg), seg)
+}
+
+func (s *ShardedAccess) SegmentSize(ctx context.Context, seg SegmentId) (int64, error) {
+	return SegmentSize(ctx, s.shard(seg), seg)
+}
+
+func (s *ShardedAccess) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteCloser, error) {
+	return s.shard(seg).WriteSegment(ctx, seg)
+}
+
+func (s *ShardedAccess) UploadSegment(ctx context.Context, seg SegmentId, f *os.File) error {
+	return s.shard(seg).UploadSegment(ctx, seg, f)
+}
+
+func (s *ShardedAccess) RemoveSegment(ctx context.Context, seg SegmentId) error {
+	return s.shard(seg).RemoveSegment(ctx, seg)
+}
+
+// RemoveSegments removes +segs+ from their shards, a batch per shard.
+func (s *ShardedAccess) RemoveSegments(ctx context.Context, segs []SegmentId) error {
+	for i, shardSegs := range s.byShard(segs) {
+		err := RemoveSegments(ctx, s.shards[i], shardSegs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ShardedAccess) AppendToSegments(ctx context.Context, vol string, seg SegmentId) error {
+	return s.shard(seg).AppendToSegments(ctx, vol, seg)
+}
+
+func (s *ShardedAccess) RemoveSegmentFromVolume(ctx context.Context, vol string, seg SegmentId) error {
+	return s.shard(seg).RemoveSegmentFromVolume(ctx, vol, seg)
+}
+
+// RemoveSegmentsFromVolume removes +segs+ from the lists of the shards they're
+// routed to, updating each list once.
+func (s *ShardedAccess) RemoveSegmentsFromVolume(ctx context.Context, vol string, segs []SegmentId) error {
+	for i, shardSegs := range s.byShard(segs) {
+		err := RemoveSegmentsFromVolume(ctx, s.shards[i], vol, shardSegs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// byShard groups +segs+ by the index of the shard they're routed to.
+func (s *ShardedAccess) byShard(segs []SegmentId) [][]SegmentId {
+	groups := make([][]SegmentId, len(s.shards))
+
+	for _, seg := range segs {
+		i := s.ShardFor(seg)
+		groups[i] = append(groups[i], seg)
+	}
+
+	return groups
+}
+
+func (s *ShardedAccess) WriteMetadata(ctx context.Context, vol, name string) (io.WriteCloser, error) {
+	return s.primary().WriteMetadata(ctx, vol, name)
+}
+
+func (s *ShardedAccess) ReadMetadata(ctx context.Context, vol, name string) (io.ReadCloser, error) {
+	return s.primary().ReadMetadata(ctx, vol, name)
+}
@@ -0,0 +1,455 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// memAccess is a SegmentAccess that keeps everything in memory.
+type memAccess struct {
+	mu       sync.Mutex
+	segments map[SegmentId][]byte
+	volumes  map[string]*memVolume
+}
+
+type memVolume struct {
+	info     VolumeInfo
+	segments []SegmentId
+	metadata map[string][]byte
+}
+
+var (
+	_ SegmentAccess = (*memAccess)(nil)
+	_ SegmentSizer  = (*memAccess)(nil)
+)
+
+func newMemAccess() *memAccess {
+	return &memAccess{
+		segments: map[SegmentId][]byte{},
+		volumes:  map[string]*memVolume{},
+	}
+}
+
+func (m *memAccess) hasSegment(seg SegmentId) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.segments[seg]
+	return ok
+}
+
+func (m *memAccess) volume(vol string) (*memVolume, error) {
+	v, ok := m.volumes[vol]
+	if !ok {
+		return nil, fmt.Errorf("unknown volume: %s", vol)
+	}
+
+	return v, nil
+}
+
+func (m *memAccess) InitContainer(ctx context.Context) error {
+	return nil
+}
+
+func (m *memAccess) InitVolume(ctx context.Context, vol *VolumeInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.volumes[vol.Name]; !ok {
+		m.volumes[vol.Name] = &memVolume{info: *vol, metadata: map[string][]byte{}}
+	}
+
+	return nil
+}
+
+func (m *memAccess) UpdateVolumeInfo(ctx context.Context, vol *VolumeInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, err := m.volume(vol.Name)
+	if err != nil {
+		return err
+	}
+
+	v.info = *vol
+	return nil
+}
+
+func (m *memAccess) ListVolumes(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []string
+	for name := range m.volumes {
+		out = append(out, name)
+	}
+
+	slices.Sort(out)
+
+	return out, nil
+}
+
+func (m *memAccess) GetVolumeInfo(ctx context.Context, vol string) (*VolumeInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, err := m.volume(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	vi := v.info
+	return &vi, nil
+}
+
+func (m *memAccess) ListSegments(ctx context.Context, vol string) ([]SegmentId, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.volumes[vol]
+	if !ok {
+		return nil, nil
+	}
+
+	return slices.Clone(v.segments), nil
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error {
+	return nil
+}
+
+func (m *memAccess) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.segments[seg]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return memReader{bytes.NewReader(data)}, nil
+}
+
+func (m *memAccess) SegmentSize(ctx context.Context, seg SegmentId) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.segments[seg]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+
+	return int64(len(data)), nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	done func([]byte)
+}
+
+func (w *memWriter) Close() error {
+	w.done(w.Bytes())
+	return nil
+}
+
+func (m *memAccess) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteCloser, error) {
+	return &memWriter{done: func(b []byte) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.segments[seg] = b
+	}}, nil
+}
+
+func (m *memAccess) UploadSegment(ctx context.Context, seg SegmentId, f *os.File) error {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.segments[seg] = data
+
+	return nil
+}
+
+func (m *memAccess) RemoveSegment(ctx context.Context, seg SegmentId) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.segments[seg]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(m.segments, seg)
+
+	return nil
+}
+
+func (m *memAccess) RemoveSegmentFromVolume(ctx context.Context, vol string, seg SegmentId) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, err := m.volume(vol)
+	if err != nil {
+		return err
+	}
+
+	v.segments = slices.DeleteFunc(v.segments, func(s SegmentId) bool {
+		return s == seg
+	})
+
+	return nil
+}
+
+func (m *memAccess) WriteMetadata(ctx context.Context, vol, name string) (io.WriteCloser, error) {
+	return &memWriter{done: func(b []byte) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if v, ok := m.volumes[vol]; ok {
+			v.metadata[name] = b
+		}
+	}}, nil
+}
+
+func (m *memAccess) ReadMetadata(ctx context.Context, vol, name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, err := m.volume(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := v.metadata[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memAccess) AppendToSegments(ctx context.Context, vol string, seg SegmentId) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, err := m.volume(vol)
+	if err != nil {
+		return err
+	}
+
+	v.segments = append(v.segments, seg)
+
+	return nil
+}
+
+func TestShardedAccess(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	newShards := func() []*memAccess {
+		return []*memAccess{newMemAccess(), newMemAccess(), newMemAccess()}
+	}
+
+	asAccess := func(shards []*memAccess) []SegmentAccess {
+		var out []SegmentAccess
+		for _, s := range shards {
+			out = append(out, s)
+		}
+
+		return out
+	}
+
+	t.Run("routes segments to a single shard", func(t *testing.T) {
+		r := require.New(t)
+
+		shards := newShards()
+
+		sa, err := NewShardedAccess(asAccess(shards)...)
+		r.NoError(err)
+
+		r.NoError(sa.InitContainer(ctx))
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "test"}))
+
+		var ids []SegmentId
+
+		entropy := ulid.Monotonic(ulid.DefaultEntropy(), 0)
+
+		for i := 0; i < 100; i++ {
+			seg := SegmentId(ulid.MustNew(ulid.Now(), entropy))
+			ids = append(ids, seg)
+
+			w, err := sa.WriteSegment(ctx, seg)
+			r.NoError(err)
+
+			fmt.Fprintf(w, "segment %d", i)
+			r.NoError(w.Close())
+
+			r.NoError(sa.AppendToSegments(ctx, "test", seg))
+		}
+
+		used := map[int]int{}
+
+		for i, seg := range ids {
+			idx := sa.ShardFor(seg)
+			r.Equal(idx, sa.ShardFor(seg))
+			used[idx]++
+
+			for j, shard := range shards {
+				r.Equal(j == idx, shard.hasSegment(seg))
+
+				listed, err := shard.ListSegments(ctx, "test")
+				r.NoError(err)
+				r.Equal(j == idx, slices.Contains(listed, seg))
+			}
+
+			sr, err := sa.OpenSegment(ctx, seg)
+			r.NoError(err)
+
+			buf := make([]byte, 100)
+			n, _ := sr.ReadAt(buf, 0)
+			r.Equal(fmt.Sprintf("segment %d", i), string(buf[:n]))
+		}
+
+		r.Len(used, len(shards))
+
+		listed, err := sa.ListSegments(ctx, "test")
+		r.NoError(err)
+		r.Equal(ids, listed)
+
+		// Routing doesn't depend on any state in the ShardedAccess.
+		sa2, err := NewShardedAccess(asAccess(shards)...)
+		r.NoError(err)
+
+		for _, seg := range ids[:50] {
+			r.NoError(sa2.RemoveSegmentFromVolume(ctx, "test", seg))
+			r.NoError(sa2.RemoveSegment(ctx, seg))
+		}
+
+		listed, err = sa.ListSegments(ctx, "test")
+		r.NoError(err)
+		r.Equal(ids[50:], listed)
+
+		for _, shard := range shards {
+			for _, seg := range ids[:50] {
+				r.False(shard.hasSegment(seg))
+			}
+		}
+	})
+
+	t.Run("keeps volume info and metadata on the first shard", func(t *testing.T) {
+		r := require.New(t)
+
+		shards := newShards()
+
+		sa, err := NewShardedAccess(asAccess(shards)...)
+		r.NoError(err)
+
+		r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: "test", Size: 1024}))
+
+		vi, err := sa.GetVolumeInfo(ctx, "test")
+		r.NoError(err)
+		r.Equal(int64(1024), vi.Size)
+
+		w, err := sa.WriteMetadata(ctx, "test", "head.map")
+		r.NoError(err)
+		fmt.Fprint(w, "map")
+		r.NoError(w.Close())
+
+		r.Contains(shards[0].volumes["test"].metadata, "head.map")
+		r.Empty(shards[1].volumes["test"].metadata)
+		r.Empty(shards[2].volumes["test"].metadata)
+
+		rd, err := sa.ReadMetadata(ctx, "test", "head.map")
+		r.NoError(err)
+
+		data, err := io.ReadAll(rd)
+		r.NoError(err)
+		r.Equal("map", string(data))
+	})
+
+	t.Run("requires a shard", func(t *testing.T) {
+		_, err := NewShardedAccess()
+		require.Error(t, err)
+	})
+
+	t.Run("backs a disk", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		shards := newShards()
+
+		sa, err := NewShardedAccess(asAccess(shards)...)
+		r.NoError(err)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(sa))
+		r.NoError(err)
+
+		for i := 0; i < 10; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		// Replaces the segment holding LBA 3 entirely, so it's removed.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(3)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
+
+		segments, err := sa.ListSegments(ctx, "default")
+		r.NoError(err)
+		r.Len(segments, 10)
+
+		var held int
+		for _, shard := range shards {
+			if n := len(shard.segments); n > 0 {
+				held++
+			}
+		}
+
+		r.Greater(held, 1)
+
+		tmpdir2, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir2)
+
+		d2, err := NewDisk(ctx, log, tmpdir2, WithSegmentAccess(sa))
+		r.NoError(err)
+		defer d2.Close(ctx)
+
+		data, err := d2.ReadExtent(ctx, Extent{LBA: 0, Blocks: 10})
+		r.NoError(err)
+
+		for i := 0; i < 10; i++ {
+			expected := testRand
+			if i == 3 {
+				expected = testData
+			}
+
+			r.Equal(expected, data.ReadData()[i*BlockSize:(i+1)*BlockSize])
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package lsvd
+
+import (
+	"context"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+)
+
+type SnapshotId ulid.ULID
+
+func (s SnapshotId) String() string {
+	return ulid.ULID(s).String()
+}
+
+func (s SnapshotId) Valid() bool {
+	return s != SnapshotId{}
+}
+
+func (s SnapshotId) metadataName() string {
+	return "snapshot." + s.String()
+}
+
+// Snapshot flushes the write cache and records the current LBA map in the
+// volume's metadata. A snapshot only records which segment data each LBA maps
+// to, so it can be used to calculate what changed between 2 points in time.
+func (d *Disk) Snapshot(ctx context.Context) (SnapshotId, error) {
+	err := d.CloseSegment(ctx)
+	if err != nil {
+		return SnapshotId{}, err
+	}
+
+	ul, err := ulid.New(ulid.Timestamp(d.clock.Now()), d.entropy)
+	if err != nil {
+		return SnapshotId{}, err
+	}
+
+	id := SnapshotId(ul)
+
+	sh, err := d.segmentsHash(ctx)
+	if err != nil {
+		return SnapshotId{}, errors.Wrapf(err, "calculating segments hash")
+	}
+
+	w, err := d.sa.WriteMetadata(ctx, d.volName, id.metadataName())
+	if err != nil {
+		return SnapshotId{}, err
+	}
+
+	err = saveLBAMap(d.lba2pba, w, &lbaCacheMapHeader{
+		CreatedAt:    d.clock.Now(),
+		SegmentsHash: sh,
+	})
+	if err != nil {
+		w.Close()
+		return SnapshotId{}, errors.Wrapf(err, "writing snapshot %s", id)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return SnapshotId{}, err
+	}
+
+	d.log.Info("created snapshot", "snapshot", id, "extents", d.lba2pba.Len())
+
+	return id, nil
+}
+
+func (d *Disk) loadSnapshot(ctx context.Context, id SnapshotId) (*ExtentMap, error) {
+	r, err := d.sa.ReadMetadata(ctx, d.volName, id.metadataName())
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening snapshot %s", id)
+	}
+
+	defer r.Close()
+
+	m, _, err := processLBAMap(d.log, r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading snapshot %s", id)
+	}
+
+	return m, nil
+}
+
+// ChangedExtents returns the extents whose mapping differs between the
+// snapshots +from+ and +to+, coalesced into the minimal set of extents. If
+// +from+ is the zero SnapshotId, every extent mapped in +to+ is returned.
+//
+// Because the comparison is done on the mappings rather than the data, blocks
+// that were rewritten with the same data, or moved by GC, are reported as changed.
+func (d *Disk) ChangedExtents(ctx context.Context, from, to SnapshotId) ([]Extent, error) {
+	toMap, err := d.loadSnapshot(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	fromMap := NewExtentMap()
+
+	if from.Valid() {
+		fromMap, err = d.loadSnapshot(ctx, from)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return diffExtentMaps(d, fromMap, toMap)
+}
+
+func diffExtentMaps(d *Disk, from, to *ExtentMap) ([]Extent, error) {
+	var changed []Extent
+
+	// Find everything in +to+ that isn't mapped to the same location in +from+.
+	for i := to.Iterator(); i.Valid(); i.Next() {
+		pe := i.Value()
+
+		same, err := matchingExtents(d, from, pe)
+		if err != nil {
+			return nil, err
+		}
+
+		diff, ok := pe.Live.SubMany(same)
+		if !ok {
+			return nil, errors.Errorf("error subtracting unchanged ranges from %s", pe.Live)
+		}
+
+		changed = append(changed, diff...)
+	}
+
+	// And everything in +from+ that is no longer mapped at all in +to+.
+	for i := from.Iterator(); i.Valid(); i.Next() {
+		pe := i.Value()
+
+		pes, err := to.Resolve(d.log, pe.Live, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var mapped []Extent
+
+		for _, x := range pes {
+			if o, ok := pe.Live.Clamp(x.Live); ok {
+				mapped = append(mapped, o)
+			}
+		}
+
+		diff, ok := pe.Live.SubMany(mapped)
+		if !ok {
+			return nil, errors.Errorf("error subtracting mapped ranges from %s", pe.Live)
+		}
+
+		changed = append(changed, diff...)
+	}
+
+	return CoalesceExtents(changed), nil
+}
+
+// matchingExtents returns the parts of pe.Live that +m+ maps to the same location.
+func matchingExtents(d *Disk, m *ExtentMap, pe PartialExtent) ([]Extent, error) {
+	pes, err := m.Resolve(d.log, pe.Live, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var same []Extent
+
+	for _, x := range pes {
+		if !sameLocation(x, pe) {
+			continue
+		}
+
+		if o, ok := pe.Live.Clamp(x.Live); ok {
+			same = append(same, o)
+		}
+	}
+
+	return same, nil
+}
+
+// sameLocation reports if +a+ and +b+ store the blocks they both map in the
+// same place. That's decided per block rather than by comparing headers, as
+// UpdateBatch coalesces adjacent extents into one entry whose header covers
+// them all, while a map rebuilt from the segments keeps an entry per extent.
+func sameLocation(a, b PartialExtent) bool {
+	if a.Segment != b.Segment || a.Disk != b.Disk || a.Flags() != b.Flags() {
+		return false
+	}
+
+	switch a.Flags() {
+	case FlagEmpty:
+		// Coalesced empty extents are only of the same segment.
+		return true
+	case FlagUncompressed:
+		// Each block is at a fixed offset from the extent's start, so the
+		// blocks match if the extents would start at the same offset.
+		start := func(pe PartialExtent) int64 {
+			return int64(pe.Offset) - int64(pe.Extent.LBA)*BlockSize
+		}
+
+		return start(a) == start(b)
+	default:
+		// Compressed extents are never coalesced.
+		return a.ExtentHeader == b.ExtentHeader
+	}
+}
+
+// ReadAsOf reads +rng+ as it was once the segment +upTo+ was written, using
+// only the volume's segments with ids up to and including +upTo+. Blocks that
+// none of those segments wrote read as zeros, as do blocks still in the write
+// cache, which aren't in any segment yet.
+//
+// The view is built by reading the header of every segment involved, so it's
+// meant for debugging rather than regular reads. It can also only see the
+// segments that still exist. A segment is removed once none of its data is
+// live, and GC moves live data into a new segment before removing the old
+// one, so data from removed segments reads as zeros.
+func (d *Disk) ReadAsOf(ctx *Context, rng Extent, upTo SegmentId) (RangeData, error) {
+	if d.detached.Load() {
+		return RangeData{}, ErrDetached
+	}
+
+	m, err := d.extentMapAsOf(ctx, upTo)
+	if err != nil {
+		return RangeData{}, err
+	}
+
+	data := NewRangeData(ctx, rng)
+	clear(data.WriteData())
+
+	pes, err := m.Resolve(d.log, rng, nil)
+	if err != nil {
+		return RangeData{}, err
+	}
+
+	for _, pe := range pes {
+		if pe.Size == 0 {
+			continue
+		}
+
+		err := d.readPartialExtent(ctx, &pe, []Extent{rng}, rng, data, false)
+		if err != nil {
+			return RangeData{}, errors.Wrapf(err, "reading %s from segment %s", pe.Live, pe.Segment)
+		}
+	}
+
+	return data, nil
+}
+
+// extentMapAsOf builds the LBA map from the volume's segments with ids up to
+// and including +upTo+, skipping those a rebuild would quarantine.
+func (d *Disk) extentMapAsOf(ctx context.Context, upTo SegmentId) (*ExtentMap, error) {
+	entries, err := d.sa.ListSegments(ctx, d.volName)
+	if err != nil {
+		return nil, err
+	}
+
+	m := NewExtentMap()
+
+	var latest uint64
+
+	// The segments applied so far, which the references of later ones can
+	// use.
+	applied := map[SegmentId]struct{}{}
+
+	for _, seg := range entries {
+		if ulid.ULID(seg).Compare(ulid.ULID(upTo)) > 0 {
+			continue
+		}
+
+		ps, err := d.readSegmentExtents(ctx, seg)
+		if err != nil {
+			if errors.Is(err, ErrTruncatedSegment) {
+				d.log.Warn("skipping truncated segment", "segment", seg, "error", err)
+				continue
+			}
+
+			return nil, err
+		}
+
+		if fencedSegment(ps.meta, &latest) {
+			d.log.Warn("skipping segment from a fenced writer", "segment", seg, "generation", ps.meta.Generation)
+			continue
+		}
+
+		for _, eh := range ps.extents {
+			_, err := m.Update(d.log, ExtentLocation{
+				ExtentHeader: eh,
+				Segment:      seg,
+			}, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// References come after the segment's own extents, as in
+		// applySegmentExtents.
+		for _, ref := range ps.refs {
+			if _, ok := applied[ref.Segment]; !ok {
+				d.log.Debug("skipping reference to a segment not in the view", "segment", seg, "ref", ref.Segment)
+				continue
+			}
+
+			_, err := m.Update(d.log, ExtentLocation{
+				ExtentHeader: ref.ExtentHeader,
+				Segment:      ref.Segment,
+			}, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		applied[seg] = struct{}{}
+	}
+
+	return m, nil
+}
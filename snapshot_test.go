@@ -0,0 +1,273 @@
+package lsvd
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	t.Run("reports changed extents between snapshots", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		for i := 0; i < 10; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+		}
+
+		s1, err := d.Snapshot(ctx)
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(5)))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(6)))
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 20, Blocks: 2}))
+
+		s2, err := d.Snapshot(ctx)
+		r.NoError(err)
+
+		changed, err := d.ChangedExtents(ctx, s1, s2)
+		r.NoError(err)
+
+		r.Equal([]Extent{{LBA: 5, Blocks: 2}, {LBA: 20, Blocks: 2}}, changed)
+
+		changed, err = d.ChangedExtents(ctx, SnapshotId{}, s2)
+		r.NoError(err)
+
+		r.Equal([]Extent{{LBA: 0, Blocks: 10}, {LBA: 20, Blocks: 2}}, changed)
+
+		changed, err = d.ChangedExtents(ctx, s2, s2)
+		r.NoError(err)
+		r.Empty(changed)
+
+		// Going backwards reports the same ranges.
+		changed, err = d.ChangedExtents(ctx, s2, s1)
+		r.NoError(err)
+
+		r.Equal([]Extent{{LBA: 5, Blocks: 2}, {LBA: 20, Blocks: 2}}, changed)
+	})
+
+	t.Run("orders snapshots taken within the same millisecond", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		clock := newFakeClock(time.Unix(1700000000, 0))
+
+		d, err := NewDisk(ctx, log, tmpdir, WithClock(clock))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		var prev SnapshotId
+
+		for i := 0; i < 5; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+
+			s, err := d.Snapshot(ctx)
+			r.NoError(err)
+
+			r.Equal(1, ulid.ULID(s).Compare(ulid.ULID(prev)))
+			prev = s
+		}
+	})
+
+	t.Run("reports nothing changed across a rebuild of the map", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		// Adjacent extents of a segment, which flushing coalesces.
+		for i := 0; i < 4; i++ {
+			r.NoError(d.WriteExtent(ctx, testRandX.MapTo(LBA(i))))
+		}
+
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 10, Blocks: 2}))
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 12, Blocks: 2}))
+
+		s1, err := d.Snapshot(ctx)
+		r.NoError(err)
+
+		coalesced := d.lba2pba.Len()
+
+		d.lba2pba.m.Clear()
+		r.NoError(d.rebuildFromSegments(ctx))
+
+		r.Greater(d.lba2pba.Len(), coalesced)
+
+		s2, err := d.Snapshot(ctx)
+		r.NoError(err)
+
+		changed, err := d.ChangedExtents(ctx, s1, s2)
+		r.NoError(err)
+		r.Empty(changed)
+
+		changed, err = d.ChangedExtents(ctx, s2, s1)
+		r.NoError(err)
+		r.Empty(changed)
+	})
+
+	t.Run("unknown snapshots are an error", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		s1, err := d.Snapshot(ctx)
+		r.NoError(err)
+
+		_, err = d.ChangedExtents(ctx, SnapshotId{1}, s1)
+		r.Error(err)
+	})
+
+	t.Run("reads the volume as of a segment", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		writes := []RawBlocks{testExtent, testRandX, testExtent2}
+
+		for i, data := range writes {
+			r.NoError(d.WriteExtent(ctx, data.MapTo(0)))
+
+			// Keeps some data in each segment live, so they aren't removed.
+			r.NoError(d.WriteExtent(ctx, data.MapTo(LBA(10+i))))
+
+			r.NoError(d.CloseSegment(ctx))
+		}
+
+		// Not yet in a segment, so never visible as of one.
+		r.NoError(d.WriteExtent(ctx, testExtent3.MapTo(0)))
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 3)
+
+		for i, seg := range segs {
+			data, err := d.ReadAsOf(ctx, Extent{LBA: 0, Blocks: 2}, seg)
+			r.NoError(err)
+
+			blockEqual(t, writes[i], data.ReadData()[:BlockSize])
+
+			// Never written, so it reads as zeros.
+			r.True(isEmpty(data.ReadData()[BlockSize:]))
+		}
+
+		data, err := d.ReadAsOf(ctx, Extent{LBA: 0, Blocks: 1}, SegmentId{})
+		r.NoError(err)
+		r.True(isEmpty(data.ReadData()))
+
+		data, err = d.ReadExtent(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		blockEqual(t, testExtent3, data.ReadData())
+	})
+
+	t.Run("reads deduplicated blocks as of a segment", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithDedup(0))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		s1 := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(47)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(48)))
+
+		s2 := SegmentId(d.curSeq)
+		r.NoError(d.CloseSegment(ctx))
+
+		// 47 is stored as a reference to s1's data.
+		r.Equal([]SegmentId{s1}, d.s.segments[s2].refs)
+
+		data, err := d.ReadAsOf(ctx, Extent{LBA: 47, Blocks: 2}, s2)
+		r.NoError(err)
+
+		blockEqual(t, testRandX, data.ReadData()[:BlockSize])
+		blockEqual(t, testExtent, data.ReadData()[BlockSize:])
+
+		data, err = d.ReadAsOf(ctx, Extent{LBA: 47, Blocks: 1}, s1)
+		r.NoError(err)
+		r.True(isEmpty(data.ReadData()))
+	})
+
+	t.Run("reads part of an extent that was later partly overwritten", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		orig := NewRangeData(ctx, Extent{LBA: 0, Blocks: 4})
+		_, err = io.ReadFull(rand.Reader, orig.WriteData())
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, orig))
+		r.NoError(d.CloseSegment(ctx))
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+		r.NoError(d.CloseSegment(ctx))
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 2)
+
+		data, err := d.ReadAsOf(ctx, Extent{LBA: 1, Blocks: 2}, segs[0])
+		r.NoError(err)
+		r.Equal(orig.ReadData()[BlockSize:3*BlockSize], data.ReadData())
+
+		data, err = d.ReadAsOf(ctx, Extent{LBA: 1, Blocks: 2}, segs[1])
+		r.NoError(err)
+		blockEqual(t, testExtent, data.ReadData()[:BlockSize])
+		r.Equal(orig.ReadData()[2*BlockSize:3*BlockSize], data.ReadData()[BlockSize:])
+	})
+}
@@ -0,0 +1,177 @@
+package lsvd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How much each new sample moves a moving average.
+const movingAverageWeight = 0.1
+
+// movingAverage is an exponentially weighted average of samples, favoring
+// the recent ones.
+type movingAverage struct {
+	value float64
+	set   bool
+}
+
+func (m *movingAverage) add(v float64) {
+	if !m.set {
+		m.value = v
+		m.set = true
+		return
+	}
+
+	m.value += (v - m.value) * movingAverageWeight
+}
+
+// DiskStats reports how the disk has been performing recently.
+type DiskStats struct {
+	// Recent averages, per ReadExtent, of how many distinct segments were
+	// read from and how many blocks were served from the write caches and
+	// from segments.
+	ReadSegments      float64
+	ReadCacheBlocks   float64
+	ReadBackendBlocks float64
+
+	// How many reads missed the write caches and the read cache and so read
+	// from segment storage, and the recent average of how many bytes those
+	// reads read from it. Many cold reads suggest a larger read cache.
+	ColdReads     int64
+	ColdReadBytes float64
+
+	// How full the current write cache is: the size of its body, which is
+	// flushed once it reaches FlushThreshHold, the extents written to it, and
+	// the blocks they cover.
+	WriteCacheBytes   int64
+	WriteCacheEntries int64
+	WriteCacheBlocks  int64
+
+	// How many closed segments are waiting to be flushed and the total size
+	// of their bodies, see WithMaxPendingFlushBytes. They stay up while
+	// flushes fail.
+	PendingFlushes    int
+	PendingFlushBytes int64
+
+	// When the compaction policy is next checked, and when and why it last
+	// compacted. They're zero without a policy, or before its first run.
+	NextCompaction       time.Time
+	LastCompaction       time.Time
+	LastCompactionReason string
+
+	// The average time compressing data took per block when writing, and
+	// decompressing it took per block when reading. Against the storage
+	// ratio, they show what compression costs for what it saves.
+	CompressBlockTime   time.Duration
+	DecompressBlockTime time.Duration
+}
+
+// readFanout records where the data for a single read came from.
+type readFanout struct {
+	segments      int
+	cacheBlocks   int
+	backendBlocks int
+
+	// The cold bytes of the read's Context when it started.
+	coldStart int64
+}
+
+func (d *Disk) recordRead(ctx *Context, f *readFanout) {
+	cold := atomic.LoadInt64(&ctx.coldBytes) - f.coldStart
+
+	d.metrics.readSegments.Observe(float64(f.segments))
+	d.metrics.readCacheBlocks.Add(float64(f.cacheBlocks))
+	d.metrics.readBackendBlocks.Add(float64(f.backendBlocks))
+
+	if cold > 0 {
+		d.metrics.coldReads.Inc()
+		d.metrics.coldReadBytes.Observe(float64(cold))
+
+		d.log.Debug("read missed all caches", "bytes", cold, "segments", f.segments)
+	}
+
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+
+	d.readSegments.add(float64(f.segments))
+	d.readCacheBlocks.add(float64(f.cacheBlocks))
+	d.readBackendBlocks.add(float64(f.backendBlocks))
+
+	if cold > 0 {
+		d.coldReads++
+		d.coldReadBytes.add(float64(cold))
+	}
+}
+
+// recordWriteCache updates the occupancy of the write cache after it's
+// written to or replaced.
+func (d *Disk) recordWriteCache() {
+	bytes := int64(d.curOC.BodySize())
+	entries := int64(d.curOC.Entries())
+	blocks := int64(d.curOC.TotalBlocks())
+
+	d.writeCacheBytes.Store(bytes)
+	d.writeCacheEntries.Store(entries)
+	d.writeCacheBlocks.Store(blocks)
+
+	d.metrics.writeCacheBytes.Set(float64(bytes))
+	d.metrics.writeCacheEntries.Set(float64(entries))
+	d.metrics.writeCacheBlocks.Set(float64(blocks))
+}
+
+// Stats returns the recent averages of the reads performed by the disk, the
+// current occupancy of its write cache, and the state of its compaction.
+func (d *Disk) Stats() DiskStats {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+
+	return DiskStats{
+		ReadSegments:      d.readSegments.value,
+		ReadCacheBlocks:   d.readCacheBlocks.value,
+		ReadBackendBlocks: d.readBackendBlocks.value,
+		ColdReads:         d.coldReads,
+		ColdReadBytes:     d.coldReadBytes.value,
+		WriteCacheBytes:   d.writeCacheBytes.Load(),
+		WriteCacheEntries: d.writeCacheEntries.Load(),
+		WriteCacheBlocks:  d.writeCacheBlocks.Load(),
+		PendingFlushes:    len(d.prevCache.Load()),
+		PendingFlushBytes: d.prevCache.Bytes(),
+
+		NextCompaction:       d.nextCompaction,
+		LastCompaction:       d.lastCompaction,
+		LastCompactionReason: d.lastCompactionReason,
+
+		CompressBlockTime:   timeAvgValue(d.metrics.compressBlockTime),
+		DecompressBlockTime: timeAvgValue(d.metrics.decompressBlockTime),
+	}
+}
+
+// fanout returns the number of distinct segments read from by +reqs+ and
+// how many blocks they fill.
+func fanout(reqs []readRequest) (segments, blocks int) {
+	for i, o := range reqs {
+		seen := false
+		for _, p := range reqs[:i] {
+			if p.pe.Disk == o.pe.Disk && p.pe.Segment == o.pe.Segment {
+				seen = true
+				break
+			}
+		}
+
+		if !seen {
+			segments++
+		}
+
+		if x, ok := o.pe.Live.Clamp(o.extent); ok {
+			blocks += int(x.Blocks)
+		}
+
+		for _, e := range o.extra {
+			if x, ok := o.pe.Live.Clamp(e); ok {
+				blocks += int(x.Blocks)
+			}
+		}
+	}
+
+	return segments, blocks
+}
@@ -0,0 +1,335 @@
+package lsvd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/pkg/errors"
+)
+
+// How much data to read at a time while migrating a segment.
+const migrateBufferSize = 1024 * 1024
+
+// TieredAccess keeps newly written segments in a local, hot tier and moves
+// them to a remote, cold tier once they're older than a threshold. Reads
+// check the hot tier first and then the cold one. The volume itself, that is
+// its info, segment list, and metadata, is kept in the cold tier so that
+// ListSegments always returns every segment regardless of which tier it's
+// currently in.
+type TieredAccess struct {
+	log    logger.Logger
+	hot    *LocalFileAccess
+	cold   SegmentAccess
+	maxAge time.Duration
+
+	now func() time.Time
+
+	// Serializes migrations against removals of the same segment.
+	mu sync.Mutex
+}
+
+var (
+	_ SegmentAccess = (*TieredAccess)(nil)
+	_ SegmentSizer  = (*TieredAccess)(nil)
+)
+
+// NewTieredAccess returns a TieredAccess that writes segments into +hot+ and
+// moves them into +cold+ when MigrateSegments finds them older than +maxAge+.
+func NewTieredAccess(log logger.Logger, hot *LocalFileAccess, cold SegmentAccess, maxAge time.Duration) *TieredAccess {
+	return &TieredAccess{
+		log:    log,
+		hot:    hot,
+		cold:   cold,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+}
+
+func (t *TieredAccess) InitContainer(ctx context.Context) error {
+	err := t.hot.InitContainer(ctx)
+	if err != nil {
+		return err
+	}
+
+	return t.cold.InitContainer(ctx)
+}
+
+func (t *TieredAccess) InitVolume(ctx context.Context, vol *VolumeInfo) error {
+	return t.cold.InitVolume(ctx, vol)
+}
+
+// UpdateVolumeInfo updates the info of +vol+ in the cold tier, which is where
+// the volume is kept.
+func (t *TieredAccess) UpdateVolumeInfo(ctx context.Context, vol *VolumeInfo) error {
+	vu, ok := t.cold.(VolumeInfoUpdater)
+	if !ok {
+		return nil
+	}
+
+	return vu.UpdateVolumeInfo(ctx, vol)
+}
+
+func (t *TieredAccess) ListVolumes(ctx context.Context) ([]string, error) {
+	return t.cold.ListVolumes(ctx)
+}
+
+func (t *TieredAccess) coldTrash() (VolumeTrash, error) {
+	return volumeTrash(t.cold)
+}
+
+// SoftDeleteVolume moves +vol+ into the trash of the cold tier, which is where
+// the volume is kept.
+func (t *TieredAccess) SoftDeleteVolume(ctx context.Context, vol string) error {
+	vt, err := t.coldTrash()
+	if err != nil {
+		return err
+	}
+
+	return vt.SoftDeleteVolume(ctx, vol)
+}
+
+func (t *TieredAccess) RestoreVolume(ctx context.Context, vol string) error {
+	vt, err := t.coldTrash()
+	if err != nil {
+		return err
+	}
+
+	return vt.RestoreVolume(ctx, vol)
+}
+
+// ListTrashedVolumes returns the volumes in the trash of the cold tier. If it
+// has no trash, nothing can have been soft deleted.
+func (t *TieredAccess) ListTrashedVolumes(ctx context.Context) ([]TrashedVolume, error) {
+	vt, ok := t.cold.(VolumeTrash)
+	if !ok {
+		return nil, nil
+	}
+
+	return vt.ListTrashedVolumes(ctx)
+}
+
+func (t *TieredAccess) ListTrashedSegments(ctx context.Context, vol string) ([]SegmentId, error) {
+	vt, err := t.coldTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	return vt.ListTrashedSegments(ctx, vol)
+}
+
+func (t *TieredAccess) PurgeVolume(ctx context.Context, vol string) error {
+	vt, err := t.coldTrash()
+	if err != nil {
+		return err
+	}
+
+	return vt.PurgeVolume(ctx, vol)
+}
+
+func (t *TieredAccess) GetVolumeInfo(ctx context.Context, vol string) (*VolumeInfo, error) {
+	return t.cold.GetVolumeInfo(ctx, vol)
+}
+
+func (t *TieredAccess) ListSegments(ctx context.Context, vol string) ([]SegmentId, error) {
+	return t.cold.ListSegments(ctx, vol)
+}
+
+func (t *TieredAccess) OpenSegment(ctx context.Context, seg SegmentId) (SegmentReader, error) {
+	sr, err := t.hot.OpenSegment(ctx, seg)
+	if err == nil {
+		return sr, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return t.cold.OpenSegment(ctx, seg)
+}
+
+func (t *TieredAccess) StreamSegment(ctx context.Context, seg SegmentId) (io.ReadCloser, int64, error) {
+	rc, size, err := StreamSegment(ctx, t.hot, seg)
+	if err == nil {
+		return rc, size, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, err
+	}
+
+	return StreamSegment(ctx, t.cold, seg)
+}
+
+func (t *TieredAccess) SegmentSize(ctx context.Context, seg SegmentId) (int64, error) {
+	size, err := SegmentSize(ctx, t.hot, seg)
+	if err == nil {
+		return size, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	return SegmentSize(ctx, t.cold, seg)
+}
+
+func (t *TieredAccess) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteCloser, error) {
+	return t.hot.WriteSegment(ctx, seg)
+}
+
+func (t *TieredAccess) UploadSegment(ctx context.Context, seg SegmentId, f *os.File) error {
+	return t.hot.UploadSegment(ctx, seg, f)
+}
+
+// RemoveSegment removes the segment from both tiers. It's only an error for
+// the segment to be missing if it's in neither.
+func (t *TieredAccess) RemoveSegment(ctx context.Context, seg SegmentId) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hotErr := t.hot.RemoveSegment(ctx, seg)
+	if hotErr != nil && !errors.Is(hotErr, os.ErrNotExist) {
+		return hotErr
+	}
+
+	coldErr := t.cold.RemoveSegment(ctx, seg)
+	if coldErr == nil || (errors.Is(coldErr, os.ErrNotExist) && hotErr == nil) {
+		return nil
+	}
+
+	return coldErr
+}
+
+func (t *TieredAccess) RemoveSegmentFromVolume(ctx context.Context, vol string, seg SegmentId) error {
+	return t.cold.RemoveSegmentFromVolume(ctx, vol, seg)
+}
+
+func (t *TieredAccess) WriteMetadata(ctx context.Context, vol, name string) (io.WriteCloser, error) {
+	return t.cold.WriteMetadata(ctx, vol, name)
+}
+
+func (t *TieredAccess) ReadMetadata(ctx context.Context, vol, name string) (io.ReadCloser, error) {
+	return t.cold.ReadMetadata(ctx, vol, name)
+}
+
+func (t *TieredAccess) AppendToSegments(ctx context.Context, vol string, seg SegmentId) error {
+	return t.cold.AppendToSegments(ctx, vol, seg)
+}
+
+// MigrateSegments moves the segments in the hot tier that are older than the
+// threshold into the cold tier, returning how many were moved. The hot copy
+// of a segment is only removed once the cold copy has been read back and
+// matches it.
+func (t *TieredAccess) MigrateSegments(ctx context.Context) (int, error) {
+	segments, err := t.hot.ListAllSegments(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := t.now().Add(-t.maxAge)
+
+	var moved int
+
+	for _, seg := range segments {
+		if !seg.Time().Before(cutoff) {
+			continue
+		}
+
+		err := t.migrateSegment(ctx, seg)
+		if err != nil {
+			return moved, errors.Wrapf(err, "migrating segment %s", seg)
+		}
+
+		moved++
+	}
+
+	return moved, nil
+}
+
+func (t *TieredAccess) migrateSegment(ctx context.Context, seg SegmentId) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sr, err := t.hot.OpenSegment(ctx, seg)
+	if err != nil {
+		// Removed since we listed it.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	defer sr.Close()
+
+	buf := make([]byte, migrateBufferSize)
+
+	w, err := t.cold.WriteSegment(ctx, seg)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+
+	_, err = io.CopyBuffer(io.MultiWriter(w, h), ToReader(sr), buf)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	expected := h.Sum(nil)
+
+	cr, err := t.cold.OpenSegment(ctx, seg)
+	if err != nil {
+		return errors.Wrapf(err, "opening uploaded segment")
+	}
+
+	defer cr.Close()
+
+	h.Reset()
+
+	_, err = io.CopyBuffer(h, ToReader(cr), buf)
+	if err != nil {
+		return errors.Wrapf(err, "reading back uploaded segment")
+	}
+
+	if !bytes.Equal(expected, h.Sum(nil)) {
+		return errors.New("uploaded segment does not match the local copy")
+	}
+
+	t.log.Debug("migrated segment to cold tier", "segment", seg)
+
+	return t.hot.RemoveSegment(ctx, seg)
+}
+
+// RunMover migrates segments every +interval+ until +ctx+ is canceled.
+func (t *TieredAccess) RunMover(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			moved, err := t.MigrateSegments(ctx)
+			if err != nil {
+				t.log.Error("error migrating segments to cold tier", "error", err)
+			}
+
+			if moved > 0 {
+				t.log.Info("migrated segments to cold tier", "segments", moved)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package lsvd
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// hookedAccess lets a test intercept segments being written to a memAccess.
+type hookedAccess struct {
+	*memAccess
+	onWrite func(seg SegmentId, data []byte) []byte
+}
+
+func (h *hookedAccess) WriteSegment(ctx context.Context, seg SegmentId) (io.WriteCloser, error) {
+	return &memWriter{done: func(b []byte) {
+		b = h.onWrite(seg, b)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.segments[seg] = b
+	}}, nil
+}
+
+func TestTieredAccess(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	setup := func(t *testing.T, cold SegmentAccess) (*TieredAccess, string) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		ta := NewTieredAccess(log, &LocalFileAccess{Dir: tmpdir}, cold, time.Hour)
+		r.NoError(ta.InitContainer(ctx))
+		r.NoError(ta.InitVolume(ctx, &VolumeInfo{Name: "test"}))
+
+		return ta, tmpdir
+	}
+
+	segmentAged := func(age time.Duration) SegmentId {
+		return SegmentId(ulid.MustNew(ulid.Timestamp(time.Now().Add(-age)), ulid.DefaultEntropy()))
+	}
+
+	write := func(t *testing.T, sa SegmentAccess, seg SegmentId, body string) {
+		w, err := sa.WriteSegment(ctx, seg)
+		require.NoError(t, err)
+
+		_, err = io.WriteString(w, body)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+
+	read := func(t *testing.T, sa SegmentAccess, seg SegmentId) string {
+		sr, err := sa.OpenSegment(ctx, seg)
+		require.NoError(t, err)
+		defer sr.Close()
+
+		data, err := io.ReadAll(ToReader(sr))
+		require.NoError(t, err)
+
+		return string(data)
+	}
+
+	hotPath := func(dir string, seg SegmentId) string {
+		return filepath.Join(dir, "segments", "segment."+seg.String())
+	}
+
+	t.Run("serves a segment only in the hot tier", func(t *testing.T) {
+		r := require.New(t)
+
+		cold := newMemAccess()
+		ta, dir := setup(t, cold)
+
+		seg := segmentAged(time.Minute)
+		write(t, ta, seg, "hot segment")
+
+		r.FileExists(hotPath(dir, seg))
+		r.False(cold.hasSegment(seg))
+
+		r.Equal("hot segment", read(t, ta, seg))
+
+		moved, err := ta.MigrateSegments(ctx)
+		r.NoError(err)
+		r.Zero(moved)
+
+		r.FileExists(hotPath(dir, seg))
+	})
+
+	t.Run("serves a segment only in the cold tier", func(t *testing.T) {
+		r := require.New(t)
+
+		cold := newMemAccess()
+		ta, dir := setup(t, cold)
+
+		seg := segmentAged(time.Minute)
+		write(t, cold, seg, "cold segment")
+
+		r.NoFileExists(hotPath(dir, seg))
+		r.Equal("cold segment", read(t, ta, seg))
+
+		_, err := ta.OpenSegment(ctx, segmentAged(0))
+		r.ErrorIs(err, os.ErrNotExist)
+	})
+
+	t.Run("migrates old segments to the cold tier", func(t *testing.T) {
+		r := require.New(t)
+
+		cold := newMemAccess()
+		ta, dir := setup(t, cold)
+
+		old := segmentAged(2 * time.Hour)
+		write(t, ta, old, "old segment")
+
+		recent := segmentAged(time.Minute)
+		write(t, ta, recent, "recent segment")
+
+		remote := segmentAged(3 * time.Hour)
+		write(t, cold, remote, "remote segment")
+
+		for _, seg := range []SegmentId{remote, old, recent} {
+			r.NoError(ta.AppendToSegments(ctx, "test", seg))
+		}
+
+		moved, err := ta.MigrateSegments(ctx)
+		r.NoError(err)
+		r.Equal(1, moved)
+
+		r.NoFileExists(hotPath(dir, old))
+		r.True(cold.hasSegment(old))
+		r.Equal("old segment", read(t, ta, old))
+
+		r.FileExists(hotPath(dir, recent))
+		r.False(cold.hasSegment(recent))
+
+		segments, err := ta.ListSegments(ctx, "test")
+		r.NoError(err)
+		r.Equal([]SegmentId{remote, old, recent}, segments)
+
+		r.NoError(ta.RemoveSegment(ctx, old))
+		r.NoError(ta.RemoveSegment(ctx, recent))
+		r.False(cold.hasSegment(old))
+		r.NoFileExists(hotPath(dir, recent))
+
+		r.ErrorIs(ta.RemoveSegment(ctx, old), os.ErrNotExist)
+	})
+
+	t.Run("serves the hot copy while a segment is migrating", func(t *testing.T) {
+		r := require.New(t)
+
+		var (
+			uploading = make(chan struct{})
+			release   = make(chan struct{})
+			ta        *TieredAccess
+			dir       string
+		)
+
+		cold := &hookedAccess{
+			memAccess: newMemAccess(),
+			onWrite: func(seg SegmentId, data []byte) []byte {
+				close(uploading)
+				<-release
+				return data
+			},
+		}
+
+		ta, dir = setup(t, cold)
+
+		seg := segmentAged(2 * time.Hour)
+		write(t, ta, seg, "migrating segment")
+
+		done := make(chan error)
+		go func() {
+			_, err := ta.MigrateSegments(ctx)
+			done <- err
+		}()
+
+		<-uploading
+
+		r.FileExists(hotPath(dir, seg))
+		r.Equal("migrating segment", read(t, ta, seg))
+
+		close(release)
+		r.NoError(<-done)
+
+		r.NoFileExists(hotPath(dir, seg))
+		r.Equal("migrating segment", read(t, ta, seg))
+	})
+
+	t.Run("keeps the hot copy if the upload doesn't match", func(t *testing.T) {
+		r := require.New(t)
+
+		cold := &hookedAccess{
+			memAccess: newMemAccess(),
+			onWrite: func(seg SegmentId, data []byte) []byte {
+				return data[:len(data)/2]
+			},
+		}
+
+		ta, dir := setup(t, cold)
+
+		seg := segmentAged(2 * time.Hour)
+		write(t, ta, seg, "segment to corrupt")
+
+		_, err := ta.MigrateSegments(ctx)
+		r.Error(err)
+
+		r.FileExists(hotPath(dir, seg))
+		r.Equal("segment to corrupt", read(t, ta, seg))
+	})
+
+	t.Run("backs a disk", func(t *testing.T) {
+		r := require.New(t)
+
+		cold := newMemAccess()
+		ta, _ := setup(t, cold)
+
+		gctx := NewContext(ctx)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(gctx, log, tmpdir, WithSegmentAccess(ta), WithVolumeName("test"))
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(gctx, testRandX.MapTo(0)))
+		r.NoError(d.Close(gctx))
+
+		ta.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+		moved, err := ta.MigrateSegments(ctx)
+		r.NoError(err)
+		r.Equal(1, moved)
+
+		tmpdir2, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir2)
+
+		d2, err := NewDisk(gctx, log, tmpdir2, WithSegmentAccess(ta), WithVolumeName("test"))
+		r.NoError(err)
+		defer d2.Close(gctx)
+
+		data, err := d2.ReadExtent(gctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+		r.Equal(testRand, data.ReadData())
+	})
+}
@@ -0,0 +1,164 @@
+package lsvd
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// ReadSource is where the data for part of a read came from.
+type ReadSource int
+
+const (
+	// The current write cache, ie writes not yet flushed.
+	ReadFromWriteCache ReadSource = iota
+
+	// The write cache of a flush still in progress, see PreviousCache.
+	ReadFromPrevCache
+
+	// A segment, with the data already in the read cache.
+	ReadFromExtentCache
+
+	// A segment, with at least some of the data read from segment storage.
+	ReadFromSegment
+
+	// An extent mapped as empty, read as zeros without reading anything.
+	ReadFromHole
+)
+
+func (s ReadSource) String() string {
+	switch s {
+	case ReadFromWriteCache:
+		return "write-cache"
+	case ReadFromPrevCache:
+		return "prev-cache"
+	case ReadFromExtentCache:
+		return "extent-cache"
+	case ReadFromSegment:
+		return "segment"
+	case ReadFromHole:
+		return "hole"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// ReadTraceEntry is where one part of a read came from.
+type ReadTraceEntry struct {
+	Extent Extent
+	Source ReadSource
+
+	// The segment the data was read from and the index of the disk among
+	// the disk and its lower layers, for ReadFromExtentCache and
+	// ReadFromSegment.
+	Segment SegmentId
+	Disk    uint16
+
+	// How long reading the segment's extent took. It's shared by all the
+	// parts of the read served by the same extent.
+	Latency time.Duration
+}
+
+func (e ReadTraceEntry) String() string {
+	switch e.Source {
+	case ReadFromExtentCache, ReadFromSegment:
+		return fmt.Sprintf("%s: %s %s (disk %d, %s)", e.Extent, e.Source, e.Segment, e.Disk, e.Latency)
+	default:
+		return fmt.Sprintf("%s: %s", e.Extent, e.Source)
+	}
+}
+
+// ReadTrace lists where the data for a read came from, see ReadExtentTraced.
+// Parts of the read that no entry covers weren't mapped and read as zeros.
+type ReadTrace struct {
+	// Ordered by LBA.
+	Entries []ReadTraceEntry
+}
+
+// Source returns the entry that covers +lba+, if any.
+func (t *ReadTrace) Source(lba LBA) (ReadTraceEntry, bool) {
+	for _, e := range t.Entries {
+		if lba >= e.Extent.LBA && lba < e.Extent.LBA+LBA(e.Extent.Blocks) {
+			return e, true
+		}
+	}
+
+	return ReadTraceEntry{}, false
+}
+
+// add records +e+, if the read is being traced.
+func (t *ReadTrace) add(e ReadTraceEntry) {
+	if t == nil || e.Extent.Blocks == 0 {
+		return
+	}
+
+	t.Entries = append(t.Entries, e)
+}
+
+// addExtents records each of +rngs+ as coming from +src+.
+func (t *ReadTrace) addExtents(rngs []Extent, src ReadSource) {
+	if t == nil {
+		return
+	}
+
+	for _, rng := range rngs {
+		t.add(ReadTraceEntry{Extent: rng, Source: src})
+	}
+}
+
+// addSegment records the parts of +rngs+ that +pe+ covers as read from its
+// segment, either from the read cache or storage depending on whether the
+// read added to the cold bytes of +ctx+ since +coldStart+.
+func (t *ReadTrace) addSegment(ctx *Context, pe *PartialExtent, rngs []Extent, coldStart int64, latency time.Duration) {
+	if t == nil {
+		return
+	}
+
+	src := ReadFromExtentCache
+	if atomic.LoadInt64(&ctx.coldBytes) > coldStart {
+		src = ReadFromSegment
+	}
+
+	for _, x := range rngs {
+		overlap, ok := pe.Live.Clamp(x)
+		if !ok {
+			continue
+		}
+
+		t.add(ReadTraceEntry{
+			Extent:  overlap,
+			Source:  src,
+			Segment: pe.Segment,
+			Disk:    pe.Disk,
+			Latency: latency,
+		})
+	}
+}
+
+func (t *ReadTrace) sort() {
+	slices.SortStableFunc(t.Entries, func(a, b ReadTraceEntry) int {
+		switch {
+		case a.Extent.LBA < b.Extent.LBA:
+			return -1
+		case a.Extent.LBA > b.Extent.LBA:
+			return 1
+		default:
+			return 0
+		}
+	})
+}
+
+// ReadExtentTraced is ReadExtent, also returning where each part of the data
+// came from and how long reading it from segments took. It's meant for
+// tracking down slow or wrong reads rather than regular use. On error, the
+// trace covers what was read before the error.
+func (d *Disk) ReadExtentTraced(ctx *Context, rng Extent) (RangeData, ReadTrace, error) {
+	var trace ReadTrace
+
+	data, err := d.ReadExtentWithOptions(ctx, rng, ReadOptions{trace: &trace})
+
+	trace.sort()
+
+	return data, trace, err
+}
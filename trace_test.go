@@ -0,0 +1,119 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadExtentTraced(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	t.Run("attributes a read to the write cache and segments", func(t *testing.T) {
+		r := require.New(t)
+
+		ctx := NewContext(context.Background())
+		defer ctx.Close()
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
+
+		// Reopen so the read cache starts out empty.
+		d, err = NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 1)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(1)))
+
+		rng := Extent{LBA: 0, Blocks: 3}
+
+		rctx := NewContext(context.Background())
+		defer rctx.Close()
+
+		data, trace, err := d.ReadExtentTraced(rctx, rng)
+		r.NoError(err)
+
+		for lba := LBA(0); lba < 2; lba++ {
+			sub, ok := data.SubRange(Extent{LBA: lba, Blocks: 1})
+			r.True(ok)
+			blockEqual(t, testRandX, sub.ReadData())
+		}
+
+		e, ok := trace.Source(0)
+		r.True(ok)
+		r.Equal(ReadFromSegment, e.Source)
+		r.Equal(segs[0], e.Segment)
+
+		e, ok = trace.Source(1)
+		r.True(ok)
+		r.Equal(ReadFromWriteCache, e.Source)
+
+		// Never written, so read as zeros without a source.
+		_, ok = trace.Source(2)
+		r.False(ok)
+
+		for i := 1; i < len(trace.Entries); i++ {
+			r.Less(trace.Entries[i-1].Extent.LBA, trace.Entries[i].Extent.LBA)
+		}
+
+		// The segment's data is in the read cache now.
+		again := NewContext(context.Background())
+		defer again.Close()
+
+		_, trace, err = d.ReadExtentTraced(again, rng)
+		r.NoError(err)
+
+		e, ok = trace.Source(0)
+		r.True(ok)
+		r.Equal(ReadFromExtentCache, e.Source)
+		r.Equal(segs[0], e.Segment)
+	})
+	t.Run("times segment reads by the disk's clock", func(t *testing.T) {
+		r := require.New(t)
+
+		ctx := NewContext(context.Background())
+		defer ctx.Close()
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
+
+		// Reopen so the read goes to the segment.
+		d, err = NewDisk(ctx, log, tmpdir, WithClock(newFakeClock(time.Now())))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		_, trace, err := d.ReadExtentTraced(ctx, Extent{LBA: 0, Blocks: 1})
+		r.NoError(err)
+
+		e, ok := trace.Source(0)
+		r.True(ok)
+		r.Equal(ReadFromSegment, e.Source)
+
+		// The fake clock doesn't move during the read.
+		r.Zero(e.Latency)
+	})
+}
@@ -0,0 +1,167 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// WriteTx collects the writes made in a WriteTransaction.
+type WriteTx struct {
+	oc *SegmentCreator
+}
+
+func (tx *WriteTx) WriteExtent(data RangeData) error {
+	err := data.validate()
+	if err != nil {
+		return err
+	}
+
+	return tx.oc.WriteExtent(data)
+}
+
+func (tx *WriteTx) ZeroBlocks(rng Extent) error {
+	return tx.oc.ZeroBlocks(rng)
+}
+
+// WriteTransaction calls +f+ and then writes everything it wrote via +tx+ to
+// a segment of its own. If +f+ returns an error, none of its writes are
+// applied. The disk must not be written to other than via +tx+ until +f+
+// returns.
+//
+// Once WriteTransaction returns nil, the writes are durable. If it doesn't,
+// including when the process stops before it returns, the volume as recovered
+// contains either all of the writes or none of them, never only some: they
+// are only stored in the transaction's segment, which is added to the
+// volume's segment list in a single update, and their local copy is discarded
+// rather than restored on restart. Writes made before the transaction are
+// flushed before it, and writes made after it always take precedence over it.
+func (d *Disk) WriteTransaction(ctx context.Context, f func(tx *WriteTx) error) error {
+	if d.detached.Load() {
+		return ErrDetached
+	}
+
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	if d.fenced.Load() {
+		return ErrFenced
+	}
+
+	segId, err := d.reserveTransactionId(ctx)
+	if err != nil {
+		return err
+	}
+
+	oc, err := newSegmentCreator(d.log, d.volName, d.txCachePath(segId), d.metrics)
+	if err != nil {
+		return err
+	}
+
+	oc.builder.meta = d.segmentMetadata()
+	oc.builder.compRatio = d.compRatio
+	oc.builder.noCompression = d.noCompression
+	oc.builder.maxExtent = d.maxExtent
+	oc.builder.zeroRun = d.zeroRun
+	oc.builder.clock = d.clock
+	oc.segment = segId
+
+	err = f(&WriteTx{oc: oc})
+	if err != nil || oc.EmptyP() {
+		oc.Close()
+		return err
+	}
+
+	// Keep the writes readable until the segment has been flushed.
+	err = d.prevCache.Add(ctx, oc)
+	if err != nil {
+		oc.Close()
+		return err
+	}
+
+	d.log.Info("flushing write transaction", "segment", segId)
+
+	done := make(chan EventResult, 1)
+
+	select {
+	case <-ctx.Done():
+		d.prevCache.Remove(oc)
+		oc.Close()
+		return ctx.Err()
+	case d.controller.EventsCh() <- Event{
+		Kind:      CloseSegment,
+		Value:     oc,
+		SegmentId: segId,
+		Done:      done,
+	}:
+		// ok
+	}
+
+	select {
+	case res := <-done:
+		return res.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// txCachePath returns the path of the log of the transaction writing
+// +seg+. Unlike write caches, these are never restored.
+func (d *Disk) txCachePath(seg SegmentId) string {
+	return filepath.Join(d.writeCacheDir, "txcache."+seg.String())
+}
+
+// removeTransactionCaches removes the logs of transactions that didn't
+// finish before we stopped, discarding their writes.
+func (d *Disk) removeTransactionCaches() error {
+	entries, err := filepath.Glob(filepath.Join(d.writeCacheDir, "txcache.*"))
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range entries {
+		d.log.Warn("discarding unfinished write transaction", "path", ent)
+
+		err := os.Remove(ent)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reserveTransactionId flushes the earlier writes so that restoring the write
+// cache can never replay them over the transaction, and then takes the id of
+// the empty write cache for the transaction, replacing it with one whose id
+// sorts after the transaction's. It holds writeMu so that the idle flush
+// can't close or replace the write cache at the same time.
+func (d *Disk) reserveTransactionId(ctx context.Context) (SegmentId, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	err := d.closeSegment(ctx)
+	if err != nil {
+		return SegmentId{}, err
+	}
+
+	segId := d.curSeq
+	prev := d.curOC
+
+	next, err := d.newSegmentCreator()
+	if err != nil {
+		return SegmentId{}, err
+	}
+
+	d.setWriteCache(next)
+
+	d.recordWriteCache()
+
+	err = prev.Close()
+	if err != nil {
+		return SegmentId{}, err
+	}
+
+	return segId, nil
+}
@@ -0,0 +1,160 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTransaction(t *testing.T) {
+	log := logger.New(logger.Trace)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	readBlocks := func(t *testing.T, d *Disk, rng Extent) RangeData {
+		data, err := d.ReadExtent(ctx, rng)
+		require.NoError(t, err)
+		return data
+	}
+
+	t.Run("writes everything in the transaction", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(5)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(6)))
+
+		err = d.WriteTransaction(ctx, func(tx *WriteTx) error {
+			r.NoError(tx.WriteExtent(testRandX.MapTo(0)))
+			r.NoError(tx.WriteExtent(testRandX.MapTo(1)))
+			return tx.ZeroBlocks(Extent{5, 1})
+		})
+		r.NoError(err)
+
+		// Writes after the transaction take precedence over it.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(1)))
+
+		check := func(d *Disk) {
+			data := readBlocks(t, d, Extent{0, 7})
+
+			blockEqual(t, testRandX, data.ReadData()[:BlockSize])
+			blockEqual(t, testExtent, data.ReadData()[BlockSize:2*BlockSize])
+			r.True(emptyBytes(data.ReadData()[5*BlockSize : 6*BlockSize]))
+			blockEqual(t, testExtent, data.ReadData()[6*BlockSize:])
+		}
+
+		check(d)
+
+		segs, err := d.sa.ListSegments(ctx, d.volName)
+		r.NoError(err)
+		r.Len(segs, 2)
+
+		r.NoError(d.Close(ctx))
+
+		d, err = NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		check(d)
+
+		// Rebuilding from the segments has to order them the same way.
+		r.NoError(d.rebuildFromSegments(ctx))
+
+		check(d)
+	})
+
+	t.Run("applies nothing when the transaction fails", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+
+		err = d.WriteTransaction(ctx, func(tx *WriteTx) error {
+			r.NoError(tx.WriteExtent(testRandX.MapTo(0)))
+			return errors.New("transaction failed")
+		})
+		r.Error(err)
+
+		extentEqual(t, testExtent, readBlocks(t, d, Extent{0, 1}))
+
+		txs, err := filepath.Glob(filepath.Join(tmpdir, "txcache.*"))
+		r.NoError(err)
+		r.Empty(txs)
+	})
+
+	t.Run("a crash never exposes part of a transaction", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		var sa failingLocal
+
+		sa.Dir = tmpdir
+
+		// The clock never advances, so once the upload fails the flush
+		// isn't retried, leaving the disk as it would be after a crash.
+		d, err := NewDisk(ctx, log, tmpdir, WithSegmentAccess(&sa), WithClock(newFakeClock(time.Now())))
+		r.NoError(err)
+
+		err = d.WriteTransaction(ctx, func(tx *WriteTx) error {
+			for lba := LBA(0); lba < 4; lba++ {
+				r.NoError(tx.WriteExtent(testExtent.MapTo(lba)))
+			}
+			return nil
+		})
+		r.NoError(err)
+
+		sa.failing.Store(true)
+
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+
+		err = d.WriteTransaction(tctx, func(tx *WriteTx) error {
+			for lba := LBA(0); lba < 4; lba++ {
+				r.NoError(tx.WriteExtent(testRandX.MapTo(lba)))
+			}
+			return nil
+		})
+		r.ErrorIs(err, context.DeadlineExceeded)
+
+		// Restart without closing the first disk.
+		d2, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d2.Close(ctx)
+
+		data := readBlocks(t, d2, Extent{0, 4})
+
+		for lba := 0; lba < 4; lba++ {
+			blockEqual(t, testExtent, data.ReadData()[lba*BlockSize:(lba+1)*BlockSize])
+		}
+
+		txs, err := filepath.Glob(filepath.Join(tmpdir, "txcache.*"))
+		r.NoError(err)
+		r.Empty(txs)
+	})
+}
@@ -0,0 +1,174 @@
+package lsvd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/pkg/errors"
+)
+
+// The directory volumes are moved into when they're soft deleted, and the
+// name of the metadata recording when they were.
+const (
+	trashDir       = ".trash"
+	deletedAtName  = "deleted-at"
+	deletedAtStamp = time.RFC3339Nano
+)
+
+// ErrVolumeNotTrashed is returned when restoring or purging a volume that
+// isn't in the trash.
+var ErrVolumeNotTrashed = errors.New("volume is not in the trash")
+
+// TrashedVolume is a volume that was soft deleted.
+type TrashedVolume struct {
+	Name      string
+	DeletedAt time.Time
+}
+
+// VolumeTrash is implemented by a SegmentAccess that can soft delete volumes.
+// A soft deleted volume is no longer listed by ListVolumes, but its metadata
+// and segments are kept until it's purged, so it can still be restored.
+type VolumeTrash interface {
+	SoftDeleteVolume(ctx context.Context, vol string) error
+	RestoreVolume(ctx context.Context, vol string) error
+	ListTrashedVolumes(ctx context.Context) ([]TrashedVolume, error)
+	ListTrashedSegments(ctx context.Context, vol string) ([]SegmentId, error)
+	PurgeVolume(ctx context.Context, vol string) error
+}
+
+func volumeTrash(sa SegmentAccess) (VolumeTrash, error) {
+	vt, ok := sa.(VolumeTrash)
+	if !ok {
+		return nil, fmt.Errorf("segment access %T doesn't support soft deleting volumes", sa)
+	}
+
+	return vt, nil
+}
+
+// SoftDeleteVolume moves +vol+ into the trash of +sa+, where it stays until
+// it's restored with RestoreVolume or removed by PurgeExpired.
+func SoftDeleteVolume(ctx context.Context, sa SegmentAccess, vol string) error {
+	vt, err := volumeTrash(sa)
+	if err != nil {
+		return err
+	}
+
+	return vt.SoftDeleteVolume(ctx, vol)
+}
+
+// RestoreVolume undoes the soft delete of +vol+.
+func RestoreVolume(ctx context.Context, sa SegmentAccess, vol string) error {
+	vt, err := volumeTrash(sa)
+	if err != nil {
+		return err
+	}
+
+	return vt.RestoreVolume(ctx, vol)
+}
+
+// PurgeExpired removes the volumes that were soft deleted more than
+// +retention+ ago, along with those of their segments that no other volume,
+// live or trashed, refers to. It returns the names of the volumes removed.
+func PurgeExpired(ctx context.Context, log logger.Logger, sa SegmentAccess, retention time.Duration) ([]string, error) {
+	vt, err := volumeTrash(sa)
+	if err != nil {
+		return nil, err
+	}
+
+	trashed, err := vt.ListTrashedVolumes(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing trashed volumes")
+	}
+
+	cutoff := time.Now().Add(-retention)
+
+	var purged []string
+
+	for _, tv := range trashed {
+		if !tv.DeletedAt.Before(cutoff) {
+			continue
+		}
+
+		segments, err := vt.ListTrashedSegments(ctx, tv.Name)
+		if err != nil {
+			return purged, errors.Wrapf(err, "listing segments of trashed volume %s", tv.Name)
+		}
+
+		log.Info("purging deleted volume", "volume", tv.Name, "deleted-at", tv.DeletedAt, "segments", len(segments))
+
+		err = vt.PurgeVolume(ctx, tv.Name)
+		if err != nil {
+			return purged, errors.Wrapf(err, "purging volume %s", tv.Name)
+		}
+
+		purged = append(purged, tv.Name)
+
+		// Look up the references after purging, so the volume's own are gone.
+		referenced, err := referencedSegments(ctx, sa)
+		if err != nil {
+			return purged, err
+		}
+
+		for _, seg := range segments {
+			if _, ok := referenced[seg]; ok {
+				continue
+			}
+
+			err := sa.RemoveSegment(ctx, seg)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return purged, errors.Wrapf(err, "removing segment %s of volume %s", seg, tv.Name)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// referencedSegments returns the segments that some volume in +sa+ refers to,
+// including volumes in the trash, whose segments have to be kept until
+// they're purged.
+func referencedSegments(ctx context.Context, sa SegmentAccess) (map[SegmentId]struct{}, error) {
+	volumes, err := sa.ListVolumes(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing volumes")
+	}
+
+	referenced := map[SegmentId]struct{}{}
+
+	for _, vol := range volumes {
+		segments, err := sa.ListSegments(ctx, vol)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing segments of volume %s", vol)
+		}
+
+		for _, seg := range segments {
+			referenced[seg] = struct{}{}
+		}
+	}
+
+	vt, ok := sa.(VolumeTrash)
+	if !ok {
+		return referenced, nil
+	}
+
+	trashed, err := vt.ListTrashedVolumes(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing trashed volumes")
+	}
+
+	for _, tv := range trashed {
+		segments, err := vt.ListTrashedSegments(ctx, tv.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing segments of trashed volume %s", tv.Name)
+		}
+
+		for _, seg := range segments {
+			referenced[seg] = struct{}{}
+		}
+	}
+
+	return referenced, nil
+}
@@ -0,0 +1,203 @@
+package lsvd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumeTrash(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*LocalFileAccess, []SegmentId) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		sa := &LocalFileAccess{Dir: tmpdir}
+		r.NoError(sa.InitContainer(ctx))
+
+		var segs []SegmentId
+
+		for _, vol := range []string{"a", "b"} {
+			r.NoError(sa.InitVolume(ctx, &VolumeInfo{Name: vol, Size: 1024}))
+
+			seg := SegmentId(ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()))
+
+			w, err := sa.WriteSegment(ctx, seg)
+			r.NoError(err)
+
+			_, err = w.Write(testRand)
+			r.NoError(err)
+			r.NoError(w.Close())
+
+			r.NoError(sa.AppendToSegments(ctx, vol, seg))
+
+			w, err = sa.WriteMetadata(ctx, vol, "head.map")
+			r.NoError(err)
+
+			_, err = fmt.Fprintf(w, "map of %s", vol)
+			r.NoError(err)
+			r.NoError(w.Close())
+
+			segs = append(segs, seg)
+		}
+
+		return sa, segs
+	}
+
+	hasSegment := func(sa SegmentAccess, seg SegmentId) bool {
+		sr, err := sa.OpenSegment(ctx, seg)
+		if err != nil {
+			return false
+		}
+
+		sr.Close()
+		return true
+	}
+
+	// backdate moves the deletion time of +vol+ into the past.
+	backdate := func(t *testing.T, sa *LocalFileAccess, vol string, age time.Duration) {
+		ts := time.Now().Add(-age).Format(deletedAtStamp)
+		require.NoError(t, os.WriteFile(filepath.Join(sa.trashPath(vol), deletedAtName), []byte(ts), 0644))
+	}
+
+	t.Run("soft deleting hides the volume but keeps its segments", func(t *testing.T) {
+		r := require.New(t)
+
+		sa, segs := setup(t)
+
+		r.NoError(SoftDeleteVolume(ctx, sa, "a"))
+
+		vols, err := sa.ListVolumes(ctx)
+		r.NoError(err)
+		r.Equal([]string{"b"}, vols)
+
+		listed, err := sa.ListSegments(ctx, "a")
+		r.NoError(err)
+		r.Empty(listed)
+
+		r.True(hasSegment(sa, segs[0]))
+
+		trashed, err := sa.ListTrashedVolumes(ctx)
+		r.NoError(err)
+		r.Len(trashed, 1)
+		r.Equal("a", trashed[0].Name)
+		r.WithinDuration(time.Now(), trashed[0].DeletedAt, time.Minute)
+
+		listed, err = sa.ListTrashedSegments(ctx, "a")
+		r.NoError(err)
+		r.Equal(segs[:1], listed)
+
+		// Sweeping orphans leaves the segments of trashed volumes alone.
+		removed, err := SweepOrphanSegments(ctx, log, sa, 0)
+		r.NoError(err)
+		r.Empty(removed)
+
+		r.Error(sa.SoftDeleteVolume(ctx, "a"))
+	})
+
+	t.Run("restores a soft deleted volume", func(t *testing.T) {
+		r := require.New(t)
+
+		sa, segs := setup(t)
+
+		r.NoError(SoftDeleteVolume(ctx, sa, "a"))
+		r.NoError(RestoreVolume(ctx, sa, "a"))
+
+		vols, err := sa.ListVolumes(ctx)
+		r.NoError(err)
+		r.ElementsMatch([]string{"a", "b"}, vols)
+
+		listed, err := sa.ListSegments(ctx, "a")
+		r.NoError(err)
+		r.Equal(segs[:1], listed)
+
+		mr, err := sa.ReadMetadata(ctx, "a", "head.map")
+		r.NoError(err)
+
+		data, err := io.ReadAll(mr)
+		r.NoError(err)
+		mr.Close()
+		r.Equal("map of a", string(data))
+
+		_, err = sa.ReadMetadata(ctx, "a", deletedAtName)
+		r.ErrorIs(err, os.ErrNotExist)
+
+		trashed, err := sa.ListTrashedVolumes(ctx)
+		r.NoError(err)
+		r.Empty(trashed)
+
+		r.ErrorIs(RestoreVolume(ctx, sa, "a"), ErrVolumeNotTrashed)
+	})
+
+	t.Run("purges volumes past the retention window", func(t *testing.T) {
+		r := require.New(t)
+
+		sa, segs := setup(t)
+
+		r.NoError(SoftDeleteVolume(ctx, sa, "a"))
+		r.NoError(SoftDeleteVolume(ctx, sa, "b"))
+
+		backdate(t, sa, "a", 48*time.Hour)
+
+		purged, err := PurgeExpired(ctx, log, sa, 24*time.Hour)
+		r.NoError(err)
+		r.Equal([]string{"a"}, purged)
+
+		r.False(hasSegment(sa, segs[0]))
+		r.True(hasSegment(sa, segs[1]))
+
+		trashed, err := sa.ListTrashedVolumes(ctx)
+		r.NoError(err)
+		r.Len(trashed, 1)
+		r.Equal("b", trashed[0].Name)
+
+		r.ErrorIs(RestoreVolume(ctx, sa, "a"), ErrVolumeNotTrashed)
+
+		// The volume still within the window can be restored.
+		r.NoError(RestoreVolume(ctx, sa, "b"))
+
+		vols, err := sa.ListVolumes(ctx)
+		r.NoError(err)
+		r.Equal([]string{"b"}, vols)
+	})
+
+	t.Run("keeps segments other volumes still refer to", func(t *testing.T) {
+		r := require.New(t)
+
+		sa, segs := setup(t)
+
+		r.NoError(sa.AppendToSegments(ctx, "b", segs[0]))
+
+		r.NoError(SoftDeleteVolume(ctx, sa, "a"))
+		backdate(t, sa, "a", 48*time.Hour)
+
+		purged, err := PurgeExpired(ctx, log, sa, 24*time.Hour)
+		r.NoError(err)
+		r.Equal([]string{"a"}, purged)
+
+		r.True(hasSegment(sa, segs[0]))
+	})
+
+	t.Run("requires a backend with a trash", func(t *testing.T) {
+		r := require.New(t)
+
+		r.Error(SoftDeleteVolume(ctx, newMemAccess(), "a"))
+
+		_, err := PurgeExpired(ctx, log, newMemAccess(), time.Hour)
+		r.Error(err)
+	})
+}
@@ -1,20 +1,33 @@
 package lsvd
 
-import "bytes"
+import (
+	"bytes"
+	"encoding/binary"
+)
 
 var emptyBlock = make([]byte, BlockSize)
 
+// emptyBytes reports if every byte in b is zero. Each block's first word is
+// checked on its own since non-empty data almost always has a non-zero byte
+// there; the rest is compared with bytes.Equal, which is vectorized and beats
+// a word by word scan on blocks that really are empty.
 func emptyBytes(b []byte) bool {
-	for len(b) > BlockSize {
-		if !bytes.Equal(b[:BlockSize], emptyBlock) {
+	for len(b) > 0 {
+		n := min(len(b), BlockSize)
+
+		if !emptyBlockPrefix(b[:n]) {
 			return false
 		}
 
-		b = b[BlockSize:]
+		b = b[n:]
 	}
 
-	if len(b) == 0 {
-		return true
+	return true
+}
+
+func emptyBlockPrefix(b []byte) bool {
+	if len(b) >= 8 && binary.LittleEndian.Uint64(b) != 0 {
+		return false
 	}
 
 	return bytes.Equal(b, emptyBlock[:len(b)])
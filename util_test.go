@@ -0,0 +1,95 @@
+package lsvd
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// emptyBytesEqual is the straightforward version of emptyBytes.
+func emptyBytesEqual(b []byte) bool {
+	for len(b) > BlockSize {
+		if !bytes.Equal(b[:BlockSize], emptyBlock) {
+			return false
+		}
+
+		b = b[BlockSize:]
+	}
+
+	return bytes.Equal(b, emptyBlock[:len(b)])
+}
+
+func TestEmptyBytes(t *testing.T) {
+	t.Run("matches bytes.Equal", func(t *testing.T) {
+		r := require.New(t)
+
+		rng := rand.New(rand.NewSource(1))
+
+		for i := 0; i < 10000; i++ {
+			b := make([]byte, rng.Intn(3*BlockSize+16))
+
+			// Leave a third of them empty, set a single byte in a third, and
+			// fill the rest with random data.
+			switch i % 3 {
+			case 1:
+				if len(b) > 0 {
+					b[rng.Intn(len(b))] = byte(rng.Intn(255) + 1)
+				}
+			case 2:
+				rng.Read(b)
+			}
+
+			r.Equal(emptyBytesEqual(b), emptyBytes(b), "length %d", len(b))
+		}
+	})
+
+	t.Run("checks every byte", func(t *testing.T) {
+		r := require.New(t)
+
+		b := make([]byte, 2*BlockSize+3)
+		r.True(emptyBytes(b))
+		r.True(emptyBytes(nil))
+
+		for i := range b {
+			b[i] = 1
+			r.False(emptyBytes(b), "byte %d", i)
+			b[i] = 0
+		}
+	})
+}
+
+func BenchmarkEmptyBytes(b *testing.B) {
+	empty := make([]byte, BlockSize)
+
+	nonEmpty := make([]byte, BlockSize)
+	copy(nonEmpty, testRand)
+
+	// Only the last byte is set, so the whole block has to be checked.
+	trailing := make([]byte, BlockSize)
+	trailing[BlockSize-1] = 1
+
+	for _, bc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", empty},
+		{"non-empty", nonEmpty},
+		{"trailing", trailing},
+	} {
+		b.Run(bc.name+"/emptyBytes", func(b *testing.B) {
+			b.SetBytes(BlockSize)
+			for i := 0; i < b.N; i++ {
+				emptyBytes(bc.data)
+			}
+		})
+
+		b.Run(bc.name+"/bytes.Equal", func(b *testing.B) {
+			b.SetBytes(BlockSize)
+			for i := 0; i < b.N; i++ {
+				emptyBytesEqual(bc.data)
+			}
+		})
+	}
+}
@@ -6,14 +6,39 @@ import (
 	"github.com/lab47/lsvd/logger"
 )
 
+// extentSource provides the data that an extent is expected to contain.
+type extentSource interface {
+	FillExtent(ctx *Context, data RangeDataView) ([]Extent, error)
+}
+
+// Inconsistency describes a range where the data read from the disk doesn't
+// match the data expected for it.
+type Inconsistency struct {
+	Extent Extent
+
+	// Sums of the expected data and the data read back, "0" if it was empty.
+	Expected string
+	Actual   string
+
+	// How the range was mapped when the expected data was read and when the
+	// data was read back.
+	Before []PartialExtent
+	After  []PartialExtent
+
+	// Set if either read failed, rather than returning different data.
+	Err error
+}
+
 type extentValidator struct {
 	sums    map[Extent]string
+	errs    map[Extent]error
 	resi    map[Extent][]PartialExtent
 	entries []ExtentLocation
 }
 
-func (e *extentValidator) populate(log logger.Logger, ctx *Context, d *Disk, oc *SegmentCreator, entries []ExtentLocation) {
+func (e *extentValidator) populate(log logger.Logger, ctx *Context, d *Disk, src extentSource, entries []ExtentLocation) {
 	e.sums = map[Extent]string{}
+	e.errs = map[Extent]error{}
 	e.resi = map[Extent][]PartialExtent{}
 	e.entries = entries
 
@@ -23,9 +48,10 @@ func (e *extentValidator) populate(log logger.Logger, ctx *Context, d *Disk, oc
 
 		data := NewRangeData(ctx, ent.Extent)
 
-		_, err := oc.FillExtent(ctx, data.View())
+		_, err := src.FillExtent(ctx, data.View())
 		if err != nil {
 			d.log.Error("error reading extent for validation", "error", err, "extent", ent.Extent, "offset", ent.Offset, "size", ent.Size)
+			e.errs[ent.Extent] = err
 		}
 
 		sum := "0"
@@ -45,15 +71,37 @@ func (e *extentValidator) populate(log logger.Logger, ctx *Context, d *Disk, oc
 	}
 }
 
-func (e *extentValidator) validate(ctx *Context, log logger.Logger, d *Disk) {
+func (e *extentValidator) validate(ctx *Context, log logger.Logger, d *Disk) []Inconsistency {
 	entries := e.entries
 
+	var bad []Inconsistency
+
 	d.log.Info("performing extent validation")
 	passed := 0
+
+	marker := ctx.Marker()
 	for _, ent := range entries {
+		ctx.ResetTo(marker)
+
+		if err, ok := e.errs[ent.Extent]; ok {
+			bad = append(bad, Inconsistency{
+				Extent: ent.Extent,
+				Before: e.resi[ent.Extent],
+				Err:    err,
+			})
+			continue
+		}
+
 		data, err := d.ReadExtent(ctx, ent.Extent)
 		if err != nil {
 			d.log.Error("error reading extent for validation", "error", err)
+			bad = append(bad, Inconsistency{
+				Extent:   ent.Extent,
+				Expected: e.sums[ent.Extent],
+				Before:   e.resi[ent.Extent],
+				Err:      err,
+			})
+			continue
 		}
 
 		sum := "0"
@@ -64,10 +112,20 @@ func (e *extentValidator) validate(ctx *Context, log logger.Logger, d *Disk) {
 		if sum != e.sums[ent.Extent] {
 			d.log.Error("block read validation failed", "extent", ent.Extent,
 				"sum", sum, "expected", e.sums[ent.Extent])
+
+			inc := Inconsistency{
+				Extent:   ent.Extent,
+				Expected: e.sums[ent.Extent],
+				Actual:   sum,
+				Before:   e.resi[ent.Extent],
+			}
+
 			ranges, err := d.lba2pba.Resolve(log, ent.Extent, nil)
 			if err != nil {
 				d.log.Error("unable to resolve for check", "error", err)
 			} else {
+				inc.After = ranges
+
 				var before []string
 				for _, r := range e.resi[ent.Extent] {
 					before = append(before, r.String())
@@ -82,10 +140,14 @@ func (e *extentValidator) validate(ctx *Context, log logger.Logger, d *Disk) {
 					"before", strings.Join(before, " "),
 					"after", strings.Join(after, " "))
 			}
+
+			bad = append(bad, inc)
 		} else {
 			passed++
 		}
 	}
 
 	d.log.Warn("finished block read validation", "passed", passed)
+
+	return bad
 }
@@ -0,0 +1,293 @@
+package lsvd
+
+import (
+	"fmt"
+	"slices"
+)
+
+type verifyOpts struct {
+	sampleRate float64
+}
+
+type VerifyOption func(o *verifyOpts)
+
+// VerifySampleRate limits Verify to checking the given fraction of the mapped
+// extents, spread evenly over the volume, to bound the IO it performs.
+func VerifySampleRate(rate float64) VerifyOption {
+	return func(o *verifyOpts) {
+		o.sampleRate = rate
+	}
+}
+
+// Verify checks that ReadExtent returns the data stored in the segments for
+// the ranges in the extent map. The expected data is read directly from each
+// segment, bypassing the read cache, using the extent headers the segment
+// itself records, so a map entry that has drifted from its segment is reported
+// as well. Ranges with writes still in the write cache are skipped. Nothing
+// is written to the disk.
+func (d *Disk) Verify(ctx *Context, opts ...VerifyOption) ([]Inconsistency, error) {
+	o := verifyOpts{
+		sampleRate: 1,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var (
+		candidates []ExtentLocation
+		acc        float64
+	)
+
+	for i := d.lba2pba.LockedIterator(); i.Valid(); i.Next() {
+		acc += o.sampleRate
+		if acc < 1 {
+			continue
+		}
+
+		acc--
+
+		pe := i.Value()
+
+		candidates = append(candidates, ExtentLocation{
+			ExtentHeader: ExtentHeader{Extent: pe.Live},
+			Segment:      pe.Segment,
+			Disk:         pe.Disk,
+		})
+	}
+
+	var entries []ExtentLocation
+
+	marker := ctx.Marker()
+	for _, ent := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		ctx.ResetTo(marker)
+
+		data := NewRangeData(ctx, ent.Extent)
+
+		remaining, err := d.fillFromWriteCache(ctx, d.log, data, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// Pending writes take precedence over the map, so there is nothing
+		// to compare the segment data with.
+		if len(remaining) != 1 || remaining[0] != ent.Extent {
+			continue
+		}
+
+		entries = append(entries, ent)
+	}
+
+	ctx.ResetTo(marker)
+
+	d.log.Info("verifying extents", "extents", len(entries), "skipped", len(candidates)-len(entries))
+
+	var v extentValidator
+
+	v.populate(d.log, ctx, d, &segmentSource{d: d}, entries)
+
+	return v.validate(ctx, d.log, d), nil
+}
+
+// segmentSource fills extents with the data in the segments they're mapped
+// to, reading the segments directly.
+type segmentSource struct {
+	d      *Disk
+	stored map[SegmentId]*storedExtents
+}
+
+// storedExtents are the extents a segment records, indexed to find those a
+// map entry is made of. Coalescing merges the entries of extents stored back
+// to back in a segment, so an entry can cover several of them. They include
+// the references later segments recorded to the segment's data, see
+// WithDedup, which are at the LBAs of the reference rather than those the
+// data was stored for.
+type storedExtents struct {
+	// The extents with data, by their offset in the segment.
+	byOffset map[uint32][]ExtentHeader
+
+	empty []ExtentHeader
+}
+
+func (s *segmentSource) FillExtent(ctx *Context, data RangeDataView) ([]Extent, error) {
+	d := s.d
+
+	clear(data.WriteData())
+
+	pes, err := d.lba2pba.Resolve(d.log, data.Extent, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var used []Extent
+
+	for _, pe := range pes {
+		headers, err := s.segmentHeaders(ctx, &pe)
+		if err != nil {
+			return nil, err
+		}
+
+		subDest, ok := data.SubRange(pe.Live)
+		if !ok {
+			return nil, fmt.Errorf("error calculating subrange")
+		}
+
+		used = append(used, subDest.Extent)
+
+		for _, eh := range headers {
+			part := PartialExtent{
+				ExtentHeader: eh,
+				Segment:      pe.Segment,
+				Disk:         pe.Disk,
+			}
+
+			part.Live, ok = pe.Live.Clamp(eh.Extent)
+			if !ok {
+				continue
+			}
+
+			src, _, err := d.readDisks[pe.Disk].er.fetchExtentUncached(ctx, d.log, &part, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			subSrc, ok := src.SubRange(part.Live)
+			if !ok {
+				return nil, fmt.Errorf("error calculating source subrange")
+			}
+
+			partDest, ok := data.SubRange(part.Live)
+			if !ok {
+				return nil, fmt.Errorf("error calculating subrange")
+			}
+
+			partDest.Copy(subSrc)
+		}
+	}
+
+	return used, nil
+}
+
+// segmentHeaders returns the extent headers that the segment of +pe+ records
+// for the data of pe, in order, or an error if the segment doesn't record
+// extents that make up pe. An empty extent has no data, so none are returned
+// for it, but the segment still has to record its blocks as empty.
+func (s *segmentSource) segmentHeaders(ctx *Context, pe *PartialExtent) ([]ExtentHeader, error) {
+	stored, err := s.storedExtents(ctx, pe)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := func() error {
+		return fmt.Errorf("segment %s has no extent %s at offset %d", pe.Segment, pe.Extent, pe.Offset)
+	}
+
+	switch pe.Flags() {
+	case FlagEmpty:
+		// Coalesced entries keep the offset of the first extent.
+		for lba := pe.LBA; lba <= pe.Last(); {
+			i := slices.IndexFunc(stored.empty, func(eh ExtentHeader) bool {
+				return lba >= eh.LBA && lba <= eh.Last() && (lba != pe.LBA || eh.Offset == pe.Offset)
+			})
+			if i < 0 {
+				return nil, missing()
+			}
+
+			lba = stored.empty[i].Last() + 1
+		}
+
+		return nil, nil
+	case FlagLZ4:
+		// Compressed data is only readable as the extent it was stored as,
+		// so those are never coalesced.
+		if slices.Contains(stored.byOffset[pe.Offset], pe.ExtentHeader) {
+			return []ExtentHeader{pe.ExtentHeader}, nil
+		}
+
+		return nil, missing()
+	}
+
+	var (
+		headers []ExtentHeader
+		offset  = pe.Offset
+		lba     = pe.LBA
+		end     = pe.Offset + pe.Size
+	)
+
+	for offset < end {
+		i := slices.IndexFunc(stored.byOffset[offset], func(eh ExtentHeader) bool {
+			return eh.LBA == lba && eh.Flags() == FlagUncompressed
+		})
+		if i < 0 {
+			return nil, missing()
+		}
+
+		eh := stored.byOffset[offset][i]
+		headers = append(headers, eh)
+
+		offset += eh.Size
+		lba += LBA(eh.Blocks)
+	}
+
+	if offset != end || lba != pe.LBA+LBA(pe.Blocks) {
+		return nil, missing()
+	}
+
+	return headers, nil
+}
+
+// storedExtents returns the extents recorded for the segment of +pe+, reading
+// its header and those of the segments referring to it the first time.
+func (s *segmentSource) storedExtents(ctx *Context, pe *PartialExtent) (*storedExtents, error) {
+	if s.stored == nil {
+		s.stored = map[SegmentId]*storedExtents{}
+	}
+
+	if stored, ok := s.stored[pe.Segment]; ok {
+		return stored, nil
+	}
+
+	ld := s.d.readDisks[pe.Disk]
+
+	ps, err := ld.readSegmentExtents(ctx, pe.Segment)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &storedExtents{
+		byOffset: map[uint32][]ExtentHeader{},
+	}
+
+	for _, eh := range ps.extents {
+		stored.add(eh)
+	}
+
+	for _, seg := range ld.s.Referrers(pe.Segment) {
+		ps, err := ld.readSegmentExtents(ctx, seg)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range ps.refs {
+			if ref.Segment == pe.Segment {
+				stored.add(ref.ExtentHeader)
+			}
+		}
+	}
+
+	s.stored[pe.Segment] = stored
+
+	return stored, nil
+}
+
+func (s *storedExtents) add(eh ExtentHeader) {
+	if eh.Size == 0 {
+		s.empty = append(s.empty, eh)
+	} else {
+		s.byOffset[eh.Offset] = append(s.byOffset[eh.Offset], eh)
+	}
+}
@@ -0,0 +1,242 @@
+package lsvd
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	gctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewContext(gctx)
+
+	setup := func(t *testing.T) *Disk {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		t.Cleanup(func() { os.RemoveAll(tmpdir) })
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		t.Cleanup(func() { d.Close(ctx) })
+
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(1)))
+		r.NoError(d.WriteExtent(ctx, testExtent2.MapTo(2)))
+		r.NoError(d.ZeroBlocks(ctx, Extent{LBA: 3, Blocks: 2}))
+		r.NoError(d.WriteExtent(ctx, testExtent3.MapTo(10)))
+		r.NoError(d.CloseSegment(ctx))
+
+		return d
+	}
+
+	t.Run("finds nothing on a consistent disk", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		bad, err := d.Verify(ctx)
+		r.NoError(err)
+		r.Empty(bad)
+	})
+
+	t.Run("reports a map entry that doesn't match its segment", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		pes, err := d.lba2pba.Resolve(log, Extent{LBA: 0, Blocks: 1}, nil)
+		r.NoError(err)
+		r.Len(pes, 1)
+
+		// Point LBA 2 at the data for LBA 0.
+		corrupt := pes[0]
+		corrupt.Extent = Extent{LBA: 2, Blocks: 1}
+		corrupt.Live = corrupt.Extent
+
+		r.NoError(d.lba2pba.LockToPatch(func() error {
+			d.lba2pba.set(corrupt)
+			return nil
+		}))
+
+		data, err := d.ReadExtent(ctx, Extent{LBA: 2, Blocks: 1})
+		r.NoError(err)
+		r.Equal(testData, data.ReadData())
+
+		bad, err := d.Verify(ctx)
+		r.NoError(err)
+		r.Len(bad, 1)
+
+		r.Equal(Extent{LBA: 2, Blocks: 1}, bad[0].Extent)
+		r.Error(bad[0].Err)
+		r.Len(bad[0].Before, 1)
+		r.Equal(corrupt.ExtentHeader, bad[0].Before[0].ExtentHeader)
+	})
+
+	t.Run("reports data that differs from the segment", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		// Corrupt the read cache's copy of the segment data, which only
+		// ReadExtent consults.
+		pes, err := d.lba2pba.Resolve(log, Extent{LBA: 1, Blocks: 1}, nil)
+		r.NoError(err)
+		r.Len(pes, 1)
+
+		cps, err := d.er.rangeCache.CachePositions(ctx, pes[0].Segment, int64(pes[0].Size), int64(pes[0].Offset), nil)
+		r.NoError(err)
+		r.NotEmpty(cps)
+
+		_, err = cps[0].fd.WriteAt([]byte("corrupted"), cps[0].off)
+		r.NoError(err)
+
+		bad, err := d.Verify(ctx)
+		r.NoError(err)
+		r.Len(bad, 1)
+
+		r.Equal(Extent{LBA: 1, Blocks: 1}, bad[0].Extent)
+		r.NoError(bad[0].Err)
+		r.NotEqual(bad[0].Expected, bad[0].Actual)
+		r.Equal(rangeSum(testRand), bad[0].Expected)
+	})
+
+	t.Run("skips ranges with pending writes", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		r.NoError(d.WriteExtent(ctx, testExtent3.MapTo(1)))
+
+		bad, err := d.Verify(ctx)
+		r.NoError(err)
+		r.Empty(bad)
+	})
+
+	t.Run("samples the extents", func(t *testing.T) {
+		r := require.New(t)
+
+		d := setup(t)
+
+		// Corrupt every mapped extent by shifting its offset.
+		var all []PartialExtent
+		for i := d.lba2pba.LockedIterator(); i.Valid(); i.Next() {
+			all = append(all, i.Value())
+		}
+
+		r.Len(all, 5)
+
+		r.NoError(d.lba2pba.LockToPatch(func() error {
+			for _, pe := range all {
+				pe.Offset++
+				d.lba2pba.set(pe)
+			}
+			return nil
+		}))
+
+		bad, err := d.Verify(ctx, VerifySampleRate(0.5))
+		r.NoError(err)
+		r.Len(bad, 2)
+
+		bad, err = d.Verify(ctx)
+		r.NoError(err)
+		r.Len(bad, 5)
+	})
+	t.Run("checks entries coalesced from several extents", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		region := make([]byte, 8*BlockSize)
+		_, err = io.ReadFull(rand.Reader, region)
+		r.NoError(err)
+
+		for lba := LBA(0); lba < 8; lba += 2 {
+			data := region[int(lba)*BlockSize : int(lba+2)*BlockSize]
+			r.NoError(d.WriteExtent(ctx, MapRangeData(Extent{lba, 2}, data)))
+		}
+
+		r.NoError(d.ZeroBlocks(ctx, Extent{8, 2}))
+		r.NoError(d.ZeroBlocks(ctx, Extent{10, 2}))
+		r.NoError(d.CloseSegment(ctx))
+
+		r.Equal(2, d.lba2pba.Len())
+
+		bad, err := d.Verify(ctx)
+		r.NoError(err)
+		r.Empty(bad)
+
+		// Leaves the coalesced entries partly overwritten.
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(3)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(9)))
+		r.NoError(d.CloseSegment(ctx))
+
+		bad, err = d.Verify(ctx)
+		r.NoError(err)
+		r.Empty(bad)
+	})
+	t.Run("checks data deduplicated into references", func(t *testing.T) {
+		r := require.New(t)
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir, WithDedup(0))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+
+		s1 := d.curSeq
+		r.NoError(d.CloseSegment(ctx))
+
+		// One reference to the first segment and a duplicate within the
+		// second.
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(10)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(20)))
+		r.NoError(d.WriteExtent(ctx, testExtent.MapTo(30)))
+		r.NoError(d.CloseSegment(ctx))
+
+		pes, err := d.lba2pba.Resolve(log, Extent{LBA: 10, Blocks: 1}, nil)
+		r.NoError(err)
+		r.Len(pes, 1)
+		r.Equal(s1, pes[0].Segment)
+
+		bad, err := d.Verify(ctx)
+		r.NoError(err)
+		r.Empty(bad)
+
+		// A reference that no segment recorded is still reported.
+		corrupt := pes[0]
+		corrupt.Extent.LBA = 11
+		corrupt.Live = corrupt.Extent
+
+		r.NoError(d.lba2pba.LockToPatch(func() error {
+			d.lba2pba.set(corrupt)
+			return nil
+		}))
+
+		bad, err = d.Verify(ctx)
+		r.NoError(err)
+		r.Len(bad, 1)
+		r.Equal(Extent{LBA: 11, Blocks: 1}, bad[0].Extent)
+		r.Error(bad[0].Err)
+	})
+}
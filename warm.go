@@ -0,0 +1,58 @@
+package lsvd
+
+import (
+	"time"
+)
+
+// How many chunks of segment data WarmCache fetches at once.
+const maxWarmFetches = 8
+
+// WarmCache loads the data of +rng+ into the read cache ahead of it being
+// read, such as before booting a VM from the volume, without copying it
+// anywhere. Data that's already cached isn't fetched again, so warming a range
+// twice is cheap. Blocks written since the last flush are read from the write
+// cache and so aren't warmed. Like reads, it mustn't be called concurrently
+// with other reads of the disk.
+func (d *Disk) WarmCache(ctx *Context, rng Extent) error {
+	if d.detached.Load() {
+		return ErrDetached
+	}
+
+	start := time.Now()
+
+	pes, err := d.resolveSegmentAccess(rng)
+	if err != nil {
+		return err
+	}
+
+	// The extents of lower layers are cached by their own disk.
+	spans := map[uint16][]segmentSpan{}
+
+	for _, pe := range pes {
+		// Empty extents have no data to cache.
+		if pe.Size == 0 {
+			continue
+		}
+
+		spans[pe.Disk] = append(spans[pe.Disk], segmentSpan{
+			seg:  pe.Segment,
+			off:  int64(pe.Offset),
+			size: int64(pe.Size),
+		})
+	}
+
+	var fetched int64
+
+	for idx, ss := range spans {
+		n, err := d.readDisks[idx].er.rangeCache.Warm(ctx, ss, maxWarmFetches)
+		fetched += n
+
+		if err != nil {
+			return err
+		}
+	}
+
+	d.logs.cache.Debug("warmed read cache", "extent", rng, "extents", len(pes), "fetched", fetched, "dur", time.Since(start))
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package lsvd
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lab47/lsvd/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmCache(t *testing.T) {
+	log := logger.New(logger.Info)
+
+	t.Run("reads of a warmed range hit the cache", func(t *testing.T) {
+		r := require.New(t)
+
+		ctx := NewContext(context.Background())
+		defer ctx.Close()
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(10)))
+		r.NoError(d.CloseSegment(ctx))
+		r.NoError(d.Close(ctx))
+
+		// Reopen so the read cache starts out empty.
+		m := NewMetrics(nil)
+
+		d, err = NewDisk(ctx, log, tmpdir, WithMetrics(m))
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		rng := Extent{LBA: 0, Blocks: 11}
+
+		wctx := NewContext(context.Background())
+		defer wctx.Close()
+
+		r.NoError(d.WarmCache(wctx, rng))
+		r.NotZero(wctx.coldBytes)
+
+		misses := counterValue(m.extentCacheMiss)
+		hits := counterValue(m.extentCacheHits)
+
+		data, err := d.ReadExtent(ctx, rng)
+		r.NoError(err)
+
+		r.Equal(misses, counterValue(m.extentCacheMiss))
+		r.Greater(counterValue(m.extentCacheHits), hits)
+
+		blockEqual(t, testRand, data.ReadData()[:BlockSize])
+		blockEqual(t, testRand, data.ReadData()[10*BlockSize:])
+	})
+
+	t.Run("warming a range again fetches nothing", func(t *testing.T) {
+		r := require.New(t)
+
+		ctx := NewContext(context.Background())
+		defer ctx.Close()
+
+		tmpdir, err := os.MkdirTemp("", "lsvd")
+		r.NoError(err)
+		defer os.RemoveAll(tmpdir)
+
+		d, err := NewDisk(ctx, log, tmpdir)
+		r.NoError(err)
+		defer d.Close(ctx)
+
+		r.NoError(d.WriteExtent(ctx, testRandX.MapTo(0)))
+		r.NoError(d.CloseSegment(ctx))
+
+		rng := Extent{LBA: 0, Blocks: 1}
+
+		r.NoError(d.WarmCache(ctx, rng))
+
+		again := NewContext(context.Background())
+		defer again.Close()
+
+		r.NoError(d.WarmCache(again, rng))
+		r.Zero(again.coldBytes)
+	})
+}